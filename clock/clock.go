@@ -0,0 +1,81 @@
+/*
+Package clock abstracts time for timeouts, retransmissions and refreshes,
+so they can be tested instantly with a fake clock.
+*/
+package clock
+
+import (
+	"time"
+)
+
+/*
+Clock is the source of time and timers used by ICE, STUN and TURN.
+*/
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+/*
+Timer is like time.Timer, the channel is returned by C.
+*/
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type systemClock struct{}
+
+type systemTimer struct {
+	t *time.Timer
+}
+
+//New returns the clock of the system
+func New() Clock {
+	return systemClock{}
+}
+
+//OrNew returns c, or the clock of the system when c is nil
+func OrNew(c Clock) Clock {
+	if c == nil {
+		return New()
+	}
+	return c
+}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return &systemTimer{time.NewTimer(d)}
+}
+
+func (t *systemTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t *systemTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+func (t *systemTimer) Reset(d time.Duration) bool {
+	return t.t.Reset(d)
+}
+
+/*
+NewStoppedTimer returns a timer that will not fire until Reset.
+*/
+func NewStoppedTimer(c Clock) Timer {
+	t := c.NewTimer(time.Hour)
+	if !t.Stop() {
+		<-t.C()
+	}
+	return t
+}
@@ -0,0 +1,69 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func fired(t Timer) bool {
+	select {
+	case <-t.C():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFake(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	t1 := f.NewTimer(time.Second)
+	t2 := f.NewTimer(3 * time.Second)
+	f.Add(999 * time.Millisecond)
+	if fired(t1) || fired(t2) {
+		t.Fatal("should not fire before deadline")
+	}
+	f.Add(time.Millisecond)
+	if !fired(t1) || fired(t2) {
+		t.Fatal("only t1 should fire")
+	}
+	if t1.Stop() {
+		t.Error("fired timer is not active")
+	}
+	if !t2.Reset(time.Second) {
+		t.Error("t2 should be active")
+	}
+	f.Add(2 * time.Second)
+	select {
+	case now := <-t2.C():
+		if !now.Equal(start.Add(2 * time.Second)) {
+			t.Errorf("timer should fire at its deadline, got %s", now)
+		}
+	default:
+		t.Fatal("t2 should fire after reset")
+	}
+	if !f.Now().Equal(start.Add(3 * time.Second)) {
+		t.Errorf("now error %s", f.Now())
+	}
+	t3 := NewStoppedTimer(f)
+	f.Add(time.Hour * 2)
+	if fired(t3) || f.Timers() != 0 {
+		t.Error("stopped timer should not fire")
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	f := NewFake(time.Now())
+	done := make(chan struct{})
+	go func() {
+		<-f.After(time.Minute)
+		close(done)
+	}()
+	f.BlockUntil(1)
+	f.Add(time.Minute)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("After should fire")
+	}
+}
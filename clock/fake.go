@@ -0,0 +1,142 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Fake is a clock that only moves when Add or Set is called,
+timers whose deadline is passed fire in the order of their deadlines.
+*/
+type Fake struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer //没有触发也没有 stop 的 timer
+}
+
+type fakeTimer struct {
+	f        *Fake
+	c        chan time.Time
+	deadline time.Time
+}
+
+//NewFake creates a fake clock starting at start
+func NewFake(start time.Time) *Fake {
+	f := &Fake{now: start}
+	f.cond = sync.NewCond(&f.lock)
+	return f
+}
+
+//Now returns the time of the fake clock
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+//After is NewTimer(d).C()
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+//NewTimer creates a timer fires when the clock is moved d forward
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{f: f, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+//Add moves the clock d forward and fires timers
+func (f *Fake) Add(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+/*
+Set moves the clock to now and fires timers, one by one in the order of deadlines.
+每个 timer 触发时时钟恰好是它的 deadline.
+*/
+func (f *Fake) Set(now time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for len(f.timers) > 0 {
+		sort.Slice(f.timers, func(i, j int) bool {
+			return f.timers[i].deadline.Before(f.timers[j].deadline)
+		})
+		t := f.timers[0]
+		if t.deadline.After(now) {
+			break
+		}
+		f.timers = f.timers[1:]
+		if t.deadline.After(f.now) {
+			f.now = t.deadline
+		}
+		select {
+		case t.c <- f.now:
+		default:
+		}
+	}
+	if now.After(f.now) {
+		f.now = now
+	}
+	f.cond.Broadcast()
+}
+
+/*
+BlockUntil waits until there are at least n timers waiting,
+so a test knows goroutines have armed their timers before moving the clock.
+*/
+func (f *Fake) BlockUntil(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for len(f.timers) < n {
+		f.cond.Wait()
+	}
+}
+
+//Timers returns the number of timers waiting
+func (f *Fake) Timers() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.timers)
+}
+
+func (f *Fake) removeLocked(t *fakeTimer) bool {
+	for i, t2 := range f.timers {
+		if t2 == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.f.lock.Lock()
+	defer t.f.lock.Unlock()
+	return t.f.removeLocked(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	f := t.f
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	active := f.removeLocked(t)
+	t.deadline = f.now.Add(d)
+	if d <= 0 {
+		select {
+		case t.c <- f.now:
+		default:
+		}
+		return active
+	}
+	f.timers = append(f.timers, t)
+	f.cond.Broadcast()
+	return active
+}
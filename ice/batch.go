@@ -0,0 +1,198 @@
+package ice
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/nkbai/log"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	/*
+		batchSize 一次系统调用最多收发多少个包.
+	*/
+	batchSize = 16
+	/*
+		pooledPacketSize packetPool 中缓冲区的大小, 更大的包单独分配.
+	*/
+	pooledPacketSize = 1 << 14
+	/*
+		GSO 一次最多发送的段数以及总长度, 见 linux 的 UDP_MAX_SEGMENTS
+	*/
+	maxGSOSegments = 64
+	maxGSOSize     = 65000
+)
+
+/*
+packetBatchConn 一次系统调用收发多个包, ipv4.PacketConn 和 ipv6.PacketConn 都实现了它.
+*/
+type packetBatchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+/*
+gsoWriter 把目的地址相同的多个包合并成一个 udp GSO 发送, 见 gsoRun.
+*/
+type gsoWriter func(reqs []*sendreq) error
+
+/*
+packetPool 缓存发送用的包, 发送协程写完以后放回去.
+*/
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, pooledPacketSize)
+		return &b
+	},
+}
+
+func getPacketBuffer(n int) *[]byte {
+	if n > pooledPacketSize {
+		b := make([]byte, n)
+		return &b
+	}
+	b := packetPool.Get().(*[]byte)
+	*b = (*b)[:n]
+	return b
+}
+
+func putPacketBuffer(b *[]byte) {
+	if cap(*b) != pooledPacketSize {
+		return
+	}
+	packetPool.Put(b)
+}
+
+/*
+batchReader 用 ReadBatch 读取, 缓冲区在每次读取之间重用.
+每个缓冲区都是 maxPacketSize, 和一次读一个包一样, 任何 udp 包都不会被截断.
+*/
+type batchReader struct {
+	c  packetBatchConn
+	ms []ipv4.Message
+}
+
+func newBatchReader(c packetBatchConn) *batchReader {
+	r := &batchReader{c: c, ms: make([]ipv4.Message, batchSize)}
+	for i := range r.ms {
+		r.ms[i].Buffers = [][]byte{make([]byte, maxPacketSize)}
+	}
+	return r
+}
+
+/*
+read 读取至少一个包, 对每一个完整的包调用 f, 在下一次 read 之前 f 收到的 raw 都是有效的.
+*/
+func (r *batchReader) read(f func(addr net.Addr, raw []byte)) error {
+	n, err := r.c.ReadBatch(r.ms, 0)
+	if err != nil {
+		return err
+	}
+	for _, m := range r.ms[:n] {
+		f(m.Addr, m.Buffers[0][:m.N])
+	}
+	return nil
+}
+
+/*
+batchWriter 在发送协程中使用, 能合并的用 GSO 发送, 其他的用 WriteBatch 发送.
+*/
+type batchWriter struct {
+	c   packetBatchConn
+	gso gsoWriter //nil 表示不支持 GSO
+	ms  []ipv4.Message
+	log log.Logger
+}
+
+func newBatchWriter(c packetBatchConn, gso gsoWriter, logger log.Logger) *batchWriter {
+	w := &batchWriter{c: c, gso: gso, ms: make([]ipv4.Message, batchSize), log: logger}
+	for i := range w.ms {
+		w.ms[i].Buffers = make([][]byte, 1)
+	}
+	return w
+}
+
+func (w *batchWriter) write(reqs []*sendreq) {
+	for len(reqs) > 0 {
+		if w.gso != nil {
+			if n := gsoRun(reqs); n > 1 {
+				err := w.gso(reqs[:n])
+				if err == nil {
+					reqs = reqs[n:]
+					continue
+				}
+				if isGSOUnsupported(err) {
+					//网卡或者内核不支持, 以后都不再使用 GSO
+					w.log.Info(fmt.Sprintf("gso write err %s, disable gso", err))
+					w.gso = nil
+					continue
+				}
+				//其他错误(比如对方不可达)只影响这一次, 逐个重新发送, 发送失败的会被跳过
+				w.log.Info(fmt.Sprintf("gso write to %s err %s", reqs[0].to, err))
+				w.writeBatch(reqs[:n])
+				reqs = reqs[n:]
+				continue
+			}
+		}
+		//下一个可以用 GSO 合并的包之前的都用 WriteBatch 发送
+		n := 1
+		for w.gso != nil && n < len(reqs) && gsoRun(reqs[n:]) == 1 {
+			n++
+		}
+		if w.gso == nil {
+			n = len(reqs)
+		}
+		w.writeBatch(reqs[:n])
+		reqs = reqs[n:]
+	}
+}
+
+func (w *batchWriter) writeBatch(reqs []*sendreq) {
+	ms := w.ms[:len(reqs)]
+	for i, r := range reqs {
+		ms[i].Buffers[0] = r.data
+		ms[i].Addr = r.to
+	}
+	for len(ms) > 0 {
+		n, err := w.c.WriteBatch(ms, 0)
+		if err != nil {
+			//第一个包发送失败, 跳过它
+			w.log.Info(fmt.Sprintf("write to %s err %s", ms[0].Addr, err))
+			n = 1
+		}
+		ms = ms[n:]
+	}
+	for i := range reqs {
+		w.ms[i].Buffers[0] = nil
+		w.ms[i].Addr = nil
+	}
+}
+
+/*
+gsoRun 返回开头有多少个包可以用 GSO 一次发送:
+目的地址相同, 除了最后一个以外长度都相同, 最后一个不能更长.
+*/
+func gsoRun(reqs []*sendreq) int {
+	to, ok := reqs[0].to.(*net.UDPAddr)
+	size := len(reqs[0].data)
+	if !ok || size == 0 {
+		return 1
+	}
+	total := size
+	n := 1
+	for n < len(reqs) && n < maxGSOSegments {
+		r := reqs[n]
+		to2, ok := r.to.(*net.UDPAddr)
+		if !ok || to2.Port != to.Port || !to2.IP.Equal(to.IP) || len(r.data) > size || len(r.data) == 0 || total+len(r.data) > maxGSOSize {
+			break
+		}
+		total += len(r.data)
+		n++
+		if len(r.data) < size {
+			break
+		}
+	}
+	return n
+}
@@ -0,0 +1,85 @@
+package ice
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/*
+UDP_SEGMENT, 见 linux/udp.h, 4.18 以后的内核支持.
+*/
+const udpSegment = 103
+
+/*
+linux 上 *net.UDPConn 用 recvmmsg/sendmmsg 批量收发, 其他的连接(tcp, vnet, mux) 返回 nil.
+*/
+func newPacketBatchConn(c net.PacketConn) packetBatchConn {
+	uc, ok := c.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	addr, ok := uc.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	if addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(uc)
+	}
+	return ipv6.NewPacketConn(uc)
+}
+
+/*
+内核支持 UDP_SEGMENT 的时候返回 GSO 发送函数, 否则返回 nil.
+*/
+func newGSOWriter(c net.PacketConn) gsoWriter {
+	uc, ok := c.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		_, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_UDP, udpSegment)
+	})
+	if err != nil || serr != nil {
+		return nil
+	}
+	buf := make([]byte, 0, maxGSOSize)
+	oob := make([]byte, syscall.CmsgSpace(2))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.IPPROTO_UDP
+	h.Type = udpSegment
+	h.SetLen(syscall.CmsgLen(2))
+	return func(reqs []*sendreq) error {
+		b := buf[:0]
+		for _, r := range reqs {
+			b = append(b, r.data...)
+		}
+		*(*uint16)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = uint16(len(reqs[0].data))
+		_, _, err := uc.WriteMsgUDP(b, oob, reqs[0].to.(*net.UDPAddr))
+		return err
+	}
+}
+
+/*
+内核或者网卡不支持 GSO 时 sendmsg 返回的错误, 其他错误(比如 ECONNREFUSED)和 GSO 无关.
+*/
+func isGSOUnsupported(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case syscall.EINVAL, syscall.EIO, syscall.ENOPROTOOPT, syscall.EOPNOTSUPP:
+		return true
+	}
+	return false
+}
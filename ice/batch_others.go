@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package ice
+
+import (
+	"net"
+)
+
+/*
+其他平台一次只收发一个包.
+*/
+func newPacketBatchConn(c net.PacketConn) packetBatchConn {
+	return nil
+}
+
+func newGSOWriter(c net.PacketConn) gsoWriter {
+	return nil
+}
+
+func isGSOUnsupported(err error) bool {
+	return true
+}
@@ -0,0 +1,279 @@
+package ice
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nkbai/goice/stun"
+	"github.com/nkbai/log"
+	"golang.org/x/net/ipv4"
+)
+
+/*
+seqcb 记录收到的每个包的序号, 序号在包的前4个字节
+*/
+type seqcb struct {
+	mockcb
+	lock sync.Mutex
+	seqs map[uint32]int //seq->len
+	n    int64
+}
+
+func (m *seqcb) ReceiveData(localAddr, peerAddr string, data []byte) {
+	if len(data) >= 4 {
+		m.lock.Lock()
+		m.seqs[binary.BigEndian.Uint32(data)] = len(data)
+		m.lock.Unlock()
+	}
+	atomic.AddInt64(&m.n, 1)
+}
+
+func newLoopbackSockPair(t testing.TB, batch bool) (s1, s2 *stunServerSock, cb2 *seqcb) {
+	var socks []*stunServerSock
+	cbs := []*seqcb{{seqs: make(map[uint32]int)}, {seqs: make(map[uint32]int)}}
+	for i := 0; i < 2; i++ {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := newStunServerSockWithConn(c.LocalAddr().String(), c, cbs[i], "batch", serverSockOptions{batchIO: batch})
+		cbs[i].s = s
+		socks = append(socks, s)
+	}
+	return socks[0], socks[1], cbs[1]
+}
+
+/*
+sendWindow 发送 n 个包, 最多有 window 个在路上, size 返回第 i 个包的长度
+*/
+func sendWindow(t testing.TB, s1, s2 *stunServerSock, cb2 *seqcb, n int, size func(i int) int) {
+	const window = 64
+	start := time.Now()
+	data := make([]byte, maxPacketSize)
+	for i := 0; i < n; i++ {
+		for int64(i)-atomic.LoadInt64(&cb2.n) >= window {
+			if time.Since(start) > time.Minute {
+				t.Fatalf("packets lost,sent=%d,received=%d", i, atomic.LoadInt64(&cb2.n))
+			}
+			time.Sleep(10 * time.Microsecond)
+		}
+		b := data[:size(i)]
+		binary.BigEndian.PutUint32(b, uint32(i))
+		if err := s1.sendData(b, s1.Addr, s2.Addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for atomic.LoadInt64(&cb2.n) < int64(n) {
+		if time.Since(start) > time.Minute {
+			t.Fatalf("packets lost,received=%d", atomic.LoadInt64(&cb2.n))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStunServerSock_BatchIO(t *testing.T) {
+	s1, s2, cb2 := newLoopbackSockPair(t, true)
+	defer s1.Close()
+	defer s2.Close()
+	if newPacketBatchConn(s1.c) != nil && s1.bc == nil {
+		t.Fatal("should use batch io")
+	}
+	//每 8 个包中前 7 个长度相同, 可以用 GSO 合并
+	size := func(i int) int {
+		if i%8 == 7 {
+			return 100 + i%500
+		}
+		return 1200
+	}
+	const n = 2000
+	sendWindow(t, s1, s2, cb2, n, size)
+	cb2.lock.Lock()
+	defer cb2.lock.Unlock()
+	for i := 0; i < n; i++ {
+		if l, ok := cb2.seqs[uint32(i)]; !ok || l != size(i) {
+			t.Fatalf("packet %d error, ok=%v,len=%d", i, ok, l)
+		}
+	}
+	//stun message 仍然在读取协程中解码
+	req, _ := stun.Build(stun.TransactionIDSetter, stun.BindingRequest, software, stun.Fingerprint)
+	res, err := s1.sendStunMessageSync(req, s1.Addr, s2.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Type != stun.BindingSuccess {
+		t.Errorf("expect binding success,got %s", res.Type)
+	}
+}
+
+/*
+批量接收和一次读一个包一样, 不会丢弃 16KB 以上的包.
+*/
+func TestStunServerSock_BatchIOLargePacket(t *testing.T) {
+	s1, s2, cb2 := newLoopbackSockPair(t, true)
+	defer s1.Close()
+	defer s2.Close()
+	sizes := []int{1200, pooledPacketSize, pooledPacketSize + 1, 20000, 20000, 60000}
+	size := func(i int) int { return sizes[i] }
+	sendWindow(t, s1, s2, cb2, len(sizes), size)
+	cb2.lock.Lock()
+	defer cb2.lock.Unlock()
+	for i := range sizes {
+		if l, ok := cb2.seqs[uint32(i)]; !ok || l != size(i) {
+			t.Errorf("packet %d error, ok=%v,len=%d", i, ok, l)
+		}
+	}
+}
+
+/*
+fakeBatchConn 记录 WriteBatch 发送的包
+*/
+type fakeBatchConn struct {
+	sent [][]byte
+}
+
+func (c *fakeBatchConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	return 0, errors.New("not implemented")
+}
+
+func (c *fakeBatchConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	for _, m := range ms {
+		c.sent = append(c.sent, m.Buffers[0])
+	}
+	return len(ms), nil
+}
+
+/*
+ECONNREFUSED 这样的错误只影响一次 GSO 发送, 包逐个重发, 只有内核不支持的错误才关闭 GSO.
+*/
+func TestBatchWriterGSOError(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("gso is only used on linux")
+	}
+	to := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1000}
+	reqs := []*sendreq{{data: make([]byte, 100), to: to}, {data: make([]byte, 100), to: to}}
+	cases := []struct {
+		err     error
+		disable bool
+	}{
+		{&net.OpError{Op: "write", Err: os.NewSyscallError("sendmsg", syscall.ECONNREFUSED)}, false},
+		{&net.OpError{Op: "write", Err: os.NewSyscallError("sendmsg", syscall.EIO)}, true},
+		{&net.OpError{Op: "write", Err: os.NewSyscallError("sendmsg", syscall.EINVAL)}, true},
+	}
+	for _, c := range cases {
+		bc := &fakeBatchConn{}
+		calls := 0
+		w := newBatchWriter(bc, func([]*sendreq) error {
+			calls++
+			return c.err
+		}, log.New("name", "batchWriter"))
+		w.write(reqs)
+		w.write(reqs)
+		if len(bc.sent) != 4 {
+			t.Errorf("%s: every packet should be resent by WriteBatch, sent=%d", c.err, len(bc.sent))
+		}
+		if c.disable && (w.gso != nil || calls != 1) {
+			t.Errorf("%s: gso should be disabled, calls=%d", c.err, calls)
+		}
+		if !c.disable && (w.gso == nil || calls != 2) {
+			t.Errorf("%s: gso should stay enabled, calls=%d", c.err, calls)
+		}
+	}
+}
+
+func TestGSORun(t *testing.T) {
+	a := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1000}
+	b := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1001}
+	req := func(to *net.UDPAddr, n int) *sendreq {
+		return &sendreq{data: make([]byte, n), to: to}
+	}
+	cases := []struct {
+		name string
+		reqs []*sendreq
+		n    int
+	}{
+		{"single", []*sendreq{req(a, 100)}, 1},
+		{"same", []*sendreq{req(a, 100), req(a, 100), req(a, 100)}, 3},
+		{"shortlast", []*sendreq{req(a, 100), req(a, 100), req(a, 50), req(a, 50)}, 3},
+		{"longer", []*sendreq{req(a, 100), req(a, 200)}, 1},
+		{"otheraddr", []*sendreq{req(a, 100), req(a, 100), req(b, 100)}, 2},
+		{"toolarge", []*sendreq{req(a, 40000), req(a, 40000)}, 1},
+		{"empty", []*sendreq{req(a, 0), req(a, 0)}, 1},
+	}
+	for _, c := range cases {
+		if n := gsoRun(c.reqs); n != c.n {
+			t.Errorf("%s expect %d,got %d", c.name, c.n, n)
+		}
+	}
+}
+
+func TestPacketPool(t *testing.T) {
+	b := getPacketBuffer(100)
+	if len(*b) != 100 || cap(*b) != pooledPacketSize {
+		t.Errorf("pooled buffer error len=%d,cap=%d", len(*b), cap(*b))
+	}
+	putPacketBuffer(b)
+	b = getPacketBuffer(pooledPacketSize + 1)
+	if len(*b) != pooledPacketSize+1 {
+		t.Errorf("large buffer error len=%d", len(*b))
+	}
+	putPacketBuffer(b)
+}
+
+/*
+本机回环上两个 serversock 之间发送 1200 字节的包, 比较一次一个包和批量收发.
+*/
+func BenchmarkStunServerSock_Send(b *testing.B) {
+	for _, batch := range []bool{false, true} {
+		name := "single"
+		if batch {
+			name = "batch"
+		}
+		b.Run(name, func(b *testing.B) {
+			s1, s2, cb2 := newLoopbackSockPair(b, batch)
+			defer s1.Close()
+			defer s2.Close()
+			b.SetBytes(1200)
+			b.ResetTimer()
+			start := time.Now()
+			sendWindow(b, s1, s2, cb2, b.N, func(int) int { return 1200 })
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "pkts/s")
+		})
+	}
+}
+
+func TestIceStreamTransport_BatchIO(t *testing.T) {
+	var cfgs []*TransportConfig
+	for i := 0; i < 2; i++ {
+		cfg := NewTransportConfigHostonly()
+		cfg.GatherFilter = &GatherFilter{IncludeLoopback: true, IncludeCIDRs: []string{"127.0.0.1/32"}}
+		cfg.BatchIO = true
+		cfgs = append(cfgs, cfg)
+	}
+	s1, s2, cb1, cb2 := setupNegotiatedPair(t, cfgs[0], cfgs[1])
+	defer s1.Stop()
+	defer s2.Stop()
+	for _, c := range []struct {
+		s  *StreamTransport
+		cb *icecb
+	}{{s1, cb2}, {s2, cb1}} {
+		if err := c.s.SendData([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-time.After(5 * time.Second):
+			t.Fatal("receive data timeout")
+		case data := <-c.cb.data:
+			if string(data) != "hello" {
+				t.Errorf("expect hello,got %q", data)
+			}
+		}
+	}
+}
@@ -153,15 +153,19 @@ type Candidate struct {
 	  raddr 10.1.22.220 rport 51941
 	*/
 	relatedAddr    string        //candidates provide:  raddr 10.1.22.220 rport 56024
-	transport      TransportType //must be udp,
+	transport      TransportType //udp or tcp
 	transportValue []byte
+	/*
+		only meaningful when transport is tcp, RFC 6544 section 4.5
+	*/
+	TCPType TCPType
 	/**
 	 * The foundation string, which is an identifier which value will be
 	 * equivalent for two candidates that are of the same type, share the
 	 * same base, and come from the same STUN server. The foundation is
 	 * used to optimize ICE performance in the Frozen algorithm.
 	 */
-	Foundation  int //TODO 为了和 pjnath 兼容,按照 RFC 规定这个 Foundation 可以是任意类型,长度不超过36,应该来说最好是 pjnath 那种定义.
+	Foundation  string //1 到 32 个 ice-char, 比如 pjnath 的 Hac140a06 或者 Chrome 的 3862931549
 	ComponentID int
 	/**
 	 * The candidate's priority, a 32-bit unsigned value which value will be
@@ -172,8 +176,11 @@ type Candidate struct {
 	Type     CandidateType
 
 	// Extended attributes
-	NetworkCost int
-	Generation  int
+	NetworkCost   int
+	NetworkID     int
+	Generation    int
+	hasGeneration bool //Chrome 总是带着 generation 0, 为了原样输出需要记住有没有
+	Ufrag         string
 
 	// Other attributes
 	Attributes Attributes
@@ -187,30 +194,79 @@ a=candidate:Rb6fe9bd0 1 UDP 16777215 182.254.155.208 55019 typ relay
 
 */
 func (c *Candidate) String() string {
+	return "a=candidate:" + c.attributeValue()
+}
+
+/*
+attributeValue 是 sdp 中 a=candidate: 后面的部分
+*/
+func (c *Candidate) attributeValue() string {
 	host, port, err := net.SplitHostPort(c.addr)
 	if err != nil {
 		log.Error(fmt.Sprintf("SplitHostPort %s err %s", c.addr, err))
 	}
-	s := fmt.Sprintf("a=candidate:%d %d %s %d %s %s typ %s",
-		c.Foundation, c.ComponentID, c.transport, c.Priority, host, port, c.Type)
-	if c.Type == CandidateServerReflexive {
-		rhost, rport, err := net.SplitHostPort(c.baseAddr)
+	transport := c.transport.String()
+	if len(c.transportValue) > 0 {
+		transport = string(c.transportValue)
+	}
+	s := fmt.Sprintf("%s %d %s %d %s %s typ %s",
+		c.Foundation, c.ComponentID, transport, c.Priority, host, port, c.Type)
+	related := c.relatedAddr
+	if len(related) == 0 && c.Type == CandidateServerReflexive {
+		related = c.baseAddr
+	}
+	if len(related) > 0 {
+		rhost, rport, err := net.SplitHostPort(related)
 		if err != nil {
-			log.Error(fmt.Sprintf("SplitHostPort %s err %s", c.baseAddr, err))
+			log.Error(fmt.Sprintf("SplitHostPort %s err %s", related, err))
 		}
 		s = fmt.Sprintf("%s raddr %s rport %s", s, rhost, rport)
 	}
+	if c.transport == TransportTCP {
+		s = fmt.Sprintf("%s tcptype %s", s, c.TCPType)
+	}
+	//扩展属性的顺序和 Chrome 一样
+	if c.hasGeneration {
+		s = fmt.Sprintf("%s generation %d", s, c.Generation)
+	}
+	if len(c.Ufrag) > 0 {
+		s = fmt.Sprintf("%s ufrag %s", s, c.Ufrag)
+	}
+	if c.NetworkID > 0 {
+		s = fmt.Sprintf("%s network-id %d", s, c.NetworkID)
+	}
+	if c.NetworkCost > 0 {
+		s = fmt.Sprintf("%s network-cost %d", s, c.NetworkCost)
+	}
+	for _, a := range c.Attributes {
+		s = fmt.Sprintf("%s %s %s", s, a.Key, a.Value)
+	}
 	return s
 }
 
+/*
+发送时实际使用的本地地址, srflx,prflx 以及 1:1 NAT 映射过的 host 都要从 base 发送.
+*/
+func (c *Candidate) sendAddr() string {
+	if len(c.baseAddr) > 0 {
+		return c.baseAddr
+	}
+	return c.addr
+}
+
 // reset sets all fields to zero values.
 func (c *Candidate) reset() {
 	c.addr = ""
 	c.relatedAddr = ""
+	c.Foundation = ""
 	c.NetworkCost = 0
+	c.NetworkID = 0
 	c.Generation = 0
+	c.hasGeneration = false
+	c.Ufrag = ""
 	c.transport = TransportUnknown
 	c.transportValue = c.transportValue[:0]
+	c.TCPType = TCPTypeUnknown
 	c.Attributes = c.Attributes[:0]
 }
 
@@ -222,6 +278,9 @@ func (c Candidate) Equal(b *Candidate) bool {
 	if c.transport != b.transport {
 		return false
 	}
+	if c.TCPType != b.TCPType {
+		return false
+	}
 	//if !bytes.Equal(c.transportValue, b.transportValue) {
 	//	return false
 	//}
@@ -300,17 +359,50 @@ type TransportType byte
 const (
 	TransportUDP TransportType = iota + 1
 	TransportUnknown
+	TransportTCP
 )
 
 func (t TransportType) String() string {
 	switch t {
 	case TransportUDP:
 		return "UDP"
+	case TransportTCP:
+		return "TCP"
 	default:
 		return "Unknown"
 	}
 }
 
+// TCPType is the role of a TCP candidate, see RFC 6544 Section 4.5.
+type TCPType byte
+
+// Possible tcp types.
+const (
+	TCPTypeUnknown          TCPType = iota
+	TCPTypeActive                   // "active"
+	TCPTypePassive                  // "passive"
+	TCPTypeSimultaneousOpen         // "so"
+)
+
+const (
+	tcpTypeActive           = "active"
+	tcpTypePassive          = "passive"
+	tcpTypeSimultaneousOpen = "so"
+)
+
+func (t TCPType) String() string {
+	switch t {
+	case TCPTypeActive:
+		return tcpTypeActive
+	case TCPTypePassive:
+		return tcpTypePassive
+	case TCPTypeSimultaneousOpen:
+		return tcpTypeSimultaneousOpen
+	default:
+		return "unknown"
+	}
+}
+
 // candidateParser should parse []byte into Candidate.
 //
 // a=candidate:3862931549 1 udp 2113937151 192.168.220.128 56032 typ host generation 0 network-cost 50
@@ -352,12 +444,25 @@ func parseInt(v []byte) (int, error) {
 	return i, nil
 }
 
+/*
+foundation = 1*32ice-char, ice-char = ALPHA / DIGIT / "+" / "/"
+*/
+const maxFoundationLen = 32
+
+func isIceChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '+' || c == '/'
+}
+
 func (p *candidateParser) parseFoundation(v []byte) error {
-	i, err := parseInt(v)
-	if err != nil {
-		return errors.Wrap(err, "failed to parse foundation")
+	if len(v) == 0 || len(v) > maxFoundationLen {
+		return errors.Errorf("invalid foundation length %d", len(v))
+	}
+	for _, c := range v {
+		if !isIceChar(c) {
+			return errors.Errorf("invalid foundation %q", v)
+		}
 	}
-	p.c.Foundation = i
+	p.c.Foundation = string(v)
 	return nil
 }
 
@@ -380,12 +485,12 @@ func (p *candidateParser) parsePriority(v []byte) error {
 }
 
 func (p *candidateParser) parsePort(v []byte) error {
-	p.c.addr = fmt.Sprintf("%s:%s", p.c.addr, string(v))
+	p.c.addr = net.JoinHostPort(p.c.addr, string(v))
 	return nil
 }
 
 func (p *candidateParser) parseRelatedPort(v []byte) error {
-	p.c.relatedAddr = fmt.Sprintf("%s:%s", p.c.relatedAddr, string(v))
+	p.c.relatedAddr = net.JoinHostPort(p.c.relatedAddr, string(v))
 	return nil
 }
 
@@ -399,13 +504,18 @@ func (p *candidateParser) parseRelatedAddress(v []byte) error {
 	return nil
 }
 
+/*
+transport 不区分大小写, 保留原来的值以便原样输出, 不认识的 transport 不会被配对.
+*/
 func (p *candidateParser) parseTransport(v []byte) error {
-	if bytes.Equal(v, []byte("udp")) || bytes.Equal(v, []byte("UDP")) {
+	if bytes.EqualFold(v, []byte("udp")) {
 		p.c.transport = TransportUDP
+	} else if bytes.EqualFold(v, []byte("tcp")) {
+		p.c.transport = TransportTCP
 	} else {
 		p.c.transport = TransportUnknown
-		p.c.transportValue = v
 	}
+	p.c.transportValue = append(p.c.transportValue[:0], v...)
 	return nil
 }
 
@@ -416,6 +526,9 @@ const (
 	aType           = "typ"
 	aRelatedAddress = "raddr"
 	aRelatedPort    = "rport"
+	aTCPType        = "tcptype"
+	aUfrag          = "ufrag"
+	aNetworkID      = "network-id"
 )
 
 func (p *candidateParser) parseAttribute(a Attribute) error {
@@ -430,6 +543,13 @@ func (p *candidateParser) parseAttribute(a Attribute) error {
 		return p.parseRelatedAddress(a.Value)
 	case aRelatedPort:
 		return p.parseRelatedPort(a.Value)
+	case aTCPType:
+		return p.parseTCPType(a.Value)
+	case aUfrag:
+		p.c.Ufrag = string(a.Value)
+		return nil
+	case aNetworkID:
+		return p.parseNetworkID(a.Value)
 	default:
 		p.c.Attributes = append(p.c.Attributes, a)
 		return nil
@@ -491,61 +611,34 @@ func (p *candidateParser) parse() error {
 		// no non-mandatory elements
 		return nil
 	}
-	// offsets:
-	var (
-		start  int // key start
-		end    int // key end
-		vStart int // value start
-	)
-	// subslicing to simplify offset calculation
-	buf := p.buf[last-1:]
-	// saving every k:v pair ignoring spaces
-	for i, c := range buf {
-		if c != sp && i != len(buf)-1 {
-			// char is non-space or end of buffer
-			if start == 0 {
-				// key not started
+	// saving every k:v pair ignoring spaces,
+	// end of buffer is treated as space so single char value at the end is not lost
+	buf := p.buf[last:]
+	var key []byte
+	start := -1 // token start
+	for i := 0; i <= len(buf); i++ {
+		if i < len(buf) && buf[i] != sp {
+			if start < 0 {
 				start = i
-				continue
-			}
-			if vStart == 0 && end != 0 {
-				// value not started and key ended
-				vStart = i
 			}
 			continue
 		}
-		// char is space or end of buf reached
-		if start == 0 {
-			// key not started, skipping
+		if start < 0 {
+			// no token, skipping spaces
 			continue
 		}
-		if end == 0 {
-			// key ended, saving offset
-			end = i
+		token := buf[start:i]
+		start = -1
+		if key == nil {
+			key = token
 			continue
 		}
-		if vStart == 0 {
-			// value not started, skipping
-			continue
-		}
-		if i == len(buf)-1 && buf[len(buf)-1] != sp {
-			// fix for end of buf
-			i = len(buf)
-		}
-		// value ended, saving attribute
-		a := Attribute{
-			Key:   buf[start:end],
-			Value: buf[vStart:i],
-		}
-		if err := p.parseAttribute(a); err != nil {
+		if err := p.parseAttribute(Attribute{Key: key, Value: token}); err != nil {
 			return errors.Wrapf(err, "failed to parse attribute at char %d",
 				i+last,
 			)
 		}
-		// reset offset
-		vStart = 0
-		end = 0
-		start = 0
+		key = nil
 	}
 	return nil
 }
@@ -559,12 +652,22 @@ func (p *candidateParser) parseNetworkCost(v []byte) error {
 	return nil
 }
 
+func (p *candidateParser) parseNetworkID(v []byte) error {
+	i, err := parseInt(v)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse network id")
+	}
+	p.c.NetworkID = i
+	return nil
+}
+
 func (p *candidateParser) parseGeneration(v []byte) error {
 	i, err := parseInt(v)
 	if err != nil {
 		return errors.Wrap(err, "failed to parse generation")
 	}
 	p.c.Generation = i
+	p.c.hasGeneration = true
 	return nil
 }
 
@@ -584,6 +687,20 @@ func (p *candidateParser) parseType(v []byte) error {
 	return nil
 }
 
+func (p *candidateParser) parseTCPType(v []byte) error {
+	switch string(v) {
+	case tcpTypeActive:
+		p.c.TCPType = TCPTypeActive
+	case tcpTypePassive:
+		p.c.TCPType = TCPTypePassive
+	case tcpTypeSimultaneousOpen:
+		p.c.TCPType = TCPTypeSimultaneousOpen
+	default:
+		return errors.Errorf("unknown tcptype %q", v)
+	}
+	return nil
+}
+
 // ParseAttribute parses v into c and returns error if any.
 func ParseAttribute(v []byte, c *Candidate) error {
 	p := candidateParser{
@@ -613,3 +730,50 @@ func calcCandidatePriority(candidateType CandidateType, localPreference int, com
 		((256 - int32(componentID)) & 0xff)
 	return int(p)
 }
+
+/*
+RFC 6544 Section 4.2
+local preference = (2^13) * direction-pref + other-pref
+direction-pref 取决于 candidate 类型和 tcptype, 为了让 udp 总是优先,
+最大值 6*8192+8191 也小于 udp 使用的 defaultPreference.
+*/
+func calcTCPLocalPreference(candidateType CandidateType, tcpType TCPType) int {
+	const otherPreference = 8191
+	var directionPreference int
+	if candidateType == CandidateHost || candidateType == CandidateRelay {
+		switch tcpType {
+		case TCPTypeActive:
+			directionPreference = 6
+		case TCPTypePassive:
+			directionPreference = 4
+		case TCPTypeSimultaneousOpen:
+			directionPreference = 2
+		}
+	} else {
+		switch tcpType {
+		case TCPTypeSimultaneousOpen:
+			directionPreference = 6
+		case TCPTypeActive:
+			directionPreference = 4
+		case TCPTypePassive:
+			directionPreference = 2
+		}
+	}
+	return (directionPreference << 13) + otherPreference
+}
+
+/*
+RFC 6544 Section 6.2
+active 只能和 passive 配对,passive 只能和 active 配对, so 只能和 so 配对.
+*/
+func canPairTCP(l, r TCPType) bool {
+	switch l {
+	case TCPTypeActive:
+		return r == TCPTypePassive
+	case TCPTypePassive:
+		return r == TCPTypeActive
+	case TCPTypeSimultaneousOpen:
+		return r == TCPTypeSimultaneousOpen
+	}
+	return false
+}
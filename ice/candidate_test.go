@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"fmt"
@@ -71,7 +72,7 @@ func TestParse(t *testing.T) {
 		{
 			input: []byte("candidate:3862931549 1 udp 2113937151 192.168.220.128 56032 typ host generation 0 network-cost 50  alpha   beta    ??"),
 			expected: Candidate{
-				Foundation:  3862931549,
+				Foundation:  "3862931549",
 				ComponentID: 1,
 				Priority:    2113937151,
 				addr:        "192.168.220.128:56032",
@@ -88,7 +89,7 @@ func TestParse(t *testing.T) {
 		{
 			input: []byte("candidate:842163049 1 udp 1677729535 213.141.156.236 55726 typ srflx raddr"),
 			expected: Candidate{
-				Foundation:  842163049,
+				Foundation:  "842163049",
 				ComponentID: 1,
 				Priority:    1677729535,
 				addr:        "213.141.156.236:55726",
@@ -98,20 +99,26 @@ func TestParse(t *testing.T) {
 		}, {
 			input: []byte("candidate:842163049 1 udp 1677729535 b2.cydev.ru 56024 typ srflx raddr 10.1.22.220 rport 56024 generation 0 ufrag eM2ytqY8D5Q07RAn"),
 			expected: Candidate{
-				Foundation:  842163049,
+				Foundation:  "842163049",
 				ComponentID: 1,
 				Priority:    1677729535,
 				addr:        "b2.cydev.ru:56024",
 				Type:        CandidateServerReflexive,
 				relatedAddr: "10.1.22.220:56024",
 				Generation:  0,
+				Ufrag:       "eM2ytqY8D5Q07RAn",
 				transport:   TransportUDP,
-				Attributes: Attributes{
-					Attribute{
-						Key:   []byte("ufrag"),
-						Value: []byte("eM2ytqY8D5Q07RAn"),
-					},
-				},
+			},
+		}, {
+			input: []byte("candidate:1052353102 1 tcp 1518280447 192.168.1.4 9 typ host tcptype active generation 0"),
+			expected: Candidate{
+				Foundation:  "1052353102",
+				ComponentID: 1,
+				Priority:    1518280447,
+				addr:        "192.168.1.4:9",
+				Type:        CandidateHost,
+				transport:   TransportTCP,
+				TCPType:     TCPTypeActive,
 			},
 		},
 	}
@@ -134,6 +141,55 @@ func TestParse(t *testing.T) {
 	}
 }
 
+/*
+解析以后再编码必须和原来完全一样, 这样转发给对端的 candidate 不会丢失信息.
+*/
+func TestCandidateGolden(t *testing.T) {
+	for _, line := range strings.Split(string(loadData(t, "candidates_golden.txt")), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := candidateParser{
+			c:   new(Candidate),
+			buf: []byte(strings.TrimPrefix(line, "a=")),
+		}
+		if err := p.parse(); err != nil {
+			t.Errorf("parse %s err %s", line, err)
+			continue
+		}
+		if s := p.c.String(); s != line {
+			t.Errorf("round trip error\nexpect %s\ngot    %s", line, s)
+		}
+	}
+}
+
+func TestCandidateFoundation(t *testing.T) {
+	for _, f := range []string{"", "a-b", "a_b", "abcdefghijklmnopqrstuvwxyz0123456"} {
+		p := candidateParser{
+			c:   new(Candidate),
+			buf: []byte(fmt.Sprintf("candidate:%s 1 udp 2130706431 10.0.0.1 1 typ host", f)),
+		}
+		if err := p.parse(); err == nil {
+			t.Errorf("foundation %q should be invalid", f)
+		}
+	}
+	f := calcFoundation(CandidateHost, "192.168.1.1:5000", "", TransportUDP)
+	if len(f) == 0 || len(f) > maxFoundationLen || f != calcFoundation(CandidateHost, "192.168.1.1:6000", "", TransportUDP) {
+		t.Errorf("port should not change foundation %s", f)
+	}
+	for _, f2 := range []string{
+		calcFoundation(CandidateServerReflexive, "192.168.1.1:5000", "", TransportUDP),
+		calcFoundation(CandidateHost, "192.168.1.2:5000", "", TransportUDP),
+		calcFoundation(CandidateHost, "192.168.1.1:5000", "", TransportTCP),
+		calcFoundation(CandidateServerReflexive, "192.168.1.1:5000", "1.1.1.1:3478", TransportUDP),
+	} {
+		if f2 == f {
+			t.Error("type, base ip, server and transport should change foundation")
+		}
+	}
+}
+
 func BenchmarkParse(b *testing.B) {
 	data := loadData(b, "candidates_ex1.sdp")
 	s, err := sdp.DecodeSession(data, nil)
@@ -3,6 +3,9 @@ package ice
 import (
 	"bytes"
 	"fmt"
+	"time"
+
+	"github.com/nkbai/goice/stun"
 )
 
 /*
@@ -81,6 +84,23 @@ type sessionCheck struct {
 		what error
 	*/
 	err error
+	/*
+		valid list 中的 check 是由 checklist 中的哪个 check 产生的,
+		regular nomination 需要在它上面再次发送带 USE-CANDIDATE 的请求.
+	*/
+	generatingCheck *sessionCheck
+	/*
+		正在进行的 stun transaction, 由 session 的 checkTimer 重传, 结束以后为 nil.
+	*/
+	req          *stun.Message
+	transmits    int
+	rto          time.Duration
+	retransmitAt time.Time
+	/*
+		valid pair 最后一次收到 response 的时间, 用于 failover, 见 failover.go
+	*/
+	lastResponse time.Time
+	probes       int //失败以后探测的次数
 }
 
 func (s *sessionCheck) String() string {
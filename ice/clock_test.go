@@ -0,0 +1,110 @@
+package ice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nkbai/goice/clock"
+)
+
+/*
+pump 不断地拨动假时钟, 每次 step, 中间留一点真实时间让 loop 处理, 直到 done 被关闭.
+*/
+func pump(f *clock.Fake, step time.Duration, done <-chan struct{}) {
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			f.Add(step)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+}
+
+/*
+对方不存在, 所有的重传在假时钟上完成, 不需要真的等待十秒.
+*/
+func TestIceStreamTransport_FakeClockCheckTimeout(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	cfgs := newLANConfigs(t, 1)
+	cfgs[0].Clock = fake
+	s1, err := NewIceStreamTransport(cfgs[0], "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop()
+	cb1 := newicecb("s1")
+	s1.cb = cb1
+	if err = s1.InitIce(SessionRoleControlling); err != nil {
+		t.Fatal(err)
+	}
+	peer := "v=0\r\no=- 1 1 IN IP4 10.1.9.9\r\ns=-\r\nt=0 0\r\nm=audio 5000 RTP/AVP 0\r\nc=IN IP4 10.1.9.9\r\n" +
+		"a=ice-ufrag:abcd\r\na=ice-pwd:abcdefghijklmnopqrstuvwx\r\na=candidate:1 1 UDP 2130706431 10.1.9.9 5000 typ host\r\n"
+	if err = s1.StartNegotiation(peer); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	pump(fake, 50*time.Millisecond, done)
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("check should time out on fake clock")
+	case err = <-cb1.iceresult:
+		if err == nil {
+			t.Fatal("negotiation should fail")
+		}
+	}
+	//500ms, 1s, 然后每次 1.6s, 一共发送 7 次
+	if d := fake.Now().Sub(start); d < 9*time.Second {
+		t.Errorf("retransmissions should take at least 9s on fake clock, got %s", d)
+	}
+	st := s1.Stats()
+	if st.Timestamp.Before(start) || st.Timestamp.After(fake.Now()) {
+		t.Errorf("stats should use fake clock, got %s", st.Timestamp)
+	}
+	if len(st.Pairs) != 1 || st.Pairs[0].RequestsSent != maxRetryBindingRequest {
+		t.Errorf("all retransmissions should be counted %+v", st.Pairs)
+	}
+}
+
+/*
+使用缺省的 consent 间隔(5s)和超时(30s), 在假时钟上检查 consent 的刷新和过期.
+*/
+func TestIceStreamTransport_FakeClockConsentExpiry(t *testing.T) {
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	cfgs := newLANConfigs(t, 2)
+	for _, cfg := range cfgs {
+		cfg.Clock = fake
+		cfg.ConsentInterval = 0
+	}
+	done := make(chan struct{})
+	defer close(done)
+	pump(fake, 20*time.Millisecond, done)
+	s1, s2, cb1, _ := setupNegotiatedPair(t, cfgs[0], cfgs[1])
+	defer s1.Stop()
+	//consent 一直在刷新, 过了两倍的超时时间也不会断开
+	deadline := fake.Now().Add(2 * defaultConsentTimeout)
+	for fake.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s1.getState() != TransportStateRunning || s2.getState() != TransportStateRunning {
+		t.Fatalf("should keep running,s1=%s,s2=%s", s1.getState(), s2.getState())
+	}
+	s2.Stop()
+	stopped := fake.Now()
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("s1 should detect consent expiry")
+	case err := <-cb1.disconnected:
+		if err != errConsentExpired {
+			t.Errorf("expect consent expired,got %s", err)
+		}
+	}
+	if d := fake.Now().Sub(stopped); d < defaultConsentTimeout-defaultConsentInterval*6/5 {
+		t.Errorf("consent should expire after %s, got %s", defaultConsentTimeout, d)
+	}
+}
@@ -0,0 +1,284 @@
+package ice
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nkbai/goice/clock"
+)
+
+/*
+Conn 把 StreamTransport 包装成 net.Conn 和 net.PacketConn, 这样 DTLS,QUIC 等可以直接在 ICE 上面运行.
+它总是使用当前选定的 pair 发送数据, 如果 ICE 协商失败或者连接断开, 读写都会返回对应的错误,
+Restart 成功以后同一个 Conn 又可以使用了. Close 或者 Stop 以后不能再使用.
+每次 Read 返回一个完整的数据包, 缓冲区不够时多出的部分被丢弃, 和 udp 一样.
+*/
+type Conn struct {
+	t             *StreamTransport
+	recvChan      chan *connPacket
+	closeChan     chan struct{} //关闭时 close, Restart 以后换成新的, 通过 done 读取
+	readDeadline  *deadline
+	writeDeadline *deadline
+	lock          sync.Mutex
+	err           error //关闭的原因
+}
+
+type connPacket struct {
+	data []byte
+	from net.Addr
+}
+
+var (
+	_ net.Conn       = (*Conn)(nil)
+	_ net.PacketConn = (*Conn)(nil)
+)
+
+/*
+接收队列满了以后, 新收到的数据被丢弃.
+*/
+const defaultConnQueueSize = 256
+
+var (
+	errConnClosed   = errors.New("ice conn closed")
+	errNotConnected = errors.New("ice not connected")
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+/*
+Conn returns the net.Conn view of this transport, it's created once and always the same.
+After Conn is called, received data is delivered to it instead of OnReceiveData,
+so call it before StartNegotiation to get all data.
+*/
+func (t *StreamTransport) Conn() *Conn {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.conn == nil {
+		clk := t.cfg.clock()
+		t.conn = &Conn{
+			t:             t,
+			recvChan:      make(chan *connPacket, defaultConnQueueSize),
+			closeChan:     make(chan struct{}),
+			readDeadline:  newDeadline(clk),
+			writeDeadline: newDeadline(clk),
+		}
+	}
+	return t.conn
+}
+
+func (t *StreamTransport) getConn() *Conn {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.conn
+}
+
+func (c *Conn) deliver(data []byte, from net.Addr) {
+	select {
+	case <-c.done():
+	case c.recvChan <- &connPacket{data, from}:
+	default:
+		c.t.log.Warn("conn receive queue full, packet dropped")
+	}
+}
+
+/*
+关闭 Conn, 之后的读写都返回 err
+*/
+func (c *Conn) closeWithError(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.closeChan)
+}
+
+/*
+rearm 在 Restart 成功以后调用, 因为协商失败或者断开而关闭的 Conn 重新可以读写.
+*/
+func (c *Conn) rearm() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err == nil || c.err == errConnClosed {
+		return
+	}
+	c.err = nil
+	c.closeChan = make(chan struct{})
+}
+
+func (c *Conn) done() <-chan struct{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closeChan
+}
+
+func (c *Conn) closedError() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+//ReadFrom implements net.PacketConn, addr is the peer address of the selected pair when data received
+func (c *Conn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	timer := clock.NewStoppedTimer(c.readDeadline.clock)
+	defer timer.Stop()
+	for {
+		changed := c.readDeadline.wait(timer)
+		select {
+		case pkt := <-c.recvChan:
+			return copy(p, pkt.data), pkt.from, nil
+		case <-c.done():
+			//先把已经收到的数据读完
+			select {
+			case pkt := <-c.recvChan:
+				return copy(p, pkt.data), pkt.from, nil
+			default:
+			}
+			return 0, nil, c.closedError()
+		case <-timer.C():
+			return 0, nil, timeoutError{}
+		case <-changed:
+		}
+	}
+}
+
+//Read implements net.Conn
+func (c *Conn) Read(p []byte) (n int, err error) {
+	n, _, err = c.ReadFrom(p)
+	return
+}
+
+/*
+WriteTo implements net.PacketConn, addr is ignored, data is always sent to the selected pair,
+because the selected pair may change after negotiation.
+*/
+func (c *Conn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	return c.Write(p)
+}
+
+//Write implements net.Conn
+func (c *Conn) Write(p []byte) (n int, err error) {
+	if err = c.closedError(); err != nil {
+		return
+	}
+	if c.writeDeadline.exceeded() {
+		return 0, timeoutError{}
+	}
+	s := c.t.getRunningSession()
+	if s == nil {
+		return 0, errNotConnected
+	}
+	err = s.SendData(p)
+	if err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+//Close implements net.Conn, it stops the transport too
+func (c *Conn) Close() error {
+	if c.closedError() != nil {
+		return nil
+	}
+	c.t.Stop()
+	return nil
+}
+
+func selectedAddr(s *session, local bool) net.Addr {
+	if s == nil {
+		return &net.UDPAddr{}
+	}
+	check, _, _ := s.selectedPair()
+	if check == nil {
+		return &net.UDPAddr{}
+	}
+	if local {
+		return addrToUDPAddr(check.localCandidate.addr)
+	}
+	return addrToUDPAddr(check.remoteCandidate.addr)
+}
+
+//LocalAddr implements net.Conn, local address of the selected pair
+func (c *Conn) LocalAddr() net.Addr {
+	//Restart 可能同时把 session 置为 nil, 只读取一次
+	return selectedAddr(c.t.getSession(), true)
+}
+
+//RemoteAddr implements net.Conn, remote address of the selected pair
+func (c *Conn) RemoteAddr() net.Addr {
+	return selectedAddr(c.t.getSession(), false)
+}
+
+//SetDeadline implements net.Conn
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+//SetReadDeadline implements net.Conn
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+//SetWriteDeadline implements net.Conn
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+/*
+deadline 修改以后, 正在等待的 Read 需要重新计算超时时间.
+*/
+type deadline struct {
+	lock    sync.Mutex
+	clock   clock.Clock
+	t       time.Time
+	changed chan struct{}
+}
+
+func newDeadline(c clock.Clock) *deadline {
+	return &deadline{clock: c, changed: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.lock.Lock()
+	d.t = t
+	close(d.changed)
+	d.changed = make(chan struct{})
+	d.lock.Unlock()
+}
+
+/*
+按照当前的 deadline 重新设置 timer, 没有 deadline 的时候 timer 停止, 永远不会触发.
+timer 由调用者创建, 在一次 Read 中重复使用, 返回之前由调用者 Stop.
+*/
+func (d *deadline) wait(timer clock.Timer) (changed <-chan struct{}) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !timer.Stop() {
+		//上一个 deadline 已经触发, 但是没有被读取
+		select {
+		case <-timer.C():
+		default:
+		}
+	}
+	if !d.t.IsZero() {
+		timer.Reset(d.t.Sub(d.clock.Now()))
+	}
+	return d.changed
+}
+
+func (d *deadline) exceeded() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return !d.t.IsZero() && !d.clock.Now().Before(d.t)
+}
@@ -0,0 +1,227 @@
+package ice
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nkbai/goice/clock"
+)
+
+func TestConn(t *testing.T) {
+	s1, s2, _, _ := setupNegotiatedPair(t, NewTransportConfigHostonly(), NewTransportConfigHostonly())
+	defer s1.Stop()
+	var c1, c2 net.Conn = s1.Conn(), s2.Conn()
+	if c1.RemoteAddr().String() != s1.session.sessionComponent.nominatedCheck.remoteCandidate.addr {
+		t.Errorf("remote addr error %s", c1.RemoteAddr())
+	}
+	data := []byte("hello,conn")
+	if _, err := c1.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c2.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], data) {
+		t.Errorf("read error got %s", buf[:n])
+	}
+	c1.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = c1.Read(buf)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("expect timeout,got %v", err)
+	}
+	//修改 deadline 以后阻塞的 Read 也要生效
+	c1.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c1.SetReadDeadline(time.Now())
+	}()
+	_, err = c1.Read(buf)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("expect timeout,got %v", err)
+	}
+	if err = c2.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err = c2.Read(buf); err != errConnClosed {
+		t.Errorf("expect closed,got %v", err)
+	}
+	if _, err = c2.Write(data); err != errConnClosed {
+		t.Errorf("expect closed,got %v", err)
+	}
+}
+
+/*
+tcp pair 的数据由发送协程写, Write 返回以后调用者立即重用缓冲区, 对方收到的数据不能被改写.
+*/
+func TestConnTCPReuseBuffer(t *testing.T) {
+	cfg := NewTransportConfigHostonly()
+	cfg.EnableTCP = true
+	s1, err := NewIceStreamTransport(cfg, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := NewIceStreamTransport(cfg, "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop()
+	defer s2.Stop()
+	cb1, cb2 := newicecb("s1"), newicecb("s2")
+	s1.cb, s2.cb = cb1, cb2
+	c1, c2 := s1.Conn(), s2.Conn()
+	if err = s1.InitIce(SessionRoleControlling); err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.InitIce(SessionRoleControlled); err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.StartNegotiation(encodeSessionTCPOnly(s1)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s1.StartNegotiation(encodeSessionTCPOnly(s2)); err != nil {
+		t.Fatal(err)
+	}
+	for _, cb := range []*icecb{cb1, cb2} {
+		select {
+		case <-time.After(20 * time.Second):
+			t.Fatalf("%s negotiation timeout", cb.name)
+		case err = <-cb.iceresult:
+			if err != nil {
+				t.Fatalf("%s negotiation failed %s", cb.name, err)
+			}
+		}
+	}
+	if s1.session.sessionComponent.nominatedCheck.localCandidate.transport != TransportTCP {
+		t.Fatal("nominated check should be tcp")
+	}
+	const count = 50
+	buf := make([]byte, 100)
+	for i := 0; i < count; i++ {
+		for j := range buf {
+			buf[j] = byte(i)
+		}
+		if _, err = c1.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for j := range buf {
+		buf[j] = 0xff
+	}
+	rbuf := make([]byte, 200)
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < count; i++ {
+		n, err := c2.Read(rbuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rbuf[:n], bytes.Repeat([]byte{byte(i)}, len(buf))) {
+			t.Fatalf("packet %d was overwritten after Write returned, got %v", i, rbuf[:n])
+		}
+	}
+}
+
+/*
+deadline 使用 TransportConfig.Clock
+*/
+func TestConnDeadlineFakeClock(t *testing.T) {
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	cfg := NewTransportConfigHostonly()
+	cfg.Clock = fake
+	s, err := NewIceStreamTransport(cfg, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	c := s.Conn()
+	c.SetReadDeadline(fake.Now().Add(time.Minute))
+	timers := fake.Timers()
+	done := make(chan error)
+	go func() {
+		_, err := c.Read(make([]byte, 100))
+		done <- err
+	}()
+	fake.BlockUntil(timers + 1)
+	select {
+	case err = <-done:
+		t.Fatalf("read should wait for the fake clock, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	fake.Add(time.Minute)
+	select {
+	case err = <-done:
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			t.Errorf("expect timeout,got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read should time out on fake clock")
+	}
+	if fake.Timers() != timers {
+		t.Errorf("read timer should be stopped, timers=%d want %d", fake.Timers(), timers)
+	}
+}
+
+/*
+断开以后 Conn 返回错误, Restart 并重新协商以后同一个 Conn 又可以读写.
+*/
+func TestConnRestart(t *testing.T) {
+	cfgs := newStaticLANConfigs(t, "10.1.1.1", "10.1.2.1")
+	s1, s2, cb1, cb2 := setupNegotiatedPair(t, cfgs[0], cfgs[1])
+	defer s1.Stop()
+	defer s2.Stop()
+	c1, c2 := s1.Conn(), s2.Conn()
+	s1.onDisconnected(errConsentExpired)
+	buf := make([]byte, 100)
+	if _, err := c1.Read(buf); err != errConsentExpired {
+		t.Fatalf("expect consent expired, got %v", err)
+	}
+	if _, err := c1.Write([]byte("x")); err != errConsentExpired {
+		t.Fatalf("expect consent expired, got %v", err)
+	}
+	//LocalAddr 和 Restart 同时进行
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c1.LocalAddr()
+			c1.RemoteAddr()
+		}
+	}()
+	for _, s := range []*StreamTransport{s1, s2} {
+		if err := s.Restart(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	lsdp, _ := s1.EncodeSession()
+	rsdp, _ := s2.EncodeSession()
+	if err := s2.StartNegotiation(lsdp); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.StartNegotiation(rsdp); err != nil {
+		t.Fatal(err)
+	}
+	for _, cb := range []*icecb{cb1, cb2} {
+		select {
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s negotiation timeout", cb.name)
+		case err := <-cb.iceresult:
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	data := []byte("hello,restart")
+	if _, err := c1.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c2.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], data) {
+		t.Errorf("read after restart error %v %s", err, buf[:n])
+	}
+}
@@ -0,0 +1,208 @@
+package ice
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/nkbai/goice/stun"
+)
+
+/*
+RFC 7675 Consent Freshness
+协商完成以后,full agent 在选定的 pair 上周期性的发送带认证的 binding request,
+收到正确的 response 就表示对方仍然同意接收数据, 超过 consent timeout 没有收到, 就认为连接已经断开.
+这些请求同时也起到了保持 NAT 映射的作用.
+lite agent 不发送请求, 以收到对方的 binding request 作为 consent.
+定时器在 session.loop 中处理, 所以这里的状态都不需要加锁.
+*/
+const (
+	defaultConsentInterval = time.Second * 5
+	defaultConsentTimeout  = time.Second * 30
+	/*
+		RFC 8445 Section 11, 关闭 consent 以后仍然需要保持 NAT 映射, 发送 binding indication.
+		缺省的 Timing.KeepAliveInterval.
+	*/
+	defaultKeepAliveInterval = time.Second * 15
+)
+
+var errConsentExpired = errors.New("consent expired")
+
+/*
+发出的 consent 请求, 超过 liveness timeout 没有 response 的会被清除.
+*/
+type consentRequest struct {
+	check *sessionCheck
+	sent  time.Time
+}
+
+/*
+DisconnectCallbacker is an optional interface of StreamTransportCallbacker,
+OnDisconnected is called when consent of the selected pair is lost, data can't be sent any more.
+*/
+type DisconnectCallbacker interface {
+	OnDisconnected(err error)
+}
+
+/*
+RFC 7675 Section 5.1: 发送间隔在 [0.8,1.2]*interval 之间随机, 防止多个连接同时发送.
+*/
+func consentJitter(interval time.Duration) time.Duration {
+	return interval*4/5 + time.Duration(rand.Int63n(int64(interval*2/5)+1))
+}
+
+func (s *session) refreshConsent() {
+	s.lastConsent = s.clock.Now()
+}
+
+func (s *session) consentExpired() bool {
+	return s.clock.Now().Sub(s.lastConsent) > s.consentTimeout
+}
+
+func (s *session) resetConsentTimer() {
+	interval := s.consentInterval
+	if interval < 0 {
+		//consent 被关闭, 只需要 keepalive
+		interval = s.timing.KeepAliveInterval
+	}
+	s.consentTimer.Reset(consentJitter(interval))
+}
+
+/*
+只启动一次,在第一次协商成功以后.
+*/
+func (s *session) startConsent() {
+	s.refreshConsent()
+	for _, c := range s.validCheckList.checks {
+		c.lastResponse = s.lastConsent
+	}
+	s.resetConsentTimer()
+}
+
+func (s *session) onConsentTimer() {
+	if s.consentInterval < 0 {
+		s.sendKeepAlive()
+		s.resetConsentTimer()
+		return
+	}
+	if !s.lite {
+		s.failover()
+	}
+	if s.consentExpired() {
+		s.log.Info(fmt.Sprintf("%s consent expired, no response in %s", s.Name, s.consentTimeout))
+		s.iceStreamTransport.onDisconnected(errConsentExpired)
+		return
+	}
+	if !s.lite {
+		s.sendConsentRequests()
+	}
+	s.resetConsentTimer()
+}
+
+/*
+选定的 pair 以及发送用的地址
+*/
+func (s *session) selectedPair() (check *sessionCheck, srv serverSocker, fromaddr string) {
+	p := s.getDataPath()
+	if p == nil {
+		return nil, nil, ""
+	}
+	return p.check, p.srv, p.check.localCandidate.sendAddr()
+}
+
+/*
+选定的 pair, 其他的 valid pair 以及需要探测的 check 上各发送一个请求, 见 failover.go
+*/
+func (s *session) sendConsentRequests() {
+	selected := s.getNominatedCheck()
+	if selected == nil {
+		return
+	}
+	now := s.clock.Now()
+	for id, r := range s.consentRequests {
+		if now.Sub(r.sent) > s.livenessTimeout() {
+			delete(s.consentRequests, id)
+		}
+	}
+	s.sendConsentRequest(selected, s.renominating)
+	for _, c := range s.validCheckList.checks {
+		if c != selected {
+			s.sendConsentRequest(c, false)
+		}
+	}
+	for _, c := range s.failedPairsToProbe() {
+		s.sendConsentRequest(c, false)
+	}
+}
+
+func (s *session) sendConsentRequest(check *sessionCheck, nominate bool) {
+	srv, err := s.getSenderServerSock(check.localCandidate.addr)
+	if err != nil {
+		s.log.Debug(fmt.Sprintf("send consent request err %s", err))
+		return
+	}
+	fromaddr := check.localCandidate.sendAddr()
+	//consent 不能带 USE-CANDIDATE, 只有 controlling 切换了选定的 pair 以后才带上
+	c := *check
+	c.nominated = nominate
+	req := s.buildBindingRequest(&c)
+	s.consentRequests[req.TransactionID] = &consentRequest{check, s.clock.Now()}
+	s.log.Trace(fmt.Sprintf("send consent request %s->%s nominate=%v", fromaddr, check.remoteCandidate.addr, nominate))
+	err = srv.sendStunMessageAsync(req, fromaddr, check.remoteCandidate.addr)
+	s.counter.requestSent(pairID(check.localCandidate.addr, check.remoteCandidate.addr), req.TransactionID)
+	if err != nil {
+		s.log.Debug(fmt.Sprintf("send consent request err %s", err))
+	}
+}
+
+func (s *session) sendKeepAlive() {
+	check, srv, fromaddr := s.selectedPair()
+	if check == nil {
+		return
+	}
+	req, err := stun.Build(stun.TransactionIDSetter, stun.BindingIndication, software, stun.Fingerprint)
+	if err != nil {
+		panic(fmt.Sprintf("build keepalive error %s", err))
+	}
+	err = srv.sendStunMessageAsync(req, fromaddr, check.remoteCandidate.addr)
+	if err != nil {
+		s.log.Debug(fmt.Sprintf("send keepalive err %s", err))
+	}
+}
+
+/*
+如果是 consent 的 response, 处理并返回 true
+*/
+func (s *session) handleConsentResponse(remoteAddr string, res *stun.Message) bool {
+	r, ok := s.consentRequests[res.TransactionID]
+	if !ok {
+		return false
+	}
+	delete(s.consentRequests, res.TransactionID)
+	check := r.check
+	if res.Type.Class != stun.ClassSuccessResponse {
+		s.log.Info(fmt.Sprintf("consent request got error response %s", res.Type))
+		return true
+	}
+	if remoteAddr != check.remoteCandidate.addr {
+		s.log.Warn(fmt.Sprintf("consent response from %s, expect %s", remoteAddr, check.remoteCandidate.addr))
+		return true
+	}
+	if err := s.rxCrendientials.Check(res); err != nil {
+		s.log.Warn(fmt.Sprintf("consent response crendientials check failed %s", err))
+		return true
+	}
+	s.counter.responseReceived(pairID(check.localCandidate.addr, check.remoteCandidate.addr), res.TransactionID)
+	if check.state == checkStateFailed {
+		check = s.addRecoveredPair(check)
+	}
+	check.lastResponse = s.clock.Now()
+	if check == s.getNominatedCheck() {
+		s.lastConsent = check.lastResponse
+		//对方已经收到了 USE-CANDIDATE
+		s.renominating = false
+	}
+	s.tryUpgrade()
+	return true
+}
@@ -0,0 +1,64 @@
+package ice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConsentJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := consentJitter(defaultConsentInterval)
+		if d < defaultConsentInterval*4/5 || d > defaultConsentInterval*6/5 {
+			t.Fatalf("jitter out of range %s", d)
+		}
+	}
+}
+
+func TestIceStreamTransport_Consent(t *testing.T) {
+	cfg := NewTransportConfigHostonly()
+	cfg.ConsentInterval = time.Millisecond * 50
+	cfg.ConsentTimeout = time.Millisecond * 500
+	s1, s2, cb1, _ := setupNegotiatedPair(t, cfg, cfg)
+	defer s1.Stop()
+	//consent 一直在刷新, 不应该断开
+	time.Sleep(cfg.ConsentTimeout * 2)
+	if s1.State != TransportStateRunning || s2.State != TransportStateRunning {
+		t.Fatalf("should keep running,s1=%s,s2=%s", s1.State, s2.State)
+	}
+	s2.Stop()
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("s1 should detect disconnect")
+	case err := <-cb1.disconnected:
+		if err != errConsentExpired {
+			t.Errorf("expect consent expired,got %s", err)
+		}
+	}
+	if s1.State != TransportStateDisconnected {
+		t.Errorf("state should be disconnected,got %s", s1.State)
+	}
+	if err := s1.SendData([]byte("hello")); err == nil {
+		t.Error("should not send after disconnected")
+	}
+}
+
+func TestIceStreamTransport_ConsentLite(t *testing.T) {
+	full := NewTransportConfigHostonly()
+	full.ConsentInterval = time.Millisecond * 50
+	lite := NewTransportConfigHostonly()
+	lite.Lite = true
+	lite.ConsentInterval = time.Millisecond * 50
+	lite.ConsentTimeout = time.Millisecond * 500
+	s1, s2, _, cb2 := setupNegotiatedPair(t, full, lite)
+	defer s2.Stop()
+	time.Sleep(lite.ConsentTimeout * 2)
+	if s2.State != TransportStateRunning {
+		t.Fatalf("lite should keep running,got %s", s2.State)
+	}
+	s1.Stop()
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("lite should detect disconnect")
+	case <-cb2.disconnected:
+	}
+}
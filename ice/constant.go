@@ -19,14 +19,20 @@ const maxRetryBindingRequest = 7
 const stunTimeoutValue = 1600 * time.Millisecond
 
 /**
-* The default initial STUN round-trip time estimation (the RTO value
-* in RFC 3489-bis), in miliseconds.
-* This value is used to control the STUN request
-* retransmit time. The initial value of retransmission interval
-* would be set to this value, and will be doubled after each
-* retransmission.
- */
-const defaultRTOValue = time.Millisecond * 100
+ * Ta, the interval between two new connectivity checks (RFC 8445 14.2).
+ */
+const defaultCheckInterval = time.Millisecond * 50
+
+/**
+ * Maximum number of candidate pairs in the check list (RFC 8445 6.1.2.5).
+ */
+const defaultMaxCheckListSize = 100
+
+/**
+ * Minimum RTO of connectivity checks (RFC 8445 14.3), the real value
+ * grows with the number of waiting and in-progress pairs.
+ */
+const minCheckRTOValue = time.Millisecond * 500
 
 /**
  * The TURN permission lifetime setting. This value should be taken from the
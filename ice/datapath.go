@@ -0,0 +1,122 @@
+package ice
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var errNoSelectedPair = errors.New("no selected pair")
+
+/*
+dataPath 是收发数据用的选定 pair, 在 loop 中构造, 通过 atomic.Value 发布,
+SendData 和 ReceiveData 不需要经过 loop, 也不需要加锁.
+*/
+type dataPath struct {
+	check *sessionCheck
+	srv   serverSocker
+	/*
+		direct 不为空的时候直接在调用者的协程中写 socket, 否则交给 srv.sendData
+	*/
+	direct net.PacketConn
+	from   string //发送用的本地地址
+	to     string
+	toAddr *net.UDPAddr
+	id     string //统计用的 pair id
+}
+
+/*
+updateDataPath 只能在 loop 中调用, nominatedCheck 或者 nominatedServerSock 变化以后重新发布.
+协商完成以前 nominatedServerSock 为空, 这时候还不能发送数据.
+*/
+func (s *session) updateDataPath() {
+	s.mlock.Lock()
+	check := s.sessionComponent.nominatedCheck
+	srv := s.sessionComponent.nominatedServerSock
+	s.mlock.Unlock()
+	if check == nil || srv == nil {
+		return
+	}
+	//nominatedcheck 可能在协商完成以后变化, 这时候要换成它对应的 serversock
+	if srv2, err := s.getSenderServerSock(check.localCandidate.addr); err == nil {
+		srv = srv2
+	}
+	p := &dataPath{
+		check:  check,
+		srv:    srv,
+		from:   check.localCandidate.addr,
+		to:     check.remoteCandidate.addr,
+		toAddr: addrToUDPAddr(check.remoteCandidate.addr),
+		id:     pairID(check.localCandidate.addr, check.remoteCandidate.addr),
+	}
+	if check.localCandidate.Type != CandidateRelay {
+		p.from = check.localCandidate.sendAddr()
+		var sock *stunServerSock
+		switch ss := srv.(type) {
+		case *stunServerSock:
+			sock = ss
+		case *turnServerSock:
+			sock = ss.s
+		}
+		//tcp 的 WriteTo 可能长时间阻塞, 批量发送的要和其他包一起发送, 仍然交给发送协程
+		if sock != nil && sock.bc == nil {
+			if _, ok := sock.c.(*tcpPacketConn); !ok {
+				p.direct = sock.c
+			}
+		}
+	}
+	old := s.getDataPath()
+	if old != nil && old.check == p.check && old.srv == p.srv {
+		return
+	}
+	s.log.Trace(fmt.Sprintf("data path %s->%s direct=%v", p.from, p.to, p.direct != nil))
+	s.dataPath.Store(p)
+}
+
+func (s *session) getDataPath() *dataPath {
+	p, _ := s.dataPath.Load().(*dataPath)
+	return p
+}
+
+/*
+SendData 可以在任何协程中调用, 发送到选定的 pair.
+*/
+func (s *session) SendData(data []byte) (err error) {
+	p := s.getDataPath()
+	if p == nil {
+		return errNoSelectedPair
+	}
+	if p.direct != nil {
+		_, err = p.direct.WriteTo(data, p.toAddr)
+	} else {
+		err = p.srv.sendData(data, p.from, p.to)
+	}
+	if err == nil {
+		s.counter.dataSent(p.id, len(data))
+	}
+	return err
+}
+
+/*
+1. 在协商未完全结束之前就有可能收到数据,只要有一个可用的连接,对方就会发送数据,
+2. 随着协商的完成,最终双方会确认一个一致的 check, 如果这时候是走的 relay, 那么才会启用 turn channel 模式.
+数据在 socket 的读取协程中直接交给上层, 不经过 loop. Stop 以后不再回调.
+*/
+func (s *session) ReceiveData(localAddr, peerAddr string, data []byte) {
+	s.dataLock.RLock()
+	defer s.dataLock.RUnlock()
+	if s.dataStopped {
+		return
+	}
+	var id string
+	if p := s.getDataPath(); p != nil && p.to == peerAddr && (localAddr == p.from || localAddr == p.check.localCandidate.addr) {
+		id = p.id
+	} else {
+		//loop 中可能在添加 peer reflexive candidate
+		s.mlock.Lock()
+		id = s.pairIDOf(localAddr, peerAddr)
+		s.mlock.Unlock()
+	}
+	s.counter.dataReceived(id, len(data))
+	s.iceStreamTransport.onRxData(data, peerAddr)
+}
@@ -0,0 +1,103 @@
+package ice
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+loop 被阻塞的时候, 数据仍然能够收发.
+*/
+func TestIceStreamTransport_DataBypassesLoop(t *testing.T) {
+	cfgs := newLANConfigs(t, 2)
+	s1, s2, _, cb2 := setupNegotiatedPair(t, cfgs[0], cfgs[1])
+	defer s1.Stop()
+	defer s2.Stop()
+	release := make(chan struct{})
+	blocked := make(chan struct{})
+	for _, s := range []*StreamTransport{s1, s2} {
+		go s.getSession().run(func() {
+			blocked <- struct{}{}
+			<-release
+		})
+		<-blocked
+	}
+	defer close(release)
+	if err := s1.SendData([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("data should not wait for the loop")
+	case data := <-cb2.data:
+		if string(data) != "hello" {
+			t.Errorf("expect hello,got %q", data)
+		}
+	}
+}
+
+/*
+countcb 只计数, 不保存收到的数据
+*/
+type countcb struct {
+	*icecb
+	n int64
+}
+
+func (c *countcb) OnReceiveData(data []byte, from net.Addr) {
+	atomic.AddInt64(&c.n, 1)
+}
+
+/*
+本机回环上两个 transport 之间收发数据, 报告每秒收到的包数.
+*/
+func BenchmarkIceStreamTransport_LoopbackData(b *testing.B) {
+	for _, batch := range []bool{false, true} {
+		name := "single"
+		if batch {
+			name = "batch"
+		}
+		b.Run(name, func(b *testing.B) {
+			benchmarkLoopbackData(b, batch)
+		})
+	}
+}
+
+func benchmarkLoopbackData(b *testing.B, batch bool) {
+	var cfgs []*TransportConfig
+	for i := 0; i < 2; i++ {
+		cfg := NewTransportConfigHostonly()
+		cfg.GatherFilter = &GatherFilter{IncludeLoopback: true, IncludeCIDRs: []string{"127.0.0.1/32"}}
+		cfg.BatchIO = batch
+		cfgs = append(cfgs, cfg)
+	}
+	s1, s2, _, cb2 := setupNegotiatedPair(b, cfgs[0], cfgs[1])
+	defer s1.Stop()
+	defer s2.Stop()
+	cb := &countcb{icecb: cb2}
+	s2.getSession().run(func() { s2.cb = cb })
+	data := make([]byte, 1200)
+	//最多有 window 个包在路上, 避免把 socket 的接收缓冲区写满
+	const window = 64
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		for int64(i)-atomic.LoadInt64(&cb.n) >= window {
+			if time.Since(start) > time.Minute {
+				b.Fatal("packets lost")
+			}
+			time.Sleep(10 * time.Microsecond)
+		}
+		if err := s1.SendData(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for atomic.LoadInt64(&cb.n) < int64(b.N) && time.Since(start) < time.Minute {
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&cb.n))/time.Since(start).Seconds(), "pkts/s")
+}
@@ -0,0 +1,152 @@
+package ice
+
+import (
+	"fmt"
+)
+
+/*
+ConnectionState is the state of connection to the peer, it's reported by EventConnectionStateChanged.
+*/
+type ConnectionState int
+
+const (
+	//ConnectionStateNew candidates gathered, negotiation not started
+	ConnectionStateNew ConnectionState = iota
+	//ConnectionStateChecking negotiation started, checks in progress
+	ConnectionStateChecking
+	//ConnectionStateConnected found a nominated pair, data can be sent, the selected pair may still change
+	ConnectionStateConnected
+	//ConnectionStateCompleted all checks finished, the selected pair only changes on failover or upgrade
+	ConnectionStateCompleted
+	//ConnectionStateDisconnected consent of the selected pair is lost
+	ConnectionStateDisconnected
+	//ConnectionStateFailed negotiation failed
+	ConnectionStateFailed
+	//ConnectionStateClosed transport is stopped
+	ConnectionStateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case ConnectionStateNew:
+		return "new"
+	case ConnectionStateChecking:
+		return "checking"
+	case ConnectionStateConnected:
+		return "connected"
+	case ConnectionStateCompleted:
+		return "completed"
+	case ConnectionStateDisconnected:
+		return "disconnected"
+	case ConnectionStateFailed:
+		return "failed"
+	case ConnectionStateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+/*
+EventType is the type of Event
+*/
+type EventType int
+
+const (
+	//EventGatheringStarted candidate gathering started
+	EventGatheringStarted EventType = iota
+	//EventCandidateGathered one local candidate is gathered, Event.Candidate is set
+	EventCandidateGathered
+	//EventGatheringComplete all candidates are gathered, Event.Err is set if failed
+	EventGatheringComplete
+	//EventCheckStateChanged state of one check changed, Event.Pair, Event.CheckState and Event.Err are set
+	EventCheckStateChanged
+	//EventSelectedPairChanged the pair used to send data changed, Event.Pair is set, Event.Err is set on failover
+	EventSelectedPairChanged
+	//EventConnectionStateChanged Event.ConnectionState and Event.Err are set
+	EventConnectionStateChanged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventGatheringStarted:
+		return "gathering-started"
+	case EventCandidateGathered:
+		return "candidate-gathered"
+	case EventGatheringComplete:
+		return "gathering-complete"
+	case EventCheckStateChanged:
+		return "check-state-changed"
+	case EventSelectedPairChanged:
+		return "selected-pair-changed"
+	case EventConnectionStateChanged:
+		return "connection-state-changed"
+	}
+	return "unknown"
+}
+
+/*
+Event reports progress of ICE, which fields are set depends on Type.
+*/
+type Event struct {
+	Type            EventType
+	Candidate       *Candidate
+	Pair            *CandidatePair
+	CheckState      SessionCheckState
+	ConnectionState ConnectionState
+	Err             error
+}
+
+func (e *Event) String() string {
+	switch e.Type {
+	case EventCandidateGathered:
+		return fmt.Sprintf("{%s %s}", e.Type, e.Candidate.addr)
+	case EventCheckStateChanged:
+		return fmt.Sprintf("{%s %s %s err=%v}", e.Type, e.Pair, e.CheckState, e.Err)
+	case EventSelectedPairChanged:
+		return fmt.Sprintf("{%s %s}", e.Type, e.Pair)
+	case EventConnectionStateChanged:
+		return fmt.Sprintf("{%s %s err=%v}", e.Type, e.ConnectionState, e.Err)
+	}
+	return fmt.Sprintf("{%s err=%v}", e.Type, e.Err)
+}
+
+/*
+EventCallbacker is an optional interface of StreamTransportCallbacker,
+OnEvent is called from ICE goroutines, it should not block.
+*/
+type EventCallbacker interface {
+	OnEvent(e *Event)
+}
+
+func (t *StreamTransport) emit(e *Event) {
+	t.log.Trace(fmt.Sprintf("%s event %s", t.Name, e))
+	if cb, ok := t.cb.(EventCallbacker); ok {
+		cb.OnEvent(e)
+	}
+}
+
+func (t *StreamTransport) changeConnectionState(state ConnectionState, err error) {
+	t.lock.Lock()
+	if t.connectionState == state {
+		t.lock.Unlock()
+		return
+	}
+	t.connectionState = state
+	t.lock.Unlock()
+	t.emit(&Event{Type: EventConnectionStateChanged, ConnectionState: state, Err: err})
+}
+
+/*
+ConnectionState returns current state of connection
+*/
+func (t *StreamTransport) ConnectionState() ConnectionState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.connectionState
+}
+
+func (s *session) emit(e *Event) {
+	if s.iceStreamTransport != nil {
+		s.iceStreamTransport.emit(e)
+	}
+}
@@ -0,0 +1,99 @@
+package ice
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type eventcb struct {
+	*icecb
+	lock   sync.Mutex
+	events []*Event
+}
+
+func (c *eventcb) OnEvent(e *Event) {
+	c.lock.Lock()
+	c.events = append(c.events, e)
+	c.lock.Unlock()
+}
+
+func (c *eventcb) count(typ EventType) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := 0
+	for _, e := range c.events {
+		if e.Type == typ {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *eventcb) connectionStates() (states []ConnectionState) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, e := range c.events {
+		if e.Type == EventConnectionStateChanged {
+			states = append(states, e.ConnectionState)
+		}
+	}
+	return
+}
+
+func TestIceStreamTransport_Events(t *testing.T) {
+	cfg := NewTransportConfigHostonly()
+	cb1 := &eventcb{icecb: newicecb("s1")}
+	cb2 := &eventcb{icecb: newicecb("s2")}
+	s1, err := NewIceStreamTransportWithCallback(cfg, "s1", cb1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := NewIceStreamTransportWithCallback(cfg, "s2", cb2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cb1.count(EventGatheringStarted) != 1 || cb1.count(EventGatheringComplete) != 1 ||
+		cb1.count(EventCandidateGathered) != len(s1.component.candidates) {
+		t.Fatalf("gathering events error %v", cb1.events)
+	}
+	if err = s1.InitIce(SessionRoleControlling); err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.InitIce(SessionRoleControlled); err != nil {
+		t.Fatal(err)
+	}
+	lsdp, _ := s1.EncodeSession()
+	rsdp, _ := s2.EncodeSession()
+	if err = s2.StartNegotiation(lsdp); err != nil {
+		t.Fatal(err)
+	}
+	if err = s1.StartNegotiation(rsdp); err != nil {
+		t.Fatal(err)
+	}
+	for _, cb := range []*eventcb{cb1, cb2} {
+		select {
+		case <-time.After(20 * time.Second):
+			t.Fatalf("%s negotiation timeout", cb.name)
+		case err = <-cb.iceresult:
+			if err != nil {
+				t.Fatalf("%s negotiation failed %s", cb.name, err)
+			}
+		}
+	}
+	if cb1.count(EventCheckStateChanged) == 0 {
+		t.Error("should report check state")
+	}
+	if cb1.count(EventSelectedPairChanged) == 0 {
+		t.Error("should report selected pair")
+	}
+	s1.Stop()
+	s2.Stop()
+	states := cb1.connectionStates()
+	if len(states) < 3 || states[0] != ConnectionStateChecking || states[len(states)-1] != ConnectionStateClosed {
+		t.Errorf("connection states error %v", states)
+	}
+	if s1.ConnectionState() != ConnectionStateClosed {
+		t.Errorf("state should be closed,got %s", s1.ConnectionState())
+	}
+}
@@ -2,19 +2,27 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"net"
 	"time"
 
 	"fmt"
 
 	"github.com/nkbai/goice/ice"
+	"github.com/nkbai/goice/vnet"
 	"github.com/nkbai/log"
 )
 
-const (
-	typHost = 1
-	typStun = 2
-	typTurn = 3
+/*
+-mode loopback 和 vnet 不需要网络, 可以离线运行:
+loopback 两边都只使用 127.0.0.1 上的 host candidate, vnet 两边在同一个内存中的虚拟局域网里.
+stun 和 turn 使用 -server 指定的服务器, 必须设置.
+*/
+var (
+	mode     = flag.String("mode", "loopback", "loopback, vnet, stun or turn")
+	server   = flag.String("server", "", "stun/turn server, ip:port")
+	user     = flag.String("user", "bai", "turn user")
+	password = flag.String("password", "bai", "turn password")
 )
 
 type icecb struct {
@@ -41,26 +49,64 @@ func (c *icecb) OnIceComplete(result error) {
 	c.iceresult <- result
 	log.Trace(fmt.Sprintf("%s negotiation complete", c.name))
 }
-func setupIcePair(typ int) (s1, s2 *ice.StreamTransport, err error) {
-	var cfg *ice.TransportConfig
-	switch typ {
-	case typHost:
-		cfg = ice.NewTransportConfigHostonly()
-	case typStun:
-		cfg = ice.NewTransportConfigWithStun("182.254.155.208:3478")
-	case typTurn:
-		cfg = ice.NewTransportConfigWithTurn("182.254.155.208:3478", "bai", "bai")
-	}
-	s1, err = ice.NewIceStreamTransport(cfg, "s1")
+func newConfigs() (cfgs []*ice.TransportConfig, err error) {
+	if (*mode == "stun" || *mode == "turn") && *server == "" {
+		return nil, fmt.Errorf("-server is required in mode %s", *mode)
+	}
+	switch *mode {
+	case "loopback":
+		for i := 0; i < 2; i++ {
+			cfg := ice.NewTransportConfigHostonly()
+			cfg.GatherFilter = &ice.GatherFilter{IncludeLoopback: true, IncludeCIDRs: []string{"127.0.0.1/32"}}
+			cfgs = append(cfgs, cfg)
+		}
+	case "vnet":
+		var lan *vnet.Router
+		lan, err = vnet.NewRouter(&vnet.RouterConfig{Name: "lan", CIDR: "10.0.0.0/24"})
+		if err != nil {
+			return
+		}
+		for i := 0; i < 2; i++ {
+			var n *vnet.Net
+			n, err = vnet.NewNet(nil)
+			if err != nil {
+				return
+			}
+			if err = lan.AddNet(n); err != nil {
+				return
+			}
+			cfg := ice.NewTransportConfigHostonly()
+			cfg.Net = n
+			cfgs = append(cfgs, cfg)
+		}
+	case "stun":
+		cfg := ice.NewTransportConfigWithStun(*server)
+		cfgs = append(cfgs, cfg, cfg)
+	case "turn":
+		cfg := ice.NewTransportConfigWithTurn(*server, *user, *password)
+		cfgs = append(cfgs, cfg, cfg)
+	default:
+		err = fmt.Errorf("unknown mode %s", *mode)
+	}
+	return
+}
+
+func setupIcePair() (s1, s2 *ice.StreamTransport, err error) {
+	cfgs, err := newConfigs()
+	if err != nil {
+		return
+	}
+	s1, err = ice.NewIceStreamTransport(cfgs[0], "s1")
 	if err != nil {
 		return
 	}
-	s2, err = ice.NewIceStreamTransport(cfg, "s2")
+	s2, err = ice.NewIceStreamTransport(cfgs[1], "s2")
 	log.Trace("-----------------------------------------")
 	return
 }
 func main() {
-	s1, s2, err := setupIcePair(typTurn)
+	flag.Parse()
+	s1, s2, err := setupIcePair()
 	if err != nil {
 		log.Crit(err.Error())
 		return
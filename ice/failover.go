@@ -0,0 +1,206 @@
+package ice
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+/*
+选定 pair 以后, consent 的 binding request 不只发给选定的 pair, 而是发给所有的 valid pair,
+每个 pair 最后一次收到 response 的时间就是它的 liveness:
+1. 选定的 pair 连续 livenessMisses 个 consent 间隔没有收到 response, 切换到 pairSelector 从其他仍然活着的 pair 中选出的一个
+2. 协商完成以后, 如果有优先级更高的 pair 活着(比如先走 relay, 后来直连成功), controlling 切换过去
+3. 协商时失败的 check(包括选定 pair 以后被取消的) 也在 consent 间隔探测, 成功以后加入 valid list,
+   优先级比选定的 pair 高的最多探测 upgradeProbes 次, 其他的最多探测 livenessMisses 次,
+   选定的 pair 断开以后说明网络发生了变化, 重新开始探测. ICE restart 使用新的 session, 也会重新探测
+controlling 切换以后, 在新的 pair 上发送带 USE-CANDIDATE 的请求, 直到收到 response, controlled 收到以后跟着切换.
+controlled 自己发现选定的 pair 断开也会先切换, 对方从任何一个 pair 发来的数据都会被接收.
+每次切换都通过 EventSelectedPairChanged 通知上层, 不需要重新交换 sdp.
+*/
+const (
+	livenessMisses = 3
+	upgradeProbes  = 10
+)
+
+var errSelectedPairFailed = errors.New("selected pair failed")
+
+/*
+超过这个时间没有收到 response 的 pair 认为已经断开, 不会超过 consent timeout.
+*/
+func (s *session) livenessTimeout() time.Duration {
+	d := livenessMisses * s.consentInterval
+	if d > s.consentTimeout {
+		d = s.consentTimeout
+	}
+	return d
+}
+
+func (s *session) isAlive(c *sessionCheck, now time.Time) bool {
+	return now.Sub(c.lastResponse) <= s.livenessTimeout()
+}
+
+func (s *session) getNominatedCheck() *sessionCheck {
+	s.mlock.Lock()
+	defer s.mlock.Unlock()
+	return s.sessionComponent.nominatedCheck
+}
+
+/*
+除了 except 以外仍然活着的 valid pair, 按照优先级从高到低.
+*/
+func (s *session) livePairs(except *sessionCheck) (checks []*sessionCheck) {
+	now := s.clock.Now()
+	for _, c := range s.validCheckList.checks {
+		if c != except && s.isAlive(c, now) {
+			checks = append(checks, c)
+		}
+	}
+	return
+}
+
+/*
+切换选定的 pair, err 不为空表示因为原来的 pair 断开而切换.
+*/
+func (s *session) switchSelectedPair(check *sessionCheck, err error) {
+	srv, err2 := s.getSenderServerSock(check.localCandidate.addr)
+	if err2 != nil {
+		s.log.Warn(fmt.Sprintf("cannot switch to %s, %s", check.key, err2))
+		return
+	}
+	s.mlock.Lock()
+	old := s.sessionComponent.nominatedCheck
+	s.sessionComponent.nominatedCheck = check
+	s.sessionComponent.nominatedServerSock = srv
+	s.mlock.Unlock()
+	s.log.Info(fmt.Sprintf("%s switch selected pair from %s to %s, err=%v", s.Name, old, check, err))
+	//consent 属于选定的 pair
+	s.lastConsent = check.lastResponse
+	if s.role == SessionRoleControlling {
+		s.renominating = true
+	}
+	s.updateDataPath()
+	s.emit(&Event{Type: EventSelectedPairChanged, Pair: check.toCandidatePair(), Err: err})
+	if s.role == SessionRoleControlling {
+		//不等下一次 consent, 立即通知对方
+		s.sendConsentRequest(check, true)
+	}
+}
+
+/*
+选定的 pair 断开了, 切换到其他活着的 pair, 返回是否切换了.
+*/
+func (s *session) failover() bool {
+	selected := s.getNominatedCheck()
+	if selected == nil || s.isAlive(selected, s.clock.Now()) {
+		return false
+	}
+	next := s.selectCheck(s.livePairs(selected), s.pairSelector)
+	if next == nil {
+		return false
+	}
+	s.switchSelectedPair(next, errSelectedPairFailed)
+	s.rearmProbes()
+	return true
+}
+
+/*
+失败的 check 重新开始探测
+*/
+func (s *session) rearmProbes() {
+	for _, c := range s.checkList.checks {
+		c.probes = 0
+	}
+}
+
+/*
+协商完成以后, controlling 发现优先级更高的 pair 活着, 切换过去.
+*/
+func (s *session) tryUpgrade() {
+	if s.role != SessionRoleControlling || s.completeResult < sessionAllCompleteSuccess {
+		return
+	}
+	selected := s.getNominatedCheck()
+	if selected == nil {
+		return
+	}
+	best := s.selectCheck(s.livePairs(nil), s.pairSelector)
+	if best != nil && best != selected && best.priority > selected.priority {
+		s.switchSelectedPair(best, nil)
+	}
+}
+
+/*
+协商时失败的 check 后来收到了 response, 把它加入 valid list
+*/
+func (s *session) addRecoveredPair(check *sessionCheck) *sessionCheck {
+	for _, c := range s.validCheckList.checks {
+		if c.localCandidate == check.localCandidate && c.remoteCandidate == check.remoteCandidate {
+			return c
+		}
+	}
+	c := &sessionCheck{
+		localCandidate:  check.localCandidate,
+		remoteCandidate: check.remoteCandidate,
+		priority:        check.priority,
+		state:           checkStateSucced,
+		key:             check.key,
+		generatingCheck: check,
+	}
+	s.log.Info(fmt.Sprintf("%s pair %s recovered", s.Name, c.key))
+	s.validCheckList.checks = append(s.validCheckList.checks, c)
+	sort.Sort(s.validCheckList)
+	return c
+}
+
+/*
+协商时失败的 check, 已经恢复的不再探测.
+*/
+func (s *session) failedPairsToProbe() (checks []*sessionCheck) {
+	selected := s.getNominatedCheck()
+	if selected == nil || s.completeResult < sessionAllCompleteSuccess {
+		return
+	}
+	recovered := make(map[*sessionCheck]bool)
+	for _, c := range s.validCheckList.checks {
+		recovered[c.generatingCheck] = true
+	}
+	for _, c := range s.checkList.checks {
+		if c.state != checkStateFailed || recovered[c] {
+			continue
+		}
+		limit := livenessMisses
+		if c.priority > selected.priority {
+			limit = upgradeProbes
+		}
+		if c.probes < limit {
+			c.probes++
+			checks = append(checks, c)
+		}
+	}
+	return
+}
+
+/*
+controlled 在协商完成以后收到了带 USE-CANDIDATE 的请求, 对方切换了选定的 pair, 跟着切换.
+localAddr 是收到请求的 sock 的地址, 或者是 relay 地址.
+*/
+func (s *session) handleRenomination(localAddr, fromAddr string) {
+	now := s.clock.Now()
+	for _, c := range s.validCheckList.checks {
+		if c.remoteCandidate.addr != fromAddr {
+			continue
+		}
+		if c.localCandidate.addr != localAddr && (c.localCandidate.Type == CandidateRelay || c.localCandidate.baseAddr != localAddr) {
+			continue
+		}
+		//收到了对方的请求, 至少说明这个 pair 是通的
+		c.lastResponse = now
+		if c != s.getNominatedCheck() {
+			s.switchSelectedPair(c, nil)
+		}
+		return
+	}
+	s.log.Info(fmt.Sprintf("%s renomination %s<-%s, but it's not a valid pair", s.Name, localAddr, fromAddr))
+}
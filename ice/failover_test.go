@@ -0,0 +1,218 @@
+package ice
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nkbai/goice/vnet"
+)
+
+/*
+双方各有两个地址, 协商完成以后有四个 valid pair
+*/
+func setupMultiHomedPair(t *testing.T) (s1, s2 *StreamTransport, cb1, cb2 *eventcb) {
+	lan, err := vnet.NewRouter(&vnet.RouterConfig{Name: "lan", CIDR: "10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ss []*StreamTransport
+	var cbs []*eventcb
+	for i := 1; i <= 2; i++ {
+		n, err := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{fmt.Sprintf("10.1.%d.1", i), fmt.Sprintf("10.1.%d.2", i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = lan.AddNet(n); err != nil {
+			t.Fatal(err)
+		}
+		cfg := NewTransportConfigHostonly()
+		cfg.Net = n
+		cfg.ConsentInterval = 20 * time.Millisecond
+		cb := &eventcb{icecb: newicecb(fmt.Sprintf("s%d", i))}
+		s, err := NewIceStreamTransportWithCallback(cfg, cb.name, cb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss = append(ss, s)
+		cbs = append(cbs, cb)
+	}
+	s1, s2, cb1, cb2 = ss[0], ss[1], cbs[0], cbs[1]
+	if err = s1.InitIce(SessionRoleControlling); err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.InitIce(SessionRoleControlled); err != nil {
+		t.Fatal(err)
+	}
+	lsdp, _ := s1.EncodeSession()
+	rsdp, _ := s2.EncodeSession()
+	if err = s2.StartNegotiation(lsdp); err != nil {
+		t.Fatal(err)
+	}
+	if err = s1.StartNegotiation(rsdp); err != nil {
+		t.Fatal(err)
+	}
+	//等待所有的 check 结束, 被取消的 check 探测成功以后也会成为 valid pair
+	waitFor(t, "negotiation complete", func() bool {
+		return s1.ConnectionState() == ConnectionStateCompleted && s2.ConnectionState() == ConnectionStateCompleted
+	})
+	waitFor(t, "all pairs valid", func() bool {
+		return validPairs(s1) == 4 && validPairs(s2) == 4
+	})
+	return
+}
+
+func validPairs(s *StreamTransport) (n int) {
+	s.getSession().run(func() {
+		n = len(s.getSession().validCheckList.checks)
+	})
+	return
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatalf("wait for %s timeout", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (c *eventcb) selectedPairs() (pairs []*Event) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, e := range c.events {
+		if e.Type == EventSelectedPairChanged {
+			pairs = append(pairs, e)
+		}
+	}
+	return
+}
+
+/*
+双方选定的 pair 是同一个
+*/
+func samePair(s1, s2 *StreamTransport) bool {
+	c1 := s1.getSession().getNominatedCheck()
+	c2 := s2.getSession().getNominatedCheck()
+	return c1 != nil && c2 != nil && c1.localCandidate.addr == c2.remoteCandidate.addr && c1.remoteCandidate.addr == c2.localCandidate.addr
+}
+
+func exchangeData(t *testing.T, s1, s2 *StreamTransport, cb1, cb2 *icecb) {
+	for _, c := range []struct {
+		s  *StreamTransport
+		cb *icecb
+	}{{s1, cb2}, {s2, cb1}} {
+		if err := c.s.SendData([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s receive data timeout", c.cb.name)
+		case data := <-c.cb.data:
+			if string(data) != "hello" {
+				t.Errorf("expect hello,got %q", data)
+			}
+		}
+	}
+}
+
+func TestIceStreamTransport_Failover(t *testing.T) {
+	s1, s2, cb1, cb2 := setupMultiHomedPair(t)
+	defer s1.Stop()
+	defer s2.Stop()
+	old := s1.getSession().getNominatedCheck()
+	//s1 选定的 pair 使用的地址不能用了
+	s1.getSession().run(func() {
+		srv, err := s1.getSession().getSenderServerSock(old.localCandidate.addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		srv.Close()
+	})
+	waitFor(t, "failover", func() bool {
+		for _, e := range cb1.selectedPairs() {
+			if e.Err == errSelectedPairFailed {
+				return true
+			}
+		}
+		return false
+	})
+	waitFor(t, "same pair", func() bool { return samePair(s1, s2) })
+	selected := s1.getSession().getNominatedCheck()
+	if selected.localCandidate.addr == old.localCandidate.addr {
+		t.Errorf("should switch to another local address, old=%s,new=%s", old.key, selected.key)
+	}
+	exchangeData(t, s1, s2, cb1.icecb, cb2.icecb)
+	select {
+	case err := <-cb1.disconnected:
+		t.Errorf("should not disconnect %s", err)
+	default:
+	}
+	if s1.ConnectionState() != ConnectionStateCompleted {
+		t.Errorf("connection state should not change,got %s", s1.ConnectionState())
+	}
+}
+
+/*
+先选定一个优先级最低的 pair(比如 relay), 并且让优先级最高的 pair 看起来在协商时失败了,
+探测成功以后 controlling 升级到优先级更高的 pair, controlled 跟着切换.
+*/
+func TestIceStreamTransport_UpgradeSelectedPair(t *testing.T) {
+	s1, s2, cb1, cb2 := setupMultiHomedPair(t)
+	defer s1.Stop()
+	defer s2.Stop()
+	sess := s1.getSession()
+	var high, low *sessionCheck
+	sess.run(func() {
+		checks := sess.validCheckList.checks
+		high, low = checks[0], checks[len(checks)-1]
+		high.generatingCheck.state = checkStateFailed
+		sess.validCheckList.checks = checks[1:]
+		//host pair 的优先级都一样, 剩下的都降低, 只有恢复以后的 high 优先级最高
+		for i, c := range sess.validCheckList.checks {
+			c.priority = uint64(i + 1)
+		}
+		low.priority = 0
+		sess.switchSelectedPair(low, nil)
+	})
+	n1, n2 := len(cb1.selectedPairs()), len(cb2.selectedPairs())
+	waitFor(t, "upgrade", func() bool {
+		c := sess.getNominatedCheck()
+		return c.generatingCheck == high.generatingCheck
+	})
+	waitFor(t, "same pair", func() bool { return samePair(s1, s2) })
+	if len(cb1.selectedPairs()) <= n1 || len(cb2.selectedPairs()) <= n2 {
+		t.Error("both sides should report selected pair changed")
+	}
+	exchangeData(t, s1, s2, cb1.icecb, cb2.icecb)
+}
+
+/*
+优先级更高的失败 pair 最多探测 upgradeProbes 次, 选定的 pair 断开以后重新探测.
+*/
+func TestFailedPairsToProbeStops(t *testing.T) {
+	s := newIceSession("probe", SessionRoleControlling, nil, nil, nil)
+	selected := &sessionCheck{priority: 100, state: checkStateSucced}
+	higher := &sessionCheck{priority: 200, state: checkStateFailed}
+	lower := &sessionCheck{priority: 50, state: checkStateFailed}
+	s.checkList.checks = []*sessionCheck{higher, selected, lower}
+	s.validCheckList.checks = []*sessionCheck{{priority: 100, state: checkStateSucced, generatingCheck: selected}}
+	s.sessionComponent.nominatedCheck = s.validCheckList.checks[0]
+	s.completeResult = sessionAllCompleteSuccess
+	counts := make(map[*sessionCheck]int)
+	for i := 0; i < 100; i++ {
+		for _, c := range s.failedPairsToProbe() {
+			counts[c]++
+		}
+	}
+	if counts[higher] != upgradeProbes || counts[lower] != livenessMisses {
+		t.Errorf("higher pair should be probed %d times and lower %d, got %d %d", upgradeProbes, livenessMisses, counts[higher], counts[lower])
+	}
+	s.rearmProbes()
+	if checks := s.failedPairsToProbe(); len(checks) != 2 {
+		t.Errorf("failed pairs should be probed again after rearm, got %v", checks)
+	}
+}
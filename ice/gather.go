@@ -4,10 +4,17 @@ import (
 	/* #nosec */
 	"crypto/md5"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/nkbai/goice/clock"
 	"github.com/nkbai/log"
 )
 
@@ -111,7 +118,9 @@ func (a Addr) ZeroPortAddr() string {
 	return net.JoinHostPort(host, "")
 }
 
-type defaultGatherer struct{}
+type defaultGatherer struct {
+	filter *GatherFilter //nil means all up, non-loopback interfaces
+}
 
 func (defaultGatherer) precedence(ip net.IP) int {
 	for _, p := range precedences {
@@ -134,6 +143,10 @@ func (g defaultGatherer) Gather() ([]Addr, error) {
 			//skip invalid interface. shutdown now .
 			continue
 		}
+		if !g.filter.acceptInterface(iface.Name) {
+			log.Trace(fmt.Sprintf("%s is filtered", iface.Name))
+			continue
+		}
 		iAddrs, err := iface.Addrs()
 		if err != nil {
 			return addrs, err
@@ -147,7 +160,11 @@ func (g defaultGatherer) Gather() ([]Addr, error) {
 			if len(ip.To4()) != net.IPv4len {
 				continue //just support ipv4 now
 			}
-			if ip.IsLoopback() {
+			if ip.IsLoopback() && !g.filter.includeLoopback() {
+				continue
+			}
+			if !g.filter.acceptIP(ip) {
+				log.Trace(fmt.Sprintf("%s on %s is filtered", ip, iface.Name))
 				continue
 			}
 			addr := Addr{
@@ -168,26 +185,347 @@ func (g defaultGatherer) Gather() ([]Addr, error) {
 // DefaultGatherer uses net.Interfaces to gather addresses.
 var DefaultGatherer Gatherer = defaultGatherer{}
 
+/*
+GatherFilter limits which local addresses and ports are used as host candidates,
+so internal addresses (docker, vpn...) are not leaked and firewall rules can be matched.
+*/
+type GatherFilter struct {
+	Interfaces        []string //interface names allowed, empty means all
+	ExcludeInterfaces []string //interface names never used
+	IncludeCIDRs      []string //if not empty, address must be in one of them
+	ExcludeCIDRs      []string //address in them is never used
+	IncludeLoopback   bool     //loopback is ignored by default, enable it for tests on the same host
+	PortMin           int      //udp port range of host sockets, 0 means any port
+	PortMax           int
+}
+
+var (
+	errInvalidPortRange = errors.New("invalid port range")
+	errNoHostAddress    = errors.New("no host address available")
+	errNoFreePort       = errors.New("no free port in range")
+)
+
+func (f *GatherFilter) validate() error {
+	if f == nil {
+		return nil
+	}
+	for _, cidr := range append(append([]string{}, f.IncludeCIDRs...), f.ExcludeCIDRs...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return err
+		}
+	}
+	if f.PortMin < 0 || f.PortMax > 65535 || f.PortMin > f.PortMax {
+		return errInvalidPortRange
+	}
+	return nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, s2 := range ss {
+		if s2 == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *GatherFilter) acceptInterface(name string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Interfaces) > 0 && !containsString(f.Interfaces, name) {
+		return false
+	}
+	return !containsString(f.ExcludeInterfaces, name)
+}
+
+func cidrsContain(cidrs []string, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *GatherFilter) acceptIP(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.IncludeCIDRs) > 0 && !cidrsContain(f.IncludeCIDRs, ip) {
+		return false
+	}
+	return !cidrsContain(f.ExcludeCIDRs, ip)
+}
+
+func (f *GatherFilter) includeLoopback() bool {
+	return f != nil && f.IncludeLoopback
+}
+
+/*
+hostGatherer 收集 host candidate 需要的配置, nil 表示使用 DefaultGatherer, 没有任何限制.
+*/
+type hostGatherer struct {
+	filter  *GatherFilter
+	nat     []natMapping
+	natType CandidateType
+	net     Net         //nil 表示使用真实的 socket
+	clock   clock.Clock //stun, turn 服务器的超时
+	/*
+		hostAddrs 不为空的时候 host candidate 只使用这些地址, 不再枚举网卡, 见 hostconn.go.
+		conns 是应用提供的 socket, key 为本地地址. dialing 是正在连接 stun/turn 服务器的地址.
+	*/
+	hostAddrs []string
+	conns     map[string]net.PacketConn
+	lock      sync.Mutex
+	dialing   map[string]bool
+}
+
+/*
+1:1 NAT 映射, local 为 nil 表示所有没有单独指定的本地地址.
+*/
+type natMapping struct {
+	public net.IP
+	local  net.IP
+}
+
+var errInvalidNATMapping = errors.New("invalid 1:1 nat mapping")
+
+/*
+parseNATMapping 解析 "public" 或者 "public/local" 格式的地址,
+只能有一个不指定 local 的 public 地址.
+*/
+func parseNATMapping(ips []string) (mappings []natMapping, err error) {
+	hasDefault := false
+	for _, s := range ips {
+		ss := strings.Split(s, "/")
+		if len(ss) > 2 {
+			return nil, errInvalidNATMapping
+		}
+		m := natMapping{public: net.ParseIP(ss[0])}
+		if m.public == nil || m.public.To4() == nil {
+			return nil, errInvalidNATMapping
+		}
+		if len(ss) == 2 {
+			m.local = net.ParseIP(ss[1])
+			if m.local == nil || m.local.To4() == nil {
+				return nil, errInvalidNATMapping
+			}
+		} else {
+			if hasDefault {
+				return nil, errInvalidNATMapping
+			}
+			hasDefault = true
+		}
+		mappings = append(mappings, m)
+	}
+	return
+}
+
+func newHostGatherer(cfg *TransportConfig) (g *hostGatherer, err error) {
+	if cfg.GatherFilter == nil && len(cfg.NAT1To1IPs) == 0 && cfg.Net == nil && cfg.Clock == nil &&
+		len(cfg.PacketConns) == 0 && len(cfg.BindAddrs) == 0 {
+		return nil, nil
+	}
+	if err = cfg.GatherFilter.validate(); err != nil {
+		return
+	}
+	g = &hostGatherer{
+		filter:  cfg.GatherFilter,
+		natType: cfg.NAT1To1CandidateType,
+		net:     cfg.Net,
+		clock:   cfg.clock(),
+	}
+	if g.natType != CandidateUnknown && g.natType != CandidateHost && g.natType != CandidateServerReflexive {
+		return nil, errInvalidNATMapping
+	}
+	g.nat, err = parseNATMapping(cfg.NAT1To1IPs)
+	if err != nil {
+		return
+	}
+	err = g.setHostAddrs(cfg)
+	return
+}
+
+/*
+本地地址对应的公网地址, 没有映射返回 nil
+*/
+func (g *hostGatherer) publicIP(local net.IP) net.IP {
+	if g == nil {
+		return nil
+	}
+	var def net.IP
+	for _, m := range g.nat {
+		if m.local == nil {
+			def = m.public
+		} else if m.local.Equal(local) {
+			return m.public
+		}
+	}
+	return def
+}
+
+/*
+公网地址作为 srflx 单独添加, 而不是替换 host 的地址.
+*/
+func (g *hostGatherer) natAsSrflx() bool {
+	return g != nil && g.natType == CandidateServerReflexive
+}
+
+func (g *hostGatherer) hasPortRange() bool {
+	return g != nil && g.filter != nil && g.filter.PortMax > 0
+}
+
+/*
+没有 filter 时使用 DefaultGatherer, 保持可以替换全局 Gatherer 的能力.
+*/
+func (g *hostGatherer) gather() ([]Addr, error) {
+	if g.hasHostAddrs() {
+		return g.hostIPs(), nil
+	}
+	if g != nil && g.net != nil {
+		return netGatherer{net: g.net, filter: g.filter}.Gather()
+	}
+	if g == nil || g.filter == nil {
+		return DefaultGatherer.Gather()
+	}
+	return defaultGatherer{filter: g.filter}.Gather()
+}
+
+/*
+在端口范围内随机选择一个在所有 ip 上都可用的 udp 端口.
+*/
+func (g *hostGatherer) pickPort(addrs []Addr) (int, error) {
+	if !g.hasPortRange() {
+		return int(rand.NewSource(time.Now().UnixNano()).Int63() % 50000), nil
+	}
+	f := g.filter
+	n := f.PortMax - f.PortMin + 1
+	start := rand.Intn(n)
+	for i := 0; i < n && i < maxPortTries; i++ {
+		port := f.PortMin + (start+i)%n
+		if port == 0 {
+			continue
+		}
+		if g.portAvailable(addrs, port) {
+			return port, nil
+		}
+	}
+	return 0, errNoFreePort
+}
+
+const maxPortTries = 100
+
+func (g *hostGatherer) portAvailable(addrs []Addr, port int) bool {
+	var conns []net.PacketConn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for _, a := range addrs {
+		c, err := g.listenPacket((&net.UDPAddr{IP: a.IP, Port: port}).String())
+		if err != nil {
+			return false
+		}
+		conns = append(conns, c)
+	}
+	return true
+}
+
+/*
+连接 stun/turn server 使用的 udp socket,
+有 filter 时从第一个允许的地址发出, 这样它的 base 地址一定也是 host candidate.
+*/
+func (g *hostGatherer) dialUDP(serverAddr string) (net.Conn, error) {
+	if g.hasHostAddrs() {
+		return g.dialHostAddr(serverAddr)
+	}
+	if g == nil || (g.filter == nil && g.net == nil) {
+		return net.Dial("udp", serverAddr)
+	}
+	addrs, err := g.gather()
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errNoHostAddress
+	}
+	if !g.hasPortRange() {
+		return g.dial(&net.UDPAddr{IP: addrs[0].IP}, serverAddr)
+	}
+	f := g.filter
+	n := f.PortMax - f.PortMin + 1
+	start := rand.Intn(n)
+	for i := 0; i < n && i < maxPortTries; i++ {
+		port := f.PortMin + (start+i)%n
+		if port == 0 {
+			continue
+		}
+		conn, err := g.dial(&net.UDPAddr{IP: addrs[0].IP, Port: port}, serverAddr)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, errNoFreePort
+}
+
+/*
+host candidate 的 base 地址, 指定了 hostAddrs 时就是它们, 否则所有网卡的地址都使用同一个端口.
+*/
+func (g *hostGatherer) hostBaseAddrs(port string) (bases []string, err error) {
+	if g.hasHostAddrs() {
+		return g.hostAddrs, nil
+	}
+	addrs, err := g.gather()
+	if err != nil {
+		return
+	}
+	for _, a := range addrs {
+		bases = append(bases, fmt.Sprintf("%s:%s", a.IP.String(), port))
+	}
+	return
+}
+
 /*
 返回所有可能的
 */
-const maxCandidates = 8 //candidate 列表中最多有多少个,太多了可能是攻击
-func getLocalCandidates(primaryAddress string) (candidates []*Candidate, err error) {
+const maxCandidates = 100 //candidate 列表中最多有多少个,太多了可能是攻击
+func getLocalCandidates(primaryAddress string, g *hostGatherer) (candidates []*Candidate, err error) {
+	var natCandidates []*Candidate
 	_, port, err := net.SplitHostPort(primaryAddress)
 	if err != nil {
 		return
 	}
-	addrs, err := DefaultGatherer.Gather()
+	bases, err := g.hostBaseAddrs(port)
 	if err != nil {
 		return
 	}
 	primaryFound := false
-	for _, a := range addrs {
+	for _, base := range bases {
 		c := new(Candidate)
 		c.Type = CandidateHost
-		c.addr = fmt.Sprintf("%s:%s", a.IP.String(), port)
+		c.addr = base
 		c.baseAddr = c.addr
-		c.Foundation = calcFoundation(c.baseAddr)
+		c.Foundation = calcFoundation(c.Type, c.baseAddr, "", TransportUDP)
+		/*
+			1:1 NAT, 公网地址不在任何网卡上, base 仍然是本地地址.
+		*/
+		baseAddr := addrToUDPAddr(base)
+		if public := g.publicIP(baseAddr.IP); public != nil {
+			addr := fmt.Sprintf("%s:%d", public.String(), baseAddr.Port)
+			if g.natAsSrflx() {
+				natCandidates = append(natCandidates, &Candidate{
+					Type:       CandidateServerReflexive,
+					addr:       addr,
+					baseAddr:   c.baseAddr,
+					Foundation: calcFoundation(CandidateServerReflexive, c.baseAddr, "", TransportUDP),
+				})
+			} else {
+				c.addr = addr
+			}
+		}
 		duplicate := false
 		for _, c2 := range candidates {
 			if c2.Equal(c) {
@@ -199,15 +537,13 @@ func getLocalCandidates(primaryAddress string) (candidates []*Candidate, err err
 			log.Trace(fmt.Sprintf("host %s:%s is duplicate", c.addr, c.baseAddr))
 			continue
 		}
-		if c.addr == primaryAddress {
+		if c.baseAddr == primaryAddress {
 			primaryFound = true
 			if len(candidates) != 0 {
 				//保证候选列表中的第一个是我们的主要地址,也就是连接 stun server 的地址.
 				t := candidates[0]
-				l := len(candidates)
 				candidates[0] = c
-				candidates[l-1] = t
-				primaryFound = true
+				candidates = append(candidates, t)
 			} else {
 				candidates = append(candidates, c)
 			}
@@ -216,20 +552,47 @@ func getLocalCandidates(primaryAddress string) (candidates []*Candidate, err err
 		}
 
 	}
-	if !primaryFound {
+	if !primaryFound && !g.hasHostAddrs() {
 		log.Error(fmt.Sprintf("primaryaddress not found %s", primaryAddress))
 	}
 	if len(candidates) > maxCandidates-1 {
 		candidates = candidates[:maxCandidates-1]
 	}
+	//srflx 放在最后, 作为缺省 candidate
+	for _, c := range natCandidates {
+		if len(candidates) >= maxCandidates-1 {
+			break
+		}
+		candidates = append(candidates, c)
+	}
+	return
+}
+
+/*
+需要监听的本地地址, 1:1 NAT 映射的地址只能监听 base.
+*/
+func listenAddrs(candidates []*Candidate) (addrs []string) {
+	for _, c := range candidates {
+		if c.Type == CandidateHost {
+			addrs = append(addrs, c.baseAddr)
+		}
+	}
 	return
 }
 
-func calcFoundation(baseAddr string) int {
+/*
+RFC 8445 5.1.1.3 类型, base 的 ip, stun/turn 服务器以及传输方式都相同的 candidate 有相同的 foundation,
+端口不影响 foundation, host 和 prflx 的 server 为空.
+*/
+func calcFoundation(typ CandidateType, baseAddr, server string, transport TransportType) string {
+	host, _, err := net.SplitHostPort(baseAddr)
+	if err != nil {
+		host = baseAddr
+	}
 	/* #nosec */
-	hash := md5.Sum([]byte(baseAddr))
+	hash := md5.Sum([]byte(fmt.Sprintf("%s|%s|%s|%s", typ, host, server, transport)))
 	tmp := binary.BigEndian.Uint32(hash[:4])
-	return int(tmp)
+	return strconv.FormatUint(uint64(tmp), 10)
 }
 
 func addCandidates(candidates []*Candidate, new *Candidate) []*Candidate {
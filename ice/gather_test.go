@@ -0,0 +1,211 @@
+package ice
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGatherFilter(t *testing.T) {
+	f := &GatherFilter{IncludeLoopback: true, IncludeCIDRs: []string{"127.0.0.0/8"}}
+	addrs, err := (&hostGatherer{filter: f}).gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) == 0 {
+		t.Fatal("should have loopback address")
+	}
+	for _, a := range addrs {
+		if !a.IP.IsLoopback() {
+			t.Errorf("only loopback expected,got %s", a)
+		}
+	}
+	f = &GatherFilter{ExcludeCIDRs: []string{"0.0.0.0/0"}}
+	addrs, err = (&hostGatherer{filter: f}).gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 0 {
+		t.Errorf("all addresses should be excluded,got %v", addrs)
+	}
+	all, err := DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loopback []string
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = append(loopback, iface.Name)
+		}
+	}
+	f = &GatherFilter{ExcludeInterfaces: loopback, IncludeLoopback: true}
+	addrs, err = (&hostGatherer{filter: f}).gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != len(all) {
+		t.Errorf("loopback interface excluded, expect %v,got %v", all, addrs)
+	}
+	if f.acceptInterface("docker0") != true || (&GatherFilter{Interfaces: []string{"eth0"}}).acceptInterface("docker0") {
+		t.Error("interface allow list error")
+	}
+}
+
+func TestGatherFilterValidate(t *testing.T) {
+	cases := []struct {
+		f  *GatherFilter
+		ok bool
+	}{
+		{nil, true},
+		{&GatherFilter{IncludeCIDRs: []string{"10.0.0.0/8"}, PortMin: 40000, PortMax: 40100}, true},
+		{&GatherFilter{ExcludeCIDRs: []string{"10.0.0.0"}}, false},
+		{&GatherFilter{PortMin: 5000, PortMax: 4000}, false},
+		{&GatherFilter{PortMin: 5000, PortMax: 70000}, false},
+	}
+	for i, c := range cases {
+		if err := c.f.validate(); (err == nil) != c.ok {
+			t.Errorf("[%d] expect ok=%v,err=%v", i, c.ok, err)
+		}
+	}
+	cfg := NewTransportConfigHostonly()
+	cfg.GatherFilter = &GatherFilter{IncludeCIDRs: []string{"bad"}}
+	if _, err := NewIceStreamTransport(cfg, "bad"); err == nil {
+		t.Error("invalid cidr should fail")
+	}
+}
+
+func TestHostOnlySockPortRange(t *testing.T) {
+	h := &HostOnlySock{gatherer: &hostGatherer{filter: &GatherFilter{IncludeLoopback: true, PortMin: 41000, PortMax: 41010}}}
+	candidates, err := h.GetCandidates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range candidates {
+		port := addrToUDPAddr(c.addr).Port
+		if port < 41000 || port > 41010 {
+			t.Errorf("port out of range %s", c.addr)
+		}
+	}
+	//端口全部被占用
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 41020})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h = &HostOnlySock{gatherer: &hostGatherer{filter: &GatherFilter{IncludeLoopback: true, IncludeCIDRs: []string{"127.0.0.1/32"}, PortMin: 41020, PortMax: 41020}}}
+	if _, err = h.GetCandidates(); err != errNoFreePort {
+		t.Errorf("expect no free port,got %v", err)
+	}
+}
+
+/*
+只使用 loopback, 在同一台机器上协商.
+*/
+func TestIceStreamTransport_Loopback(t *testing.T) {
+	cfg := NewTransportConfigHostonly()
+	cfg.GatherFilter = &GatherFilter{IncludeLoopback: true, IncludeCIDRs: []string{"127.0.0.0/8"}}
+	s1, s2, _, cb2 := setupNegotiatedPair(t, cfg, cfg)
+	defer s1.Stop()
+	defer s2.Stop()
+	for _, c := range s1.component.candidates {
+		if !addrToUDPAddr(c.addr).IP.IsLoopback() {
+			t.Errorf("only loopback candidate expected,got %s", c)
+		}
+	}
+	data := []byte("hello,loopback")
+	if err := s1.SendData(data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-time.After(10 * time.Second):
+		t.Error("s2 recevied timeout")
+	case d := <-cb2.data:
+		if !bytes.Equal(d, data) {
+			t.Error("s2 recevied error ,got ", string(d))
+		}
+	}
+}
+
+func TestParseNATMapping(t *testing.T) {
+	cases := []struct {
+		ips []string
+		ok  bool
+	}{
+		{[]string{"1.2.3.4"}, true},
+		{[]string{"1.2.3.4/10.0.0.1", "1.2.3.5/10.0.0.2"}, true},
+		{[]string{"1.2.3.4/10.0.0.1", "1.2.3.5"}, true},
+		{[]string{"1.2.3.4", "1.2.3.5"}, false},
+		{[]string{"1.2.3"}, false},
+		{[]string{"1.2.3.4/10.0.0"}, false},
+		{[]string{"1.2.3.4/10.0.0.1/10.0.0.2"}, false},
+	}
+	for i, c := range cases {
+		if _, err := parseNATMapping(c.ips); (err == nil) != c.ok {
+			t.Errorf("[%d] %v expect ok=%v,err=%v", i, c.ips, c.ok, err)
+		}
+	}
+	g := &hostGatherer{}
+	g.nat, _ = parseNATMapping([]string{"1.2.3.4/10.0.0.1", "1.2.3.5"})
+	if !g.publicIP(net.ParseIP("10.0.0.1")).Equal(net.ParseIP("1.2.3.4")) ||
+		!g.publicIP(net.ParseIP("10.0.0.2")).Equal(net.ParseIP("1.2.3.5")) {
+		t.Error("public ip error")
+	}
+}
+
+func TestGetLocalCandidatesNAT(t *testing.T) {
+	filter := &GatherFilter{IncludeLoopback: true, IncludeCIDRs: []string{"127.0.0.1/32"}}
+	g := &hostGatherer{filter: filter}
+	g.nat, _ = parseNATMapping([]string{"203.0.113.1"})
+	candidates, err := getLocalCandidates("127.0.0.1:40000", g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 || candidates[0].Type != CandidateHost ||
+		candidates[0].addr != "203.0.113.1:40000" || candidates[0].baseAddr != "127.0.0.1:40000" {
+		t.Fatalf("host nat error %v", candidates)
+	}
+	if addrs := listenAddrs(candidates); len(addrs) != 1 || addrs[0] != "127.0.0.1:40000" {
+		t.Errorf("should listen on base,got %v", addrs)
+	}
+	g.natType = CandidateServerReflexive
+	candidates, err = getLocalCandidates("127.0.0.1:40000", g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 2 || candidates[0].addr != "127.0.0.1:40000" {
+		t.Fatalf("srflx nat error %v", candidates)
+	}
+	srflx := candidates[1]
+	if srflx.Type != CandidateServerReflexive || srflx.addr != "203.0.113.1:40000" || srflx.baseAddr != "127.0.0.1:40000" {
+		t.Errorf("srflx nat error %s", srflx)
+	}
+}
+
+/*
+公网地址不可达, 但是对方可以通过 prflx 找到 base 地址.
+*/
+func TestIceStreamTransport_NAT1To1(t *testing.T) {
+	cfg := NewTransportConfigHostonly()
+	cfg.GatherFilter = &GatherFilter{IncludeLoopback: true, IncludeCIDRs: []string{"127.0.0.1/32"}}
+	cfg2 := *cfg
+	cfg.NAT1To1IPs = []string{"203.0.113.1"}
+	s1, s2, _, _ := setupNegotiatedPair(t, cfg, &cfg2)
+	defer s1.Stop()
+	defer s2.Stop()
+	str, err := s1.EncodeSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(str, "203.0.113.1") || strings.Contains(str, "127.0.0.1") {
+		t.Errorf("should only advertise public address %s", str)
+	}
+	if err = s1.SendData([]byte("hello")); err != nil {
+		t.Error(err)
+	}
+	if err = s2.SendData([]byte("hello")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,249 @@
+package ice
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nkbai/log"
+)
+
+/*
+TransportConfig.PacketConns 和 TransportConfig.BindAddrs 指定 host candidate 使用的 socket:
+1. PacketConns 属于应用, ICE 只在 session 期间读写, Stop 以后不再读取, 但是不会关闭, 应用可以继续使用
+2. BindAddrs 由 ICE 在 StartServer 时监听, Stop 时关闭, 和其他 socket 一样
+两者的地址都必须是具体的 ip 和端口, 设置以后不再枚举网卡, GatherFilter 的地址过滤也不再起作用.
+连接 stun/turn 服务器也使用这些 socket, 每个地址最多用于一个服务器, 这样 srflx 的 base 总是 host candidate,
+服务器比地址多的时候, 多出来的服务器被忽略.
+*/
+
+var (
+	errInvalidHostAddr = errors.New("host address must have a specified ip and port")
+	errDuplicateHost   = errors.New("duplicate host address")
+	errHostAddrsOnMux  = errors.New("PacketConns and BindAddrs cannot be used with UDPMux")
+	errAppConnClosed   = errors.New("use of closed app conn")
+	errNoFreeHostAddr  = errors.New("all host addresses are used by other servers")
+)
+
+/*
+检查并记录 PacketConns 和 BindAddrs 的地址, PacketConns 在前.
+*/
+func (g *hostGatherer) setHostAddrs(cfg *TransportConfig) error {
+	if len(cfg.PacketConns) == 0 && len(cfg.BindAddrs) == 0 {
+		return nil
+	}
+	if cfg.UDPMux != nil {
+		return errHostAddrsOnMux
+	}
+	g.conns = make(map[string]net.PacketConn)
+	g.dialing = make(map[string]bool)
+	add := func(addr string) error {
+		if err := validateHostAddr(addr); err != nil {
+			return err
+		}
+		for _, a := range g.hostAddrs {
+			if a == addr {
+				return fmt.Errorf("%s %s", errDuplicateHost, addr)
+			}
+		}
+		g.hostAddrs = append(g.hostAddrs, addr)
+		return nil
+	}
+	for _, c := range cfg.PacketConns {
+		addr := c.LocalAddr().String()
+		if err := add(addr); err != nil {
+			return err
+		}
+		g.conns[addr] = c
+	}
+	for _, addr := range cfg.BindAddrs {
+		if err := add(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateHostAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() == nil || ip.IsUnspecified() || port == "0" {
+		return fmt.Errorf("%s %s", errInvalidHostAddr, addr)
+	}
+	return nil
+}
+
+func (g *hostGatherer) hasHostAddrs() bool {
+	return g != nil && len(g.hostAddrs) > 0
+}
+
+/*
+hostAddrs 中的 ip, 按照出现的顺序, 代替网卡的地址.
+*/
+func (g *hostGatherer) hostIPs() (addrs []Addr) {
+	seen := make(map[string]bool)
+	for _, a := range g.hostAddrs {
+		ip := addrToUDPAddr(a).IP
+		if seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		addrs = append(addrs, Addr{IP: ip, Precedence: defaultGatherer{}.precedence(ip)})
+	}
+	return
+}
+
+/*
+从一个还没有被其他服务器使用的地址连接 stun/turn 服务器, 连接关闭以后这个地址可以再次使用.
+*/
+func (g *hostGatherer) dialHostAddr(serverAddr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, addr := range g.hostAddrs {
+		if g.dialing[addr] {
+			continue
+		}
+		var conn net.Conn
+		if c, ok := g.conns[addr]; ok {
+			conn = &appDialConn{appConn: newAppConn(c), raddr: raddr}
+		} else {
+			conn, err = g.dial(addrToUDPAddr(addr), serverAddr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		g.dialing[addr] = true
+		return &hostDialConn{Conn: conn, release: func() {
+			g.lock.Lock()
+			delete(g.dialing, addr)
+			g.lock.Unlock()
+		}}, nil
+	}
+	return nil, errNoFreeHostAddr
+}
+
+type hostDialConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+//Close implements net.Conn
+func (c *hostDialConn) Close() (err error) {
+	c.once.Do(func() {
+		err = c.Conn.Close()
+		c.release()
+	})
+	return
+}
+
+/*
+appDialConn 把应用的 socket 当作连接到服务器的 net.Conn, 丢弃其他地址发来的包.
+*/
+type appDialConn struct {
+	*appConn
+	raddr *net.UDPAddr
+}
+
+//Read implements net.Conn
+func (c *appDialConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			return 0, err
+		}
+		if addr.String() == c.raddr.String() {
+			return n, nil
+		}
+	}
+}
+
+//Write implements net.Conn
+func (c *appDialConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.raddr)
+}
+
+//RemoteAddr implements net.Conn
+func (c *appDialConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+/*
+appConn 包装应用提供的 socket, 每个 session 一个.
+Close 只是让阻塞的 ReadFrom 返回, 等读取的协程退出以后恢复 read deadline, 不关闭 socket.
+*/
+type appConn struct {
+	net.PacketConn
+	lock    sync.Mutex
+	closed  bool
+	readers sync.WaitGroup
+	log     log.Logger
+}
+
+func newAppConn(c net.PacketConn) *appConn {
+	return &appConn{
+		PacketConn: c,
+		log:        log.New("name", fmt.Sprintf("%s-appConn", c.LocalAddr())),
+	}
+}
+
+//ReadFrom implements net.PacketConn
+func (c *appConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return 0, nil, errAppConnClosed
+	}
+	c.readers.Add(1)
+	c.lock.Unlock()
+	defer c.readers.Done()
+	n, addr, err = c.PacketConn.ReadFrom(b)
+	if err != nil && c.isClosed() {
+		err = errAppConnClosed
+	}
+	return
+}
+
+//WriteTo implements net.PacketConn
+func (c *appConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.isClosed() {
+		return 0, errAppConnClosed
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *appConn) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+/*
+Close 不能在读取的协程中调用.
+*/
+func (c *appConn) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.lock.Unlock()
+	//一个过去的时间, 让正在阻塞的 ReadFrom 立即返回
+	err := c.PacketConn.SetReadDeadline(time.Unix(1, 0))
+	c.readers.Wait()
+	if err2 := c.PacketConn.SetReadDeadline(time.Time{}); err == nil {
+		err = err2
+	}
+	c.log.Trace(fmt.Sprintf("stop reading, err=%v", err))
+	return err
+}
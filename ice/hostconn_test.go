@@ -0,0 +1,175 @@
+package ice
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nkbai/goice/vnet"
+)
+
+func newStaticLANConfigs(t *testing.T, ips ...string) (cfgs []*TransportConfig) {
+	lan, err := vnet.NewRouter(&vnet.RouterConfig{Name: "lan", CIDR: "10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range ips {
+		n, err := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = lan.AddNet(n); err != nil {
+			t.Fatal(err)
+		}
+		cfg := NewTransportConfigHostonly()
+		cfg.Net = n
+		cfgs = append(cfgs, cfg)
+	}
+	return
+}
+
+/*
+s1 使用应用的 socket, s2 指定监听的地址, Stop 以后应用的 socket 仍然可用, 指定的地址被释放.
+*/
+func TestIceStreamTransport_PacketConnsAndBindAddrs(t *testing.T) {
+	cfgs := newStaticLANConfigs(t, "10.1.1.1", "10.1.2.1")
+	app, err := cfgs[0].Net.ListenPacket("udp", "10.1.1.1:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	cfgs[0].PacketConns = []net.PacketConn{app}
+	cfgs[1].BindAddrs = []string{"10.1.2.1:6000"}
+	s1, s2, cb1, cb2 := setupNegotiatedPair(t, cfgs[0], cfgs[1])
+	for _, c := range []struct {
+		s    *StreamTransport
+		addr string
+	}{{s1, "10.1.1.1:5000"}, {s2, "10.1.2.1:6000"}} {
+		if len(c.s.component.candidates) != 1 || c.s.component.candidates[0].addr != c.addr {
+			t.Errorf("%s should only have host candidate %s, got %v", c.s.Name, c.addr, c.s.component.candidates)
+		}
+	}
+	exchangeData(t, s1, s2, cb1, cb2)
+	s1.Stop()
+	s2.Stop()
+
+	peer, err := cfgs[1].Net.ListenPacket("udp", "10.1.2.1:6000")
+	if err != nil {
+		t.Fatalf("bind address should be closed by Stop, %s", err)
+	}
+	defer peer.Close()
+	if _, err = peer.WriteTo([]byte("ping"), app.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	app.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, _, err := app.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Errorf("app conn should still be usable after Stop, n=%d err=%v", n, err)
+	}
+}
+
+func TestTransportConfigHostAddrs(t *testing.T) {
+	cases := []struct {
+		name string
+		addr []string
+	}{
+		{"unspecified ip", []string{"0.0.0.0:5000"}},
+		{"zero port", []string{"10.1.1.1:0"}},
+		{"no port", []string{"10.1.1.1"}},
+		{"ipv6", []string{"[::1]:5000"}},
+		{"duplicate", []string{"10.1.1.1:5000", "10.1.1.1:5000"}},
+	}
+	for _, c := range cases {
+		cfg := NewTransportConfigHostonly()
+		cfg.BindAddrs = c.addr
+		if _, err := NewIceStreamTransport(cfg, "s1"); err == nil {
+			t.Errorf("%s should be rejected", c.name)
+		}
+	}
+	mux, err := NewUDPMux(0, &GatherFilter{IncludeLoopback: true, IncludeCIDRs: []string{"127.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	cfg := NewTransportConfigHostonly()
+	cfg.UDPMux = mux
+	cfg.BindAddrs = []string{"127.0.0.1:5000"}
+	if _, err = NewIceStreamTransport(cfg, "s1"); err == nil {
+		t.Error("bind addresses with udp mux should be rejected")
+	}
+}
+
+/*
+Close 让阻塞的 ReadFrom 返回, 但是不关闭应用的 socket.
+*/
+func TestAppConnClose(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ac := newAppConn(c)
+	done := make(chan error)
+	go func() {
+		_, _, err := ac.ReadFrom(make([]byte, 100))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	ac.Close()
+	select {
+	case err = <-done:
+		if err != errAppConnClosed {
+			t.Errorf("expect errAppConnClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close should unblock ReadFrom")
+	}
+	if _, err = ac.WriteTo([]byte("x"), c.LocalAddr()); err != errAppConnClosed {
+		t.Errorf("write after close should fail, %v", err)
+	}
+	//read deadline 已经恢复, socket 仍然可用
+	if _, err = c.WriteTo([]byte("ping"), c.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, _, err := c.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Errorf("conn should still be usable, n=%d err=%v", n, err)
+	}
+}
+
+/*
+stun server 也通过指定的地址和应用的 socket 连接, srflx 的 base 就是 host candidate, 跨越 NAT 协商成功.
+*/
+func TestIceStreamTransport_HostAddrsWithStun(t *testing.T) {
+	cfgs, stop := setupVNet(t, vnetLAN{nat: vnet.NATPortRestricted}, vnetLAN{nat: vnet.NATFullCone})
+	defer stop()
+	cfgs[0].BindAddrs = []string{"192.168.1.1:7000"}
+	app, err := cfgs[1].Net.ListenPacket("udp", "192.168.2.1:7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	cfgs[1].PacketConns = []net.PacketConn{app}
+	s1, s2, _, _, err := negotiateOnVNet(t, cfgs[0], cfgs[1])
+	defer s1.Stop()
+	defer s2.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*StreamTransport{s1, s2} {
+		var host, srflx *Candidate
+		for _, c := range s.component.candidates {
+			switch c.Type {
+			case CandidateHost:
+				host = c
+			case CandidateServerReflexive:
+				srflx = c
+			}
+		}
+		if host == nil || srflx == nil || srflx.baseAddr != host.addr || addrToUDPAddr(host.addr).Port != 7000 {
+			t.Errorf("%s srflx base should be the host address, %v", s.Name, s.component.candidates)
+		}
+	}
+}
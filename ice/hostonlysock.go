@@ -3,8 +3,6 @@ package ice
 import (
 	"errors"
 	"fmt"
-	"math/rand"
-	"time"
 )
 
 /*
@@ -12,27 +10,36 @@ HostOnlySock 没有指定 turn /stun server 也是允许的,
 */
 type HostOnlySock struct {
 	localCandidates []string
+	gatherer        *hostGatherer
 }
 
 //GetCandidates Gather interface
 func (h *HostOnlySock) GetCandidates() (candidates []*Candidate, err error) {
-	addrs, err := DefaultGatherer.Gather()
+	addrs, err := h.gatherer.gather()
 	if err != nil {
 		return
 	}
-	if len(addrs) < 0 {
+	if len(addrs) == 0 {
 		//no ip
 		err = errors.New("no network")
+		return
+	}
+	var primaryAddress string
+	if h.gatherer.hasHostAddrs() {
+		primaryAddress = h.gatherer.hostAddrs[0]
+	} else {
+		var port int
+		port, err = h.gatherer.pickPort(addrs)
+		if err != nil {
+			return
+		}
+		primaryAddress = fmt.Sprintf("%s:%d", addrs[0].IP.String(), port)
 	}
-	port := rand.NewSource(time.Now().UnixNano()).Int63() % 50000
-	primaryAddress := fmt.Sprintf("%s:%d", addrs[0].IP.String(), port)
-	candidates, err = getLocalCandidates(primaryAddress)
+	candidates, err = getLocalCandidates(primaryAddress, h.gatherer)
 	if err != nil {
 		return
 	}
-	for _, c := range candidates {
-		h.localCandidates = append(h.localCandidates, c.addr)
-	}
+	h.localCandidates = listenAddrs(candidates)
 	return
 }
 
@@ -13,8 +13,11 @@ import (
 
 	"sync"
 
+	"sync/atomic"
+
 	"encoding/hex"
 
+	"github.com/nkbai/goice/clock"
 	"github.com/nkbai/goice/ice/attr"
 	"github.com/nkbai/goice/stun"
 	"github.com/nkbai/goice/turn"
@@ -56,6 +59,22 @@ type session struct {
 	 * Specify whether to use aggressive nomination.
 	 */
 	aggresive bool
+	/*
+		regular nomination 时如何从 valid list 中选择要 nominate 的 pair
+	*/
+	pairSelector PairSelector
+	/*
+		ICE-lite, 不发送 check, 只回应对方的 binding request
+	*/
+	lite bool
+	/*
+		RFC 7675 consent freshness
+	*/
+	consentInterval time.Duration
+	consentTimeout  time.Duration
+	lastConsent     time.Time
+	consentRequests map[stun.TransactionID]*consentRequest
+	renominating    bool //controlling 切换了选定的 pair, consent 请求带上 USE-CANDIDATE 直到收到 response
 
 	/**
 	 * For a controlled agent, specify how long it wants to wait (in
@@ -89,15 +108,29 @@ type session struct {
 	*/
 	serverSocks map[string]serverSocker
 	/*
-			按照现在的实现,连接到 stun/turn 服务器的那个需要特殊处理,
+			按照现在的实现,连接到 turn 服务器的那个需要特殊处理,
 			只有他发送数据的时候,可能需要经过 turn server 中转.
-		当然如果真的没有 turnserver, 也不影响,它会是 nil, 也不会从服务器发送中转数据
+		可能同时有多个 turn server, 每个 turn server 对应一个, 当然如果真的没有 turnserver, 也不影响,
+		它会是空的, 也不会从服务器发送中转数据
 	*/
-	turnServerSock *turnServerSock
+	turnServerSocks []*turnServerSock
 
 	isNominating bool /* Nominating stage   */
-	//write this chan to finish one check.
-	checkMap map[string]chan error
+	/*
+		check 的调度, 见 scheduler.go, 只在 loop 中访问.
+		ta 每隔多长时间开始一个新的 check, maxCheckListSize checklist 中最多有多少个 pair.
+		timing 中的 RTO, MaxRTO, MaxRetransmits 控制 check 的重传.
+	*/
+	ta               time.Duration
+	timing           Timing
+	maxCheckListSize int
+	checksStarted    bool
+	pendingResolves  int //还在解析的 .local 和域名 candidate, 见 resolveCandidates, 都结束以前 checklist 不会失败
+	triggeredChecks  []*sessionCheck
+	checkTimer       clock.Timer
+	nextPace         time.Time
+	pacePending      bool
+	scheduleChan     chan struct{}
 	//todo refer state, etc.
 	iceStreamTransport *StreamTransport
 	/*
@@ -111,13 +144,30 @@ type session struct {
 	/*
 		收到的stun message, 不要堵塞发送接收routine
 	*/
-	msgChan        chan *stunMessageWrapper
-	dataChan       chan *stunDataWrapper
-	tryFailChan    chan *checkFailedWrapper
-	quitChan       chan struct{}         //close when stop
-	hasStopped     bool                  //停止销毁相关资源时,标记.
-	completeResult sessionCompleteResult //0,not complete ,1 complete success, 2 complete failure
-	log            log.Logger
+	msgChan chan *stunMessageWrapper
+	/*
+		dataPath 选定的 pair, 见 datapath.go. 收发数据不经过 loop.
+		dataLock 保证 Stop 返回以后不会再有数据回调.
+	*/
+	dataPath    atomic.Value
+	dataLock    sync.RWMutex
+	dataStopped bool
+	/*
+		cmdChan 来自上层调用的操作, 都在 loop 中执行, 见 run.
+	*/
+	cmdChan  chan func()
+	quitChan chan struct{} //close when stop
+	stopOnce sync.Once
+	wg       sync.WaitGroup //loop 协程, Stop 等待它退出
+	clock    clock.Clock    //所有的定时器和时间戳都来自它, 见 TransportConfig.Clock
+	/*
+		controlled 等待对方 nominate 的定时器, 以及 consent 的定时器, 都由 loop 处理.
+	*/
+	nominationTimer clock.Timer
+	consentTimer    clock.Timer
+	counter         *pairCounter
+	completeResult  sessionCompleteResult //0,not complete ,1 complete success, 2 complete failure
+	log             log.Logger
 }
 type sessionCompleteResult int
 
@@ -176,28 +226,22 @@ type stunMessageWrapper struct {
 	remoteAddr string
 	msg        *stun.Message
 }
-type stunDataWrapper struct {
-	localAddr  string
-	remoteAddr string
-	data       []byte
-}
-
-/*
-尝试多次失败以后,需要结束这次 check,
-*/
-type checkFailedWrapper struct {
-	c   *sessionCheck
-	err error
-}
 
 /*
-ice session运行着四种协程
-1.来自上层的调用
-2.来自下层 socket 的消息协程
-3.自身的 loop 协程
-4.check 时候的大量协程,
+ice session 的所有状态只在 loop 协程中修改:
+1.来自上层的调用通过 run 交给 loop 执行
+2.来自下层 socket 的消息通过 msgChan 交给 loop
+3.check,重传,consent 以及等待 nomination 都是 loop 中的定时器
+只有 sessionComponent 由 mlock 保护, 可以在任何协程中读取.
+收到的数据在 socket 的读取协程中直接交给上层, 发送数据使用 loop 发布的 dataPath.
 */
 func newIceSession(name string, role SessionRole, localCandidates []*Candidate, transporter stunTranporter, ice *StreamTransport) *session {
+	var cfg *TransportConfig
+	if ice != nil {
+		cfg = ice.cfg
+	}
+	clk := cfg.clock()
+	timing := cfg.timing().withDefaults()
 	s := &session{
 		Name:               name,
 		role:               role,
@@ -206,21 +250,39 @@ func newIceSession(name string, role SessionRole, localCandidates []*Candidate,
 		rxPassword:         utils.RandomString(8),
 		localCandidates:    localCandidates,
 		transporter:        transporter,
-		checkMap:           make(map[string]chan error),
 		iceStreamTransport: ice,
 		checkList:          new(sessionCheckList),
 		validCheckList:     new(sessionCheckList),
 		tieBreaker:         attr.RandUint64(),
 		serverSocks:        make(map[string]serverSocker),
 		msg2Check:          make(map[stun.TransactionID]*sessionCheck),
+		consentRequests:    make(map[stun.TransactionID]*consentRequest),
+		consentInterval:    timing.ConsentInterval,
+		consentTimeout:     timing.ConsentTimeout,
 		msgChan:            make(chan *stunMessageWrapper, 10),
-		dataChan:           make(chan *stunDataWrapper, 10),
+		cmdChan:            make(chan func()),
 		quitChan:           make(chan struct{}),
-		tryFailChan:        make(chan *checkFailedWrapper, 10),
+		clock:              clk,
+		nominationTimer:    clock.NewStoppedTimer(clk),
+		consentTimer:       clock.NewStoppedTimer(clk),
+		counter:            newPairCounter(clk),
+		ta:                 timing.CheckInterval,
+		timing:             timing,
+		maxCheckListSize:   defaultMaxCheckListSize,
+		checkTimer:         clock.NewStoppedTimer(clk),
+		scheduleChan:       make(chan struct{}, 1),
 		log:                log.New("name", fmt.Sprintf("%s-icesession", name)),
-		controlledAgentWaitNomiatedTimeout: time.Second * 10,
+		controlledAgentWaitNomiatedTimeout: timing.NominationWait,
 	}
 	s.rxCrendientials = stun.NewShortTermIntegrity(s.rxPassword)
+	if ice != nil && ice.cfg != nil {
+		s.aggresive = ice.cfg.Nomination == NominationAggressive
+		s.pairSelector = ice.cfg.PairSelector
+		s.lite = ice.cfg.Lite
+		if ice.cfg.MaxCheckListSize > 0 {
+			s.maxCheckListSize = ice.cfg.MaxCheckListSize
+		}
+	}
 	//make sure the first candidates is used to communicate with stun/turn server
 
 	return s
@@ -243,20 +305,46 @@ func (s *session) deleteMsgCheck(id stun.TransactionID) {
 	delete(s.msg2Check, id)
 	s.mlock.Unlock()
 }
+/*
+Stop 可以调用多次, 等待 loop 退出以后才关闭 socket, 所以不能在 loop 中(比如回调里)调用.
+*/
 func (s *session) Stop() {
-	s.hasStopped = true
-	for _, srv := range s.serverSocks {
-		srv.Close()
-	}
-	for _, c := range s.checkMap {
-		close(c)
-	}
-	close(s.quitChan) //avoid send on close
+	s.stopOnce.Do(func() {
+		close(s.quitChan)
+		s.dataLock.Lock()
+		s.dataStopped = true
+		s.dataLock.Unlock()
+		s.wg.Wait()
+		s.checkTimer.Stop()
+		s.nominationTimer.Stop()
+		s.consentTimer.Stop()
+		for _, srv := range s.serverSocks {
+			srv.Close()
+		}
+	})
 }
-func (s *session) createCheckList(sd *sessionDescription) error {
-	if len(sd.candidates) > maxCandidates {
-		return errTooManyCandidates
+
+/*
+run 在 loop 中执行 f 并等待它结束, session 已经停止的时候返回 errSessionStopped.
+*/
+func (s *session) run(f func()) error {
+	done := make(chan struct{})
+	select {
+	case s.cmdChan <- func() { f(); close(done) }:
+	case <-s.quitChan:
+		return errSessionStopped
+	}
+	select {
+	case <-done:
+		return nil
+	case <-s.quitChan:
+		return errSessionStopped
 	}
+}
+/*
+根据对方的 sdp 设置认证信息以及对方的 candidate
+*/
+func (s *session) setRemoteDescription(sd *sessionDescription) {
 	s.txUserName = fmt.Sprintf("%s:%s", sd.user, s.rxUserFrag)
 	s.rxUserName = fmt.Sprintf("%s:%s", s.rxUserFrag, sd.user)
 	s.txPassword = sd.password
@@ -267,27 +355,133 @@ func (s *session) createCheckList(sd *sessionDescription) error {
 		}
 		s.remoteCandidates = append(s.remoteCandidates, c)
 	}
-	for _, l := range s.localCandidates {
-		for _, r := range s.remoteCandidates {
-			chk := &sessionCheck{
-				localCandidate:  l,
-				remoteCandidate: r,
-				key:             fmt.Sprintf("%s-%s", l.addr, r.addr),
-				state:           checkStateFrozen,
-				priority:        calcPairPriority(s.role, l, r),
-			}
-			s.checkList.checks = append(s.checkList.checks, chk)
-		}
+}
+func (s *session) createCheckList(sd *sessionDescription) error {
+	if len(sd.candidates)+s.pendingResolves > maxCandidates {
+		return errTooManyCandidates
 	}
-	if len(s.checkList.checks) == 0 {
-		return errors.New("no matched candidate found")
+	s.setRemoteDescription(sd)
+	for _, r := range s.remoteCandidates {
+		s.checkList.checks = append(s.checkList.checks, s.newPairs(r)...)
+	}
+	//只有 .local 或者域名 candidate 的时候, 等它们解析完成以后再配对
+	if len(s.checkList.checks) == 0 && s.pendingResolves == 0 {
+		if len(s.remoteCandidates) > 0 {
+			return errors.New("no matched candidate found")
+		}
+		/*
+			trickle 的占位 sdp 中一个 candidate 也没有, 只能从对方的 check 中发现 peer reflexive candidate,
+			和 controlled 等待 nominate 一样, 超时以后协商失败.
+		*/
+		s.log.Info(fmt.Sprintf("no remote candidate, wait for checks from remote"))
+		s.nominationTimer.Reset(s.controlledAgentWaitNomiatedTimeout)
 	}
 	//priority from high to low. not stable
 	sort.Stable(s.checkList)
 	s.pruneCheckList()
+	/*
+		RFC 8445 6.1.2.5 pair 太多的时候去掉优先级低的, 避免检查时间过长.
+	*/
+	if len(s.checkList.checks) > s.maxCheckListSize {
+		s.log.Info(fmt.Sprintf("check list is limited from %d to %d", len(s.checkList.checks), s.maxCheckListSize))
+		s.checkList.checks = s.checkList.checks[:s.maxCheckListSize]
+	}
 	return nil
 }
 
+/*
+newPairs 返回 remote candidate r 和所有 local candidate 组成的 frozen pair.
+*/
+func (s *session) newPairs(r *Candidate) (checks []*sessionCheck) {
+	for _, l := range s.localCandidates {
+		if l.transport != r.transport || !sameAddressFamily(l.addr, r.addr) {
+			continue
+		}
+		if l.transport == TransportTCP && !canPairTCP(l.TCPType, r.TCPType) {
+			continue
+		}
+		checks = append(checks, &sessionCheck{
+			localCandidate:  l,
+			remoteCandidate: r,
+			key:             fmt.Sprintf("%s-%s", l.addr, r.addr),
+			state:           checkStateFrozen,
+			priority:        calcPairPriority(s.role, l, r),
+		})
+	}
+	return
+}
+
+/*
+addResolvedCandidate 在 loop 中加入一个解析完成的 remote candidate, c 为 nil 表示解析失败.
+checks 已经开始了, 新的 pair 插入 checklist 和其他 pair 一起调度: 相同 foundation 的 pair 正在进行的时候 frozen,
+否则 waiting. 已经有 nominated pair 或者失败以后只记录 candidate. 最后一个解析结束以后重新判断 checklist 是否完成.
+*/
+func (s *session) addResolvedCandidate(c *Candidate) {
+	s.pendingResolves--
+	if c != nil && c.ComponentID == 1 {
+		for _, r := range s.remoteCandidates {
+			if r.addr == c.addr {
+				//已经作为 peer reflexive 或者其他 candidate 出现了
+				c = nil
+				break
+			}
+		}
+	}
+	if c != nil && c.ComponentID == 1 && len(s.remoteCandidates) < maxCandidates {
+		s.remoteCandidates = append(s.remoteCandidates, c)
+		if s.checksStarted && s.completeResult < sessionCompleteSuccess {
+			s.addChecks(s.newPairs(c))
+		}
+	}
+	if s.pendingResolves == 0 && s.checksStarted && s.completeResult < sessionAllCompleteSuccess &&
+		s.completeResult != sessionCheckComplete {
+		s.tryCompleteCheckList()
+	}
+}
+
+/*
+addChecks 把 checks 开始以后新得到的 pair 加入 checklist, 和 pruneCheckList 一样去掉重复的 pair.
+*/
+func (s *session) addChecks(checks []*sessionCheck) {
+	active := make(map[string]bool)
+	exists := make(map[string]bool)
+	for _, c := range s.checkList.checks {
+		if c.state == checkStateWaiting || c.state == checkStateInProgress {
+			active[c.foundation()] = true
+		}
+		exists[fmt.Sprintf("%s-%s-%s", c.localCandidate.transport, c.localCandidate.sendAddr(), c.remoteCandidate.addr)] = true
+	}
+	added := false
+	for _, c := range checks {
+		key := fmt.Sprintf("%s-%s-%s", c.localCandidate.transport, c.localCandidate.sendAddr(), c.remoteCandidate.addr)
+		if exists[key] || (c.localCandidate.transport == TransportTCP && c.localCandidate.TCPType == TCPTypePassive) {
+			continue
+		}
+		if len(s.checkList.checks) >= s.maxCheckListSize {
+			s.log.Warn(fmt.Sprintf("check list is full, pair %s is ignored", c.key))
+			break
+		}
+		exists[key] = true
+		s.checkList.checks = append(s.checkList.checks, c)
+		if !active[c.foundation()] {
+			active[c.foundation()] = true
+			s.changeCheckState(c, checkStateWaiting, nil)
+		}
+		added = true
+	}
+	if added {
+		sort.Stable(s.checkList)
+		s.kick()
+	}
+}
+
+/*
+ipv4 和 ipv6 的 candidate 之间不能配对
+*/
+func sameAddressFamily(addr1, addr2 string) bool {
+	return (addrToUDPAddr(addr1).IP.To4() == nil) == (addrToUDPAddr(addr2).IP.To4() == nil)
+}
+
 /* Since an agent cannot sendData requests directly from a reflexive
  * candidate, but only from its base, the agent next goes through the
  * sorted list of candidate pairs.  For each pair where the local
@@ -297,12 +491,21 @@ func (s *session) createCheckList(sd *sessionDescription) error {
  * candidates are identical to the local and remote candidates of a pair
  * higher up on the priority list.  The result is a sequence of ordered
  * candidate pairs, called the check list for that media stream.
+ *
+ * RFC 8445 6.1.2.4 比较的是 base, 和 foundation 无关, relay 的 base 就是它自己.
+ */
+/* RFC 6544 Section 6.2
+ * When the agent prunes the check list, it MUST also remove any pair for
+ * which the local candidate is a passive TCP candidate.
  */
 func (s *session) pruneCheckList() {
 	m := make(map[string]bool)
 	var checks []*sessionCheck
 	for _, c := range s.checkList.checks {
-		key := fmt.Sprintf("%d%s", c.localCandidate.Foundation, c.remoteCandidate.addr)
+		if c.localCandidate.transport == TransportTCP && c.localCandidate.TCPType == TCPTypePassive {
+			continue
+		}
+		key := fmt.Sprintf("%s-%s-%s", c.localCandidate.transport, c.localCandidate.sendAddr(), c.remoteCandidate.addr)
 		if m[key] {
 			continue
 		}
@@ -331,35 +534,68 @@ func (s *session) StartServer() (err error) {
 		}
 	}()
 	s.transporter.Close() //首先要关闭这个连接,否则没法再次 Listen, 会提示被占用
-	turnsock, hasRelay := s.transporter.(*turnSock)
-	start := 0
 	candidates := s.transporter.getListenCandidiates()
-	if hasRelay {
-		start = 1
+	for _, turnsock := range relaySocks(s.transporter) {
 		cfg := &turnServerSockConfig{
-			user:         turnsock.user,
-			password:     turnsock.password,
-			nonce:        turnsock.nonce,
-			realm:        turnsock.realm,
-			credentials:  turnsock.credentials,
-			relayAddress: turnsock.relayAddress,
-			serverAddr:   turnsock.serverAddr,
-			lifetime:     turnsock.lifetime,
+			user:               turnsock.user,
+			password:           turnsock.password,
+			nonce:              turnsock.nonce,
+			realm:              turnsock.realm,
+			credentials:        turnsock.credentials,
+			relayAddress:       turnsock.relayAddress,
+			serverAddr:         turnsock.serverAddr,
+			lifetime:           turnsock.lifetime,
+			clock:              s.clock,
+			batchIO:            s.iceStreamTransport.cfg.sockOptions().batchIO,
+			keepAlive:          s.timing.TurnKeepAlive,
+			refreshMargin:      s.timing.TurnRefreshMargin,
+			transactionTimeout: s.timing.TransactionTimeout,
 		}
-		s.turnServerSock, err = newTurnServerSockWrapper(candidates[0], s.Name, s, cfg)
+		var c net.PacketConn
+		c, err = s.iceStreamTransport.gatherer.listenPacket(turnsock.s.LocalAddr)
 		if err != nil {
 			return err
 		}
-		s.serverSocks[candidates[0]] = s.turnServerSock
+		ts := newTurnServerSockWrapperWithConn(turnsock.s.LocalAddr, c, s.Name, s, cfg)
+		s.turnServerSocks = append(s.turnServerSocks, ts)
+		s.serverSocks[turnsock.s.LocalAddr] = ts
 	}
-	for ; start < len(candidates); start++ {
+	for _, addr := range candidates {
+		if _, ok := s.serverSocks[addr]; ok {
+			continue
+		}
 		var srv *stunServerSock
-		srv, err = newStunServerSock(candidates[start], s, s.Name)
+		if ms, ok := s.transporter.(*muxSock); ok {
+			//共用 mux 的 socket, 根据我的 ufrag 收取数据
+			var c *muxConn
+			c, err = ms.mux.newConn(s.rxUserFrag, addr)
+			if err != nil {
+				return err
+			}
+			srv = newStunServerSockWithConn(addr, c, s, s.Name, s.iceStreamTransport.cfg.sockOptions())
+		} else {
+			var c net.PacketConn
+			c, err = s.iceStreamTransport.gatherer.listenPacket(addr)
+			if err != nil {
+				return err
+			}
+			srv = newStunServerSockWithConn(addr, c, s, s.Name, s.iceStreamTransport.cfg.sockOptions())
+		}
+		s.serverSocks[addr] = srv
+	}
+	for _, c := range s.localCandidates {
+		if c.transport != TransportTCP || c.Type != CandidateHost {
+			continue
+		}
+		var conn *tcpPacketConn
+		conn, err = newTCPPacketConn(c.addr, c.TCPType, s.iceStreamTransport.takeTCPListener(c.addr))
 		if err != nil {
 			return err
 		}
-		s.serverSocks[candidates[start]] = srv
+		conn.dialTimeout = s.timing.MaxRTO
+		s.serverSocks[c.addr] = newStunServerSockWithConn(c.addr, conn, s, s.Name, s.iceStreamTransport.cfg.sockOptions())
 	}
+	s.wg.Add(1)
 	go s.loop()
 	return
 }
@@ -369,10 +605,10 @@ func (s *session) StartServer() (err error) {
 那么需要在turn server 上专门设置,对方发送到 turn server 的数据才会中转给我.
 否则会被 turn server 丢弃.
 */
-func (s *session) createTurnPermissionIfNeeded() (err error) {
+func (s *session) createTurnPermissionIfNeeded(remoteCandidates []*Candidate) (err error) {
 	var res *stun.Message
-	if s.turnServerSock != nil {
-		res, err = s.turnServerSock.createPermission(s.remoteCandidates)
+	for _, ts := range s.turnServerSocks {
+		res, err = ts.createPermission(remoteCandidates)
 		if err != nil {
 			return
 		}
@@ -383,6 +619,18 @@ func (s *session) createTurnPermissionIfNeeded() (err error) {
 	return nil
 }
 
+/*
+找到 relay 地址对应的 turnServerSock
+*/
+func (s *session) getTurnServerSock(relayAddr string) *turnServerSock {
+	for _, ts := range s.turnServerSocks {
+		if ts.cfg.relayAddress == relayAddr {
+			return ts
+		}
+	}
+	return nil
+}
+
 /*
 check stage:
 one check received a valid response
@@ -450,10 +698,11 @@ func (s *session) handleCheckResponse(check *sessionCheck, from string, res *stu
 	*/
 	if err = s.rxCrendientials.Check(res); err != nil {
 		if s.role == SessionRoleControlling {
-			err = fmt.Errorf("receive check response,but crendientials check failed %s", err)
-			s.log.Error(err.Error())
-			s.changeCheckState(check, checkStateFailed, err)
-			s.tryCompleteCheck(check) //is this the last check?
+			/*
+				对方可能还没有收到我的 sdp, response 不能认证, 当作没有收到, 等待重传.
+			*/
+			s.log.Warn(fmt.Sprintf("receive check response,but crendientials check failed %s, wait for retransmission", err))
+			return
 		} else {
 			s.log.Warn(fmt.Sprintf("receive check response,but crendientials check failed %s", err))
 		}
@@ -513,7 +762,7 @@ func (s *session) handleCheckResponse(check *sessionCheck, from string, res *stu
 		 * any of the local candidates that the agent knows about, the mapped
 		 * address represents a new candidate - a peer reflexive candidate.
 		 */
-		foundation := calcFoundation(check.localCandidate.baseAddr)
+		foundation := calcFoundation(CandidatePeerReflexive, check.localCandidate.baseAddr, "", check.localCandidate.transport)
 		lcand = new(Candidate)
 		lcand.Foundation = foundation
 		lcand.baseAddr = check.localCandidate.baseAddr
@@ -521,9 +770,13 @@ func (s *session) handleCheckResponse(check *sessionCheck, from string, res *stu
 		lcand.ComponentID = check.localCandidate.ComponentID
 		lcand.addr = xaddr.String()
 		lcand.transport = check.localCandidate.transport
+		lcand.TCPType = check.localCandidate.TCPType
 		lcand.Priority = calcCandidatePriority(lcand.Type, defaultPreference, lcand.ComponentID)
 		s.log.Trace(fmt.Sprintf("candidate add peer reflexive :%s", lcand))
+		//ReceiveData 会在读取协程中查找 local candidate
+		s.mlock.Lock()
 		s.localCandidates = append(s.localCandidates, lcand)
+		s.mlock.Unlock()
 	}
 	/* 7.1.2.2.3.  Constructing a Valid Pair
 	 * Next, the agent constructs a candidate pair whose local candidate
@@ -552,8 +805,10 @@ func (s *session) handleCheckResponse(check *sessionCheck, from string, res *stu
 			state:           checkStateSucced,
 			nominated:       check.nominated,
 			key:             fmt.Sprintf("%s-%s", lcand.addr, check.remoteCandidate.addr),
+			generatingCheck: check,
 		}
 		s.validCheckList.checks = append(s.validCheckList.checks, newcheck)
+		newcheck.lastResponse = s.clock.Now()
 		sort.Sort(s.validCheckList) //todo 为什么要排序呢?看不出来有任何必要
 	}
 	//find valid check and nominated check
@@ -571,17 +826,26 @@ func (s *session) handleCheckResponse(check *sessionCheck, from string, res *stu
 	s.tryCompleteCheck(check)
 }
 func (s *session) markValidAndNonimated(check *sessionCheck) {
+	var selected *sessionCheck
+	if check.nominated {
+		//是否切换到新的 pair 由 pairSelector 决定
+		selected = s.selectNominatedCheck()
+	}
 	s.mlock.Lock()
 	if s.sessionComponent.validCheck == nil || s.sessionComponent.validCheck.priority < check.priority {
 		s.sessionComponent.validCheck = check
 	}
-	if check.nominated {
-		if s.sessionComponent.nominatedCheck == nil || s.sessionComponent.nominatedCheck.priority < check.priority {
-			s.log.Trace(fmt.Sprintf("old nominatedcheck=%s\n,new nominated=%s", s.sessionComponent.nominatedCheck, check))
-			s.sessionComponent.nominatedCheck = check
-		}
+	changed := false
+	if selected != nil && selected != s.sessionComponent.nominatedCheck {
+		s.log.Trace(fmt.Sprintf("old nominatedcheck=%s\n,new nominated=%s", s.sessionComponent.nominatedCheck, selected))
+		s.sessionComponent.nominatedCheck = selected
+		changed = true
 	}
 	s.mlock.Unlock()
+	if changed {
+		s.updateDataPath()
+		s.emit(&Event{Type: EventSelectedPairChanged, Pair: selected.toCandidatePair()})
+	}
 }
 
 /*
@@ -601,11 +865,7 @@ func (s *session) tryCompleteCheck(check *sessionCheck) bool {
 	 *     always.
 	 */
 	if check.err == nil {
-		for _, c := range s.checkList.checks {
-			if c.localCandidate.Foundation == check.localCandidate.Foundation && c.state == checkStateFrozen {
-				s.changeCheckState(c, checkStateWaiting, nil)
-			}
-		}
+		s.unfreezeFoundation(check.foundation())
 		s.log.Trace(fmt.Sprintf("check  finished:%s", check.String()))
 	}
 
@@ -679,7 +939,13 @@ func (s *session) tryCompleteCheck(check *sessionCheck) bool {
 	 *     differs from offerer to answerer), the success of this check may
 	 *     unfreeze checks for other media streams.
 	 */
+	return s.tryCompleteCheckList()
+}
 
+/*
+tryCompleteCheckList 根据 checklist 的状态判断协商是否结束, 返回 true 表示已经结束.
+*/
+func (s *session) tryCompleteCheckList() bool {
 	/* 7.1.2.3.  Check List and Timer State Updates
 	 * Regardless of whether the check was successful or failed, the
 	 * completion of the transaction may require updating of check list and
@@ -694,8 +960,9 @@ func (s *session) tryCompleteCheck(check *sessionCheck) bool {
 	/*
 	 * See if all checks in the checklist have completed. If we do,
 	 * then mark ICE processing as failed.
+	 * 还有 candidate 在解析的时候, 它们的 pair 还没有加入 checklist.
 	 */
-	hasNotFinished := false
+	hasNotFinished := s.pendingResolves > 0
 	for _, c := range s.checkList.checks {
 		if c.state < checkStateSucced {
 			hasNotFinished = true
@@ -719,26 +986,28 @@ func (s *session) tryCompleteCheck(check *sessionCheck) bool {
 				s.iceComplete(errors.New("no valid check"), true)
 				return true
 			}
+			if s.completeResult >= sessionCheckComplete {
+				//重复收到对方的 check, 已经在等待 nomination 了
+				return false
+			}
 			s.log.Trace(fmt.Sprintf("all checks completed. controlled agent now waits for nomination.."))
 			s.changeCompleteResult(sessionCheckComplete)
-			go func() {
-				//start a timer,failed if there is no nomiated
-				time.Sleep(s.controlledAgentWaitNomiatedTimeout) // time from pjnath
-				//有可能这个连接已经因为其他原因已经被用户关闭了,要考虑这种可能性.
-				if s.sessionComponent.nominatedCheck == nil && !s.hasStopped {
-					s.iceComplete(errors.New("no nonimated"), true)
-				}
-			}()
+			//start a timer,failed if there is no nomiated, time from pjnath
+			s.nominationTimer.Reset(s.controlledAgentWaitNomiatedTimeout)
 			return false
-		} else if s.isNominating { //如果我是 controlling, 那么总是采用 aggressive策略.
+		} else if s.isNominating { //aggressive 模式或者 regular 模式下 nominate 失败了.
 			s.iceComplete(fmt.Errorf("%s controlling no nominated ", s.Name), true)
 			return true
 		} else {
 			/*
-				如果我是 regular 模式,那么此时应该是再次发送 bingdingrequest, 并带上 usecandidate, 目前没必要.
+				regular 模式,所有的 check 都已经完成,选择一个 valid pair, 再次发送 bingdingrequest, 并带上 usecandidate.
 			*/
-			panic("not implemented")
-			//return false
+			err := s.startNomination()
+			if err != nil {
+				s.iceComplete(fmt.Errorf("%s controlling nominate err %s", s.Name, err), true)
+				return true
+			}
+			return false
 		}
 
 	}
@@ -746,7 +1015,7 @@ func (s *session) tryCompleteCheck(check *sessionCheck) bool {
 	 * and see if they have a valid pair, if we are controlling and we haven't
 	 * started our nominated check yet.
 	 */
-	//目前只有一个 component, 另外只支持 aggressive 模式.
+	//目前只有一个 component
 	return false
 }
 func (s *session) changeCompleteResult(r sessionCompleteResult) {
@@ -759,18 +1028,30 @@ func (s *session) changeCompleteResult(r sessionCompleteResult) {
 }
 
 /*
-关闭除要使用的那个 serversock 以外其他所有的 sock, 因为只有一个是有效的,要使用的.
+关闭不在任何 pair 中使用的 sock, 选定的 pair 断开以后还可能切换到其他 pair, 它们的 sock 要保留, 见 failover.go.
 */
 func (s *session) closeUselessServerSock() {
+	used := map[serverSocker]bool{s.sessionComponent.nominatedServerSock: true}
+	for _, l := range []*sessionCheckList{s.checkList, s.validCheckList} {
+		for _, c := range l.checks {
+			if srv, err := s.getSenderServerSock(c.localCandidate.addr); err == nil {
+				used[srv] = true
+			}
+		}
+	}
 	for k, srv2 := range s.serverSocks {
-		if s.sessionComponent.nominatedServerSock != srv2 {
+		if !used[srv2] {
 			delete(s.serverSocks, k)
 			srv2.Close()
 		}
 	}
-	if s.sessionComponent.nominatedServerSock != s.turnServerSock {
-		s.turnServerSock = nil
+	var turnServerSocks []*turnServerSock
+	for _, ts := range s.turnServerSocks {
+		if used[ts] {
+			turnServerSocks = append(turnServerSocks, ts)
+		}
 	}
+	s.turnServerSocks = turnServerSocks
 }
 func (s *session) iceComplete(result error, allcomplete bool) {
 	//应该继续允许处理 BindingRequest, 因为对方可能还没有结束.
@@ -799,8 +1080,10 @@ func (s *session) iceComplete(result error, allcomplete bool) {
 			*/
 			s.changeCompleteResult(sessionAllCompleteSuccess)
 			s.log.Debug(fmt.Sprintf("icesession allcomplete"))
-			if len(s.checkMap) != 0 {
-				panic("all check should finished")
+			for _, c := range s.checkList.checks {
+				if c.state == checkStateInProgress {
+					panic("all check should finished")
+				}
 			}
 		} else {
 			if s.completeResult < sessionCompleteSuccess {
@@ -814,12 +1097,15 @@ func (s *session) iceComplete(result error, allcomplete bool) {
 		}
 		s.mlock.Lock()
 		s.sessionComponent.nominatedServerSock = srv
+		s.mlock.Unlock()
+		s.updateDataPath()
 		if allcomplete {
+			s.mlock.Lock()
 			s.closeUselessServerSock()
 			s.mlock.Unlock()
 			check := s.sessionComponent.nominatedCheck
 			if check.localCandidate.Type == CandidateRelay {
-				result = s.turnServerSock.channelBind(check.remoteCandidate.addr)
+				result = s.getTurnServerSock(check.localCandidate.addr).channelBind(check.remoteCandidate.addr)
 				if result != nil {
 					/*
 						失败了,不妨碍我继续使用sendIndication 来传输数据,继续这么做吧.
@@ -834,12 +1120,16 @@ func (s *session) iceComplete(result error, allcomplete bool) {
 			} else {
 				srv.FinishNegotiation(stunModeData)
 			}
-		} else {
-			s.mlock.Unlock()
 		}
 	}
 	if old < sessionCompleteSuccess { //只通知上层一次,但是可能完成多次,不断更新状态.
 		s.iceStreamTransport.onIceComplete(result)
+		if result == nil {
+			s.startConsent()
+		}
+	}
+	if result == nil && allcomplete {
+		s.iceStreamTransport.changeConnectionState(ConnectionStateCompleted, nil)
 	}
 }
 
@@ -847,32 +1137,47 @@ func (s *session) iceComplete(result error, allcomplete bool) {
 cancel one started check
 */
 func (s *session) cancelOneCheck(check *sessionCheck) {
-	chr := s.checkMap[check.key]
-	chr <- errors.New("canceled")
 	s.changeCheckState(check, checkStateFailed, errors.New("canceled"))
 }
+
+/*
+停止重传, 以后收到的 response 都会被忽略.
+*/
 func (s *session) finishOneCheck(check *sessionCheck) {
-	chr := s.checkMap[check.key]
-	delete(s.checkMap, check.key)
-	close(chr)
+	if check.req != nil {
+		s.deleteMsgCheck(check.req.TransactionID)
+		check.req = nil
+	}
 }
+
+/*
+角色冲突以后使用新的角色立即重新发送.
+*/
 func (s *session) retryOneCheck(check *sessionCheck) {
 	if check.state != checkStateInProgress {
 		s.log.Info(fmt.Sprintf("only can retry a check in progress, check=%s", check))
 		return
 	}
-	chr := s.checkMap[check.key]
-	chr <- errCheckRetry
+	s.triggerCheck(check)
 }
 func (s *session) startCheck() error {
 	s.log.Trace(fmt.Sprintf("start ice check..."))
 	if s.aggresive && s.role == SessionRoleControlling {
 		s.isNominating = true
 	}
-	if s.checkList.checks[0].state != checkStateFrozen {
+	if s.checksStarted {
 		return errors.New("already start another check")
 	}
-	s.allcheck(s.checkList.checks)
+	s.checksStarted = true
+	s.initCheckStates()
+	for _, rc := range s.earlyCheckList {
+		/*
+			优先处理收到的请求,可能已经可以成功了.
+		*/
+		s.log.Trace(fmt.Sprintf("process early check list %s", rc))
+		s.handleIncomingCheck(rc)
+	}
+	s.kick()
 	return nil
 }
 func (s *session) changeCheckState(check *sessionCheck, newState SessionCheckState, err error) {
@@ -883,60 +1188,14 @@ func (s *session) changeCheckState(check *sessionCheck, newState SessionCheckSta
 	}
 	check.state = newState
 	check.err = err
-	//停止探测
+	s.emit(&Event{Type: EventCheckStateChanged, Pair: check.toCandidatePair(), CheckState: newState, Err: err})
+	//停止探测, 可能有 frozen 的 check 可以开始了
 	if check.state >= checkStateSucced {
 		s.finishOneCheck(check)
+		s.kick()
 	}
 }
 
-//启动完毕以后立即返回,结果要从 ice complete中获取.
-func (s *session) allcheck(checks []*sessionCheck) {
-	const checkInterval = time.Millisecond * 20
-	fmap := make(map[int]bool)
-	for _, c := range checks {
-		key := fmt.Sprintf("%s-%s", c.localCandidate.addr, c.remoteCandidate.addr)
-		ch := make(chan error, 1)
-		s.checkMap[key] = ch
-	}
-	/*
-		only one compondent, all waiting...
-	*/
-	for _, c := range checks {
-		if !fmap[c.localCandidate.Foundation] {
-			fmap[c.localCandidate.Foundation] = true
-			s.changeCheckState(c, checkStateWaiting, nil)
-		}
-
-	}
-	for _, rc := range s.earlyCheckList {
-		/*
-			优先处理收到的请求,可能已经可以成功了.
-		*/
-		s.log.Trace(fmt.Sprintf("process early check list %s", rc))
-		s.handleIncomingCheck(rc)
-	}
-	for _, c := range checks {
-		ch := s.checkMap[c.key]
-		//有可能还没有启动,其他 check 已经完毕,这个就没有必要了.
-		if c.state == checkStateWaiting {
-			s.changeCheckState(c, checkStateInProgress, nil)
-			go s.onecheck(c, ch, s.isNominating)
-			time.Sleep(checkInterval)
-		}
-	}
-	/* If we don't have anything in Waiting state, perform check to
-	 * highest priority pair that is in Frozen state.
-	 */
-	for _, c := range checks {
-		ch := s.checkMap[c.key]
-		//有可能还没有启动,其他 check 已经完毕,这个就没有必要了.
-		if c.state == checkStateFrozen {
-			s.changeCheckState(c, checkStateInProgress, nil)
-			go s.onecheck(c, ch, s.isNominating)
-			time.Sleep(checkInterval)
-		}
-	}
-}
 func (s *session) buildBindingRequest(c *sessionCheck) (req *stun.Message) {
 	var (
 		err      error
@@ -970,6 +1229,22 @@ func (s *session) buildBindingRequest(c *sessionCheck) (req *stun.Message) {
 	}
 	return
 }
+/*
+收到 request 的本地地址对应的 candidate, 1:1 NAT 映射过的 host candidate 只能通过 base 找到.
+*/
+func (s *session) findLocalCandidate(localAddr string) *Candidate {
+	for _, c := range s.localCandidates {
+		if c.addr == localAddr {
+			return c
+		}
+	}
+	for _, c := range s.localCandidates {
+		if c.Type == CandidateHost && c.baseAddr == localAddr {
+			return c
+		}
+	}
+	return nil
+}
 func (s *session) getSenderServerSock(localAddr string) (ss serverSocker, err error) {
 	srv, ok := s.serverSocks[localAddr]
 	if ok {
@@ -977,7 +1252,15 @@ func (s *session) getSenderServerSock(localAddr string) (ss serverSocker, err er
 	}
 	for _, c := range s.localCandidates {
 		if c.addr == localAddr && c.Type == CandidateRelay {
-			return s.turnServerSock, nil
+			ts := s.getTurnServerSock(localAddr)
+			if ts == nil {
+				break
+			}
+			return ts, nil
+		} else if c.addr == localAddr && c.Type == CandidateHost && c.baseAddr != c.addr {
+			//1:1 NAT
+			ss = s.serverSocks[c.baseAddr]
+			return
 		} else if c.addr == localAddr && c.Type == CandidateServerReflexive {
 			ss = s.serverSocks[c.baseAddr]
 			return
@@ -990,65 +1273,6 @@ func (s *session) getSenderServerSock(localAddr string) (ss serverSocker, err er
 	return nil, err
 }
 
-func calcRetransmitTimeout(count int, lastsleep time.Duration) time.Duration {
-	if count == 0 {
-		return defaultRTOValue
-	} else if count < maxRetryBindingRequest-1 {
-		return lastsleep * 2
-	} else {
-		return stunTimeoutValue
-	}
-
-}
-func (s *session) onecheck(c *sessionCheck, chCheckResult chan error, nominate bool) {
-	var (
-		err        error
-		req        *stun.Message
-		sleep      = defaultRTOValue
-		serversock serverSocker
-	)
-	s.log.Trace(fmt.Sprintf("start check %s", c.key))
-	defer func() {
-		s.log.Trace(fmt.Sprintf("check complete %s", c.key))
-		if req != nil {
-			s.deleteMsgCheck(req.TransactionID)
-		}
-	}()
-	serversock, err = s.getSenderServerSock(c.localCandidate.addr)
-	if err != nil && s.completeResult < sessionAllCompleteSuccess {
-		s.log.Error(err.Error())
-		return
-	}
-	if nominate && s.role == SessionRoleControlling {
-		c.nominated = true
-	}
-	//build req message
-lblRestart:
-	req = s.buildBindingRequest(c)
-	for i := 0; i < maxRetryBindingRequest; i++ {
-		s.log.Trace(fmt.Sprintf("%s sendData %d times,bindingrequestlength=%d", c.key, i+1, len(req.Raw)))
-		sleep = calcRetransmitTimeout(i, sleep)
-		s.addMsgCheck(req.TransactionID, c)
-
-		err = serversock.sendStunMessageAsync(req, c.localCandidate.addr, c.remoteCandidate.addr)
-		if err != nil {
-			s.log.Debug(fmt.Sprintf("send binding request from %s to %s ,err %s", c.localCandidate.addr, c.remoteCandidate.addr, err))
-		}
-		select {
-		case <-time.After(sleep):
-			continue
-		case err = <-chCheckResult:
-			if err == errCheckRetry {
-				goto lblRestart // 立即进行下一次探测.
-			}
-			return
-		}
-	}
-	//探测了七次,没有任何结果,失败.
-	s.tryFailChan <- &checkFailedWrapper{c, errTriedTooManyTimes}
-	return
-}
-
 func (s *session) changeRole(newrole SessionRole) {
 	s.log.Trace(fmt.Sprintf("role changed from %s to %s", s.role, newrole))
 	s.role = newrole
@@ -1087,6 +1311,7 @@ func (s *session) sendResponse(localAddr, fromAddr string, req *stun.Message, co
 			panic(fmt.Sprintf("build res message error %s", err))
 		}
 		sc.sendStunMessageAsync(res, localAddr, fromAddr)
+		s.counter.responseSent(s.pairIDOf(localAddr, fromAddr))
 		return
 	} else if code == stun.CodeRoleConflict {
 		err = res.Build(
@@ -1152,6 +1377,15 @@ func (s *session) processBindingRequest(localAddr, fromAddr string, req *stun.Me
 		s.sendResponse(localAddr, fromAddr, req, stun.CodeUnauthorised)
 		return
 	}
+	s.counter.requestReceived(s.pairIDOf(localAddr, fromAddr))
+	if s.lite && len(s.txUserName) == 0 {
+		/*
+			lite agent 不会发送 triggered check, 没有对方的 sdp 也无法给出正确的 response,
+			直接忽略, 对方会重传.
+		*/
+		s.log.Info(fmt.Sprintf("lite received early check from %s,ignored", fromAddr))
+		return
+	}
 	_, err = req.Get(stun.AttrICEControlling)
 	if err == nil {
 		hasControll = true
@@ -1175,6 +1409,13 @@ func (s *session) processBindingRequest(localAddr, fromAddr string, req *stun.Me
 	if err == nil {
 		hasControll = true
 		rcheck.role = SessionRoleControlled
+		if s.lite {
+			/*
+				lite agent 只能是 controlled, 让对方切换到 controlling.
+			*/
+			s.sendResponse(localAddr, fromAddr, req, stun.CodeRoleConflict)
+			return
+		}
 		if s.role != SessionRoleControlling {
 			var peerTieBreaker attr.IceControlled
 			peerTieBreaker.GetFrom(req)
@@ -1196,11 +1437,19 @@ func (s *session) processBindingRequest(localAddr, fromAddr string, req *stun.Me
 		如果是 earlycheck, 那么发送过去的 response 中 username 应该是错的,所以我们不能认为 username 不对就是错的.
 	*/
 	s.sendResponse(localAddr, fromAddr, req, 0)
+	if s.lite && s.completeResult >= sessionCompleteSuccess {
+		//lite agent 以收到对方的请求作为 consent
+		s.refreshConsent()
+	}
 	if s.completeResult >= sessionAllCompleteSuccess {
+		//对方切换了选定的 pair, 见 failover.go
+		if _, err = req.Get(stun.AttrUseCandidate); err == nil && !s.lite && s.role == SessionRoleControlled {
+			s.handleRenomination(localAddr, fromAddr)
+		}
 		return // 不应该继续处理了,因为negotiation 已经完成了.
 	}
 	//early check received.
-	if len(s.checkMap) <= 0 && s.completeResult == sessionNotComplete {
+	if !s.checksStarted && s.completeResult == sessionNotComplete {
 		s.rxUserName = string(userName)
 		s.log.Info(fmt.Sprintf("received early check from %s, username=%s", fromAddr, s.rxUserName))
 	}
@@ -1220,7 +1469,11 @@ func (s *session) processBindingRequest(localAddr, fromAddr string, req *stun.Me
 	rcheck.componentID = 1
 	rcheck.remoteAddress = fromAddr
 	rcheck.localAddress = localAddr
-	if len(s.checkMap) <= 0 && s.completeResult == sessionNotComplete { //checkmap为空表示我还没开始协商,当然也可能是我已经把所有的 check 都检查完了.
+	if s.lite {
+		s.handleLiteCheck(rcheck)
+		return
+	}
+	if !s.checksStarted && s.completeResult == sessionNotComplete { //我还没开始协商
 		/*
 			We don't have answer yet, so keep this request for later
 		*/
@@ -1263,17 +1516,33 @@ func (s *session) handleIncomingCheck(rcheck *rxCheck) {
 		rcand.Type = CandidatePeerReflexive
 		rcand.Priority = rcheck.priority
 		rcand.addr = rcheck.remoteAddress
-		rcand.Foundation = calcFoundation(rcheck.remoteAddress)
 		s.remoteCandidates = append(s.remoteCandidates, rcand)
 		s.log.Info(fmt.Sprintf("add new remote candidate from the request %s", rcand.addr))
 	}
 	/*
 		寻找匹配这个 rcheck 的 localCandidates, 就找优先级最高的那个就可以了.
 	*/
-	for _, cand := range s.localCandidates {
-		if cand.addr == rcheck.localAddress {
-			lcand = cand
-			break
+	lcand = s.findLocalCandidate(rcheck.localAddress)
+	if lcand == nil {
+		s.log.Warn(fmt.Sprintf("received check on unknown local address %s", rcheck.localAddress))
+		return
+	}
+	if rcand.transport == 0 {
+		/*
+			新发现的 peer reflexive candidate, 和接收到请求的 local candidate 使用相同的传输方式.
+			对方主动连接到我的 passive candidate, 那么对方就是 active 的.
+		*/
+		rcand.transport = lcand.transport
+		rcand.Foundation = calcFoundation(CandidatePeerReflexive, rcand.addr, "", rcand.transport)
+		if lcand.transport == TransportTCP {
+			switch lcand.TCPType {
+			case TCPTypePassive:
+				rcand.TCPType = TCPTypeActive
+			case TCPTypeActive:
+				rcand.TCPType = TCPTypePassive
+			default:
+				rcand.TCPType = lcand.TCPType
+			}
 		}
 	}
 	/*
@@ -1303,6 +1572,8 @@ func (s *session) handleIncomingCheck(rcheck *rxCheck) {
 	 *   check in progress.  This is to facilitate rapid completion of
 	 *   ICE when both agents are behind NAT.
 	 *
+	 * RFC 8445 7.3.1.4 这两种情况都放到 triggered check 队列中, 由 Ta 定时器发送.
+	 *
 	 * - If the state of that pair is Failed or Succeeded, no triggered
 	 *   check is sent.
 	 */
@@ -1312,12 +1583,7 @@ func (s *session) handleIncomingCheck(rcheck *rxCheck) {
 		s.log.Trace(fmt.Sprintf("change check %s nominated from %v to %v", c.key, oldnominated, c.nominated))
 		if c.state == checkStateFrozen || c.state == checkStateWaiting {
 			s.log.Trace(fmt.Sprintf("performing triggered check for %s", c.key))
-			chResult, ok := s.checkMap[c.key]
-			if !ok {
-				panic("must ...")
-			}
-			s.changeCheckState(c, checkStateInProgress, nil)
-			go s.onecheck(c, chResult, c.nominated || s.isNominating)
+			s.triggerCheck(c)
 		} else if c.state == checkStateInProgress {
 			//Should retransmit immediately
 			s.log.Trace(fmt.Sprintf("triggered check for check %s not performed, because its in progress. Retransmitting", c.key))
@@ -1345,19 +1611,20 @@ func (s *session) handleIncomingCheck(rcheck *rxCheck) {
 		 * - A triggered check for that pair is performed immediately.
 		 */
 		/* Note: only do this if we don't have too many checks in checklist */
+		if len(s.checkList.checks) >= s.maxCheckListSize {
+			s.log.Warn(fmt.Sprintf("check list is full, triggered check %s-%s is ignored", lcand.addr, rcand.addr))
+			return
+		}
 		c := &sessionCheck{
 			localCandidate:  lcand,
 			remoteCandidate: rcand,
 			priority:        calcPairPriority(s.role, lcand, rcand),
-			state:           checkStateInProgress,
+			state:           checkStateWaiting,
 			nominated:       rcheck.userCandidate,
 			key:             fmt.Sprintf("%s-%s", lcand.addr, rcand.addr),
 		}
 		s.checkList.checks = append(s.checkList.checks, c)
-		ch := make(chan error, 1)
-		s.checkMap[c.key] = ch
-		nominated := c.nominated || s.isNominating
-		go s.onecheck(c, ch, nominated)
+		s.triggerCheck(c)
 		s.log.Trace(fmt.Sprintf("New triggered check added:%s", c.key))
 	}
 }
@@ -1368,16 +1635,20 @@ func (s *session) handleIncomingCheck(rcheck *rxCheck) {
 代表的是SessionCheck 中的 localCandidate
 */
 func (s *session) processBindingResponse(localAddr, remoteAddr string, msg *stun.Message) {
+	if s.handleConsentResponse(remoteAddr, msg) {
+		return
+	}
 	id := msg.TransactionID
 	check := s.getMsgCheck(id)
 	if check == nil {
 		s.log.Info(fmt.Sprintf("receive bind response ,but has no related check %s", msg))
 		return
 	}
-	if check.localCandidate.addr != localAddr {
-		s.log.Warn(fmt.Sprintf("received bind response ,but local addr err ,expect %s,got %s", check.localCandidate.addr, localAddr))
+	if check.localCandidate.addr != localAddr && check.localCandidate.sendAddr() != localAddr {
+		s.log.Warn(fmt.Sprintf("received bind response ,but local addr err ,expect %s,got %s", check.localCandidate.sendAddr(), localAddr))
 		return
 	}
+	s.counter.responseReceived(pairID(check.localCandidate.addr, check.remoteCandidate.addr), id)
 	if check.state >= checkStateSucced {
 		s.log.Info(fmt.Sprintf("check %s has been finished", check.key))
 		return
@@ -1389,11 +1660,12 @@ func (s *session) processBindingResponse(localAddr, remoteAddr string, msg *stun
 ice 协商的核心就是处理
 1. 收到的 binding Request msgChan
 2. 收到的 binding response  msgChan
-3. 自己不断的发送binding Request 发送完毕对应的 tryFailChan
-4. 协商找到可用连接以后,收发数据. 收数据用dataChan
+3. 按照 Ta 的节奏发送 binding Request 以及重传, 由 checkTimer 驱动
+4. 选定的 pair 变化以后发布新的 dataPath, 收发数据不经过 loop
 
 */
 func (s *session) loop() {
+	defer s.wg.Done()
 	for {
 		r := utils.RandomString(20)
 		s.log.Trace(fmt.Sprintf("session loop %s start @%s", r, time.Now().Format("15:04:05.999")))
@@ -1404,22 +1676,19 @@ func (s *session) loop() {
 			} else {
 				return
 			}
-		case data, ok := <-s.dataChan:
-			if ok {
-				s.iceStreamTransport.onRxData(data.data, data.remoteAddr)
-			} else {
-				return
-			}
-		case c, ok := <-s.tryFailChan:
-			if ok {
-				if c.c.state < checkStateSucced {
-					//可能已经成功了,
-					s.changeCheckState(c.c, checkStateFailed, c.err)
-					s.tryCompleteCheck(c.c)
-				}
-			} else {
-				return
+		case <-s.checkTimer.C():
+			s.runScheduler()
+		case <-s.scheduleChan:
+			s.pacePending = true
+			s.runScheduler()
+		case <-s.nominationTimer.C():
+			if s.sessionComponent.nominatedCheck == nil && s.completeResult < sessionCompleteSuccess {
+				s.iceComplete(errors.New("no nonimated"), true)
 			}
+		case <-s.consentTimer.C():
+			s.onConsentTimer()
+		case f := <-s.cmdChan:
+			f()
 		case <-s.quitChan:
 			return
 		}
@@ -1449,48 +1718,12 @@ message received from peer or stun server after negiotiation complete.
 */
 func (s *session) RecieveStunMessage(localAddr, remoteAddr string, msg *stun.Message) {
 	s.log.Trace(fmt.Sprintf("%s receive stun message from  %s, msg:%s", localAddr, remoteAddr, msg.Type))
-	if s.hasStopped {
-		return
+	select {
+	case s.msgChan <- &stunMessageWrapper{localAddr, remoteAddr, msg}:
+	case <-s.quitChan:
 	}
-	//不要阻塞发送接收消息线程.
-	s.msgChan <- &stunMessageWrapper{localAddr, remoteAddr, msg}
-	return
-
-}
-
-/*
-1. 在协商未完全结束之前就有可能收到数据,只要有一个可用的连接,对方就会发送数据,
-2. 随着协商的完成,最终双方会确认一个一致的 check, 如果这时候是走的 relay, 那么才会启用 turn channel 模式.
-*/
-func (s *session) ReceiveData(localAddr, peerAddr string, data []byte) {
-	if s.hasStopped {
-		return
-	}
-	s.log.Trace(fmt.Sprintf("recevied data %s<-----%s l=%d", localAddr, peerAddr, len(data)))
-	s.dataChan <- &stunDataWrapper{localAddr, peerAddr, data}
-	return
 
 }
-func (s *session) SendData(data []byte) error {
-	s.mlock.Lock()
-	//nominiatedcheck可能会在可以发送数据以后变化.
-	check := s.sessionComponent.nominatedCheck
-	srv := s.sessionComponent.nominatedServerSock
-	fromaddr := check.localCandidate.addr
-	s.mlock.Unlock()
-	if check == nil {
-		return errors.New("no check")
-	}
-	if srv == nil {
-		return errors.New("no stun transport")
-	}
-	s.log.Trace(fmt.Sprintf("send data from %s to %s datalen=%d", fromaddr, check.remoteCandidate.addr, len(data)))
-	if check.localCandidate.Type == CandidateServerReflexive || check.localCandidate.Type == CandidatePeerReflexive {
-		fromaddr = check.localCandidate.baseAddr
-		s.log.Trace(fmt.Sprintf("accutally send data from %s to %s datalen=%d", fromaddr, check.remoteCandidate.addr, len(data)))
-	}
-	return srv.sendData(data, fromaddr, check.remoteCandidate.addr)
-}
 
 /*
 pair priority = 2^32*MIN(G,D) + 2*MAX(G,D) + (G>D?1:0)
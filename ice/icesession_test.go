@@ -0,0 +1,180 @@
+package ice
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nkbai/goice/vnet"
+)
+
+func newLANConfigs(t testing.TB, n int) []*TransportConfig {
+	lan, err := vnet.NewRouter(&vnet.RouterConfig{Name: "lan", CIDR: "10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfgs []*TransportConfig
+	for i := 0; i < n; i++ {
+		nt, _ := vnet.NewNet(nil)
+		if err = lan.AddNet(nt); err != nil {
+			t.Fatal(err)
+		}
+		cfg := NewTransportConfigHostonly()
+		cfg.Net = nt
+		cfg.ConsentInterval = 20 * time.Millisecond
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs
+}
+
+/*
+stresscb 丢弃收到的数据, 回调不能阻塞 loop.
+*/
+type stresscb struct {
+	*icecb
+}
+
+func (c *stresscb) OnReceiveData(data []byte, from net.Addr) {}
+
+/*
+很多对 transport 同时协商, 协商过程中不断读取状态, 完成以后并发发送数据并且同时 Stop,
+用 go test -race 运行.
+*/
+func TestIceStreamTransport_ConcurrentStress(t *testing.T) {
+	const pairs = 8
+	cfgs := newLANConfigs(t, pairs*2)
+	var wg sync.WaitGroup
+	errs := make(chan error, pairs)
+	for i := 0; i < pairs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s1, err := NewIceStreamTransport(cfgs[2*i], fmt.Sprintf("s%d-1", i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			s2, err := NewIceStreamTransport(cfgs[2*i+1], fmt.Sprintf("s%d-2", i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			cb1, cb2 := newicecb(s1.Name), newicecb(s2.Name)
+			s1.cb, s2.cb = &stresscb{cb1}, &stresscb{cb2}
+			if err = s1.InitIce(SessionRoleControlling); err != nil {
+				errs <- err
+				return
+			}
+			if err = s2.InitIce(SessionRoleControlled); err != nil {
+				errs <- err
+				return
+			}
+			quit := make(chan struct{})
+			var readers sync.WaitGroup
+			for _, s := range []*StreamTransport{s1, s2} {
+				readers.Add(1)
+				go func(s *StreamTransport) {
+					defer readers.Done()
+					for {
+						select {
+						case <-quit:
+							return
+						default:
+						}
+						s.Stats()
+						s.ConnectionState()
+						s.SendData([]byte("early"))
+						time.Sleep(time.Millisecond)
+					}
+				}(s)
+			}
+			lsdp, _ := s1.EncodeSession()
+			rsdp, _ := s2.EncodeSession()
+			go s2.StartNegotiation(lsdp)
+			go s1.StartNegotiation(rsdp)
+			for _, cb := range []*icecb{cb1, cb2} {
+				select {
+				case <-time.After(20 * time.Second):
+					err = fmt.Errorf("%s negotiation timeout", cb.name)
+				case result := <-cb.iceresult:
+					if result != nil && err == nil {
+						err = result
+					}
+				}
+			}
+			for j := 0; j < 10; j++ {
+				s1.SendData([]byte("hello"))
+			}
+			var stops sync.WaitGroup
+			for j := 0; j < 4; j++ {
+				stops.Add(1)
+				go func(s *StreamTransport) {
+					defer stops.Done()
+					s.Stop()
+				}([]*StreamTransport{s1, s2}[j%2])
+			}
+			stops.Wait()
+			close(quit)
+			readers.Wait()
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+/*
+check 正在进行的时候 Stop, loop 退出以后不会再有回调, 再次 Stop 不会阻塞.
+*/
+func TestIceStreamTransport_StopDuringChecks(t *testing.T) {
+	cfgs := newLANConfigs(t, 1)
+	s1, err := NewIceStreamTransport(cfgs[0], "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb1 := &eventcb{icecb: newicecb("s1")}
+	s1.cb = cb1
+	if err = s1.InitIce(SessionRoleControlling); err != nil {
+		t.Fatal(err)
+	}
+	//对方不存在, check 一直在重传
+	peer := "v=0\r\no=- 1 1 IN IP4 10.1.9.9\r\ns=-\r\nt=0 0\r\nm=audio 5000 RTP/AVP 0\r\nc=IN IP4 10.1.9.9\r\n" +
+		"a=ice-ufrag:abcd\r\na=ice-pwd:abcdefghijklmnopqrstuvwx\r\na=candidate:1 1 UDP 2130706431 10.1.9.9 5000 typ host\r\n"
+	if err = s1.StartNegotiation(peer); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	s := s1.getSession()
+	s1.Stop()
+	cb1.lock.Lock()
+	n := len(cb1.events)
+	cb1.lock.Unlock()
+	s1.Stop()
+	if err = s.run(func() {}); err != errSessionStopped {
+		t.Errorf("loop should exit after stop, got %v", err)
+	}
+	if err = s1.StartNegotiation(peer); err == nil {
+		t.Error("should not negotiate after stop")
+	}
+	if st := s1.Stats(); len(st.Pairs) == 0 {
+		t.Error("stats should be available after stop")
+	}
+	time.Sleep(300 * time.Millisecond)
+	cb1.lock.Lock()
+	defer cb1.lock.Unlock()
+	if len(cb1.events) != n {
+		t.Errorf("no events after stop, got %v", cb1.events[n:])
+	}
+	select {
+	case err = <-cb1.iceresult:
+		t.Errorf("ice should not complete after stop, got %v", err)
+	default:
+	}
+}
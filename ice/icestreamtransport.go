@@ -1,16 +1,18 @@
 package ice
 
 import (
-	"bytes"
 	"fmt"
 	"net"
 
-	"strings"
+	"sync"
 
 	"errors"
 
+	"time"
+
+	"github.com/nkbai/goice/clock"
+	"github.com/nkbai/goice/mdns"
 	"github.com/nkbai/log"
-	"github.com/nkbai/goice/sdp"
 )
 
 //StreamTransportCallbacker callback of ICE
@@ -19,6 +21,7 @@ type StreamTransportCallbacker interface {
 			OnReceiveData will be called when the ICE transport receives
 		     * incoming packet from the sockets which is not related to ICE
 		     * (for example, normal RTP/RTCP packet destined for application).
+		     * It is called from the socket goroutines, maybe concurrently, and must not block.
 	*/
 	OnReceiveData(data []byte, from net.Addr)
 	/*
@@ -37,6 +40,172 @@ type TransportConfig struct {
 	TurnUserName    string
 	TurnPassword    string
 	ComponentNumber int //must be 1,right now
+	/*
+		StunServers and TurnServers 会和 StunSever,TurnSever 合并,
+		所有服务器并行收集 candidate, 部分服务器失败不影响创建.
+	*/
+	StunServers []string
+	TurnServers []TurnServer
+	/*
+		GatherTimeout 每个服务器收集 candidate 的超时时间,缺省为10秒, 大于 0 时覆盖 Timing.GatherTimeout
+	*/
+	GatherTimeout time.Duration
+	/*
+		Nomination 作为 controlling 时使用的 nominate 方式,缺省为 aggressive
+	*/
+	Nomination NominationMode
+	/*
+		PairSelector regular nomination 时选择 pair 的策略,缺省为优先级最高的
+	*/
+	PairSelector PairSelector
+	/*
+		EnableTCP 同时收集 RFC 6544 的 tcp candidate, 用于 udp 被完全屏蔽的网络.
+	*/
+	EnableTCP bool
+	/*
+		Lite 作为 ICE-lite agent, 用于有公网地址的服务器.
+		只使用 host candidate, 总是 controlled, 不主动发送 check,
+		使用对方 nominate 的 pair.
+	*/
+	Lite bool
+	/*
+		ConsentInterval 协商成功以后在选定的 pair 上发送 consent 请求(RFC 7675)的间隔, 缺省5秒,
+		小于0表示关闭 consent, 只发送 keepalive.
+		ConsentTimeout 超过这么长时间没有收到 consent 就认为连接断开了,缺省30秒.
+	*/
+	ConsentInterval time.Duration
+	ConsentTimeout  time.Duration
+	/*
+		GatherFilter 限制使用哪些网卡,地址以及端口作为 host candidate, nil 表示所有非 loopback 网卡.
+	*/
+	GatherFilter *GatherFilter
+	/*
+		NAT1To1IPs 云主机的公网地址不在任何网卡上,直接指定公网地址就不需要 stun 了.
+		格式为 "public" 或者 "public/local", 只能有一个不指定 local 的地址, 它用于所有其他的本地地址.
+		NAT1To1CandidateType 为 CandidateHost(缺省) 时替换 host candidate 的地址,
+		为 CandidateServerReflexive 时作为 srflx candidate 添加, base 都是本地地址.
+	*/
+	NAT1To1IPs           []string
+	NAT1To1CandidateType CandidateType
+	/*
+		UDPMux 不为 nil 时所有 udp host candidate 都使用它的端口, 不再单独监听,
+		stun 和 turn 服务器被忽略. UDPMux 可以被很多 StreamTransport 共用.
+	*/
+	UDPMux *UDPMux
+	/*
+		NetworkCosts 本地地址的 network-cost, key 为 CIDR, 比如把蜂窝网络的地址设置为 900,
+		会在 sdp 中通告给对方, 配合 SelectLowestNetworkCost 可以避免使用计费的链路.
+	*/
+	NetworkCosts map[string]int
+	/*
+		NetworkMonitorInterval 大于0时按照这个间隔检查本地地址的变化(Linux 上同时监听 rtnetlink),
+		选定 pair 的本地地址消失或者出现了新地址时, 自动重新收集 candidate 并 restart ICE,
+		回调 NetworkChangeCallbacker.OnNetworkChanged, 应用需要把新的 sdp 发给对方. 0 表示不检查.
+	*/
+	NetworkMonitorInterval time.Duration
+	/*
+		Net 不为 nil 时使用它代替真实的 socket 和网卡地址, 比如 vnet 的虚拟网络,
+		用于在一个进程中确定性地测试各种 NAT 组合. 只支持 udp, EnableTCP 被忽略.
+	*/
+	Net Net
+	/*
+		CheckInterval 即 RFC 8445 的 Ta, 每隔这么长时间开始一个新的 check, 缺省 50ms.
+		MaxCheckListSize checklist 中最多有多少个 pair, 多出来的优先级低的被丢弃, 缺省 100.
+	*/
+	CheckInterval    time.Duration
+	MaxCheckListSize int
+	/*
+		MDNSHostCandidates 在 sdp 中用随机的 <uuid>.local 代替 host candidate 的内网地址,
+		由内置的 mDNS responder 应答, 其他 candidate 的 raddr 为 0.0.0.0.
+		无论是否设置, 对方的 .local 和域名 candidate 都会在配对之前解析.
+	*/
+	MDNSHostCandidates bool
+	/*
+		Clock 所有的定时器(check 重传, nomination 等待, consent, turn 的 keepalive 和 refresh)以及时间戳都从这里获取,
+		nil 表示系统时钟, 测试中可以使用 clock.NewFake 在瞬间完成超时.
+	*/
+	Clock clock.Clock
+	/*
+		BatchIO 在 linux 上用 recvmmsg/sendmmsg 批量收发 udp 包, 内核支持的时候用 GSO 合并发往同一地址的包,
+		其他平台以及 tcp candidate 忽略它. 批量接收时不小于 16KB 的包会被丢弃.
+	*/
+	BatchIO bool
+	/*
+		Timing check, 重传, nomination 等待, consent 以及 turn keepalive/refresh 的时间参数,
+		可以从 TimingPreset 获取, 为 0 的字段使用缺省值.
+		上面的 CheckInterval, ConsentInterval 和 ConsentTimeout 不为 0 时优先使用.
+	*/
+	Timing Timing
+	/*
+		PacketConns 应用已经打开的 udp socket, 比如同时用于 DTLS 的, 每一个作为一个 host candidate,
+		它们属于应用: 协商期间由 ICE 读取, Stop 以后不再读取, 但是不会关闭.
+		BindAddrs 每个网卡上监听的 "ip:port", 由 ICE 打开, Stop 时关闭.
+		设置以后 host candidate 只使用这些地址, 不再枚举网卡, 不能和 UDPMux 一起使用, NetworkMonitorInterval 被忽略.
+		地址必须是具体的 ipv4 地址和端口. stun/turn 服务器也通过它们连接, 每个地址最多用于一个服务器.
+	*/
+	PacketConns []net.PacketConn
+	BindAddrs   []string
+}
+
+/*
+cfg 为 nil 或者没有设置 Clock 时使用系统时钟.
+*/
+func (cfg *TransportConfig) clock() clock.Clock {
+	if cfg == nil {
+		return clock.New()
+	}
+	return clock.OrNew(cfg.Clock)
+}
+
+func (cfg *TransportConfig) sockOptions() serverSockOptions {
+	opts := serverSockOptions{
+		clock:              cfg.clock(),
+		transactionTimeout: cfg.timing().withDefaults().TransactionTimeout,
+	}
+	if cfg != nil {
+		opts.batchIO = cfg.BatchIO
+	}
+	return opts
+}
+
+/*
+合并 Timing 和单独设置的 CheckInterval, ConsentInterval, ConsentTimeout, GatherTimeout, 为 0 的字段没有填充缺省值.
+*/
+func (cfg *TransportConfig) timing() Timing {
+	if cfg == nil {
+		return Timing{}
+	}
+	t := cfg.Timing
+	if cfg.CheckInterval > 0 {
+		t.CheckInterval = cfg.CheckInterval
+	}
+	if cfg.ConsentInterval != 0 {
+		t.ConsentInterval = cfg.ConsentInterval
+	}
+	if cfg.ConsentTimeout > 0 {
+		t.ConsentTimeout = cfg.ConsentTimeout
+	}
+	if cfg.GatherTimeout > 0 {
+		t.GatherTimeout = cfg.GatherTimeout
+	}
+	return t
+}
+
+/*
+candidate 的 network-cost 由发送数据的本地地址决定.
+*/
+func (cfg *TransportConfig) networkCost(c *Candidate) int {
+	if len(cfg.NetworkCosts) == 0 {
+		return 0
+	}
+	ip := addrToUDPAddr(c.sendAddr()).IP
+	cost := 0
+	for cidr, v := range cfg.NetworkCosts {
+		if cidrsContain([]string{cidr}, ip) && v > cost {
+			cost = v
+		}
+	}
+	return cost
 }
 
 //StreamTransport is a transport
@@ -44,11 +213,20 @@ type StreamTransport struct {
 	Name        string //debug info
 	cfg         *TransportConfig
 	transporter stunTranporter
+	gatherer    *hostGatherer
 	component   *transportComponent
 	State       transportState
 	session     *session
 	cb          StreamTransportCallbacker
 	log         log.Logger
+
+	connectionState ConnectionState
+	conn            *Conn
+	watcher         *networkWatcher
+	lock            sync.Mutex
+	restartLock     sync.Mutex //Restart 不能同时进行, Stop 等待正在进行的 Restart 结束
+	mdns            *mdns.Conn
+	mdnsNames       map[string]string //host candidate 的 ip 对应的名字
 }
 
 type sessionDescription struct {
@@ -58,6 +236,7 @@ type sessionDescription struct {
 	defaultIP       string
 	candidates      []*Candidate
 	defautCandidate *Candidate
+	lite            bool //a=ice-lite
 }
 type transportComponent struct {
 	Name             string
@@ -65,6 +244,28 @@ type transportComponent struct {
 	candidates       []*Candidate
 	defaultCandidate *Candidate
 	candidateGetter  candidateGetter
+	enableTCP        bool
+	/*
+		tcpListeners 收集时已经监听的 passive tcp candidate, 由 session 在 StartServer 中取走,
+		没有被取走的在重新收集或者 Stop 时关闭.
+	*/
+	lock         sync.Mutex
+	tcpListeners map[string]net.Listener
+}
+
+/*
+把单个服务器的配置和服务器列表合并到一起.
+*/
+func (cfg *TransportConfig) servers() (stunServers []string, turnServers []TurnServer) {
+	if len(cfg.TurnSever) > 0 {
+		turnServers = append(turnServers, TurnServer{cfg.TurnSever, cfg.TurnUserName, cfg.TurnPassword})
+	}
+	turnServers = append(turnServers, cfg.TurnServers...)
+	if len(cfg.StunSever) > 0 {
+		stunServers = append(stunServers, cfg.StunSever)
+	}
+	stunServers = append(stunServers, cfg.StunServers...)
+	return
 }
 
 //NewTransportConfigHostonly return a  hostonly config
@@ -82,6 +283,15 @@ func NewTransportConfigWithStun(stunServer string) *TransportConfig {
 	}
 }
 
+//NewTransportConfigWithServers return a config which gathers from all stun and turn servers
+func NewTransportConfigWithServers(stunServers []string, turnServers []TurnServer) *TransportConfig {
+	return &TransportConfig{
+		StunServers:     stunServers,
+		TurnServers:     turnServers,
+		ComponentNumber: 1,
+	}
+}
+
 //NewTransportConfigWithTurn return a turn config
 func NewTransportConfigWithTurn(turnServer, turnUser, turnPass string) *TransportConfig {
 	return &TransportConfig{
@@ -115,6 +325,10 @@ const (
 	/*TransportStateStopped ICE negotiation has completed with failure.
 	 */
 	TransportStateStopped
+	/*TransportStateDisconnected means consent of the selected pair is lost after negotiation success,
+	data can't be sent any more.
+	*/
+	TransportStateDisconnected
 )
 
 func (s transportState) String() string {
@@ -131,6 +345,8 @@ func (s transportState) String() string {
 		return "Negotiation Failed"
 	case TransportStateStopped:
 		return "stopped"
+	case TransportStateDisconnected:
+		return "disconnected"
 	}
 	return "unkown"
 }
@@ -138,48 +354,203 @@ func (s transportState) String() string {
 //NewIceStreamTransport create streamTransport from configuration
 //name is for debug
 func NewIceStreamTransport(cfg *TransportConfig, name string) (it *StreamTransport, err error) {
+	return NewIceStreamTransportWithCallback(cfg, name, nil)
+}
+
+/*
+NewIceStreamTransportWithCallback create streamTransport with callback,
+if cb implements EventCallbacker, it receives gathering events too.
+*/
+func NewIceStreamTransportWithCallback(cfg *TransportConfig, name string, cb StreamTransportCallbacker) (it *StreamTransport, err error) {
 	it = &StreamTransport{
 		cfg:   cfg,
 		State: TransportStateReady,
 		Name:  name,
+		cb:    cb,
 		log:   log.New("name", fmt.Sprintf("%s-StreamTransport", name)),
 	}
-	if len(it.cfg.StunSever) > 0 {
-		it.transporter, err = newStunSocket(it.cfg.StunSever)
-	} else if len(it.cfg.TurnSever) > 0 {
-		it.transporter, err = newTurnSock(it.cfg.TurnSever, cfg.TurnUserName, cfg.TurnPassword)
-	} else {
-		it.transporter = new(HostOnlySock)
+	if err = cfg.timing().Validate(); err != nil {
+		return
+	}
+	it.gatherer, err = newHostGatherer(cfg)
+	if err != nil {
+		return
+	}
+	for cidr := range cfg.NetworkCosts {
+		if _, _, err = net.ParseCIDR(cidr); err != nil {
+			return
+		}
 	}
+	err = it.gather()
 	if err != nil {
 		return
 	}
-	it.component = newTransportComponent(it.transporter, 1)
-	_, err = it.component.GetCandidates()
+	if cfg.NetworkMonitorInterval > 0 {
+		if cfg.UDPMux != nil {
+			it.log.Warn(fmt.Sprintf("udp mux addresses are fixed, network monitor is ignored"))
+		} else if it.gatherer.hasHostAddrs() {
+			it.log.Warn(fmt.Sprintf("host addresses are fixed, network monitor is ignored"))
+		} else {
+			it.watcher = newNetworkWatcher(it, it.gatherer.gather)
+			it.watcher.start(cfg.NetworkMonitorInterval)
+		}
+	}
+	return
+}
+
+/*
+收集 candidate, ICE restart 的时候需要重新收集.
+*/
+func (t *StreamTransport) gather() (err error) {
+	cfg := t.cfg
+	stunServers, turnServers := cfg.servers()
+	if cfg.Lite && (len(stunServers) > 0 || len(turnServers) > 0) {
+		t.log.Warn(fmt.Sprintf("ice-lite only uses host candidates, stun and turn servers are ignored"))
+		stunServers, turnServers = nil, nil
+	}
+	if cfg.UDPMux != nil && (len(stunServers) > 0 || len(turnServers) > 0) {
+		t.log.Warn(fmt.Sprintf("udp mux only uses host candidates, stun and turn servers are ignored"))
+		stunServers, turnServers = nil, nil
+	}
+	/*
+		restart 之前的 transporter 如果没有被 session 关闭(没有调用过 InitIce), 先关闭它连接 stun/turn 服务器的 socket,
+		这样新的 transporter 可以使用同样的地址.
+	*/
+	if oldComponent, old := t.getGathered(); old != nil {
+		old.Close()
+		oldComponent.closeTCPListeners()
+	}
+	var transporter stunTranporter
+	if cfg.UDPMux != nil {
+		transporter = &muxSock{mux: cfg.UDPMux, gatherer: t.gatherer}
+	} else if len(stunServers) > 0 || len(turnServers) > 0 {
+		transporter = newMultiSock(stunServers, turnServers, cfg.timing().withDefaults().GatherTimeout, t.gatherer)
+	} else {
+		transporter = &HostOnlySock{gatherer: t.gatherer}
+	}
+	component := newTransportComponent(transporter, 1)
+	component.enableTCP = cfg.EnableTCP
+	if cfg.EnableTCP && cfg.Net != nil {
+		t.log.Warn(fmt.Sprintf("tcp is not supported on Net, tcp candidates are ignored"))
+		component.enableTCP = false
+	}
+	t.emit(&Event{Type: EventGatheringStarted})
+	defer func() {
+		if err != nil {
+			transporter.Close()
+			component.closeTCPListeners()
+			t.emit(&Event{Type: EventGatheringComplete, Err: err})
+		}
+	}()
+	_, err = component.GetCandidates()
 	if err != nil {
 		return
 	}
-	it.log.Trace(fmt.Sprintf("candidates=%#v", it.component.candidates))
+	for _, c := range component.candidates {
+		c.NetworkCost = cfg.networkCost(c)
+		t.emit(&Event{Type: EventCandidateGathered, Candidate: c})
+	}
+	if cfg.MDNSHostCandidates {
+		if err = t.publishHostCandidates(component.candidates); err != nil {
+			return
+		}
+	}
+	//其他协程(EncodeSession, Stats, network watcher 等)可能正在读取, 在锁中一起替换.
+	t.lock.Lock()
+	t.transporter, t.component = transporter, component
+	t.lock.Unlock()
+	t.emit(&Event{Type: EventGatheringComplete})
+	t.log.Trace(fmt.Sprintf("candidates=%#v", component.candidates))
 	return
 }
 
+/*
+最近一次收集的结果, transporter 和 component 总是一起替换.
+*/
+func (t *StreamTransport) getGathered() (*transportComponent, stunTranporter) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.component, t.transporter
+}
+
+/*
+session 的 passive tcp candidate 使用收集时已经监听的 socket, 见 getTCPCandidates.
+*/
+func (t *StreamTransport) takeTCPListener(addr string) net.Listener {
+	component, _ := t.getGathered()
+	if component == nil {
+		return nil
+	}
+	return component.takeTCPListener(addr)
+}
+
 //InitIce set role of this transport
 func (t *StreamTransport) InitIce(role SessionRole) error {
-	s := newIceSession(t.Name, role, t.component.candidates, t.transporter, t)
-	t.session = s
+	if t.cfg.Lite && role != SessionRoleControlled {
+		t.log.Warn(fmt.Sprintf("ice-lite agent is always controlled"))
+		role = SessionRoleControlled
+	}
+	component, transporter := t.getGathered()
+	s := newIceSession(t.Name, role, component.candidates, transporter, t)
 	for i, c := range s.localCandidates {
-		t.log.Trace(fmt.Sprintf("%s Candidate %d added componentID=%d type=%s foundation=%d,addr=%s,base=%s,priority=%d",
+		t.log.Trace(fmt.Sprintf("%s Candidate %d added componentID=%d type=%s foundation=%s,addr=%s,base=%s,priority=%d",
 			t.Name, i, c.ComponentID, c.Type, c.Foundation, c.addr, c.baseAddr, c.Priority,
 		))
 	}
-	err := t.session.StartServer()
+	err := s.StartServer()
 	if err != nil {
 		return err
 	}
+	t.lock.Lock()
+	if t.State == TransportStateStopped {
+		//Stop 和 Restart 同时进行
+		t.lock.Unlock()
+		s.Stop()
+		return errTransportClosed
+	}
+	t.session = s
 	t.State = TransportStateSessionReady
+	t.lock.Unlock()
 	return nil
 }
 
+func (t *StreamTransport) getSession() *session {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.session
+}
+
+/*
+只有 running 的时候返回 session, state 和 session 在同一个锁中读取, restart 不会在中间把 session 置为 nil.
+*/
+func (t *StreamTransport) getRunningSession() *session {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.State != TransportStateRunning {
+		return nil
+	}
+	return t.session
+}
+
+func (t *StreamTransport) getState() transportState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.State
+}
+
+/*
+changeState 只有当前状态是 from 的时候才切换到 to, 返回是否切换了.
+*/
+func (t *StreamTransport) changeState(from, to transportState) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.State != from {
+		return false
+	}
+	t.State = to
+	return true
+}
+
 //SetCallBack set the callback
 // TODO should move set to NewIceStreamTransport
 func (t *StreamTransport) SetCallBack(cb StreamTransportCallbacker) {
@@ -193,162 +564,203 @@ func (t *StreamTransport) StartNegotiation(remoteSDP string) (err error) {
 			t.log.Error(fmt.Sprintf("StartNegotiation with remotesdp err =%s", err))
 		}
 	}()
-	if t.session == nil || t.State != TransportStateSessionReady {
+	s := t.getSession()
+	if s == nil || !t.changeState(TransportStateSessionReady, TransportStateNegotiation) {
 		err = errors.New("no session")
 		return
 	}
 	t.log.Trace(fmt.Sprintf("%s received sdp \n%s\n", t.Name, remoteSDP))
-	t.State = TransportStateNegotiation
 	sd, err := decodeSession(remoteSDP)
 	if err != nil {
 		return
 	}
-	err = t.session.createCheckList(sd)
-	if err != nil {
+	//.local 和域名的 candidate 在 check 开始以后才解析, 见 resolveCandidates
+	named := splitHostnameCandidates(sd)
+	t.changeConnectionState(ConnectionStateChecking, nil)
+	/*
+		session 的状态只能在它的 loop 中修改.
+	*/
+	if t.cfg.Lite {
+		if err2 := s.run(func() { err = s.startLite(sd) }); err2 != nil {
+			return err2
+		}
+		if err == nil {
+			t.resolveCandidates(s, named)
+		}
 		return
 	}
-	t.log.Trace(fmt.Sprintf("checklist created\n%s", t.session.checkList))
-	err = t.session.createTurnPermissionIfNeeded()
+	var remoteCandidates []*Candidate
+	err2 := s.run(func() {
+		/*
+			对方是 lite, 那么我必须是 controlling
+		*/
+		if sd.lite && s.role != SessionRoleControlling {
+			t.log.Info(fmt.Sprintf("remote is ice-lite, change role to controlling"))
+			s.changeRole(SessionRoleControlling)
+		}
+		s.pendingResolves = len(named)
+		err = s.createCheckList(sd)
+		if err != nil {
+			return
+		}
+		t.log.Trace(fmt.Sprintf("checklist created\n%s", s.checkList))
+		remoteCandidates = append(remoteCandidates, s.remoteCandidates...)
+	})
+	if err2 != nil {
+		return err2
+	}
 	if err != nil {
 		return
 	}
-	t.log.Trace(fmt.Sprintf("create permission success for all remote address"))
-
-	err = t.session.startCheck()
+	//需要等待 turn server 的应答, 不能在 loop 中进行
+	err = s.createTurnPermissionIfNeeded(remoteCandidates)
 	if err != nil {
 		return
 	}
-	return nil
+	t.log.Trace(fmt.Sprintf("create permission success for all remote address"))
+	if err2 = s.run(func() { err = s.startCheck() }); err2 != nil {
+		return err2
+	}
+	if err == nil {
+		t.resolveCandidates(s, named)
+	}
+	return
 }
 
 //EncodeSession encoding ice info to sdp
 func (t *StreamTransport) EncodeSession() (s string, err error) {
-	if t.session == nil {
-		err = fmt.Errorf("no session and state =%d", t.State)
+	session := t.getSession()
+	if session == nil {
+		err = fmt.Errorf("no session and state =%d", t.getState())
 		return
 	}
-	buf := new(bytes.Buffer)
-	fmt.Fprintf(buf, "v=0\no=- 3414953978 3414953978 IN IP4 localhost\ns=ice\nt=0 0\n")
-	fmt.Fprintf(buf, "a=ice-ufrag:%s\na=ice-pwd:%s\n", t.session.rxUserFrag, t.session.rxPassword)
-	//only on component now....
-	uaddr := addrToUDPAddr(t.component.defaultCandidate.addr)
-	fmt.Fprintf(buf, "m=audio %d RTP/AVP 0\nc=IN IP4 %s\n", uaddr.Port, uaddr.IP.String())
-	for _, c := range t.component.candidates {
-		fmt.Fprintf(buf, "%s\n", c)
+	var options []string
+	if t.cfg.Nomination == NominationRegular {
+		options = append(options, sdpIceOptionIce2)
 	}
-	return string(buf.Bytes()), nil
+	component, _ := t.getGathered()
+	def, candidates := component.defaultCandidate, component.candidates
+	if t.cfg.MDNSHostCandidates {
+		candidates = nil
+		for _, c := range component.candidates {
+			candidates = append(candidates, t.obfuscate(c))
+		}
+		if def.Type == CandidateHost {
+			//和浏览器一样, 缺省地址不能泄露内网地址
+			def = &Candidate{addr: "0.0.0.0:9"}
+		}
+	}
+	//only on component now....
+	s = encodeSession(session.rxUserFrag, session.rxPassword, t.cfg.Lite, options,
+		def, candidates, int(session.tieBreaker>>33))
+	return
 }
 
-//Stop destroy this transport, and cannot be reused
+/*
+Stop destroy this transport, and cannot be reused.
+It can be called more than once, and returns after all goroutines of ICE exit,
+so it must not be called from callbacks.
+*/
 func (t *StreamTransport) Stop() {
+	t.lock.Lock()
 	if t.State == TransportStateStopped {
-		t.log.Error(fmt.Sprintf("%s has already stopped", t.Name))
+		t.lock.Unlock()
+		t.log.Debug(fmt.Sprintf("%s has already stopped", t.Name))
 		return
 	}
-	t.State = TransportStateFailed
-	if t.session != nil {
-		t.session.Stop()
+	t.State = TransportStateStopped
+	t.lock.Unlock()
+	//先停止 watcher, 它可能正在 restart, 创建新的 session
+	if t.watcher != nil {
+		t.watcher.stop()
+	}
+	//正在进行的 Restart 看到 TransportStateStopped 以后会尽快返回, 等它结束以后再清理它创建的 session 和 socket
+	t.restartLock.Lock()
+	defer t.restartLock.Unlock()
+	if s := t.getSession(); s != nil {
+		s.Stop()
+	}
+	//没有调用过 InitIce 的时候, 连接 stun/turn 服务器的 socket 还没有关闭
+	if component, transporter := t.getGathered(); transporter != nil {
+		transporter.Close()
+		component.closeTCPListeners()
+	}
+	if c := t.getConn(); c != nil {
+		c.closeWithError(errConnClosed)
 	}
+	t.closeMDNS()
+	t.changeConnectionState(ConnectionStateClosed, nil)
 }
 
 //SendData send data to peer, peer's ip and port are select by ice
 func (t *StreamTransport) SendData(data []byte) error {
-	if t.State != TransportStateRunning {
+	s := t.getRunningSession()
+	if s == nil {
 		return errors.New("transport not running")
 	}
-	return t.session.SendData(data)
+	return s.SendData(data)
 }
 
 /*
-保证只会被调用一次,表示已经找到了至少一个有效连接,可以发送数据了,
+表示已经找到了至少一个有效连接,可以发送数据了,
 但是这个连接未必是最后确定的,可能会发生变化.
+只有第一次调用会通知上层, 之后的调用(比如已经 Stop 了)被忽略.
 */
 func (t *StreamTransport) onIceComplete(result error) {
-
-	if t.State != TransportStateNegotiation {
-		t.log.Error(fmt.Sprintf("%s finish reulst %s,t.State=%d", t.Name, result, t.State))
-		panic(fmt.Sprintf("%s only finish once", t.Name))
+	newState := TransportStateRunning
+	if result != nil {
+		newState = TransportStateFailed
+	}
+	if !t.changeState(TransportStateNegotiation, newState) {
+		t.log.Info(fmt.Sprintf("%s finish reulst %s ignored,state=%s", t.Name, result, t.getState()))
+		return
 	}
 	defer func() {
 		if t.cb != nil {
 			t.cb.OnIceComplete(result)
 		}
-		t.log.Debug(fmt.Sprintf("%s ice negotiation finished ,new state is %s", t.Name, t.State.String()))
+		t.log.Debug(fmt.Sprintf("%s ice negotiation finished ,new state is %s", t.Name, newState))
 	}()
 	if result != nil {
 		t.log.Info(fmt.Sprintf("%s ice negotiation failed", t.Name))
-		t.State = TransportStateFailed
+		if c := t.getConn(); c != nil {
+			c.closeWithError(result)
+		}
+		t.changeConnectionState(ConnectionStateFailed, result)
 		return
 	}
-	t.State = TransportStateRunning
+	t.changeConnectionState(ConnectionStateConnected, nil)
 }
 
 /*
-收到数据,并不表示协商已经完毕,而是对方找到了一条有效连接.
+consent 丢失, 不再允许发送数据.
 */
-func (t *StreamTransport) onRxData(data []byte, from string) {
-	if t.cb != nil {
-		t.cb.OnReceiveData(data, addrToUDPAddr(from))
-	}
-}
-func decodeSession(str string) (session *sessionDescription, err error) {
-	var s sdp.Session
-	s, err = sdp.DecodeSession([]byte(str), s)
-	if err != nil {
+func (t *StreamTransport) onDisconnected(err error) {
+	if !t.changeState(TransportStateRunning, TransportStateDisconnected) {
 		return
 	}
-	session = &sessionDescription{}
-	for _, line := range s {
-		v := string(line.Value)
-		//log.Trace(v)
-		switch line.Type {
-		case sdp.TypeAttribute:
-			ss := strings.Split(v, ":")
-			if len(ss) != 2 {
-				err = fmt.Errorf("attribute error :%s", v)
-				return
-			}
-			switch ss[0] {
-			case "ice-ufrag":
-				session.user = ss[1]
-			case "ice-pwd":
-				session.password = ss[1]
-			case "candidate":
-				parser := candidateParser{
-					buf: line.Value,
-					c:   new(Candidate),
-				}
-				err = parser.parse()
-				if err != nil {
-					return
-				}
-				session.candidates = append(session.candidates, parser.c)
-			}
-		case sdp.TypeMediaDescription:
-			fmt.Sscanf(v, "audio %d RTP/", &session.defaultPort)
-		case sdp.TypeConnectionData:
-			fmt.Sscanf(v, "IN IP4 %s", &session.defaultIP)
-		}
+	t.log.Info(fmt.Sprintf("%s disconnected %s", t.Name, err))
+	if c := t.getConn(); c != nil {
+		c.closeWithError(err)
 	}
-	if len(session.user) <= 0 || len(session.password) == 0 ||
-		len(session.defaultIP) == 0 ||
-		len(session.candidates) == 0 {
-		err = fmt.Errorf("remote session description error %s", str)
-		return
+	t.changeConnectionState(ConnectionStateDisconnected, err)
+	if cb, ok := t.cb.(DisconnectCallbacker); ok {
+		cb.OnDisconnected(err)
 	}
-	s2 := fmt.Sprintf("%s:%d", session.defaultIP, session.defaultPort)
-	for _, c := range session.candidates {
-		if c.addr == s2 {
-			session.defautCandidate = c
-			break
-		}
+}
+
+/*
+收到数据,并不表示协商已经完毕,而是对方找到了一条有效连接.
+*/
+func (t *StreamTransport) onRxData(data []byte, from string) {
+	if c := t.getConn(); c != nil {
+		c.deliver(data, addrToUDPAddr(from))
+		return
 	}
-	if session.defautCandidate == nil {
-		err = fmt.Errorf("no default candidate found %s", s2)
+	if t.cb != nil {
+		t.cb.OnReceiveData(data, addrToUDPAddr(from))
 	}
-	return
 }
-
 func newTransportComponent(candidateGetter candidateGetter, id int) *transportComponent {
 	return &transportComponent{
 		candidateGetter: candidateGetter,
@@ -366,7 +778,40 @@ func (t *transportComponent) GetCandidates() (candidates []*Candidate, err error
 		c.Priority = calcCandidatePriority(c.Type, defaultPreference, c.ComponentID)
 		c.transport = TransportUDP
 	}
-	t.candidates = candidates
 	t.defaultCandidate = candidates[len(candidates)-1]
+	if t.enableTCP {
+		var tcpCandidates []*Candidate
+		var listeners map[string]net.Listener
+		tcpCandidates, listeners, err = getTCPCandidates(candidates)
+		if err != nil {
+			return
+		}
+		t.lock.Lock()
+		t.tcpListeners = listeners
+		t.lock.Unlock()
+		for _, c := range tcpCandidates {
+			c.ComponentID = t.componentID
+			c.Priority = calcCandidatePriority(c.Type, calcTCPLocalPreference(c.Type, c.TCPType), c.ComponentID)
+		}
+		candidates = append(candidates, tcpCandidates...)
+	}
+	t.candidates = candidates
 	return
 }
+
+/*
+取走 addr 上已经监听的 listener, 没有的时候返回 nil.
+*/
+func (t *transportComponent) takeTCPListener(addr string) net.Listener {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	l := t.tcpListeners[addr]
+	delete(t.tcpListeners, addr)
+	return l
+}
+
+func (t *transportComponent) closeTCPListeners() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	closeTCPListeners(t.tcpListeners)
+}
@@ -14,6 +14,7 @@ import (
 	"os"
 
 	"github.com/nkbai/goice/utils"
+	"github.com/nkbai/goice/vnet"
 	"github.com/nkbai/log"
 )
 
@@ -24,9 +25,10 @@ const (
 )
 
 type icecb struct {
-	data      chan []byte
-	iceresult chan error
-	name      string
+	data         chan []byte
+	iceresult    chan error
+	disconnected chan error
+	name         string
 }
 
 func init() {
@@ -34,9 +36,10 @@ func init() {
 }
 func newicecb(name string) *icecb {
 	return &icecb{
-		name:      name,
-		data:      make(chan []byte, 1),
-		iceresult: make(chan error, 1),
+		name:         name,
+		data:         make(chan []byte, 1),
+		iceresult:    make(chan error, 1),
+		disconnected: make(chan error, 1),
 	}
 }
 func (c *icecb) OnReceiveData(data []byte, from net.Addr) {
@@ -50,21 +53,33 @@ func (c *icecb) OnIceComplete(result error) {
 	c.iceresult <- result
 	log.Trace(fmt.Sprintf("%s negotiation complete", c.name))
 }
-func setupTestIceStreamTransport(typ int) (s1, s2 *StreamTransport, err error) {
-	var cfg *TransportConfig
+
+func (c *icecb) OnDisconnected(err error) {
+	c.disconnected <- err
+}
+/*
+typHost 使用本机的网卡, typStun 和 typTurn 在 setupVNet 的两个内网中, 使用 vnetStunServer 上的 stun/turn server.
+*/
+func setupTestIceStreamTransport(tb testing.TB, typ int) (s1, s2 *StreamTransport, stop func(), err error) {
+	var cfgs []*TransportConfig
+	stop = func() {}
 	switch typ {
 	case typHost:
-		cfg = NewTransportConfigHostonly()
-	case typStun:
-		cfg = NewTransportConfigWithStun("182.254.155.208:3478")
-	case typTurn:
-		cfg = NewTransportConfigWithTurn("182.254.155.208:3478", "bai", "bai")
+		cfgs = []*TransportConfig{NewTransportConfigHostonly(), NewTransportConfigHostonly()}
+	case typStun, typTurn:
+		cfgs, stop = setupVNet(tb, vnetLAN{nat: vnet.NATPortRestricted}, vnetLAN{nat: vnet.NATPortRestricted})
+		if typ == typTurn {
+			for _, cfg := range cfgs {
+				cfg.StunServers = nil
+				cfg.TurnServers = []TurnServer{{vnetStunServer, vnetTurnUser, vnetTurnPassword}}
+			}
+		}
 	}
-	s1, err = NewIceStreamTransport(cfg, "s1")
+	s1, err = NewIceStreamTransport(cfgs[0], "s1")
 	if err != nil {
 		return
 	}
-	s2, err = NewIceStreamTransport(cfg, "s2")
+	s2, err = NewIceStreamTransport(cfgs[1], "s2")
 	log.Trace("-----------------------------------------")
 	return
 }
@@ -76,27 +91,33 @@ func TestNewIceStreamTransport(t *testing.T) {
 		return
 	}
 	t.Log("candidates host only:", utils.StringInterface(trans.component.candidates, 3))
-	cfg = NewTransportConfigWithStun("182.254.155.208:3478")
-	trans, err = NewIceStreamTransport(cfg, "stun")
-	if err != nil {
-		t.Error(err)
-		return
-	}
-	t.Log("candidates stun: ", utils.StringInterface(trans.component.candidates, 3))
-	cfg = NewTransportConfigWithTurn("182.254.155.208:3478", "bai", "bai")
-	trans, err = NewIceStreamTransport(cfg, "turn")
-	if err != nil {
-		t.Error(err)
-		return
-	}
-	t.Log("candidates turn:", utils.StringInterface(trans.component.candidates, 3))
-	trans.InitIce(SessionRoleControlling)
-	s, err := trans.EncodeSession()
-	if err != nil {
-		t.Error(err)
-		return
+	trans.Stop()
+	for _, typ := range []int{typStun, typTurn} {
+		s1, s2, stop, err := setupTestIceStreamTransport(t, typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := CandidateServerReflexive
+		if typ == typTurn {
+			want = CandidateRelay
+		}
+		found := false
+		for _, c := range s1.component.candidates {
+			found = found || c.Type == want
+		}
+		if !found {
+			t.Errorf("should have %s candidate, got %v", want, s1.component.candidates)
+		}
+		s1.InitIce(SessionRoleControlling)
+		s, err := s1.EncodeSession()
+		if err != nil {
+			t.Error(err)
+		}
+		t.Log(s)
+		s1.Stop()
+		s2.Stop()
+		stop()
 	}
-	t.Log(s)
 }
 
 func TestIceStreamDecodeSession(t *testing.T) {
@@ -125,11 +146,14 @@ a=candidate:Rb6fe9bd0 1 UDP 16777215 182.254.155.208 52628 typ relay
 }
 
 func TestIceStreamTransport_StartNegotiation(t *testing.T) {
-	s1, s2, err := setupTestIceStreamTransport(typHost)
+	s1, s2, stop, err := setupTestIceStreamTransport(t, typHost)
 	if err != nil {
 		t.Error(err)
 		return
 	}
+	defer stop()
+	defer s1.Stop()
+	defer s2.Stop()
 	cb1 := newicecb("s1")
 	cb2 := newicecb("s2")
 	s1.cb = cb1
@@ -246,11 +270,14 @@ func encodeSessionExclude(t *StreamTransport, excludes ...CandidateType) string
 	return string(buf.Bytes())
 }
 func TestIceStreamTransport_StartNegotiationOnlyRelay(t *testing.T) {
-	s1, s2, err := setupTestIceStreamTransport(typTurn)
+	s1, s2, stop, err := setupTestIceStreamTransport(t, typTurn)
 	if err != nil {
 		t.Error(err)
 		return
 	}
+	defer stop()
+	defer s1.Stop()
+	defer s2.Stop()
 	cb1 := newicecb("s1")
 	cb2 := newicecb("s2")
 	s1.cb = cb1
@@ -299,15 +326,22 @@ func TestIceStreamTransport_StartNegotiationOnlyRelay(t *testing.T) {
 		}
 	}
 	log.Info("s2 negotiation success")
-
+	if c := s1.session.getNominatedCheck(); c == nil || c.remoteCandidate.Type != CandidateRelay {
+		t.Fatalf("selected pair should be relayed, got %v", c)
+	}
+	//选定以后绑定 channel, 数据通过 channel data 中转
+	exchangeData(t, s1, s2, cb1, cb2)
 }
 
 func TestIceStreamTransport_StartNegotiationNoHost(t *testing.T) {
-	s1, s2, err := setupTestIceStreamTransport(typTurn)
+	s1, s2, stop, err := setupTestIceStreamTransport(t, typTurn)
 	if err != nil {
 		t.Error(err)
 		return
 	}
+	defer stop()
+	defer s1.Stop()
+	defer s2.Stop()
 	cb1 := newicecb("s1")
 	cb2 := newicecb("s2")
 	s1.cb = cb1
@@ -363,11 +397,14 @@ func TestIceStreamTransport_StartNegotiationNoHost(t *testing.T) {
 
 func BenchmarkIceStreamTransport_StartNegotiation(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		s1, s2, err := setupTestIceStreamTransport(typTurn)
+		s1, s2, stop, err := setupTestIceStreamTransport(b, typTurn)
 		if err != nil {
 			log.Error(err.Error())
 			return
 		}
+		defer stop()
+		defer s1.Stop()
+		defer s2.Stop()
 		cb1 := newicecb("s1")
 		cb2 := newicecb("s2")
 		s1.cb = cb1
@@ -425,11 +462,14 @@ func BenchmarkIceStreamTransport_StartNegotiation(b *testing.B) {
 func BenchmarkIceStreamTransport_StartNegotiationOnlyRelay(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 
-		s1, s2, err := setupTestIceStreamTransport(typTurn)
+		s1, s2, stop, err := setupTestIceStreamTransport(b, typTurn)
 		if err != nil {
 			log.Error(err.Error())
 			return
 		}
+		defer stop()
+		defer s1.Stop()
+		defer s2.Stop()
 		cb1 := newicecb("s1")
 		cb2 := newicecb("s2")
 		s1.cb = cb1
@@ -485,11 +525,14 @@ func BenchmarkIceStreamTransport_StartNegotiationOnlyRelay(b *testing.B) {
 func BenchmarkIceStreamTransport_StartNegotiationNoHost(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 
-		s1, s2, err := setupTestIceStreamTransport(typTurn)
+		s1, s2, stop, err := setupTestIceStreamTransport(b, typTurn)
 		if err != nil {
 			log.Error(err.Error())
 			return
 		}
+		defer stop()
+		defer s1.Stop()
+		defer s2.Stop()
 		cb1 := newicecb("s1")
 		cb2 := newicecb("s2")
 		s1.cb = cb1
@@ -555,3 +598,53 @@ func TestStunServerSock(t *testing.T) {
 		t.Error("not equal 2")
 	}
 }
+
+/*
+用 cfg 创建两个 transport 并完成协商, s1 是 controlling.
+*/
+func setupNegotiatedPair(t testing.TB, cfg1, cfg2 *TransportConfig) (s1, s2 *StreamTransport, cb1, cb2 *icecb) {
+	var err error
+	s1, err = NewIceStreamTransport(cfg1, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err = NewIceStreamTransport(cfg2, "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb1 = newicecb("s1")
+	cb2 = newicecb("s2")
+	s1.cb = cb1
+	s2.cb = cb2
+	if err = s1.InitIce(SessionRoleControlling); err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.InitIce(SessionRoleControlled); err != nil {
+		t.Fatal(err)
+	}
+	lsdp, err := s1.EncodeSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsdp, err := s2.EncodeSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.StartNegotiation(lsdp); err != nil {
+		t.Fatal(err)
+	}
+	if err = s1.StartNegotiation(rsdp); err != nil {
+		t.Fatal(err)
+	}
+	for _, cb := range []*icecb{cb1, cb2} {
+		select {
+		case <-time.After(20 * time.Second):
+			t.Fatalf("%s negotiation timeout", cb.name)
+		case err = <-cb.iceresult:
+			if err != nil {
+				t.Fatalf("%s negotiation failed %s", cb.name, err)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,100 @@
+package ice
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+ICE-lite, RFC 8445 Section 2.5
+lite agent 只有 host candidate, 总是 controlled, 自己不发送任何 check,
+只回应对方的 binding request, 并使用对方 nominate 的 pair.
+所以不需要 checklist, 也没有探测协程以及重传定时器.
+*/
+
+var errBothLite = errors.New("both agents are ice-lite")
+
+/*
+收到对方的 sdp 以后,lite agent 只需要知道对方的认证信息,
+在此之前收到的 check 都被忽略了, 等待对方重传即可.
+*/
+func (s *session) startLite(sd *sessionDescription) error {
+	if sd.lite {
+		return errBothLite
+	}
+	if len(sd.candidates) > maxCandidates {
+		return errTooManyCandidates
+	}
+	s.setRemoteDescription(sd)
+	return nil
+}
+
+/*
+lite agent 处理一个已经通过认证的 binding request,
+只有带 USE-CANDIDATE 的才有意义,
+如果对方 nominate 了多个 pair, 选择优先级最高的那个.
+*/
+func (s *session) handleLiteCheck(rcheck *rxCheck) {
+	if !rcheck.userCandidate {
+		return
+	}
+	var rcand *Candidate
+	lcand := s.findLocalCandidate(rcheck.localAddress)
+	if lcand == nil {
+		s.log.Warn(fmt.Sprintf("lite received check on unknown local address %s", rcheck.localAddress))
+		return
+	}
+	for _, c := range s.remoteCandidates {
+		if c.addr == rcheck.remoteAddress {
+			rcand = c
+			break
+		}
+	}
+	if rcand == nil {
+		if len(s.remoteCandidates) > maxCandidates {
+			s.log.Warn(fmt.Sprintf("unable to add new peer reflexive candidate: too many candidates ."))
+			return
+		}
+		rcand = &Candidate{
+			ComponentID: 1,
+			Type:        CandidatePeerReflexive,
+			Priority:    rcheck.priority,
+			addr:        rcheck.remoteAddress,
+			Foundation:  calcFoundation(CandidatePeerReflexive, rcheck.remoteAddress, "", lcand.transport),
+			transport:   lcand.transport,
+		}
+		s.remoteCandidates = append(s.remoteCandidates, rcand)
+	}
+	priority := calcPairPriority(s.role, lcand, rcand)
+	old := s.sessionComponent.nominatedCheck
+	if old != nil && old.priority >= priority {
+		return
+	}
+	srv, err := s.getSenderServerSock(lcand.addr)
+	if err != nil {
+		s.log.Error(err.Error())
+		return
+	}
+	check := &sessionCheck{
+		localCandidate:  lcand,
+		remoteCandidate: rcand,
+		key:             fmt.Sprintf("%s-%s", lcand.addr, rcand.addr),
+		priority:        priority,
+		state:           checkStateSucced,
+		nominated:       true,
+	}
+	s.log.Trace(fmt.Sprintf("lite nominated check %s", check))
+	s.mlock.Lock()
+	s.sessionComponent.validCheck = check
+	s.sessionComponent.nominatedCheck = check
+	s.sessionComponent.nominatedServerSock = srv
+	s.mlock.Unlock()
+	s.updateDataPath()
+	s.emit(&Event{Type: EventSelectedPairChanged, Pair: check.toCandidatePair()})
+	srv.FinishNegotiation(stunModeData)
+	if s.completeResult < sessionCompleteSuccess {
+		s.changeCompleteResult(sessionCompleteSuccess)
+		s.iceStreamTransport.onIceComplete(nil)
+		s.startConsent()
+	}
+}
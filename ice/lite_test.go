@@ -0,0 +1,113 @@
+package ice
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeSessionLite(t *testing.T) {
+	cfg := NewTransportConfigHostonly()
+	cfg.Lite = true
+	s, err := NewIceStreamTransport(cfg, "lite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.InitIce(SessionRoleControlling); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if s.session.role != SessionRoleControlled {
+		t.Error("lite agent should be controlled")
+	}
+	str, err := s.EncodeSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(str, "a=ice-lite\n") {
+		t.Errorf("sdp should contain ice-lite, %s", str)
+	}
+	sd, err := decodeSession(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sd.lite {
+		t.Error("should decode ice-lite")
+	}
+}
+
+func TestIceStreamTransport_Lite(t *testing.T) {
+	lite := NewTransportConfigHostonly()
+	lite.Lite = true
+	s1, s2, _, cb2 := setupNegotiatedPair(t, NewTransportConfigHostonly(), lite)
+	defer s1.Stop()
+	defer s2.Stop()
+	if len(s2.session.checkList.checks) != 0 {
+		t.Error("lite agent should not send checks")
+	}
+	nominated := s2.session.sessionComponent.nominatedCheck
+	if nominated == nil {
+		t.Fatal("lite agent should use the nominated pair")
+	}
+	if s1.session.sessionComponent.nominatedCheck.localCandidate.addr != nominated.remoteCandidate.addr {
+		t.Errorf("pair not match,full=%s,lite=%s", s1.session.sessionComponent.nominatedCheck, nominated)
+	}
+	s1data := []byte("hello,lite")
+	if err := s1.SendData(s1data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-time.After(10 * time.Second):
+		t.Error("lite recevied timeout")
+	case data := <-cb2.data:
+		if !bytes.Equal(data, s1data) {
+			t.Error("lite recevied error ,got ", string(data))
+		}
+	}
+	if err := s2.SendData([]byte("hello,full")); err != nil {
+		t.Error(err)
+	}
+}
+
+/*
+full agent 初始化为 controlled, 发现对方是 lite 以后必须切换为 controlling.
+*/
+func TestIceStreamTransport_LiteRoleSwitch(t *testing.T) {
+	lite := NewTransportConfigHostonly()
+	lite.Lite = true
+	s1, s2, _, _ := setupNegotiatedPair(t, lite, NewTransportConfigHostonly())
+	defer s1.Stop()
+	defer s2.Stop()
+	if s1.session.role != SessionRoleControlled || s2.session.role != SessionRoleControlling {
+		t.Errorf("role error lite=%s,full=%s", s1.session.role, s2.session.role)
+	}
+}
+
+func TestIceStreamTransport_BothLite(t *testing.T) {
+	cfg := NewTransportConfigHostonly()
+	cfg.Lite = true
+	s1, err := NewIceStreamTransport(cfg, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := NewIceStreamTransport(cfg, "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s1.InitIce(SessionRoleControlled); err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.InitIce(SessionRoleControlled); err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop()
+	defer s2.Stop()
+	str, err := s2.EncodeSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s1.StartNegotiation(str); err != errBothLite {
+		t.Errorf("expect both lite error,got %v", err)
+	}
+}
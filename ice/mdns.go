@@ -0,0 +1,196 @@
+package ice
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nkbai/goice/mdns"
+)
+
+/*
+mDNS 解析对方 <uuid>.local 的超时时间, 和浏览器差不多.
+*/
+const mdnsQueryTimeout = 3 * time.Second
+
+var errMulticastNotSupported = errors.New("multicast is not supported by Net")
+
+/*
+multicastNet 是 Net 的可选接口, 实现了它才能在虚拟网络上使用 mDNS.
+*/
+type multicastNet interface {
+	ListenMulticastUDP(network string, ifi *net.Interface, gaddr *net.UDPAddr) (net.PacketConn, error)
+}
+
+func (g *hostGatherer) listenMulticast(gaddr *net.UDPAddr) (net.PacketConn, error) {
+	if g == nil || g.net == nil {
+		return net.ListenMulticastUDP("udp4", nil, gaddr)
+	}
+	m, ok := g.net.(multicastNet)
+	if !ok {
+		return nil, errMulticastNotSupported
+	}
+	return m.ListenMulticastUDP("udp4", nil, gaddr)
+}
+
+/*
+hostname 返回 candidate 地址中的名字, 地址是 ip 的返回空.
+*/
+func (c *Candidate) hostname() string {
+	host, _, err := net.SplitHostPort(c.addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return ""
+	}
+	return host
+}
+
+/*
+mdnsConn 第一次用到的时候才加入组播组, 发布 host candidate 和解析对方的 .local 共用一个.
+*/
+func (t *StreamTransport) mdnsConn() (*mdns.Conn, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.mdns != nil {
+		return t.mdns, nil
+	}
+	gaddr, err := net.ResolveUDPAddr("udp4", mdns.DefaultAddress)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := t.gatherer.listenMulticast(gaddr)
+	if err != nil {
+		return nil, err
+	}
+	t.mdns = mdns.Server(pc, gaddr)
+	return t.mdns, nil
+}
+
+func (t *StreamTransport) closeMDNS() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.mdns != nil {
+		t.mdns.Close()
+		t.mdns = nil
+	}
+}
+
+/*
+publishHostCandidates 为每个 host candidate 的 ip 分配一个随机的名字并应答对它的查询,
+restart 以后同一个 ip 的名字不变, 消失的 ip 不再应答.
+*/
+func (t *StreamTransport) publishHostCandidates(candidates []*Candidate) error {
+	conn, err := t.mdnsConn()
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	oldNames := t.mdnsNames
+	t.lock.Unlock()
+	names := make(map[string]string)
+	for _, c := range candidates {
+		if c.Type != CandidateHost {
+			continue
+		}
+		ip := addrToUDPAddr(c.addr).IP
+		name, ok := oldNames[ip.String()]
+		if !ok {
+			name = mdns.RandomName()
+		}
+		names[ip.String()] = name
+		conn.Publish(name, ip)
+	}
+	for ip, name := range oldNames {
+		if _, ok := names[ip]; !ok {
+			conn.Unpublish(name)
+		}
+	}
+	t.lock.Lock()
+	t.mdnsNames = names
+	t.lock.Unlock()
+	return nil
+}
+
+/*
+obfuscate 返回 sdp 中使用的 candidate, host candidate 的 ip 替换为名字,
+其他 candidate 的 raddr 替换为 0.0.0.0, 和浏览器一样不泄露内网地址.
+*/
+func (t *StreamTransport) obfuscate(c *Candidate) *Candidate {
+	cc := *c
+	if c.Type != CandidateHost {
+		cc.relatedAddr = "0.0.0.0:0"
+		return &cc
+	}
+	addr := addrToUDPAddr(c.addr)
+	t.lock.Lock()
+	name, ok := t.mdnsNames[addr.IP.String()]
+	t.lock.Unlock()
+	if ok {
+		cc.addr = net.JoinHostPort(name, strconv.Itoa(addr.Port))
+	}
+	return &cc
+}
+
+func (t *StreamTransport) resolve(host string) (net.IP, error) {
+	if strings.HasSuffix(strings.ToLower(strings.TrimSuffix(host, ".")), mdns.LocalSuffix) {
+		conn, err := t.mdnsConn()
+		if err != nil {
+			return nil, err
+		}
+		return conn.Query(host, mdnsQueryTimeout)
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	//优先使用 ipv4, 目前只收集了 ipv4 的 candidate
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip, nil
+		}
+	}
+	return ips[0], nil
+}
+
+/*
+splitHostnameCandidates 从 sd 中取出对方 .local 和域名的 candidate, 剩下的都是 ip 地址, 可以立即开始 check.
+*/
+func splitHostnameCandidates(sd *sessionDescription) (named []*Candidate) {
+	var candidates []*Candidate
+	for _, c := range sd.candidates {
+		if len(c.hostname()) > 0 {
+			named = append(named, c)
+		} else {
+			candidates = append(candidates, c)
+		}
+	}
+	sd.candidates = candidates
+	return
+}
+
+/*
+resolveCandidates 并行解析 splitHostnameCandidates 取出的 candidate, 不阻塞 ip 地址 candidate 的 check,
+每一个解析完成以后在 loop 中加入 session, 和协商过程中才得到的 candidate 一样, 解析失败的 candidate 被丢弃.
+*/
+func (t *StreamTransport) resolveCandidates(s *session, candidates []*Candidate) {
+	for _, c := range candidates {
+		go func(c *Candidate) {
+			host := c.hostname()
+			ip, err := t.resolve(host)
+			if err == nil {
+				_, port, _ := net.SplitHostPort(c.addr)
+				c.addr = net.JoinHostPort(ip.String(), port)
+				t.log.Trace(fmt.Sprintf("%s resolved to %s", host, c.addr))
+				//和 StartNegotiation 一样, 先在 turn server 上为它创建 permission
+				err = s.createTurnPermissionIfNeeded([]*Candidate{c})
+			}
+			if err != nil {
+				t.log.Warn(fmt.Sprintf("resolve %s err %s, candidate is ignored", host, err))
+				c = nil
+			}
+			s.run(func() { s.addResolvedCandidate(c) })
+		}(c)
+	}
+}
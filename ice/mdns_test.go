@@ -0,0 +1,185 @@
+package ice
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nkbai/goice/vnet"
+)
+
+/*
+同一个内网中的两台主机只通告 .local 的 host candidate, 通过 mDNS 解析以后协商成功.
+*/
+func TestIceStreamTransport_MDNSHostCandidates(t *testing.T) {
+	lan, err := vnet.NewRouter(&vnet.RouterConfig{Name: "lan", CIDR: "192.168.1.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfgs []*TransportConfig
+	for i := 0; i < 2; i++ {
+		n, _ := vnet.NewNet(nil)
+		if err = lan.AddNet(n); err != nil {
+			t.Fatal(err)
+		}
+		cfg := NewTransportConfigHostonly()
+		cfg.Net = n
+		cfg.MDNSHostCandidates = true
+		cfgs = append(cfgs, cfg)
+	}
+	s1, s2, _, cb2, err := negotiateOnVNet(t, cfgs[0], cfgs[1])
+	defer s1.Stop()
+	defer s2.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sdp, err := s1.EncodeSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sdp, "192.168.1.") || !strings.Contains(sdp, ".local ") || !strings.Contains(sdp, "c=IN IP4 0.0.0.0") {
+		t.Errorf("private address should not be in sdp\n%s", sdp)
+	}
+	data := []byte("hello,mdns")
+	if err = s1.SendData(data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("s2 recevied timeout")
+	case d := <-cb2.data:
+		if !bytes.Equal(d, data) {
+			t.Error("s2 recevied error ,got ", string(d))
+		}
+	}
+}
+
+func TestSplitHostnameCandidates(t *testing.T) {
+	sd := &sessionDescription{candidates: []*Candidate{
+		{addr: "localhost:1000"},
+		{addr: "1.2.3.4:5"},
+		{addr: "0123abcd.local:1000"},
+	}}
+	if !hasHostname(sd.candidates) {
+		t.Error("should have hostname")
+	}
+	named := splitHostnameCandidates(sd)
+	if len(sd.candidates) != 1 || sd.candidates[0].addr != "1.2.3.4:5" {
+		t.Errorf("only ip candidates should be left %v", sd.candidates)
+	}
+	if len(named) != 2 || named[0].addr != "localhost:1000" || named[1].addr != "0123abcd.local:1000" {
+		t.Errorf("named candidates error %v", named)
+	}
+}
+
+/*
+对方的 sdp 中有一个无法解析的 .local candidate, ip 地址的 candidate 不等它解析就开始 check,
+协商在 mDNS 查询超时之前完成, 超时以后 candidate 被丢弃, checklist 完成.
+*/
+func TestIceStreamTransport_ResolveCandidatesAsync(t *testing.T) {
+	cfgs := newStaticLANConfigs(t, "10.1.1.1", "10.1.2.1")
+	s1, err := NewIceStreamTransport(cfgs[0], "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop()
+	s2, err := NewIceStreamTransport(cfgs[1], "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Stop()
+	cb1, cb2 := newicecb("s1"), newicecb("s2")
+	s1.cb, s2.cb = cb1, cb2
+	if err = s1.InitIce(SessionRoleControlling); err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.InitIce(SessionRoleControlled); err != nil {
+		t.Fatal(err)
+	}
+	lsdp, _ := s1.EncodeSession()
+	rsdp, _ := s2.EncodeSession()
+	rsdp = strings.Replace(rsdp, "a=end-of-candidates", "a=candidate:99 1 UDP 2130706431 0123abcd-nosuch.local 5000 typ host\r\na=end-of-candidates", 1)
+	start := time.Now()
+	if err = s2.StartNegotiation(lsdp); err != nil {
+		t.Fatal(err)
+	}
+	if err = s1.StartNegotiation(rsdp); err != nil {
+		t.Fatal(err)
+	}
+	for _, cb := range []*icecb{cb1, cb2} {
+		select {
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s negotiation timeout", cb.name)
+		case err = <-cb.iceresult:
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if d := time.Since(start); d >= mdnsQueryTimeout {
+		t.Errorf("checks should not wait for mDNS resolution, took %s", d)
+	}
+	s := s1.getSession()
+	deadline := time.Now().Add(mdnsQueryTimeout + 5*time.Second)
+	for {
+		var pending, remotes int
+		var result sessionCompleteResult
+		if err = s.run(func() { pending, remotes, result = s.pendingResolves, len(s.remoteCandidates), s.completeResult }); err != nil {
+			t.Fatal(err)
+		}
+		if pending == 0 {
+			if remotes != 1 || result != sessionAllCompleteSuccess {
+				t.Errorf("unresolved candidate should be dropped and checks complete, remotes=%d,result=%d", remotes, result)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("resolution should finish after mDNS timeout")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	exchangeData(t, s1, s2, cb1, cb2)
+}
+
+/*
+发布 .local 的一方 c= 是 0.0.0.0 端口 9, 没有 default candidate, 不使用 mDNS 的一方同样可以解码, 解析以后协商成功.
+*/
+func TestIceStreamTransport_MDNSPeerWithPlainPeer(t *testing.T) {
+	lan, err := vnet.NewRouter(&vnet.RouterConfig{Name: "lan", CIDR: "192.168.1.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfgs []*TransportConfig
+	for i := 0; i < 2; i++ {
+		n, _ := vnet.NewNet(nil)
+		if err = lan.AddNet(n); err != nil {
+			t.Fatal(err)
+		}
+		cfg := NewTransportConfigHostonly()
+		cfg.Net = n
+		cfgs = append(cfgs, cfg)
+	}
+	cfgs[1].MDNSHostCandidates = true
+	s1, s2, cb1, cb2, err := negotiateOnVNet(t, cfgs[0], cfgs[1])
+	defer s1.Stop()
+	defer s2.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsdp, err := s2.EncodeSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rsdp, "c=IN IP4 0.0.0.0") || !strings.Contains(rsdp, "m=audio 9 ") {
+		t.Errorf("default candidate should be 0.0.0.0:9\n%s", rsdp)
+	}
+	sd, err := decodeSession(rsdp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd.defautCandidate != nil || !hasHostname(sd.candidates) {
+		t.Errorf("there should be no default candidate, %v", sd.defautCandidate)
+	}
+	exchangeData(t, s1, s2, cb1, cb2)
+}
@@ -0,0 +1,238 @@
+package ice
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nkbai/log"
+)
+
+/*
+TurnServer is one turn server and its long term credentials.
+*/
+type TurnServer struct {
+	Server   string
+	UserName string
+	Password string
+}
+
+/*
+multiSock 同时从多个 stun/turn 服务器收集 candidate,
+所有的服务器并行进行,每一个服务器都有自己的超时时间,
+部分服务器失败不影响其他服务器的结果,如果全部失败,那么退化为 host only.
+*/
+type multiSock struct {
+	children      []stunTranporter
+	timeout       time.Duration //per server
+	localAddrs    []string
+	succeedSocks  []stunTranporter //gather 成功的 sock, 第一个是主要的
+	gatherResults []*gatherResult
+	gatherer      *hostGatherer
+}
+
+type gatherResult struct {
+	sock       stunTranporter
+	server     string
+	candidates []*Candidate
+	err        error
+}
+
+/*
+创建连接失败的服务器直接忽略,在 GetCandidates 时候作为失败处理.
+*/
+func newMultiSock(stunServers []string, turnServers []TurnServer, timeout time.Duration, g *hostGatherer) (m *multiSock) {
+	if timeout <= 0 {
+		timeout = Timing{}.withDefaults().GatherTimeout
+	}
+	m = &multiSock{
+		timeout:  timeout,
+		gatherer: g,
+	}
+	//turn 排在前面,它同时提供了 srflx 和 relay, 优先作为主要的 sock.
+	for _, t := range turnServers {
+		ts, err := newTurnSock(t.Server, t.UserName, t.Password, g)
+		if err != nil {
+			log.Warn(fmt.Sprintf("create turn sock for %s err %s", t.Server, err))
+			continue
+		}
+		ts.s.ReadDeadline = timeout
+		m.children = append(m.children, ts)
+	}
+	for _, server := range stunServers {
+		s, err := newStunSocket(server, g)
+		if err != nil {
+			log.Warn(fmt.Sprintf("create stun sock for %s err %s", server, err))
+			continue
+		}
+		s.ReadDeadline = timeout
+		m.children = append(m.children, s)
+	}
+	return m
+}
+
+func serverOfSock(sock stunTranporter) string {
+	switch s := sock.(type) {
+	case *turnSock:
+		return s.serverAddr
+	case *stunSocket:
+		return s.ServerAddr
+	}
+	return ""
+}
+
+/*
+GetCandidates 并行收集,
+主要 sock(第一个成功的)提供全部 candidate, 包括所有网卡上的 host candidate,
+其他的 sock 只提供 srflx 和 relay, 以及它们对应的 base 地址需要监听,
+foundation 相同的 candidate 只保留一个.
+*/
+func (m *multiSock) GetCandidates() (candidates []*Candidate, err error) {
+	results := make([]*gatherResult, len(m.children))
+	ch := make(chan int, len(m.children))
+	for i, sock := range m.children {
+		results[i] = &gatherResult{sock: sock, server: serverOfSock(sock)}
+		go func(i int) {
+			r := results[i]
+			r.candidates, r.err = r.sock.GetCandidates()
+			ch <- i
+		}(i)
+	}
+	//stun client 本身有 deadline, 这里再加上一点余量, 防止某个服务器一直不返回
+	timeout := m.gatherer.getClock().After(m.timeout + time.Second)
+	finished := make([]bool, len(m.children))
+	for n := 0; n < len(m.children); n++ {
+		select {
+		case i := <-ch:
+			finished[i] = true
+		case <-timeout:
+			n = len(m.children)
+		}
+	}
+	/*
+		超时的 sock 还在被它的协程使用, 等协程返回以后再关闭.
+	*/
+	if remain := len(m.children) - countTrue(finished); remain > 0 {
+		go func() {
+			for ; remain > 0; remain-- {
+				results[<-ch].sock.Close()
+			}
+		}()
+	}
+	for i, r := range results {
+		if !finished[i] {
+			log.Warn(fmt.Sprintf("gather candidates from %s timeout", r.server))
+			continue
+		}
+		if r.err != nil {
+			log.Warn(fmt.Sprintf("gather candidates from %s err %s", r.server, r.err))
+			r.sock.Close()
+			continue
+		}
+		m.gatherResults = append(m.gatherResults, r)
+		m.succeedSocks = append(m.succeedSocks, r.sock)
+	}
+	if len(m.gatherResults) == 0 {
+		log.Warn(fmt.Sprintf("all stun/turn servers failed, use host candidates only"))
+		h := &HostOnlySock{gatherer: m.gatherer}
+		candidates, err = h.GetCandidates()
+		if err != nil {
+			return
+		}
+		m.localAddrs = h.getListenCandidiates()
+		return
+	}
+	primary := m.gatherResults[0]
+	candidates = append(candidates, primary.candidates...)
+	m.localAddrs = append(m.localAddrs, primary.sock.getListenCandidiates()...)
+	for _, r := range m.gatherResults[1:] {
+		for _, c := range r.candidates {
+			if c.Type == CandidateHost {
+				continue
+			}
+			if hasFoundation(candidates, c) {
+				continue
+			}
+			candidates = append(candidates, c)
+			if c.Type == CandidateServerReflexive && !m.isListening(c.baseAddr) {
+				m.localAddrs = append(m.localAddrs, c.baseAddr)
+			}
+		}
+		if ts, ok := r.sock.(*turnSock); ok && !m.isListening(ts.s.LocalAddr) {
+			m.localAddrs = append(m.localAddrs, ts.s.LocalAddr)
+		}
+	}
+	/*
+		保持最后一个是缺省 candidate 的约定, 主要 sock 的最后一个.
+	*/
+	last := primary.candidates[len(primary.candidates)-1]
+	for i, c := range candidates {
+		if c == last {
+			candidates = append(candidates[:i], candidates[i+1:]...)
+			candidates = append(candidates, last)
+			break
+		}
+	}
+	return
+}
+
+/*
+foundation 由类型, base ip, 服务器和传输协议决定, 相同的 foundation 说明是从同一个服务器(比如同时作为 stun 和 turn 使用)
+得到的重复的 candidate.
+*/
+func hasFoundation(candidates []*Candidate, c *Candidate) bool {
+	for _, c2 := range candidates {
+		if c2.Foundation == c.Foundation {
+			return true
+		}
+	}
+	return false
+}
+
+func countTrue(bs []bool) (n int) {
+	for _, b := range bs {
+		if b {
+			n++
+		}
+	}
+	return
+}
+
+func (m *multiSock) isListening(addr string) bool {
+	for _, a := range m.localAddrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+//Close implements io.Closer
+func (m *multiSock) Close() {
+	for _, sock := range m.succeedSocks {
+		sock.Close()
+	}
+}
+
+/*
+address need to listen for input stun binding request...
+*/
+func (m *multiSock) getListenCandidiates() []string {
+	return m.localAddrs
+}
+
+/*
+返回所有成功分配了 relay 地址的 turnSock
+*/
+func relaySocks(transporter stunTranporter) (socks []*turnSock) {
+	switch t := transporter.(type) {
+	case *turnSock:
+		socks = append(socks, t)
+	case *multiSock:
+		for _, sock := range t.succeedSocks {
+			if ts, ok := sock.(*turnSock); ok {
+				socks = append(socks, ts)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,120 @@
+package ice
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nkbai/goice/stun"
+	"github.com/nkbai/goice/vnet"
+)
+
+/*
+一个最简单的 stun server, 只回应 binding request, 用于离线测试.
+*/
+func startTestStunServer(t *testing.T) (addr string, stop func()) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := new(stun.Message)
+			if _, err = req.Write(buf[:n]); err != nil || req.Type != stun.BindingRequest {
+				continue
+			}
+			uaddr := from.(*net.UDPAddr)
+			res, err := stun.Build(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingSuccess,
+				&stun.XORMappedAddress{IP: uaddr.IP, Port: uaddr.Port}, stun.Fingerprint)
+			if err != nil {
+				continue
+			}
+			c.WriteTo(res.Raw, from)
+		}
+	}()
+	return c.LocalAddr().String(), func() { c.Close() }
+}
+
+func TestMultiSockPartialFailure(t *testing.T) {
+	server, stop := startTestStunServer(t)
+	defer stop()
+	m := newMultiSock([]string{"127.0.0.1:1", server}, nil, time.Millisecond*500, nil)
+	if len(m.children) != 2 {
+		t.Fatalf("expect 2 children,got %d", len(m.children))
+	}
+	candidates, err := m.GetCandidates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) == 0 {
+		t.Error("should have host candidates")
+	}
+	if len(m.gatherResults) != 1 || m.gatherResults[0].server != server {
+		t.Errorf("only %s should succeed", server)
+	}
+	m.Close()
+}
+
+func TestMultiSockAllFailed(t *testing.T) {
+	cfg := NewTransportConfigWithServers([]string{"127.0.0.1:1"}, []TurnServer{{"127.0.0.1:2", "bai", "bai"}})
+	cfg.GatherTimeout = time.Millisecond * 500
+	trans, err := NewIceStreamTransport(cfg, "multi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range trans.component.candidates {
+		if c.Type != CandidateHost {
+			t.Errorf("should only have host candidates,got %s", c)
+		}
+	}
+	if len(trans.transporter.getListenCandidiates()) == 0 {
+		t.Error("should listen on host candidates")
+	}
+}
+
+func TestTransportConfigServers(t *testing.T) {
+	cfg := NewTransportConfigWithTurn("1.1.1.1:3478", "u", "p")
+	cfg.StunServers = []string{"2.2.2.2:3478"}
+	cfg.TurnServers = []TurnServer{{"3.3.3.3:3478", "u2", "p2"}}
+	stunServers, turnServers := cfg.servers()
+	if len(stunServers) != 1 || len(turnServers) != 2 || turnServers[0].Server != "1.1.1.1:3478" {
+		t.Errorf("servers error stun=%v,turn=%v", stunServers, turnServers)
+	}
+}
+
+/*
+一个服务器地址无效, 一个不可达, 一个正常, 仍然可以创建 transport, 并且得到正常服务器的 srflx.
+同一个服务器出现两次, 相同 foundation 的 srflx 只保留一个.
+*/
+func TestMultiSockBadAndGoodServer(t *testing.T) {
+	cfgs, stop := setupVNet(t, vnetLAN{nat: vnet.NATPortRestricted})
+	defer stop()
+	cfgs[0].StunServers = []string{"1.0.0.200", "1.0.0.201:3478", vnetStunServer, vnetStunServer}
+	cfgs[0].GatherTimeout = time.Millisecond * 500
+	s, err := NewIceStreamTransport(cfgs[0], "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	m := s.transporter.(*multiSock)
+	if len(m.children) != 3 {
+		t.Errorf("the invalid server should be skipped, children=%d", len(m.children))
+	}
+	var host, srflx int
+	for _, c := range s.component.candidates {
+		switch c.Type {
+		case CandidateHost:
+			host++
+		case CandidateServerReflexive:
+			srflx++
+		}
+	}
+	if host == 0 || srflx != 1 {
+		t.Errorf("expect host candidates and one srflx, got %v", s.component.candidates)
+	}
+}
@@ -0,0 +1,89 @@
+package ice
+
+import (
+	"net"
+	"sort"
+
+	"github.com/nkbai/goice/clock"
+)
+
+/*
+Net replaces real sockets and interfaces, so ICE can run on a virtual network like package vnet.
+Only udp is used, tcp candidates are disabled when TransportConfig.Net is set.
+*/
+type Net interface {
+	ListenPacket(network, address string) (net.PacketConn, error)
+	DialUDP(network string, laddr, raddr *net.UDPAddr) (net.Conn, error)
+	InterfaceAddrs() ([]net.Addr, error)
+}
+
+/*
+netGatherer 和 defaultGatherer 一样过滤地址, 只是地址来自 Net.
+*/
+type netGatherer struct {
+	net    Net
+	filter *GatherFilter
+}
+
+func (g netGatherer) Gather() ([]Addr, error) {
+	iAddrs, err := g.net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]Addr, 0, len(iAddrs))
+	for _, a := range iAddrs {
+		ip, _, err := net.ParseCIDR(a.String())
+		if err != nil {
+			return addrs, err
+		}
+		if len(ip.To4()) != net.IPv4len {
+			continue //just support ipv4 now
+		}
+		if ip.IsLoopback() && !g.filter.includeLoopback() {
+			continue
+		}
+		if !g.filter.acceptIP(ip) {
+			continue
+		}
+		addrs = append(addrs, Addr{
+			IP:         ip,
+			Precedence: defaultGatherer{}.precedence(ip),
+		})
+	}
+	sort.Sort(Addrs(addrs))
+	return addrs, nil
+}
+
+/*
+所有监听 udp 的地方都要经过这里, 以便使用 Net 以及应用提供的 socket.
+*/
+func (g *hostGatherer) listenPacket(addr string) (net.PacketConn, error) {
+	if g != nil {
+		if c, ok := g.conns[addr]; ok {
+			return newAppConn(c), nil
+		}
+	}
+	if g == nil || g.net == nil {
+		return net.ListenPacket("udp", addr)
+	}
+	return g.net.ListenPacket("udp", addr)
+}
+
+func (g *hostGatherer) getClock() clock.Clock {
+	if g == nil {
+		return clock.New()
+	}
+	return g.clock
+}
+
+func (g *hostGatherer) dial(laddr *net.UDPAddr, serverAddr string) (net.Conn, error) {
+	if g.net == nil {
+		d := net.Dialer{LocalAddr: laddr}
+		return d.Dial("udp", serverAddr)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	return g.net.DialUDP("udp", laddr, raddr)
+}
@@ -0,0 +1,254 @@
+package ice
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nkbai/goice/stun"
+	"github.com/nkbai/goice/vnet"
+)
+
+const vnetStunServer = "1.0.0.100:3478"
+
+/*
+在虚拟的 internet 上运行一个最简单的 stun server, 回应 binding request,
+其他的 stun 消息和 channel data 交给同一个地址上的 turn server, 见 vnetturn_test.go.
+*/
+func startVNetStunServer(t testing.TB, n *vnet.Net) net.PacketConn {
+	c, err := n.ListenPacket("udp", vnetStunServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newVNetTurnServer(n, c)
+	go func() {
+		defer ts.close()
+		buf := make([]byte, maxPacketSize)
+		for {
+			l, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if classifyPacket(buf[:l]) == packetChannelData {
+				ts.channelData(buf[:l], addr)
+				continue
+			}
+			req := new(stun.Message)
+			if _, err = req.Write(buf[:l]); err != nil {
+				continue
+			}
+			if req.Type != stun.BindingRequest {
+				ts.handle(req, addr)
+				continue
+			}
+			ua := addr.(*net.UDPAddr)
+			res, err := stun.Build(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingSuccess,
+				&stun.XORMappedAddress{IP: ua.IP, Port: ua.Port})
+			if err != nil {
+				continue
+			}
+			c.WriteTo(res.Raw, addr)
+		}
+	}()
+	return c
+}
+
+type vnetLAN struct {
+	nat      vnet.NATType
+	latency  time.Duration
+	lossRate float64
+}
+
+/*
+setupVNet 创建 internet 1.0.0.0/8 和两个内网 192.168.1.0/24, 192.168.2.0/24,
+返回两个内网中主机的配置, 都使用 internet 上的 stun server.
+*/
+func setupVNet(t testing.TB, lans ...vnetLAN) (cfgs []*TransportConfig, stop func()) {
+	wan, err := vnet.NewRouter(&vnet.RouterConfig{Name: "wan", CIDR: "1.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{"1.0.0.100"}})
+	if err = wan.AddNet(server); err != nil {
+		t.Fatal(err)
+	}
+	for i, l := range lans {
+		r, err := vnet.NewRouter(&vnet.RouterConfig{
+			Name:     fmt.Sprintf("lan%d", i+1),
+			CIDR:     fmt.Sprintf("192.168.%d.0/24", i+1),
+			NAT:      l.nat,
+			Latency:  l.latency,
+			LossRate: l.lossRate,
+			Seed:     int64(i + 1),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = wan.AddRouter(r); err != nil {
+			t.Fatal(err)
+		}
+		n, _ := vnet.NewNet(nil)
+		if err = r.AddNet(n); err != nil {
+			t.Fatal(err)
+		}
+		cfg := NewTransportConfigHostonly()
+		cfg.StunServers = []string{vnetStunServer}
+		cfg.Net = n
+		cfgs = append(cfgs, cfg)
+	}
+	c := startVNetStunServer(t, server)
+	return cfgs, func() { c.Close() }
+}
+
+/*
+negotiate 返回协商的结果, 两边都成功才返回 nil
+*/
+func negotiateOnVNet(t *testing.T, cfg1, cfg2 *TransportConfig) (s1, s2 *StreamTransport, cb1, cb2 *icecb, err error) {
+	s1, err = NewIceStreamTransport(cfg1, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err = NewIceStreamTransport(cfg2, "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb1, cb2 = newicecb("s1"), newicecb("s2")
+	s1.cb, s2.cb = cb1, cb2
+	if err = s1.InitIce(SessionRoleControlling); err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.InitIce(SessionRoleControlled); err != nil {
+		t.Fatal(err)
+	}
+	lsdp, _ := s1.EncodeSession()
+	rsdp, _ := s2.EncodeSession()
+	if err = s2.StartNegotiation(lsdp); err != nil {
+		t.Fatal(err)
+	}
+	if err = s1.StartNegotiation(rsdp); err != nil {
+		t.Fatal(err)
+	}
+	for _, cb := range []*icecb{cb1, cb2} {
+		select {
+		case <-time.After(40 * time.Second):
+			t.Fatalf("%s negotiation timeout", cb.name)
+		case result := <-cb.iceresult:
+			if result != nil && err == nil {
+				err = result
+			}
+		}
+	}
+	return
+}
+
+func TestIceStreamTransport_VNetGather(t *testing.T) {
+	cfgs, stop := setupVNet(t, vnetLAN{nat: vnet.NATPortRestricted})
+	defer stop()
+	s, err := NewIceStreamTransport(cfgs[0], "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var host, srflx *Candidate
+	for _, c := range s.component.candidates {
+		switch c.Type {
+		case CandidateHost:
+			host = c
+		case CandidateServerReflexive:
+			srflx = c
+		}
+	}
+	if host == nil || srflx == nil {
+		t.Fatalf("should have host and srflx candidates %v", s.component.candidates)
+	}
+	if addrToUDPAddr(host.addr).IP.String() != "192.168.1.1" || addrToUDPAddr(srflx.addr).IP.String() != "1.0.0.1" {
+		t.Errorf("candidate address error host=%s,srflx=%s", host.addr, srflx.addr)
+	}
+	if srflx.baseAddr != host.addr {
+		t.Errorf("srflx base should be host, base=%s,host=%s", srflx.baseAddr, host.addr)
+	}
+}
+
+/*
+各种 NAT 组合下能否打洞成功, symmetric 和 port restricted 以及 symmetric 之间是无法直接连通的.
+*/
+func TestIceStreamTransport_VNetNATMatrix(t *testing.T) {
+	cases := []struct {
+		nat1, nat2 vnet.NATType
+		success    bool
+	}{
+		{vnet.NATFullCone, vnet.NATFullCone, true},
+		{vnet.NATRestricted, vnet.NATPortRestricted, true},
+		{vnet.NATPortRestricted, vnet.NATPortRestricted, true},
+		{vnet.NATSymmetric, vnet.NATFullCone, true},
+		{vnet.NATSymmetric, vnet.NATRestricted, true},
+		{vnet.NATNone, vnet.NATSymmetric, true},
+		{vnet.NATSymmetric, vnet.NATPortRestricted, false},
+		{vnet.NATSymmetric, vnet.NATSymmetric, false},
+	}
+	for _, cs := range cases {
+		cs := cs
+		t.Run(fmt.Sprintf("%s-%s", cs.nat1, cs.nat2), func(t *testing.T) {
+			t.Parallel()
+			cfgs, stop := setupVNet(t, vnetLAN{nat: cs.nat1}, vnetLAN{nat: cs.nat2})
+			defer stop()
+			s1, s2, _, cb2, err := negotiateOnVNet(t, cfgs[0], cfgs[1])
+			defer s1.Stop()
+			defer s2.Stop()
+			if (err == nil) != cs.success {
+				t.Fatalf("expect success=%v,got err=%v", cs.success, err)
+			}
+			if !cs.success {
+				return
+			}
+			data := []byte("hello,vnet")
+			if err = s1.SendData(data); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-time.After(5 * time.Second):
+				t.Fatal("s2 recevied timeout")
+			case d := <-cb2.data:
+				if !bytes.Equal(d, data) {
+					t.Error("s2 recevied error ,got ", string(d))
+				}
+			}
+		})
+	}
+}
+
+/*
+有延迟和丢包时靠重传仍然可以协商成功
+*/
+func TestIceStreamTransport_VNetLossAndLatency(t *testing.T) {
+	cfgs, stop := setupVNet(t,
+		vnetLAN{nat: vnet.NATPortRestricted, latency: 30 * time.Millisecond, lossRate: 0.1},
+		vnetLAN{nat: vnet.NATFullCone, latency: 50 * time.Millisecond, lossRate: 0.1})
+	defer stop()
+	s1, s2, _, cb2, err := negotiateOnVNet(t, cfgs[0], cfgs[1])
+	defer s1.Stop()
+	defer s2.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//选中的 pair 的本地地址是 srflx, rtt 记录在发送 check 的 pair 上
+	for _, p := range s1.Stats().Pairs {
+		if p.ResponsesReceived > 0 && p.CurrentRoundTripTime < 160*time.Millisecond {
+			t.Errorf("rtt should include latency of both routers twice, got %s", p.CurrentRoundTripTime)
+		}
+	}
+	//数据可能丢失, 多发几次
+	for i := 0; i < 10; i++ {
+		if err = s1.SendData([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-time.After(time.Second):
+			continue
+		case <-cb2.data:
+			return
+		}
+	}
+	t.Error("s2 should receive data")
+}
@@ -0,0 +1,211 @@
+package ice
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+NetworkChangeCallbacker is an optional interface of StreamTransportCallbacker.
+OnNetworkChanged is called after local addresses changed and ICE is restarted,
+localSDP is the new session description which must be sent to peer,
+peer should call Restart and StartNegotiation with it, then send back its new sdp.
+err is set if restart failed.
+*/
+type NetworkChangeCallbacker interface {
+	OnNetworkChanged(localSDP string, err error)
+}
+
+var (
+	errTransportClosed = errors.New("transport closed")
+	/*
+		rtnetlink 等平台相关的通知只是为了更快发现变化, 不支持的平台仍然可以定时检查.
+	*/
+	errNetworkNotifyNotSupported = errors.New("network change notification not supported")
+)
+
+/*
+networkWatcher 定时比较本地地址, Linux 上收到 rtnetlink 通知时立即比较.
+*/
+type networkWatcher struct {
+	t        *StreamTransport
+	gather   func() ([]Addr, error)
+	last     map[string]bool
+	quitChan chan struct{}
+	once     sync.Once
+	wg       sync.WaitGroup
+}
+
+func newNetworkWatcher(t *StreamTransport, gather func() ([]Addr, error)) *networkWatcher {
+	w := &networkWatcher{
+		t:        t,
+		gather:   gather,
+		quitChan: make(chan struct{}),
+	}
+	w.last, _ = w.addrs()
+	return w
+}
+
+func (w *networkWatcher) addrs() (map[string]bool, error) {
+	addrs, err := w.gather()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]bool)
+	for _, a := range addrs {
+		m[a.IP.String()] = true
+	}
+	return m, nil
+}
+
+func (w *networkWatcher) start(interval time.Duration) {
+	notify, err := subscribeNetworkChange(w.quitChan)
+	if err != nil {
+		w.t.log.Info(fmt.Sprintf("subscribe network change err %s, polling only", err))
+	}
+	w.wg.Add(1)
+	go w.loop(interval, notify)
+}
+
+/*
+stop 等待正在进行的 restart 结束.
+*/
+func (w *networkWatcher) stop() {
+	w.once.Do(func() {
+		close(w.quitChan)
+	})
+	w.wg.Wait()
+}
+
+func (w *networkWatcher) loop(interval time.Duration, notify <-chan struct{}) {
+	defer w.wg.Done()
+	timer := w.t.cfg.clock().NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C():
+			timer.Reset(interval)
+		case _, ok := <-notify:
+			if !ok {
+				notify = nil
+			}
+		case <-w.quitChan:
+			return
+		}
+		w.check()
+	}
+}
+
+/*
+check 比较本地地址和上一次的结果, 有变化时通知 StreamTransport.
+*/
+func (w *networkWatcher) check() {
+	current, err := w.addrs()
+	if err != nil {
+		w.t.log.Info(fmt.Sprintf("gather local address err %s", err))
+		return
+	}
+	added, removed := diffAddrs(w.last, current)
+	w.last = current
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	w.t.onNetworkChanged(added, removed)
+}
+
+func diffAddrs(old, current map[string]bool) (added, removed []string) {
+	for a := range current {
+		if !old[a] {
+			added = append(added, a)
+		}
+	}
+	for a := range old {
+		if !current[a] {
+			removed = append(removed, a)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return
+}
+
+/*
+needRestart 出现了新地址(可能有更好的路径), 或者选定的 pair 的本地地址消失了, 都需要 restart.
+其他 candidate 的地址消失不影响正在使用的 pair, 还没有选定 pair 的时候, 这些 candidate 上的 check 失败就可以了.
+*/
+func (t *StreamTransport) needRestart(added, removed []string) bool {
+	if len(added) > 0 {
+		return true
+	}
+	s := t.getSession()
+	if s == nil {
+		return false
+	}
+	_, _, fromaddr := s.selectedPair()
+	if fromaddr == "" {
+		return false
+	}
+	return containsString(removed, addrToUDPAddr(fromaddr).IP.String())
+}
+
+func (t *StreamTransport) onNetworkChanged(added, removed []string) {
+	t.log.Info(fmt.Sprintf("%s network changed, added=%v,removed=%v", t.Name, added, removed))
+	if !t.needRestart(added, removed) {
+		return
+	}
+	var sdp string
+	err := t.Restart()
+	if err == nil && t.getSession() != nil {
+		sdp, err = t.EncodeSession()
+	}
+	if cb, ok := t.cb.(NetworkChangeCallbacker); ok {
+		cb.OnNetworkChanged(sdp, err)
+	}
+}
+
+/*
+Restart gathers candidates again and creates a new session with new ufrag and password (ICE restart),
+the role is not changed. After that, exchange EncodeSession with peer and call StartNegotiation again.
+If InitIce has not been called, it only gathers candidates again.
+Conn closed by a failed negotiation or a disconnection can be used again after Restart.
+The peer should call Restart too when it receives a sdp with different ufrag.
+Concurrent calls are serialized, and Restart during or after Stop returns an error.
+*/
+func (t *StreamTransport) Restart() error {
+	t.restartLock.Lock()
+	defer t.restartLock.Unlock()
+	t.lock.Lock()
+	if t.State == TransportStateStopped {
+		t.lock.Unlock()
+		return errTransportClosed
+	}
+	old := t.session
+	t.session = nil
+	t.State = TransportStateReady
+	t.lock.Unlock()
+	if old != nil {
+		old.Stop()
+	}
+	if err := t.gather(); err != nil {
+		t.changeState(TransportStateReady, TransportStateFailed)
+		return err
+	}
+	if t.getState() == TransportStateStopped {
+		//收集的过程中被 Stop, 新的 socket 由 Stop 关闭
+		return errTransportClosed
+	}
+	t.changeConnectionState(ConnectionStateNew, nil)
+	if old != nil {
+		t.log.Info(fmt.Sprintf("%s ice restart", t.Name))
+		if err := t.InitIce(old.role); err != nil {
+			return err
+		}
+	}
+	if c := t.getConn(); c != nil {
+		c.rearm()
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package ice
+
+import (
+	"syscall"
+)
+
+/*
+linux/rtnetlink.h, syscall 中没有定义
+*/
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv6IfAddr = 0x100
+)
+
+/*
+subscribeNetworkChange 监听 rtnetlink 的网卡和地址变化, 有变化时向返回的 chan 写入通知,
+quit 关闭以后退出并关闭 chan.
+*/
+func subscribeNetworkChange(quit chan struct{}) (<-chan struct{}, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr,
+	}
+	if err = syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	//阻塞的 Recvfrom 不会因为 Close 返回, 所以使用超时来检查 quit
+	tv := syscall.Timeval{Sec: 1}
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer syscall.Close(fd)
+		defer close(ch)
+		buf := make([]byte, 4096)
+		for {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			_, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK || err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
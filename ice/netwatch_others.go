@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package ice
+
+/*
+其他平台只能定时检查.
+*/
+func subscribeNetworkChange(quit chan struct{}) (<-chan struct{}, error) {
+	return nil, errNetworkNotifyNotSupported
+}
@@ -0,0 +1,288 @@
+package ice
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nkbai/goice/vnet"
+)
+
+type netcb struct {
+	*icecb
+	changed chan string
+}
+
+func (c *netcb) OnNetworkChanged(localSDP string, err error) {
+	if err != nil {
+		localSDP = ""
+	}
+	c.changed <- localSDP
+}
+
+func TestDiffAddrs(t *testing.T) {
+	added, removed := diffAddrs(map[string]bool{"10.0.0.1": true, "10.0.0.2": true},
+		map[string]bool{"10.0.0.2": true, "10.0.0.3": true})
+	if len(added) != 1 || added[0] != "10.0.0.3" || len(removed) != 1 || removed[0] != "10.0.0.1" {
+		t.Errorf("diff error added=%v,removed=%v", added, removed)
+	}
+}
+
+func TestSubscribeNetworkChange(t *testing.T) {
+	quit := make(chan struct{})
+	ch, err := subscribeNetworkChange(quit)
+	if err != nil {
+		t.Skip(err)
+	}
+	close(quit)
+	select {
+	case <-time.After(3 * time.Second):
+		t.Error("should quit")
+	case <-ch:
+	}
+}
+
+/*
+出现新地址以后自动 restart, 双方交换新的 sdp 重新协商.
+*/
+func TestIceStreamTransport_NetworkChangeRestart(t *testing.T) {
+	cfg := NewTransportConfigHostonly()
+	cfg.GatherFilter = &GatherFilter{IncludeLoopback: true, IncludeCIDRs: []string{"127.0.0.1/32"}}
+	s1, s2, cb1, cb2 := setupNegotiatedPair(t, cfg, cfg)
+	defer s1.Stop()
+	defer s2.Stop()
+	ncb := &netcb{icecb: cb1, changed: make(chan string, 1)}
+	//loop 里面可能还在通知 event
+	s1.getSession().run(func() { s1.cb = ncb })
+	oldSDP, _ := s1.EncodeSession()
+	addrs := []Addr{{IP: net.ParseIP("127.0.0.1")}}
+	w := newNetworkWatcher(s1, func() ([]Addr, error) {
+		return addrs, nil
+	})
+	w.check()
+	select {
+	case <-ncb.changed:
+		t.Fatal("no change, should not restart")
+	default:
+	}
+	addrs = append(addrs, Addr{IP: net.ParseIP("127.0.0.2")})
+	w.check()
+	var sdp1 string
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("should restart")
+	case sdp1 = <-ncb.changed:
+	}
+	if sdp1 == "" || sdp1 == oldSDP || s1.State != TransportStateSessionReady || s1.ConnectionState() != ConnectionStateNew {
+		t.Fatalf("restart error state=%s,sdp=%s", s1.State, sdp1)
+	}
+	if strings.Contains(sdp1, s1.session.rxUserFrag) == false || strings.Contains(oldSDP, s1.session.rxUserFrag) {
+		t.Error("ufrag should change after restart")
+	}
+	if err := s2.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	sdp2, err := s2.EncodeSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.StartNegotiation(sdp1); err != nil {
+		t.Fatal(err)
+	}
+	if err = s1.StartNegotiation(sdp2); err != nil {
+		t.Fatal(err)
+	}
+	for _, cb := range []*icecb{cb1, cb2} {
+		select {
+		case <-time.After(20 * time.Second):
+			t.Fatalf("%s negotiation timeout", cb.name)
+		case err = <-cb.iceresult:
+			if err != nil {
+				t.Fatalf("%s negotiation failed %s", cb.name, err)
+			}
+		}
+	}
+	data := []byte("hello,restart")
+	if err = s1.SendData(data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("s2 recevied timeout")
+	case d := <-cb2.data:
+		if !bytes.Equal(d, data) {
+			t.Error("s2 recevied error ,got ", string(d))
+		}
+	}
+}
+
+/*
+没有调用 InitIce 就 restart, 之前连接 stun server 的 socket 也要关闭, 否则指定的地址一直被占用, 拿不到 srflx.
+*/
+func TestIceStreamTransport_RestartClosesTransporter(t *testing.T) {
+	cfgs, stop := setupVNet(t, vnetLAN{nat: vnet.NATPortRestricted})
+	defer stop()
+	cfgs[0].BindAddrs = []string{"192.168.1.1:7000"}
+	s, err := NewIceStreamTransport(cfgs[0], "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			if err = s.Restart(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		component, _ := s.getGathered()
+		srflx := 0
+		for _, c := range component.candidates {
+			if c.Type == CandidateServerReflexive {
+				srflx++
+			}
+		}
+		if srflx != 1 {
+			t.Fatalf("gather %d should have srflx, got %v", i, component.candidates)
+		}
+	}
+}
+
+/*
+同时调用 Restart 依次执行, Stop 等待正在进行的 Restart 结束, 之后绑定的地址可以再次使用.
+*/
+func TestIceStreamTransport_ConcurrentRestartStop(t *testing.T) {
+	cfgs, stop := setupVNet(t, vnetLAN{nat: vnet.NATPortRestricted})
+	defer stop()
+	cfgs[0].BindAddrs = []string{"192.168.1.1:7000"}
+	s, err := NewIceStreamTransport(cfgs[0], "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.InitIce(SessionRoleControlling); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		go func() {
+			errs <- s.Restart()
+		}()
+	}
+	for i := 0; i < 16; i++ {
+		if err = <-errs; err != nil {
+			t.Fatalf("concurrent restart should succeed, %s", err)
+		}
+	}
+	if _, transporter := s.getGathered(); s.getSession() == nil || s.getSession().transporter != transporter {
+		t.Fatal("session should be created again from the last gathering")
+	}
+	for i := 0; i < 16; i++ {
+		go func() {
+			errs <- s.Restart()
+		}()
+	}
+	s.Stop()
+	for i := 0; i < 16; i++ {
+		if err = <-errs; err != nil && err != errTransportClosed {
+			t.Errorf("restart during stop, %s", err)
+		}
+	}
+	if err = s.Restart(); err != errTransportClosed {
+		t.Errorf("restart after stop should fail, got %v", err)
+	}
+	if st := s.ConnectionState(); st != ConnectionStateClosed {
+		t.Errorf("restart should not change state after stop, got %s", st)
+	}
+	s2, err := NewIceStreamTransport(cfgs[0], "s2")
+	if err != nil {
+		t.Fatalf("sockets should be closed by stop, %s", err)
+	}
+	s2.Stop()
+}
+
+/*
+restart 的同时发送数据, session 被替换的时候不能 panic.
+*/
+func TestIceStreamTransport_SendDataDuringRestart(t *testing.T) {
+	s1, s2, _, _ := setupNegotiatedPair(t, NewTransportConfigHostonly(), NewTransportConfigHostonly())
+	defer s1.Stop()
+	defer s2.Stop()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		data := []byte("hello")
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s1.SendData(data)
+			s1.Conn().Write(data)
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		if err := s1.Restart(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	<-stopped
+}
+
+/*
+没有被选中的地址消失不需要 restart, 选定的 pair 的本地地址消失才 restart.
+*/
+func TestIceStreamTransport_NetworkChangeRemoveUnselected(t *testing.T) {
+	lan, err := vnet.NewRouter(&vnet.RouterConfig{Name: "lan", CIDR: "10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfgs []*TransportConfig
+	for _, ips := range [][]string{{"10.1.1.1", "10.1.1.2"}, {"10.1.2.1"}} {
+		n, err := vnet.NewNet(&vnet.NetConfig{StaticIPs: ips})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = lan.AddNet(n); err != nil {
+			t.Fatal(err)
+		}
+		cfg := NewTransportConfigHostonly()
+		cfg.Net = n
+		cfgs = append(cfgs, cfg)
+	}
+	s1, s2, cb1, _ := setupNegotiatedPair(t, cfgs[0], cfgs[1])
+	defer s1.Stop()
+	defer s2.Stop()
+	ncb := &netcb{icecb: cb1, changed: make(chan string, 1)}
+	s1.getSession().run(func() { s1.cb = ncb })
+	_, _, fromaddr := s1.getSession().selectedPair()
+	selected := addrToUDPAddr(fromaddr).IP.String()
+	other := "10.1.1.1"
+	if selected == other {
+		other = "10.1.1.2"
+	}
+	addrs := []Addr{{IP: net.ParseIP("10.1.1.1")}, {IP: net.ParseIP("10.1.1.2")}}
+	w := newNetworkWatcher(s1, func() ([]Addr, error) {
+		return addrs, nil
+	})
+	addrs = []Addr{{IP: net.ParseIP(selected)}}
+	w.check()
+	select {
+	case <-ncb.changed:
+		t.Fatalf("%s is not used by the selected pair, should not restart", other)
+	default:
+	}
+	if s1.State != TransportStateRunning {
+		t.Errorf("state should not change, got %s", s1.State)
+	}
+	addrs = nil
+	w.check()
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("the address of the selected pair is removed, should restart")
+	case <-ncb.changed:
+	}
+}
@@ -0,0 +1,211 @@
+package ice
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// NominationMode is how the controlling agent nominates candidate pair.
+type NominationMode int
+
+const (
+	/*NominationAggressive means every check carries USE-CANDIDATE,
+	the selected pair may change briefly until all checks complete.
+	*/
+	NominationAggressive NominationMode = iota
+	/*NominationRegular means checks are sent without USE-CANDIDATE, after all checks complete,
+	the best valid pair is selected and nominated with one more check.
+	*/
+	NominationRegular
+)
+
+func (n NominationMode) String() string {
+	switch n {
+	case NominationAggressive:
+		return "aggressive"
+	case NominationRegular:
+		return "regular"
+	}
+	return "unknown"
+}
+
+/*
+CandidatePair is a local and remote candidate whose connectivity check has succeeded.
+RTT is the round trip time of the latest binding request on this pair, 0 if unknown.
+*/
+type CandidatePair struct {
+	Local     *Candidate
+	Remote    *Candidate
+	Priority  uint64
+	Nominated bool
+	RTT       time.Duration
+}
+
+/*
+NetworkCost is the higher network-cost of two candidates, a metered cellular link on either side makes the pair expensive.
+*/
+func (p *CandidatePair) NetworkCost() int {
+	if p.Local.NetworkCost > p.Remote.NetworkCost {
+		return p.Local.NetworkCost
+	}
+	return p.Remote.NetworkCost
+}
+
+//IsRelay returns true if data of this pair goes through a turn server
+func (p *CandidatePair) IsRelay() bool {
+	return p.Local.Type == CandidateRelay || p.Remote.Type == CandidateRelay
+}
+
+func (p *CandidatePair) String() string {
+	return fmt.Sprintf("{l=%s,r=%s,priority=%x,nominated=%v}", p.Local.addr, p.Remote.addr, p.Priority, p.Nominated)
+}
+
+/*
+PairSelector chooses one pair from valid pairs, pairs are sorted from high priority to low,
+and it is never empty. The returned pair must be one of pairs.
+It's used to nominate with regular nomination, and to choose among nominated pairs
+when more than one is nominated (aggressive nomination), so it decides whether to switch the selected pair.
+*/
+type PairSelector func(pairs []*CandidatePair) *CandidatePair
+
+/*
+SelectHighestPriority is the default PairSelector of RFC 5245
+*/
+func SelectHighestPriority(pairs []*CandidatePair) *CandidatePair {
+	return pairs[0]
+}
+
+/*
+SelectLowestNetworkCost selects the pair with the lowest network-cost, the one with higher priority if equal.
+*/
+func SelectLowestNetworkCost(pairs []*CandidatePair) *CandidatePair {
+	selected := pairs[0]
+	for _, p := range pairs[1:] {
+		if p.NetworkCost() < selected.NetworkCost() {
+			selected = p
+		}
+	}
+	return selected
+}
+
+/*
+SelectDirectOverRelay selects the highest priority pair not using turn server,
+a relay pair is selected only if there is no other choice.
+*/
+func SelectDirectOverRelay(pairs []*CandidatePair) *CandidatePair {
+	for _, p := range pairs {
+		if !p.IsRelay() {
+			return p
+		}
+	}
+	return pairs[0]
+}
+
+/*
+SelectLowestRTT selects the pair with the lowest RTT, pairs without RTT are only used when no pair has RTT.
+*/
+func SelectLowestRTT(pairs []*CandidatePair) *CandidatePair {
+	var selected *CandidatePair
+	for _, p := range pairs {
+		if p.RTT > 0 && (selected == nil || p.RTT < selected.RTT) {
+			selected = p
+		}
+	}
+	if selected == nil {
+		return pairs[0]
+	}
+	return selected
+}
+
+var errNoValidPair = errors.New("no valid pair to nominate")
+
+func (c *sessionCheck) toCandidatePair() *CandidatePair {
+	return &CandidatePair{
+		Local:     c.localCandidate,
+		Remote:    c.remoteCandidate,
+		Priority:  c.priority,
+		Nominated: c.nominated,
+	}
+}
+
+/*
+按照 selector 从 valid list 中选择一个 check.
+*/
+func (s *session) selectValidCheck(selector PairSelector) *sessionCheck {
+	return s.selectCheck(s.validCheckList.checks, selector)
+}
+
+/*
+按照 selector 从 checks 中选择一个, checks 必须是按照优先级从高到低排好序的.
+*/
+func (s *session) selectCheck(checks []*sessionCheck, selector PairSelector) *sessionCheck {
+	if len(checks) == 0 {
+		return nil
+	}
+	if selector == nil {
+		selector = SelectHighestPriority
+	}
+	pairs := make([]*CandidatePair, len(checks))
+	for i, c := range checks {
+		pairs[i] = c.toCandidatePair()
+		if s.counter != nil {
+			pairs[i].RTT = s.counter.copyOf(pairID(c.localCandidate.addr, c.remoteCandidate.addr)).CurrentRoundTripTime
+		}
+	}
+	selected := selector(pairs)
+	for i, p := range pairs {
+		if p == selected {
+			return checks[i]
+		}
+	}
+	s.log.Error(fmt.Sprintf("pair selector returned unknown pair %s", selected))
+	return checks[0]
+}
+
+/*
+有多个 nominated pair 时, 由 pairSelector 决定使用哪一个, 没有指定 pairSelector 时使用优先级最高的.
+*/
+func (s *session) selectNominatedCheck() *sessionCheck {
+	var nominated []*sessionCheck
+	for _, c := range s.validCheckList.checks {
+		if c.nominated {
+			nominated = append(nominated, c)
+		}
+	}
+	if len(nominated) <= 1 {
+		return s.selectCheck(nominated, SelectHighestPriority)
+	}
+	return s.selectCheck(nominated, s.pairSelector)
+}
+
+/*
+8.1.1.1.  Regular Nomination
+With regular nomination, the agent lets some number of checks complete, each of which omit the
+USE-CANDIDATE attribute. Once one or more checks complete successfully for a component of a media
+stream, valid pairs are generated and added to the valid list. The agent picks a pair from the valid list,
+and sends a second STUN request on its generating pair, this time with the USE-CANDIDATE attribute.
+*/
+func (s *session) startNomination() error {
+	valid := s.selectValidCheck(s.pairSelector)
+	if valid == nil {
+		return errNoValidPair
+	}
+	generating := valid.generatingCheck
+	if generating == nil {
+		generating = valid
+	}
+	s.isNominating = true
+	c := &sessionCheck{
+		localCandidate:  generating.localCandidate,
+		remoteCandidate: generating.remoteCandidate,
+		key:             generating.key,
+		priority:        generating.priority,
+		state:           checkStateWaiting,
+		nominated:       true,
+	}
+	s.log.Trace(fmt.Sprintf("regular nomination, selected %s, send nominating check %s", valid, c.key))
+	s.checkList.checks = append(s.checkList.checks, c)
+	s.triggerCheck(c)
+	return nil
+}
@@ -0,0 +1,126 @@
+package ice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nkbai/log"
+)
+
+func TestSelectValidCheck(t *testing.T) {
+	s := &session{validCheckList: new(sessionCheckList)}
+	if s.selectValidCheck(nil) != nil {
+		t.Error("empty valid list should select nothing")
+	}
+	l := &Candidate{addr: "192.168.0.1:1000"}
+	r := &Candidate{addr: "192.168.0.2:1000"}
+	c1 := &sessionCheck{localCandidate: l, remoteCandidate: r, priority: 10}
+	c2 := &sessionCheck{localCandidate: l, remoteCandidate: r, priority: 5}
+	s.validCheckList.checks = []*sessionCheck{c1, c2}
+	if s.selectValidCheck(nil) != c1 {
+		t.Error("default selector should select highest priority")
+	}
+	last := func(pairs []*CandidatePair) *CandidatePair {
+		return pairs[len(pairs)-1]
+	}
+	if s.selectValidCheck(last) != c2 {
+		t.Error("selector not used")
+	}
+}
+
+func TestIceStreamTransport_RegularNomination(t *testing.T) {
+	cfg := NewTransportConfigHostonly()
+	cfg.Nomination = NominationRegular
+	selected := 0
+	cfg.PairSelector = func(pairs []*CandidatePair) *CandidatePair {
+		selected++
+		return pairs[len(pairs)-1]
+	}
+	s1, s2, _, _ := setupNegotiatedPair(t, cfg, cfg)
+	defer s1.Stop()
+	defer s2.Stop()
+	if selected != 1 {
+		t.Errorf("selector should be called once, called %d", selected)
+	}
+	if s1.session.aggresive {
+		t.Error("should use regular nomination")
+	}
+	nominated := s1.session.sessionComponent.nominatedCheck
+	if nominated == nil || !nominated.nominated {
+		t.Fatal("should have nominated check")
+	}
+	for _, c := range s1.session.validCheckList.checks {
+		if c != nominated && c.nominated {
+			t.Errorf("only one pair should be nominated, %s", c)
+		}
+	}
+	if err := s1.SendData([]byte("hello")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBuiltinPairSelectors(t *testing.T) {
+	host := &Candidate{Type: CandidateHost}
+	cellular := &Candidate{Type: CandidateHost, NetworkCost: 900}
+	relay := &Candidate{Type: CandidateRelay}
+	p1 := &CandidatePair{Local: cellular, Remote: host, Priority: 30, RTT: 50 * time.Millisecond}
+	p2 := &CandidatePair{Local: relay, Remote: host, Priority: 20, RTT: 10 * time.Millisecond}
+	p3 := &CandidatePair{Local: host, Remote: host, Priority: 10}
+	pairs := []*CandidatePair{p1, p2, p3}
+	if SelectLowestNetworkCost(pairs) != p2 {
+		t.Error("should select lowest network cost with highest priority")
+	}
+	if SelectDirectOverRelay([]*CandidatePair{p2, p3}) != p3 || SelectDirectOverRelay([]*CandidatePair{p2}) != p2 {
+		t.Error("should prefer direct pair")
+	}
+	if SelectLowestRTT(pairs) != p2 || SelectLowestRTT([]*CandidatePair{p3}) != p3 {
+		t.Error("should select lowest rtt")
+	}
+}
+
+/*
+多个 nominated pair 时由 PairSelector 决定是否切换.
+*/
+func TestMarkValidAndNominatedSelector(t *testing.T) {
+	s := &session{validCheckList: new(sessionCheckList), pairSelector: SelectLowestNetworkCost, log: log.New("name", "test")}
+	r := &Candidate{addr: "192.168.0.2:1000"}
+	c1 := &sessionCheck{localCandidate: &Candidate{addr: "192.168.0.1:1000"}, remoteCandidate: r, priority: 5, nominated: true}
+	c2 := &sessionCheck{localCandidate: &Candidate{addr: "10.0.0.1:1000", NetworkCost: 900}, remoteCandidate: r, priority: 10, nominated: true}
+	s.validCheckList.checks = []*sessionCheck{c1}
+	s.markValidAndNonimated(c1)
+	s.validCheckList.checks = []*sessionCheck{c2, c1}
+	s.markValidAndNonimated(c2)
+	if s.sessionComponent.nominatedCheck != c1 {
+		t.Errorf("should not switch to expensive pair, got %s", s.sessionComponent.nominatedCheck)
+	}
+	s.pairSelector = nil
+	s.markValidAndNonimated(c2)
+	if s.sessionComponent.nominatedCheck != c2 {
+		t.Errorf("default should switch to higher priority, got %s", s.sessionComponent.nominatedCheck)
+	}
+}
+
+func TestIceStreamTransport_NetworkCost(t *testing.T) {
+	cfg := NewTransportConfigHostonly()
+	cfg.GatherFilter = &GatherFilter{IncludeLoopback: true, IncludeCIDRs: []string{"127.0.0.1/32"}}
+	cfg.NetworkCosts = map[string]int{"127.0.0.0/8": 900}
+	cfg.PairSelector = SelectLowestNetworkCost
+	s1, s2, _, _ := setupNegotiatedPair(t, cfg, cfg)
+	defer s1.Stop()
+	defer s2.Stop()
+	for _, c := range s1.component.candidates {
+		if c.NetworkCost != 900 {
+			t.Errorf("network cost not set %s", c)
+		}
+	}
+	for _, c := range s2.session.remoteCandidates {
+		if c.Type == CandidateHost && c.NetworkCost != 900 {
+			t.Errorf("remote network cost not parsed %s", c)
+		}
+	}
+	bad := *cfg
+	bad.NetworkCosts = map[string]int{"127.0.0.1": 1}
+	if _, err := NewIceStreamTransport(&bad, "bad"); err == nil {
+		t.Error("invalid cidr should fail")
+	}
+}
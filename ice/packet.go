@@ -0,0 +1,78 @@
+package ice
+
+import (
+	"encoding/binary"
+)
+
+/*
+packetKind 是从 socket 收到的包的种类, 只根据包头判断, 不分配 stun.Message.
+*/
+type packetKind int
+
+const (
+	packetData packetKind = iota
+	packetSTUN
+	packetChannelData
+)
+
+const (
+	stunHeaderSize        = 20
+	stunMagicCookie       = 0x2112A442
+	channelDataHeaderSize = 4
+	/*
+		maxPacketSize 接收缓冲区的大小, 能放下任何一个 udp 包.
+	*/
+	maxPacketSize = 65536
+)
+
+func (k packetKind) String() string {
+	switch k {
+	case packetSTUN:
+		return "stun"
+	case packetChannelData:
+		return "channeldata"
+	}
+	return "data"
+}
+
+/*
+classifyPacket 按照 RFC 7983 根据第一个字节区分:
+1. 第一个字节在 64-79 之间(channel number 0x4000-0x4FFF), 并且长度正好是 4+length, 是 turn 的 channel data
+2. 前两位为0, magic cookie 正确, 长度正好是 20+length 并且是4的倍数, 是 stun message
+3. 其他的都是应用的数据
+*/
+func classifyPacket(b []byte) packetKind {
+	if len(b) < channelDataHeaderSize {
+		return packetData
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if b[0] >= 0x40 && b[0] <= 0x4F {
+		if length+channelDataHeaderSize == len(b) {
+			return packetChannelData
+		}
+		return packetData
+	}
+	if b[0]&0xC0 != 0 || len(b) < stunHeaderSize || length%4 != 0 || length+stunHeaderSize != len(b) {
+		return packetData
+	}
+	if binary.BigEndian.Uint32(b[4:8]) != stunMagicCookie {
+		return packetData
+	}
+	return packetSTUN
+}
+
+/*
+parseChannelData 返回 channel data 的 channel number 和其中的数据, b 必须是 packetChannelData.
+*/
+func parseChannelData(b []byte) (number int, data []byte) {
+	return int(binary.BigEndian.Uint16(b[0:2])), b[channelDataHeaderSize:]
+}
+
+/*
+putChannelData 把 data 编码成 channel data 写入 b, b 的长度必须是 4+len(data), udp 上不需要填充.
+*/
+func putChannelData(b []byte, number int, data []byte) {
+	binary.BigEndian.PutUint16(b[0:2], uint16(number))
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(data)))
+	copy(b[channelDataHeaderSize:], data)
+}
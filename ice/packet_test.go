@@ -0,0 +1,82 @@
+package ice
+
+import (
+	"testing"
+
+	"github.com/nkbai/goice/stun"
+	"github.com/nkbai/goice/turn"
+)
+
+func TestClassifyPacket(t *testing.T) {
+	req, err := stun.Build(stun.TransactionIDSetter, stun.BindingRequest, stun.Fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := stun.Build(turn.ChannelDataRequest)
+	cd := &turn.ChannelData{ChannelNumber: turn.MinChannelNumber, Data: []byte("hello")}
+	if err = cd.AddTo(r); err != nil {
+		t.Fatal(err)
+	}
+	badCookie := append([]byte{}, req.Raw...)
+	badCookie[4] ^= 0xff
+	cases := []struct {
+		name string
+		b    []byte
+		kind packetKind
+	}{
+		{"short", []byte{0, 1}, packetData},
+		{"stun", req.Raw, packetSTUN},
+		{"channeldata", r.Raw, packetChannelData},
+		{"badcookie", badCookie, packetData},
+		{"truncated", req.Raw[:len(req.Raw)-4], packetData},
+		{"text", []byte("hello world, this is not a stun message"), packetData},
+	}
+	for _, c := range cases {
+		if k := classifyPacket(c.b); k != c.kind {
+			t.Errorf("%s expect %s,got %s", c.name, c.kind, k)
+		}
+	}
+	//长度字段都正确, 只有第一个字节在 64-79 之间的才是 channel data
+	for _, c := range []struct {
+		first byte
+		kind  packetKind
+	}{
+		{0x3F, packetData},
+		{0x40, packetChannelData},
+		{0x4F, packetChannelData},
+		{0x50, packetData},
+		{0x7F, packetData},
+		{0x80, packetData},
+		{0xC0, packetData},
+		{0xFF, packetData},
+	} {
+		b := []byte{c.first, 0, 0, 4, 1, 2, 3, 4}
+		if k := classifyPacket(b); k != c.kind {
+			t.Errorf("first byte %#x expect %s,got %s", c.first, c.kind, k)
+		}
+	}
+	number, data := parseChannelData(r.Raw)
+	if number != turn.MinChannelNumber || string(data) != "hello" {
+		t.Errorf("channel data error %d %q", number, data)
+	}
+	b := make([]byte, channelDataHeaderSize+len("hello"))
+	putChannelData(b, turn.MinChannelNumber, []byte("hello"))
+	if string(b) != string(r.Raw) || classifyPacket(b) != packetChannelData {
+		t.Errorf("put channel data error %x", b)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		classifyPacket(req.Raw)
+		classifyPacket(r.Raw)
+	})
+	if allocs != 0 {
+		t.Errorf("classify should not allocate, got %f", allocs)
+	}
+}
+
+func BenchmarkClassifyPacket(b *testing.B) {
+	data := make([]byte, 1200)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		classifyPacket(data)
+	}
+}
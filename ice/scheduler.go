@@ -0,0 +1,231 @@
+package ice
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+check 的调度, RFC 8445 6.1.4.
+所有的 check 都在 session.loop 中发送, 每隔 Ta 最多开始一个新的 check:
+1. 先发送 triggered check 队列中的
+2. 然后是优先级最高的 waiting pair
+3. 都没有的时候, 解冻一个 foundation 和所有 waiting, in-progress pair 都不同的 frozen pair
+重传由同一个 checkTimer 驱动, 不再为每个 pair 启动一个协程.
+*/
+
+/*
+foundation of a pair is the local foundation plus the remote foundation.
+*/
+func (c *sessionCheck) foundation() string {
+	return c.localCandidate.Foundation + ":" + c.remoteCandidate.Foundation
+}
+
+/*
+RFC 8445 6.1.2.6 每个 foundation 中优先级最高的 pair 为 waiting, 其他都是 frozen.
+checklist 已经按照优先级排好序了.
+*/
+func (s *session) initCheckStates() {
+	fmap := make(map[string]bool)
+	for _, c := range s.checkList.checks {
+		if !fmap[c.foundation()] {
+			fmap[c.foundation()] = true
+			s.changeCheckState(c, checkStateWaiting, nil)
+		}
+	}
+}
+
+/*
+一个 check 成功以后, 相同 foundation 的 frozen pair 都可以开始了.
+*/
+func (s *session) unfreezeFoundation(foundation string) {
+	for _, c := range s.checkList.checks {
+		if c.state == checkStateFrozen && c.foundation() == foundation {
+			s.changeCheckState(c, checkStateWaiting, nil)
+		}
+	}
+}
+
+/*
+kick 通知 loop 有新的 check 可以发送了, 可以在任何协程中调用.
+*/
+func (s *session) kick() {
+	select {
+	case s.scheduleChan <- struct{}{}:
+	default:
+	}
+}
+
+/*
+triggerCheck 把 pair 放到 triggered check 队列中, in-progress 的 pair 会开始一个新的 transaction.
+*/
+func (s *session) triggerCheck(c *sessionCheck) {
+	if c.state == checkStateFrozen {
+		s.changeCheckState(c, checkStateWaiting, nil)
+	}
+	for _, c2 := range s.triggeredChecks {
+		if c2 == c {
+			return
+		}
+	}
+	s.triggeredChecks = append(s.triggeredChecks, c)
+	s.kick()
+}
+
+/*
+nextCheck 返回下一个要开始的 check, 没有可以开始的返回 nil.
+*/
+func (s *session) nextCheck() *sessionCheck {
+	for len(s.triggeredChecks) > 0 {
+		c := s.triggeredChecks[0]
+		s.triggeredChecks = s.triggeredChecks[1:]
+		if c.state == checkStateWaiting || c.state == checkStateInProgress {
+			return c
+		}
+	}
+	var best *sessionCheck
+	for _, c := range s.checkList.checks {
+		if c.state == checkStateWaiting && (best == nil || c.priority > best.priority) {
+			best = c
+		}
+	}
+	if best != nil {
+		return best
+	}
+	active := make(map[string]bool)
+	for _, c := range s.checkList.checks {
+		if c.state == checkStateWaiting || c.state == checkStateInProgress {
+			active[c.foundation()] = true
+		}
+	}
+	for _, c := range s.checkList.checks {
+		if c.state == checkStateFrozen && !active[c.foundation()] && (best == nil || c.priority > best.priority) {
+			best = c
+		}
+	}
+	if best != nil {
+		s.changeCheckState(best, checkStateWaiting, nil)
+	}
+	return best
+}
+
+/*
+sendCheck 为 check 开始一个新的 stun transaction.
+*/
+func (s *session) sendCheck(c *sessionCheck, now time.Time) {
+	if c.state < checkStateInProgress {
+		s.changeCheckState(c, checkStateInProgress, nil)
+	}
+	if c.req != nil {
+		s.deleteMsgCheck(c.req.TransactionID)
+	}
+	if s.isNominating && s.role == SessionRoleControlling {
+		c.nominated = true
+	}
+	s.log.Trace(fmt.Sprintf("start check %s", c.key))
+	c.req = s.buildBindingRequest(c)
+	c.transmits = 0
+	s.transmit(c, now)
+}
+
+/*
+checkRTO 是 check 第一次重传的时间, RFC 8445 14.3:
+RTO = MAX (500ms, Ta * (Num-Waiting + Num-In-Progress)), 500ms 可以通过 Timing.RTO 修改.
+*/
+func (s *session) checkRTO() time.Duration {
+	n := 0
+	for _, c := range s.checkList.checks {
+		if c.state == checkStateWaiting || c.state == checkStateInProgress {
+			n++
+		}
+	}
+	rto := s.ta * time.Duration(n)
+	if rto < s.timing.RTO {
+		rto = s.timing.RTO
+	}
+	return rto
+}
+
+/*
+transmit 发送一次 check 的请求, 之后每次重传的间隔加倍, 最多到 Timing.MaxRTO.
+*/
+func (s *session) transmit(c *sessionCheck, now time.Time) {
+	if c.transmits == 0 {
+		c.rto = s.checkRTO()
+	} else {
+		c.rto *= 2
+		if c.rto > s.timing.MaxRTO {
+			c.rto = s.timing.MaxRTO
+		}
+	}
+	c.transmits++
+	c.retransmitAt = now.Add(c.rto)
+	s.log.Trace(fmt.Sprintf("%s sendData %d times,bindingrequestlength=%d", c.key, c.transmits, len(c.req.Raw)))
+	serversock, err := s.getSenderServerSock(c.localCandidate.addr)
+	if err != nil {
+		s.log.Error(err.Error())
+		return
+	}
+	s.addMsgCheck(c.req.TransactionID, c)
+	err = serversock.sendStunMessageAsync(c.req, c.localCandidate.sendAddr(), c.remoteCandidate.addr)
+	s.counter.requestSent(pairID(c.localCandidate.addr, c.remoteCandidate.addr), c.req.TransactionID)
+	if err != nil {
+		s.log.Debug(fmt.Sprintf("send binding request from %s to %s ,err %s", c.localCandidate.addr, c.remoteCandidate.addr, err))
+	}
+}
+
+/*
+runScheduler 在 loop 中运行: 按照 Ta 开始新的 check, 重传到期的 check, 最后设置下一次的定时器.
+*/
+func (s *session) runScheduler() {
+	now := s.clock.Now()
+	if s.checksStarted && s.pacePending && !now.Before(s.nextPace) {
+		if c := s.nextCheck(); c != nil {
+			s.sendCheck(c, now)
+			s.nextPace = now.Add(s.ta)
+		} else {
+			//等待其他 check 结束或者新的 triggered check
+			s.pacePending = false
+		}
+	}
+	checks := append([]*sessionCheck{}, s.checkList.checks...)
+	for _, c := range checks {
+		if c.state != checkStateInProgress || c.req == nil || now.Before(c.retransmitAt) {
+			continue
+		}
+		if c.transmits >= s.timing.MaxRetransmits {
+			//探测了 MaxRetransmits 次,没有任何结果,失败.
+			s.changeCheckState(c, checkStateFailed, errTriedTooManyTimes)
+			s.tryCompleteCheck(c)
+			continue
+		}
+		s.transmit(c, now)
+	}
+	s.resetCheckTimer(now)
+}
+
+func (s *session) resetCheckTimer(now time.Time) {
+	var next time.Time
+	if s.pacePending {
+		next = s.nextPace
+	}
+	for _, c := range s.checkList.checks {
+		if c.state == checkStateInProgress && c.req != nil && (next.IsZero() || c.retransmitAt.Before(next)) {
+			next = c.retransmitAt
+		}
+	}
+	if !s.checkTimer.Stop() {
+		select {
+		case <-s.checkTimer.C():
+		default:
+		}
+	}
+	if next.IsZero() {
+		return
+	}
+	d := next.Sub(now)
+	if d < 0 {
+		d = 0
+	}
+	s.checkTimer.Reset(d)
+}
@@ -0,0 +1,208 @@
+package ice
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nkbai/goice/vnet"
+)
+
+func newTestCandidate(typ CandidateType, addr, base string) *Candidate {
+	return &Candidate{
+		Type:        typ,
+		addr:        addr,
+		baseAddr:    base,
+		ComponentID: 1,
+		transport:   TransportUDP,
+		Priority:    calcCandidatePriority(typ, defaultPreference, 1),
+		Foundation:  calcFoundation(typ, base, "", TransportUDP),
+	}
+}
+
+/*
+两个本地地址, 每个都有 host 和 srflx, 对方两个 host candidate.
+srflx 的 pair 被 prune 掉以后, 每个 foundation 中优先级最高的是 waiting.
+*/
+func TestCheckListStates(t *testing.T) {
+	var locals []*Candidate
+	for i := 1; i <= 2; i++ {
+		base := fmt.Sprintf("192.168.1.%d:5000", i)
+		locals = append(locals, newTestCandidate(CandidateHost, base, base),
+			newTestCandidate(CandidateServerReflexive, fmt.Sprintf("1.0.0.%d:4000", i), base))
+	}
+	remotes := []*Candidate{
+		newTestCandidate(CandidateHost, "10.0.0.1:6000", "10.0.0.1:6000"),
+		newTestCandidate(CandidateHost, "10.0.0.1:6001", "10.0.0.1:6001"),
+	}
+	s := newIceSession("s", SessionRoleControlling, locals, nil, nil)
+	if err := s.createCheckList(&sessionDescription{candidates: remotes}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.checkList.checks) != 4 {
+		t.Fatalf("srflx pairs should be pruned\n%s", s.checkList)
+	}
+	for _, c := range s.checkList.checks {
+		if c.localCandidate.Type != CandidateHost {
+			t.Errorf("pair with srflx should be pruned %s", c)
+		}
+	}
+	s.initCheckStates()
+	//同一个 ip 的两个端口 foundation 相同
+	waiting := 0
+	for _, c := range s.checkList.checks {
+		if c.state == checkStateWaiting {
+			waiting++
+		}
+	}
+	if waiting != 2 {
+		t.Fatalf("one waiting pair for each foundation\n%s", s.checkList)
+	}
+	s.checksStarted = true
+	//triggered check 优先
+	last := s.checkList.checks[3]
+	s.triggerCheck(last)
+	if c := s.nextCheck(); c != last || c.state != checkStateWaiting {
+		t.Fatalf("triggered check should be first, got %s", c)
+	}
+	s.changeCheckState(last, checkStateInProgress, nil)
+	var started []*sessionCheck
+	for c := s.nextCheck(); c != nil; c = s.nextCheck() {
+		s.changeCheckState(c, checkStateInProgress, nil)
+		started = append(started, c)
+	}
+	//另一个 pair 和 in-progress 的 pair 的 foundation 相同, 只能等它成功
+	if len(started) != 2 {
+		t.Fatalf("frozen pair with active foundation should not start, started %v\n%s", started, s.checkList)
+	}
+	var frozen *sessionCheck
+	for _, c := range s.checkList.checks {
+		if c.state == checkStateFrozen {
+			frozen = c
+		}
+	}
+	if frozen == nil {
+		t.Fatalf("one pair should be frozen\n%s", s.checkList)
+	}
+	s.unfreezeFoundation(frozen.foundation())
+	if c := s.nextCheck(); c != frozen {
+		t.Errorf("pair should be unfrozen after success, got %s", c)
+	}
+}
+
+func TestCheckListLimit(t *testing.T) {
+	var locals, remotes []*Candidate
+	for i := 1; i <= 12; i++ {
+		addr := fmt.Sprintf("192.168.1.%d:5000", i)
+		locals = append(locals, newTestCandidate(CandidateHost, addr, addr))
+		addr = fmt.Sprintf("10.0.0.%d:5000", i)
+		remotes = append(remotes, newTestCandidate(CandidateHost, addr, addr))
+	}
+	s := newIceSession("s", SessionRoleControlling, locals, nil, nil)
+	if err := s.createCheckList(&sessionDescription{candidates: remotes}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.checkList.checks) != defaultMaxCheckListSize {
+		t.Errorf("check list should be limited to %d, got %d", defaultMaxCheckListSize, len(s.checkList.checks))
+	}
+	for i := 1; i < len(s.checkList.checks); i++ {
+		if s.checkList.checks[i].priority > s.checkList.checks[i-1].priority {
+			t.Fatal("lower priority pairs should be dropped")
+		}
+	}
+}
+
+/*
+pacecb 记录每个 check 开始的时间.
+*/
+type pacecb struct {
+	*icecb
+	lock   sync.Mutex
+	starts []time.Time
+}
+
+func (c *pacecb) OnEvent(e *Event) {
+	if e.Type == EventCheckStateChanged && e.CheckState == checkStateInProgress {
+		c.lock.Lock()
+		c.starts = append(c.starts, time.Now())
+		c.lock.Unlock()
+	}
+}
+
+/*
+每台主机有很多地址, pair 的数量超过了限制, 仍然可以协商成功, 而且新的 check 之间至少间隔 Ta.
+*/
+func TestIceStreamTransport_ManyInterfaces(t *testing.T) {
+	lan, err := vnet.NewRouter(&vnet.RouterConfig{Name: "lan", CIDR: "10.0.0.0/16", Latency: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfgs []*TransportConfig
+	for i := 1; i <= 2; i++ {
+		var ips []string
+		for j := 1; j <= 12; j++ {
+			ips = append(ips, fmt.Sprintf("10.0.%d.%d", i, j))
+		}
+		n, err := vnet.NewNet(&vnet.NetConfig{StaticIPs: ips})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = lan.AddNet(n); err != nil {
+			t.Fatal(err)
+		}
+		cfg := NewTransportConfigHostonly()
+		cfg.Net = n
+		cfg.CheckInterval = 20 * time.Millisecond
+		cfgs = append(cfgs, cfg)
+	}
+	s1, err := NewIceStreamTransport(cfgs[0], "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop()
+	s2, err := NewIceStreamTransport(cfgs[1], "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Stop()
+	if len(s1.component.candidates) != 12 {
+		t.Fatalf("all addresses should be gathered, got %d", len(s1.component.candidates))
+	}
+	cb1, cb2 := &pacecb{icecb: newicecb("s1")}, newicecb("s2")
+	s1.cb, s2.cb = cb1, cb2
+	if err = s1.InitIce(SessionRoleControlling); err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.InitIce(SessionRoleControlled); err != nil {
+		t.Fatal(err)
+	}
+	lsdp, _ := s1.EncodeSession()
+	rsdp, _ := s2.EncodeSession()
+	if err = s2.StartNegotiation(lsdp); err != nil {
+		t.Fatal(err)
+	}
+	if err = s1.StartNegotiation(rsdp); err != nil {
+		t.Fatal(err)
+	}
+	for _, cb := range []*icecb{cb1.icecb, cb2} {
+		select {
+		case <-time.After(20 * time.Second):
+			t.Fatalf("%s negotiation timeout", cb.name)
+		case err = <-cb.iceresult:
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	cb1.lock.Lock()
+	defer cb1.lock.Unlock()
+	if len(cb1.starts) < 2 {
+		t.Fatalf("too few checks %d", len(cb1.starts))
+	}
+	for i := 1; i < len(cb1.starts); i++ {
+		if d := cb1.starts[i].Sub(cb1.starts[i-1]); d < 15*time.Millisecond {
+			t.Errorf("checks should be paced by Ta, got %s", d)
+		}
+	}
+}
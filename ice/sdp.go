@@ -0,0 +1,173 @@
+package ice
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/nkbai/goice/sdp"
+	"github.com/nkbai/log"
+)
+
+/*
+sdp 中和 ICE 相关的属性, RFC 8839
+*/
+const (
+	sdpIceLite         = "ice-lite"
+	sdpIceUfrag        = "ice-ufrag"
+	sdpIcePwd          = "ice-pwd"
+	sdpIceOptions      = "ice-options"
+	sdpCandidate       = "candidate"
+	sdpEndOfCandidates = "end-of-candidates"
+	/*
+		RFC 8445 去掉了 aggressive nomination, 只有 regular nomination 时才声明 ice2.
+	*/
+	sdpIceOptionIce2 = "ice2"
+)
+
+var (
+	errNoMediaDescription = errors.New("no media description in sdp")
+	errNoIceCredentials   = errors.New("no ice-ufrag or ice-pwd in sdp")
+	errNoCandidate        = errors.New("no candidate in sdp")
+)
+
+/*
+encodeSession 只有一个 stream, 所以只有一个 m 行, 缺省地址是 default candidate.
+ufrag 和 pwd 放在 media 级别, 和浏览器一样.
+*/
+func encodeSession(ufrag, pwd string, lite bool, options []string, def *Candidate, candidates []*Candidate, id int) string {
+	var s sdp.Session
+	s = s.AddVersion(0)
+	s = s.AddOrigin(sdp.Origin{
+		Username:       "-",
+		SessionID:      id,
+		SessionVersion: id,
+		Address:        "localhost",
+	})
+	s = s.AddSessionName("ice")
+	s = s.AddTimingNTP(0, 0)
+	if lite {
+		s = s.AddFlag(sdpIceLite)
+	}
+	if len(options) > 0 {
+		s = s.AddAttribute(sdpIceOptions, options...)
+	}
+	addr := addrToUDPAddr(def.addr)
+	s = s.AddMediaDescription(sdp.MediaDescription{
+		Type:     "audio",
+		Port:     addr.Port,
+		Protocol: "RTP/AVP",
+		Format:   "0",
+	})
+	s = s.AddConnectionDataIP(addr.IP)
+	s = s.AddAttribute(sdpIceUfrag, ufrag)
+	s = s.AddAttribute(sdpIcePwd, pwd)
+	for _, c := range candidates {
+		s = s.AddAttribute(sdpCandidate, c.attributeValue())
+	}
+	//所有 candidate 都收集完了才会编码
+	s = s.AddFlag(sdpEndOfCandidates)
+	return string(s.AppendTo(nil)) + "\n"
+}
+
+/*
+选择第一个有 candidate 的 media, 使用 bundle 的时候浏览器只在第一个 media 中给出 candidate,
+或者每个 media 中都是一样的. 都没有 candidate 时使用第一个 media.
+*/
+func iceMedia(m *sdp.Message) *sdp.Media {
+	for i := range m.Medias {
+		if len(m.Medias[i].Attributes.Values(sdpCandidate)) > 0 {
+			return &m.Medias[i]
+		}
+	}
+	return &m.Medias[0]
+}
+
+/*
+media 级别的属性优先, 没有时使用 session 级别的
+*/
+func iceAttribute(m *sdp.Message, media *sdp.Media, key string) string {
+	if v := media.Attribute(key); len(v) > 0 {
+		return v
+	}
+	return m.Attribute(key)
+}
+
+func decodeSession(str string) (session *sessionDescription, err error) {
+	var s sdp.Session
+	s, err = sdp.DecodeSession([]byte(str), s)
+	if err != nil {
+		return
+	}
+	m := new(sdp.Message)
+	d := sdp.NewDecoder(s)
+	if err = d.Decode(m); err != nil {
+		return
+	}
+	if len(m.Medias) == 0 {
+		return nil, errNoMediaDescription
+	}
+	media := iceMedia(m)
+	session = &sessionDescription{
+		lite:     m.Flag(sdpIceLite),
+		user:     iceAttribute(m, media, sdpIceUfrag),
+		password: iceAttribute(m, media, sdpIcePwd),
+	}
+	if len(session.user) == 0 || len(session.password) == 0 {
+		return nil, errNoIceCredentials
+	}
+	for _, v := range media.Attributes.Values(sdpCandidate) {
+		parser := candidateParser{
+			buf: []byte(v),
+			c:   new(Candidate),
+		}
+		if err := parser.parse(); err != nil {
+			//不认识的 candidate(比如其他传输方式或者扩展)不影响其他 candidate
+			log.Warn(fmt.Sprintf("ignore candidate %q err %s", v, err))
+			continue
+		}
+		//只支持一个 component, 浏览器可能给出 rtcp 的 candidate
+		if parser.c.ComponentID != 1 {
+			continue
+		}
+		session.candidates = append(session.candidates, parser.c)
+	}
+	conn := media.Connection
+	if conn.Blank() {
+		conn = m.Connection
+	}
+	if conn.IP == nil {
+		return nil, fmt.Errorf("no connection data in sdp %s", str)
+	}
+	session.defaultIP = conn.IP.String()
+	session.defaultPort = media.Description.Port
+	if conn.IP.IsUnspecified() {
+		//trickle ice 的占位地址, 没有 default candidate, candidate 也可以一个都没有
+		return
+	}
+	if len(session.candidates) == 0 {
+		return nil, errNoCandidate
+	}
+	def := net.JoinHostPort(session.defaultIP, strconv.Itoa(session.defaultPort))
+	for _, c := range session.candidates {
+		if addrToUDPAddr(c.addr).String() == addrToUDPAddr(def).String() {
+			session.defautCandidate = c
+			break
+		}
+	}
+	if session.defautCandidate == nil && !hasHostname(session.candidates) {
+		//缺省地址可能是 .local 或者域名 candidate 解析以后的地址
+		err = fmt.Errorf("no default candidate found %s", def)
+	}
+	return
+}
+
+func hasHostname(candidates []*Candidate) bool {
+	for _, c := range candidates {
+		if len(c.hostname()) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package ice
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeSession(t *testing.T) {
+	host := &Candidate{Foundation: "1", ComponentID: 1, transport: TransportUDP, Priority: 2130706431,
+		addr: "192.168.1.2:5000", Type: CandidateHost}
+	srflx := &Candidate{Foundation: "2", ComponentID: 1, transport: TransportUDP, Priority: 1694498815,
+		addr: "1.2.3.4:40000", baseAddr: "192.168.1.2:5000", Type: CandidateServerReflexive}
+	v6 := &Candidate{Foundation: "3", ComponentID: 1, transport: TransportUDP, Priority: 2130706175,
+		addr: "[2001:db8::1]:5000", Type: CandidateHost}
+	str := encodeSession("ufrag", "pwd", true, []string{sdpIceOptionIce2}, srflx, []*Candidate{host, srflx, v6}, 123)
+	expect := `v=0
+o=- 123 123 IN IP4 localhost
+s=ice
+t=0 0
+a=ice-lite
+a=ice-options:ice2
+m=audio 40000 RTP/AVP 0
+c=IN IP4 1.2.3.4
+a=ice-ufrag:ufrag
+a=ice-pwd:pwd
+a=candidate:1 1 UDP 2130706431 192.168.1.2 5000 typ host
+a=candidate:2 1 UDP 1694498815 1.2.3.4 40000 typ srflx raddr 192.168.1.2 rport 5000
+a=candidate:3 1 UDP 2130706175 2001:db8::1 5000 typ host
+a=end-of-candidates
+`
+	if str != expect {
+		t.Fatalf("encode error, got\n%s", str)
+	}
+	sd, err := decodeSession(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sd.lite || sd.user != "ufrag" || sd.password != "pwd" || len(sd.candidates) != 3 {
+		t.Errorf("decode error %+v", sd)
+	}
+	if sd.defautCandidate == nil || sd.defautCandidate.addr != srflx.addr {
+		t.Error("default candidate error")
+	}
+	if sd.candidates[1].relatedAddr != "192.168.1.2:5000" || sd.candidates[2].addr != "[2001:db8::1]:5000" {
+		t.Errorf("candidate address error %s %s", sd.candidates[1].relatedAddr, sd.candidates[2].addr)
+	}
+}
+
+/*
+浏览器生成的 offer, 有多个 m 行, bundle, 带冒号的属性, rtcp 的 candidate 以及 ipv6.
+*/
+const browserOffer = "v=0\r\n" +
+	"o=- 4611731400430051336 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"a=group:BUNDLE 0 1\r\n" +
+	"a=ice-options:trickle\r\n" +
+	"a=msid-semantic: WMS\r\n" +
+	"m=audio 54400 UDP/TLS/RTP/SAVPF 111 103\r\n" +
+	"c=IN IP6 2001:db8::2\r\n" +
+	"a=rtcp:9 IN IP4 0.0.0.0\r\n" +
+	"a=candidate:842163049 1 udp 1677729535 2001:db8::2 54400 typ srflx raddr :: rport 0 generation 0 network-cost 999\r\n" +
+	"a=candidate:1 1 UDP 2122260223 192.168.1.5 54401 typ host generation 0\r\n" +
+	"a=candidate:1 2 udp 2122260222 192.168.1.5 54402 typ host generation 0\r\n" +
+	"a=end-of-candidates\r\n" +
+	"a=ice-ufrag:EsAw\r\n" +
+	"a=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\n" +
+	"a=fingerprint:sha-256 D1:2C:BE:AD:C4:F6:64:5C:25:16:11:9C:AF:E7:0F:73:79:36:4E:9C:1E:15:54:39:0C:06:8B:ED:96:86:00:39\r\n" +
+	"a=setup:actpass\r\n" +
+	"a=mid:0\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=ice-ufrag:EsAw\r\n" +
+	"a=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\n" +
+	"a=mid:1\r\n" +
+	"a=bundle-only\r\n"
+
+func TestDecodeSessionBrowserOffer(t *testing.T) {
+	sd, err := decodeSession(browserOffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd.user != "EsAw" || sd.password != "P2uYro0UCOQ4zxjKXaWCBui1" || sd.lite {
+		t.Errorf("credentials error %+v", sd)
+	}
+	if len(sd.candidates) != 2 {
+		t.Fatalf("rtcp candidate should be ignored, got %d", len(sd.candidates))
+	}
+	c := sd.candidates[0]
+	if c.addr != "[2001:db8::2]:54400" || c.NetworkCost != 999 || c.Foundation != "842163049" {
+		t.Errorf("ipv6 candidate error %+v", c)
+	}
+	if sd.defautCandidate != c || sd.defaultIP != "2001:db8::2" || sd.defaultPort != 54400 {
+		t.Errorf("default candidate error %s %d", sd.defaultIP, sd.defaultPort)
+	}
+}
+
+func TestDecodeSessionLevelCredentials(t *testing.T) {
+	//老版本的格式, ufrag 在 session 级别, 没有 end-of-candidates
+	str := strings.Join([]string{
+		"v=0",
+		"o=- 3414953978 3414953978 IN IP4 localhost",
+		"s=ice",
+		"t=0 0",
+		"a=ice-ufrag:088e4954",
+		"a=ice-pwd:35702e2f",
+		"m=audio 59951 RTP/AVP 0",
+		"c=IN IP4 172.20.10.6",
+		"a=candidate:Hac140a06 1 UDP 2130706431 172.20.10.6 59951 typ host",
+		"",
+	}, "\n")
+	sd, err := decodeSession(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd.user != "088e4954" || sd.password != "35702e2f" || sd.defautCandidate == nil {
+		t.Errorf("decode error %+v", sd)
+	}
+	//media 级别的优先
+	str = strings.Replace(str, "a=candidate:", "a=ice-ufrag:media\na=candidate:", 1)
+	if sd, err = decodeSession(str); err != nil || sd.user != "media" {
+		t.Errorf("media level ufrag should be used, %v", err)
+	}
+	//无法解析的 candidate 被跳过
+	bad := strings.Replace(str, "a=candidate:", "a=candidate:Hbad 1 UDP 1 172.20.10.6 59952 typ unknown\na=candidate:", 1)
+	if sd, err = decodeSession(bad); err != nil || len(sd.candidates) != 1 || sd.defautCandidate == nil {
+		t.Errorf("bad candidate should be skipped, %v", err)
+	}
+	noCandidate := strings.Replace(str, "a=candidate:", "a=x-candidate:", 1)
+	//trickle 占位的地址不需要 default candidate, 也可以没有 candidate
+	str = strings.Replace(str, "c=IN IP4 172.20.10.6", "c=IN IP4 0.0.0.0", 1)
+	if sd, err = decodeSession(str); err != nil || sd.defautCandidate != nil {
+		t.Errorf("placeholder address should be allowed, %v", err)
+	}
+	if sd, err = decodeSession(strings.Replace(str, "a=candidate:", "a=x-candidate:", 1)); err != nil || len(sd.candidates) != 0 {
+		t.Errorf("placeholder address without candidates should be allowed, %v", err)
+	}
+	for _, bad := range []string{
+		strings.Replace(str, "a=ice-pwd:35702e2f\n", "", 1),
+		noCandidate,
+		str[:strings.Index(str, "m=")],
+	} {
+		if _, err = decodeSession(bad); err == nil {
+			t.Errorf("should fail\n%s", bad)
+		}
+	}
+}
+
+/*
+对方的 sdp 只有 trickle 的占位地址, 没有 candidate, 从对方的 check 中发现 peer reflexive candidate 以后协商成功.
+*/
+func TestIceStreamTransport_DecodeSessionNoCandidate(t *testing.T) {
+	cfgs := newStaticLANConfigs(t, "10.1.1.1", "10.1.2.1")
+	s1, err := NewIceStreamTransport(cfgs[0], "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop()
+	s2, err := NewIceStreamTransport(cfgs[1], "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Stop()
+	cb1, cb2 := newicecb("s1"), newicecb("s2")
+	s1.cb, s2.cb = cb1, cb2
+	if err = s1.InitIce(SessionRoleControlling); err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.InitIce(SessionRoleControlled); err != nil {
+		t.Fatal(err)
+	}
+	lsdp, _ := s1.EncodeSession()
+	rsdp, _ := s2.EncodeSession()
+	var lines []string
+	for _, l := range strings.Split(rsdp, "\n") {
+		if !strings.HasPrefix(l, "a=candidate:") {
+			lines = append(lines, l)
+		}
+	}
+	rsdp = strings.Replace(strings.Join(lines, "\n"), "c=IN IP4 10.1.2.1", "c=IN IP4 0.0.0.0", 1)
+	if err = s1.StartNegotiation(rsdp); err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.StartNegotiation(lsdp); err != nil {
+		t.Fatal(err)
+	}
+	for _, cb := range []*icecb{cb1, cb2} {
+		select {
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s negotiation timeout", cb.name)
+		case err = <-cb.iceresult:
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if c := s1.getSession().getNominatedCheck(); c == nil || c.remoteCandidate.Type != CandidatePeerReflexive {
+		t.Errorf("remote candidate should be peer reflexive, %v", c)
+	}
+	exchangeData(t, s1, s2, cb1, cb2)
+}
+
+func TestSameAddressFamily(t *testing.T) {
+	if !sameAddressFamily("1.2.3.4:1", "5.6.7.8:2") || !sameAddressFamily("[::1]:1", "[2001:db8::1]:2") {
+		t.Error("same family")
+	}
+	if sameAddressFamily("1.2.3.4:1", "[2001:db8::1]:2") {
+		t.Error("different family")
+	}
+}
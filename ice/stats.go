@@ -0,0 +1,295 @@
+package ice
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nkbai/goice/clock"
+	"github.com/nkbai/goice/stun"
+)
+
+/*
+CandidatePairStats is like RTCIceCandidatePairStats of WebRTC,
+ID is "localaddr-remoteaddr", LocalCandidateID and RemoteCandidateID are IDs of CandidateStats.
+*/
+type CandidatePairStats struct {
+	ID                string
+	LocalCandidateID  string
+	RemoteCandidateID string
+	State             SessionCheckState
+	Nominated         bool
+	Selected          bool //used to send data now
+	Priority          uint64
+
+	CurrentRoundTripTime time.Duration //rtt of the latest binding request
+	TotalRoundTripTime   time.Duration //sum of all rtt, average is TotalRoundTripTime/ResponsesReceived
+
+	RequestsSent      uint64 //binding requests sent, including retransmissions and consent
+	RequestsReceived  uint64
+	ResponsesSent     uint64
+	ResponsesReceived uint64
+	PacketsSent       uint64 //data only, stun messages not included
+	PacketsReceived   uint64
+	BytesSent         uint64
+	BytesReceived     uint64
+
+	LastRequestSent      time.Time
+	LastRequestReceived  time.Time
+	LastResponseReceived time.Time
+	LastPacketSent       time.Time
+	LastPacketReceived   time.Time
+}
+
+/*
+CandidateStats is like RTCIceCandidateStats of WebRTC, ID is the address of candidate.
+*/
+type CandidateStats struct {
+	ID             string
+	Type           CandidateType
+	Address        string
+	BaseAddress    string
+	RelatedAddress string
+	Transport      TransportType
+	Priority       int
+	NetworkCost    int
+}
+
+/*
+Stats is a snapshot of all candidates and pairs of a StreamTransport.
+*/
+type Stats struct {
+	Timestamp        time.Time
+	Pairs            []*CandidatePairStats
+	LocalCandidates  []*CandidateStats
+	RemoteCandidates []*CandidateStats
+	SelectedPairID   string //empty if no pair selected
+}
+
+/*
+Pair returns stats of pair id, nil if not found
+*/
+func (s *Stats) Pair(id string) *CandidatePairStats {
+	for _, p := range s.Pairs {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+//SelectedPair returns stats of the selected pair, nil if not selected
+func (s *Stats) SelectedPair() *CandidatePairStats {
+	if s.SelectedPairID == "" {
+		return nil
+	}
+	return s.Pair(s.SelectedPairID)
+}
+
+func pairID(localAddr, remoteAddr string) string {
+	return fmt.Sprintf("%s-%s", localAddr, remoteAddr)
+}
+
+/*
+超过这么多个没有回应的请求时, 清除很早以前的, 防止对方一直不回应导致内存增长.
+*/
+const maxPendingStatsRequests = 256
+
+/*
+pairCounter 记录每个 pair 的统计数据, 收发数据和 stun 消息的 goroutine 都会修改,
+所以使用单独的锁.
+*/
+type pairCounter struct {
+	lock     sync.Mutex
+	pairs    map[string]*CandidatePairStats
+	requests map[stun.TransactionID]time.Time //binding request 发送时间,用于计算 rtt
+	clock    clock.Clock
+}
+
+func newPairCounter(c clock.Clock) *pairCounter {
+	return &pairCounter{
+		pairs:    make(map[string]*CandidatePairStats),
+		requests: make(map[stun.TransactionID]time.Time),
+		clock:    c,
+	}
+}
+
+func (pc *pairCounter) get(id string) *CandidatePairStats {
+	p, ok := pc.pairs[id]
+	if !ok {
+		p = &CandidatePairStats{ID: id}
+		pc.pairs[id] = p
+	}
+	return p
+}
+
+func (pc *pairCounter) requestSent(id string, tid stun.TransactionID) {
+	now := pc.clock.Now()
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if len(pc.requests) >= maxPendingStatsRequests {
+		for k, t := range pc.requests {
+			if now.Sub(t) > time.Minute {
+				delete(pc.requests, k)
+			}
+		}
+	}
+	pc.requests[tid] = now
+	p := pc.get(id)
+	p.RequestsSent++
+	p.LastRequestSent = now
+}
+
+/*
+重传的请求使用同一个 transaction id, rtt 是从最后一次发送开始计算的.
+*/
+func (pc *pairCounter) responseReceived(id string, tid stun.TransactionID) {
+	now := pc.clock.Now()
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	p := pc.get(id)
+	p.ResponsesReceived++
+	p.LastResponseReceived = now
+	if sent, ok := pc.requests[tid]; ok {
+		delete(pc.requests, tid)
+		p.CurrentRoundTripTime = now.Sub(sent)
+		p.TotalRoundTripTime += p.CurrentRoundTripTime
+	}
+}
+
+func (pc *pairCounter) requestReceived(id string) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	p := pc.get(id)
+	p.RequestsReceived++
+	p.LastRequestReceived = pc.clock.Now()
+}
+
+func (pc *pairCounter) responseSent(id string) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	pc.get(id).ResponsesSent++
+}
+
+func (pc *pairCounter) dataSent(id string, n int) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	p := pc.get(id)
+	p.PacketsSent++
+	p.BytesSent += uint64(n)
+	p.LastPacketSent = pc.clock.Now()
+}
+
+func (pc *pairCounter) dataReceived(id string, n int) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	p := pc.get(id)
+	p.PacketsReceived++
+	p.BytesReceived += uint64(n)
+	p.LastPacketReceived = pc.clock.Now()
+}
+
+func (pc *pairCounter) copyOf(id string) CandidatePairStats {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if p, ok := pc.pairs[id]; ok {
+		return *p
+	}
+	return CandidatePairStats{ID: id}
+}
+
+func candidateStats(c *Candidate) *CandidateStats {
+	return &CandidateStats{
+		ID:             c.addr,
+		Type:           c.Type,
+		Address:        c.addr,
+		BaseAddress:    c.baseAddr,
+		RelatedAddress: c.relatedAddr,
+		Transport:      c.transport,
+		Priority:       c.Priority,
+		NetworkCost:    c.NetworkCost,
+	}
+}
+
+/*
+收到数据或者请求的 pair, localAddr 可能是 socket 的地址, 需要转换成 candidate 的地址.
+*/
+func (s *session) pairIDOf(localAddr, remoteAddr string) string {
+	if c := s.findLocalCandidate(localAddr); c != nil {
+		localAddr = c.addr
+	}
+	return pairID(localAddr, remoteAddr)
+}
+
+/*
+buildStats 只能在 loop 中或者 session 停止以后调用, 因为 checklist 只在 loop 中修改.
+*/
+func (s *session) buildStats() *Stats {
+	st := &Stats{Timestamp: s.clock.Now()}
+	for _, c := range s.localCandidates {
+		st.LocalCandidates = append(st.LocalCandidates, candidateStats(c))
+	}
+	for _, c := range s.remoteCandidates {
+		st.RemoteCandidates = append(st.RemoteCandidates, candidateStats(c))
+	}
+	s.mlock.Lock()
+	selected := s.sessionComponent.nominatedCheck
+	s.mlock.Unlock()
+	if selected != nil {
+		st.SelectedPairID = pairID(selected.localCandidate.addr, selected.remoteCandidate.addr)
+	}
+	add := func(c *sessionCheck, valid bool) {
+		id := pairID(c.localCandidate.addr, c.remoteCandidate.addr)
+		p := st.Pair(id)
+		if p == nil {
+			ps := s.counter.copyOf(id)
+			p = &ps
+			p.LocalCandidateID = c.localCandidate.addr
+			p.RemoteCandidateID = c.remoteCandidate.addr
+			p.Priority = c.priority
+			p.Selected = id == st.SelectedPairID
+			p.State = c.state
+			st.Pairs = append(st.Pairs, p)
+		}
+		//valid list 中的 pair 一定是成功的, 即使 checklist 中对应的 check 后来失败了
+		if valid {
+			p.State = checkStateSucced
+			p.Nominated = p.Nominated || c.nominated
+		}
+	}
+	for _, c := range s.checkList.checks {
+		add(c, false)
+	}
+	for _, c := range s.validCheckList.checks {
+		add(c, true)
+	}
+	return st
+}
+
+/*
+Stats 需要在 loop 中读取 checklist, 停止以后 loop 已经退出, 可以直接读取.
+*/
+func (s *session) getStats() (st *Stats) {
+	if err := s.run(func() { st = s.buildStats() }); err != nil {
+		s.wg.Wait()
+		return s.buildStats()
+	}
+	return st
+}
+
+/*
+Stats returns a snapshot of statistics of all candidates and pairs,
+it's safe to call at any time from any goroutine.
+*/
+func (t *StreamTransport) Stats() *Stats {
+	session := t.getSession()
+	if session == nil {
+		st := &Stats{Timestamp: t.cfg.clock().Now()}
+		component, _ := t.getGathered()
+		for _, c := range component.candidates {
+			st.LocalCandidates = append(st.LocalCandidates, candidateStats(c))
+		}
+		return st
+	}
+	return session.getStats()
+}
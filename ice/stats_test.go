@@ -0,0 +1,54 @@
+package ice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIceStreamTransport_Stats(t *testing.T) {
+	cfg := NewTransportConfigHostonly()
+	s, err := NewIceStreamTransport(cfg, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Stats(); len(st.LocalCandidates) != len(s.component.candidates) || len(st.Pairs) != 0 {
+		t.Errorf("stats before init error %v", st)
+	}
+	s1, s2, _, cb2 := setupNegotiatedPair(t, cfg, cfg)
+	defer s1.Stop()
+	data := []byte("hello,stats")
+	if err = s1.SendData(data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("s2 recevied timeout")
+	case <-cb2.data:
+	}
+	st := s1.Stats()
+	if len(st.RemoteCandidates) == 0 || len(st.Pairs) == 0 {
+		t.Fatalf("stats error %v", st)
+	}
+	p := st.SelectedPair()
+	if p == nil {
+		t.Fatal("should have selected pair")
+	}
+	if !p.Selected || !p.Nominated || p.State != checkStateSucced {
+		t.Errorf("selected pair state error %+v", p)
+	}
+	if p.RequestsSent == 0 || p.ResponsesReceived == 0 || p.TotalRoundTripTime < p.CurrentRoundTripTime {
+		t.Errorf("selected pair check stats error %+v", p)
+	}
+	if p.PacketsSent != 1 || p.BytesSent != uint64(len(data)) || p.LastPacketSent.IsZero() {
+		t.Errorf("selected pair data stats error %+v", p)
+	}
+	s2.Stop()
+	//停止以后仍然可以获取
+	p = s2.Stats().SelectedPair()
+	if p == nil {
+		t.Fatal("s2 should have selected pair")
+	}
+	if p.PacketsReceived != 1 || p.BytesReceived != uint64(len(data)) || p.RequestsReceived == 0 || p.ResponsesSent == 0 {
+		t.Errorf("s2 selected pair stats error %+v", p)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/nkbai/goice/clock"
 	"github.com/nkbai/log"
 	"github.com/nkbai/goice/stun"
 	"github.com/nkbai/goice/turn"
@@ -70,6 +71,17 @@ type cachedResponse struct {
 type sendreq struct {
 	data []byte
 	to   net.Addr
+	buf  *[]byte //来自 packetPool, 写完以后放回去
+}
+
+/*
+serverSockOptions 来自 TransportConfig, 零值表示使用系统时钟, 一次只收发一个包.
+*/
+type serverSockOptions struct {
+	clock   clock.Clock
+	batchIO bool
+	//transactionTimeout 同步等待 response 的时间, 为 0 使用 Timing 的缺省值
+	transactionTimeout time.Duration
 }
 type stunServerSock struct {
 	Addr                  string //address listening on
@@ -80,11 +92,14 @@ type stunServerSock struct {
 	address2ChannelNumber map[string]int
 	waiters               map[stun.TransactionID]chan *serverSockResponse
 	lock                  sync.RWMutex
-	syncMessageTimeout    time.Duration //default 10 seconds?
+	syncMessageTimeout    time.Duration //Timing.TransactionTimeout
+	clock                 clock.Clock
 	Name                  string
 	cachedResponse        map[stun.TransactionID]*cachedResponse //重复的 bindingrequest, 就不要提交给上层了.
 	sendchan              chan *sendreq
-	stoped                bool
+	bc                    packetBatchConn //不为空的时候批量收发, 见 TransportConfig.BatchIO
+	closeChan             chan struct{} //close when stop, 发送协程随之退出
+	closeOnce             sync.Once
 	log                   log.Logger
 }
 type serverSockResponse struct {
@@ -98,7 +113,7 @@ type serverSockCallbacker interface {
 	RecieveStunMessage(localAddr, remoteAddr string, msg *stun.Message)
 	/*
 		ICE 协商建立连接以后,收到了对方发过来的数据,可能是经过 turn server 中转的 channel data( 不接受 sendData data request),也可能直接是数据.
-		如果是经过 turn server 中转的, channelNumber 一定介于0x4000-0x7fff 之间.否则一定为0
+		如果是经过 turn server 中转的, channelNumber 一定介于0x4000-0x4fff 之间.否则一定为0
 	*/
 	ReceiveData(localAddr, peerAddr string, data []byte)
 }
@@ -108,27 +123,48 @@ var (
 	errNotSTUNMessage = errors.New("not stun message")
 )
 
-func (s *stunServerSock) serveConn(c net.PacketConn, req *stun.Message) error {
+/*
+serveConn 读取一个包, buf 在每次读取之间重用.
+*/
+func (s *stunServerSock) serveConn(c net.PacketConn, buf []byte) error {
 	if c == nil {
 		return nil
 	}
-	buf := make([]byte, 1024)
 	n, addr, err := c.ReadFrom(buf)
 	if err != nil {
 		s.log.Info(fmt.Sprintf("ReadFrom: %v", err))
 		return err
 	}
-	s.log.Trace(fmt.Sprintf("StunServerSockreceive from %s len=%d", addr.String(), n))
-	raw := buf[:n]
-	if _, err = req.Write(raw); err != nil {
-		s.dataReceived(udpAddrToAddr(addr), raw)
-		return nil
+	s.packetReceived(addr, buf[:n])
+	return nil
+}
+
+/*
+只有 stun message 才解码, 数据复制一份以后直接在读取的协程中交给上层, 不经过 session 的 loop.
+*/
+func (s *stunServerSock) packetReceived(addr net.Addr, raw []byte) {
+	switch classifyPacket(raw) {
+	case packetData:
+		s.dataReceived(udpAddrToAddr(addr), copyBytes(raw))
+		return
+	case packetChannelData:
+		s.channelDataReceived(udpAddrToAddr(addr), raw)
+		return
+	}
+	s.log.Trace(fmt.Sprintf("StunServerSockreceive from %s len=%d", addr.String(), len(raw)))
+	req := new(stun.Message)
+	if _, err := req.Write(raw); err != nil {
+		s.dataReceived(udpAddrToAddr(addr), copyBytes(raw))
+		return
 	}
 	if req.Type == stun.BindingIndication || req.Type == turn.SendIndication {
-		return nil //ignore indication ,只是为了保持心跳而已.
+		return //ignore indication ,只是为了保持心跳而已.
 	}
-	s.stunMessageReceived(s.Addr, addr.String(), req)
-	return nil
+	s.stunMessageReceived(s.Addr, udpAddrToAddr(addr), req)
+}
+
+func copyBytes(b []byte) []byte {
+	return append(make([]byte, 0, len(b)), b...)
 }
 
 /*
@@ -138,52 +174,48 @@ turn 模式下: from 是 turnserver 的地址
 peerAddr 才是真正的通信节点地址
 */
 func (s *stunServerSock) dataReceived(peerAddr string, data []byte) {
-	s.log.Trace(fmt.Sprintf("---- recevied data from %s,len=%d -----", peerAddr, len(data)))
 	if s.cb != nil {
 		s.cb.ReceiveData(s.Addr, peerAddr, data)
 	}
 }
 
+/*
+收到 channeldata 要特殊处理,
+如果是在 negiotiation 阶段,说明出错了.
+如果是 stunmode, 说明判断错了,把普通的 data 当成了 channeldata.
+turn 模式下根据 channel number 找到真正的通信节点.
+*/
+func (s *stunServerSock) channelDataReceived(from string, raw []byte) {
+	switch s.getMode() {
+	case stageNegotiation:
+		/*
+			在 channel binding success 和 changemode 之间接收到了数据怎么办?直接丢弃,反正对方会重传.
+		*/
+		s.log.Error(fmt.Sprintf("receive data error when negiotiation"))
+	case stunModeData:
+		s.dataReceived(from, copyBytes(raw))
+	case turnModeData:
+		number, data := parseChannelData(raw)
+		s.lock.RLock()
+		peer, ok := s.channelNumber2Address[number]
+		s.lock.RUnlock()
+		if !ok {
+			s.log.Info(fmt.Sprintf("received data ,but wrong channel number got %d  ", number))
+			return
+		}
+		s.dataReceived(peer, copyBytes(data))
+	}
+}
+
 /*
 在 localaddr 上收到了 stun message
 localaddr 有可能是 turn server 的 relay 地址.
 */
 func (s *stunServerSock) stunMessageReceived(localaddr, from string, msg *stun.Message) {
 	s.log.Trace(fmt.Sprintf("--receive stun message %s<----%s  --\n%s\n", localaddr, from, msg))
-	var err error
-	/*
-		收到 channeldata 要特殊处理,如果是 turn server 模式下,
-		如果是在 negiotiation 阶段,说明出错了.
-		如果是 stunmode, 说明解析错了,把普通的 data 解析成了 channeldata 了
-	*/
 	if msg.Type.Method == stun.MethodChannelData {
-		if s.mode == stageNegotiation {
-			s.log.Error(fmt.Sprintf("receive data error when negiotiation"))
-			/*
-				在 channel binding success 和 changemode 之间接收到了数据怎么办?直接丢弃,反正对方会重传.
-			*/
-			//s.dataReceived(from, msg.Raw)
-			return
-		} else if s.mode == stunModeData {
-			/*
-				收到了普通的数据,但是被误判为 channelData, 直接纠正即可.
-			*/
-			s.dataReceived(from, msg.Raw)
-			return
-		} else if s.mode == turnModeData {
-			var data turn.ChannelData
-			err = data.GetFrom(msg)
-			if err != nil {
-				s.log.Error(fmt.Sprintf("received channel data,but Channel Data err:%s", err))
-				return
-			}
-			peer, ok := s.channelNumber2Address[int(data.ChannelNumber)]
-			if !ok {
-				s.log.Info(fmt.Sprintf("received data ,but wrong channel number got %d  ", data.ChannelNumber))
-				return
-			}
-			s.dataReceived(peer, data.Data)
-		}
+		s.channelDataReceived(from, msg.Raw)
+		return
 	}
 	ch, ok := s.getAndRemoveWaiter(msg.TransactionID)
 	if ok {
@@ -202,12 +234,9 @@ func (s *stunServerSock) stunMessageReceived(localaddr, from string, msg *stun.M
 
 //如果对应的消息应答,已经缓存了,直接发送即可.
 func (s *stunServerSock) checkCachedResponse(req *stun.Message, from string) bool {
-	if len(s.cachedResponse) <= 0 {
-		return false
-	}
+	var cached *cachedResponse
 	s.lock.Lock()
-	defer s.lock.Unlock()
-	now := time.Now()
+	now := s.clock.Now()
 	for id, c := range s.cachedResponse {
 		if c.cacheTime.Add(stunResponseCacheDuration).Before(now) {
 			delete(s.cachedResponse, id)
@@ -215,12 +244,17 @@ func (s *stunServerSock) checkCachedResponse(req *stun.Message, from string) boo
 	}
 	for _, c := range s.cachedResponse {
 		if c.msg.Type.Method == req.Type.Method && c.msg.TransactionID == req.TransactionID {
-			s.log.Trace(fmt.Sprintf("id %s duplicated", hex.EncodeToString(req.TransactionID[:])))
-			s.sendData(c.msg.Raw, s.Addr, from)
-			return true
+			cached = c
+			break
 		}
 	}
-	return false
+	s.lock.Unlock()
+	if cached == nil {
+		return false
+	}
+	s.log.Trace(fmt.Sprintf("id %s duplicated", hex.EncodeToString(req.TransactionID[:])))
+	s.sendData(cached.msg.Raw, s.Addr, from)
+	return true
 }
 
 //sendData packet to peer
@@ -228,19 +262,36 @@ func (s *stunServerSock) sendData(data []byte, fromaddr, toaddr string) (err err
 	if s.Addr != fromaddr {
 		panic(fmt.Sprintf("each binding..., me=%s,got=%s", s.Addr, fromaddr))
 	}
-	if s.stoped {
-		s.log.Debug(fmt.Sprintf("sendData from %s to %s ,len=%d, but serversock has stoped", fromaddr, toaddr, len(data)))
-		return
-	}
-	s.sendchan <- &sendreq{data, addrToUDPAddr(toaddr)}
+	//发送协程要等一会儿才写, 调用者的 data 可能已经被重用了
+	b := getPacketBuffer(len(data))
+	copy(*b, data)
+	s.sendPooled(b, toaddr)
 	return
 }
 
+/*
+sendPooled 发送 getPacketBuffer 得到的包, 写完以后由发送协程放回 packetPool.
+*/
+func (s *stunServerSock) sendPooled(b *[]byte, toaddr string) {
+	s.send(&sendreq{data: *b, to: addrToUDPAddr(toaddr), buf: b})
+}
+
+func (s *stunServerSock) send(r *sendreq) {
+	select {
+	case s.sendchan <- r:
+	case <-s.closeChan:
+		s.log.Debug(fmt.Sprintf("sendData from %s to %s ,len=%d, but serversock has stoped", s.Addr, r.to, len(r.data)))
+		if r.buf != nil {
+			putPacketBuffer(r.buf)
+		}
+	}
+}
+
 func (s *stunServerSock) sendStunMessageAsync(msg *stun.Message, fromaddr, toaddr string) error {
 	s.log.Trace(fmt.Sprintf("---sendData stun message %s-->%s ---\n%s\n", s.Addr, toaddr, msg))
 	if msg.Type.Class == stun.ClassSuccessResponse || msg.Type.Class == stun.ClassErrorResponse {
 		s.lock.Lock()
-		s.cachedResponse[msg.TransactionID] = &cachedResponse{time.Now(), msg}
+		s.cachedResponse[msg.TransactionID] = &cachedResponse{s.clock.Now(), msg}
 		s.lock.Unlock()
 	}
 	return s.sendData(msg.Raw, fromaddr, toaddr)
@@ -250,20 +301,17 @@ func (s *stunServerSock) sendStunMessageAsync(msg *stun.Message, fromaddr, toadd
 create channel etc...
 */
 func (s *stunServerSock) sendStunMessageWithResult(msg *stun.Message, fromaddr, toaddr string) (key stun.TransactionID, ch chan *serverSockResponse, err error) {
-	wait := make(chan *serverSockResponse)
-	err = s.addWaiter(msg.TransactionID, wait)
+	ch = make(chan *serverSockResponse, 1)
+	err = s.addWaiter(msg.TransactionID, ch)
 	if err != nil {
 		return
 	}
 	err = s.sendStunMessageAsync(msg, fromaddr, toaddr)
-	if err != nil {
-		return
-	}
-	ch = s.waiters[msg.TransactionID]
 	return
 }
 func (s *stunServerSock) sendStunMessageSync(msg *stun.Message, fromaddr, toaddr string) (res *stun.Message, err error) {
-	wait := make(chan *serverSockResponse)
+	//超时以后应答才到达, 不能阻塞接收协程
+	wait := make(chan *serverSockResponse, 1)
 	err = s.addWaiter(msg.TransactionID, wait)
 	if err != nil {
 		return
@@ -300,18 +348,31 @@ func (s *stunServerSock) wait(ch chan *serverSockResponse) (res *stun.Message, e
 			return nil, errWaiterClosed
 		}
 		return res.res, nil
-	case <-time.After(s.syncMessageTimeout):
+	case <-s.clock.After(s.syncMessageTimeout):
 		return nil, errTimeout
 	}
 }
 
+func (s *stunServerSock) getMode() serverSockMode {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.mode
+}
+
+func (s *stunServerSock) channelNumberOf(addr string) int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.address2ChannelNumber[addr]
+}
+
 /*
 根据需要发生了 channel binding 以后,需要指定 channel number, 这样才知道收到了来自哪里的消息.
 */
 func (s *stunServerSock) SetChannelNumber(channelNumber int, addr string) {
-	//todo fixit ,need a lock?
+	s.lock.Lock()
 	s.channelNumber2Address[channelNumber] = addr
 	s.address2ChannelNumber[addr] = channelNumber
+	s.lock.Unlock()
 }
 
 /*
@@ -319,46 +380,105 @@ func (s *stunServerSock) SetChannelNumber(channelNumber int, addr string) {
 //todo 如果我有真实的公网 ip 地址呢? 应该是不需要 keep alive 的
 */
 func (s *stunServerSock) FinishNegotiation(mode serverSockMode) {
+	s.lock.Lock()
 	s.log.Trace(fmt.Sprintf("change mode from %d to %d", s.mode, mode))
 	s.mode = mode
+	s.lock.Unlock()
 }
 
 // Serve reads packets from connections and responds to BINDING requests.
 func (s *stunServerSock) Serve(c net.PacketConn) error {
+	//writeto 是阻塞函数,不要阻塞 sendasync
+	if s.bc != nil {
+		go s.writeBatchLoop()
+		return s.serveBatch()
+	}
 	go func() {
-		//writeto 是阻塞函数,不要阻塞 sendasync
 		for {
 			select {
-			case r, ok := <-s.sendchan:
-				if !ok {
-					return
-				}
+			case <-s.closeChan:
+				return
+			case r := <-s.sendchan:
 				s.log.Trace(fmt.Sprintf("%s write to %s, len=%d", s.Addr, r.to.String(), len(r.data)))
 				n, err := s.c.WriteTo(r.data, r.to)
 				if err != nil || n != len(r.data) {
 					s.log.Info(fmt.Sprintf("%s write to %s err %s", s.Addr, r.to.String(), err))
 				}
+				if r.buf != nil {
+					putPacketBuffer(r.buf)
+				}
 			}
 		}
 	}()
+	buf := make([]byte, maxPacketSize)
 	for {
-		req := new(stun.Message)
-		if err := s.serveConn(c, req); err != nil {
+		if err := s.serveConn(c, buf); err != nil {
 			s.log.Info(fmt.Sprintf("serve: %v", err))
 			return err
 		}
 	}
 }
-func (s *stunServerSock) Close() {
-	s.log.Trace(fmt.Sprintf("%s closed", s.Addr))
-	s.stoped = true
-	s.c.Close()
-	close(s.sendchan)
-	for key, ch := range s.waiters {
-		s.getAndRemoveWaiter(key)
-		close(ch)
+
+/*
+serveBatch 一次系统调用读取多个包
+*/
+func (s *stunServerSock) serveBatch() error {
+	r := newBatchReader(s.bc)
+	for {
+		if err := r.read(s.packetReceived); err != nil {
+			s.log.Info(fmt.Sprintf("serve: %v", err))
+			return err
+		}
 	}
-	return
+}
+
+/*
+writeBatchLoop 取出所有排队的包, 一次系统调用发送.
+*/
+func (s *stunServerSock) writeBatchLoop() {
+	w := newBatchWriter(s.bc, newGSOWriter(s.c), s.log)
+	reqs := make([]*sendreq, 0, batchSize)
+	for {
+		select {
+		case <-s.closeChan:
+			return
+		case r := <-s.sendchan:
+			reqs = append(reqs[:0], r)
+		}
+	more:
+		for len(reqs) < batchSize {
+			select {
+			case r := <-s.sendchan:
+				reqs = append(reqs, r)
+			default:
+				break more
+			}
+		}
+		w.write(reqs)
+		for i, r := range reqs {
+			if r.buf != nil {
+				putPacketBuffer(r.buf)
+			}
+			reqs[i] = nil
+		}
+	}
+}
+/*
+Close 可以调用多次, 等待同步应答的调用者会立即返回 errWaiterClosed.
+*/
+func (s *stunServerSock) Close() {
+	s.closeOnce.Do(func() {
+		s.log.Trace(fmt.Sprintf("%s closed", s.Addr))
+		close(s.closeChan)
+		s.c.Close()
+		s.lock.Lock()
+		waiters := s.waiters
+		s.waiters = make(map[stun.TransactionID]chan *serverSockResponse)
+		s.lock.Unlock()
+		for _, ch := range waiters {
+			close(ch)
+		}
+	})
 }
 
 /*
@@ -370,20 +490,36 @@ func newStunServerSock(bindAddr string, cb serverSockCallbacker, name string) (s
 	if err != nil {
 		return
 	}
+	return newStunServerSockWithConn(bindAddr, c, cb, name, serverSockOptions{}), nil
+}
+
+/*
+使用一个已经建立好的连接,比如 tcp candidate 的 tcpPacketConn.
+*/
+func newStunServerSockWithConn(bindAddr string, c net.PacketConn, cb serverSockCallbacker, name string, opts serverSockOptions) (s *stunServerSock) {
 	s = &stunServerSock{
 		Addr:               bindAddr,
 		mode:               stageNegotiation,
 		c:                  c,
 		waiters:            make(map[stun.TransactionID]chan *serverSockResponse),
-		syncMessageTimeout: time.Second * 5,
+		syncMessageTimeout: opts.transactionTimeout,
+		clock:              clock.OrNew(opts.clock),
 		cb:                 cb,
 		Name:               name,
 		channelNumber2Address: make(map[int]string),
 		address2ChannelNumber: make(map[string]int),
 		cachedResponse:        make(map[stun.TransactionID]*cachedResponse),
 		sendchan:              make(chan *sendreq, 10),
+		closeChan:             make(chan struct{}),
 		log:                   log.New("name", fmt.Sprintf("%s-stunServerSock", name)),
 	}
+	if s.syncMessageTimeout <= 0 {
+		s.syncMessageTimeout = Timing{}.withDefaults().TransactionTimeout
+	}
+	if opts.batchIO {
+		s.bc = newPacketBatchConn(c)
+		s.sendchan = make(chan *sendreq, 4*batchSize)
+	}
 	go func() {
 		s.Serve(s.c)
 	}()
@@ -7,10 +7,10 @@ import (
 
 	"fmt"
 
-	"github.com/nkbai/log"
 	"github.com/nkbai/goice/stun"
 )
 
+//缺省的 Timing.GatherTimeout
 const defaultReadDeadLine = time.Second * 10
 
 /*
@@ -23,35 +23,40 @@ type stunSocket struct {
 	Client       *stun.Client
 	ReadDeadline time.Duration
 	localAddrs   []string //for listen
+	gatherer     *hostGatherer
 }
 
-func newStunSocket(serverAddr string) (s *stunSocket, err error) {
+func newStunSocket(serverAddr string, g *hostGatherer) (s *stunSocket, err error) {
 	s = &stunSocket{
 		ServerAddr:   serverAddr,
-		ReadDeadline: defaultReadDeadLine,
+		ReadDeadline: Timing{}.withDefaults().GatherTimeout,
+		gatherer:     g,
 	}
-	conn, err := net.Dial("udp", serverAddr)
+	conn, err := g.dialUDP(serverAddr)
 	if err != nil {
-		log.Crit(fmt.Sprintf("failed to dial:%s", err))
+		err = fmt.Errorf("failed to dial %s:%s", serverAddr, err)
+		return
 	}
 	client, err := stun.NewClient(stun.ClientOptions{
 		Connection: conn,
+		Clock:      g.getClock(),
 	})
 	if err != nil {
+		conn.Close()
 		return
 	}
 	s.Client = client
-	s.LocalAddr = conn.(*net.UDPConn).LocalAddr().String()
+	s.LocalAddr = conn.LocalAddr().String()
 	return
 }
 
 //get mapped address from server
 func (s *stunSocket) mapAddress() error {
-	deadline := time.Now().Add(s.ReadDeadline)
-	var err error
+	deadline := s.gatherer.getClock().Now().Add(s.ReadDeadline)
+	var err, doErr error
 	wg := sync.WaitGroup{}
 	wg.Add(1)
-	err = s.Client.Do(stun.MustBuild(stun.TransactionIDSetter, stun.BindingRequest), deadline, func(res stun.Event) {
+	doErr = s.Client.Do(stun.MustBuild(stun.TransactionIDSetter, stun.BindingRequest), deadline, func(res stun.Event) {
 		defer wg.Done()
 		if res.Error != nil {
 			err = res.Error
@@ -69,6 +74,10 @@ func (s *stunSocket) mapAddress() error {
 			s.MappedAddr = net.UDPAddr{IP: xorAddr.IP, Port: xorAddr.Port}
 		}
 	})
+	if doErr != nil {
+		//callback 不会被调用
+		return doErr
+	}
 	wg.Wait()
 	//keep alive todo
 	return err
@@ -86,16 +95,14 @@ func (s *stunSocket) GetCandidates() (candidates []*Candidate, err error) {
 	c.baseAddr = s.LocalAddr
 	c.Type = CandidateServerReflexive
 	c.addr = s.MappedAddr.String()
-	c.Foundation = calcFoundation(c.baseAddr)
-	candidates, err = getLocalCandidates(c.baseAddr)
+	c.Foundation = calcFoundation(c.Type, c.baseAddr, s.ServerAddr, TransportUDP)
+	candidates, err = getLocalCandidates(c.baseAddr, s.gatherer)
 	if err != nil {
 		return
 	}
-	for _, c := range candidates {
-		s.localAddrs = append(s.localAddrs, c.addr)
-	}
+	s.localAddrs = listenAddrs(candidates)
 	if c.addr != c.baseAddr { //we have a public ip
-		candidates = append(candidates, c)
+		candidates = addCandidates(candidates, c)
 	}
 	return
 }
@@ -3,19 +3,33 @@ package ice
 import (
 	"testing"
 
-	"github.com/davecgh/go-spew/spew"
+	"github.com/nkbai/goice/vnet"
 )
 
 func TestNewStunSocket(t *testing.T) {
-	stun, err := newStunSocket("182.254.155.208:3478")
+	cfgs, stop := setupVNet(t, vnetLAN{nat: vnet.NATPortRestricted})
+	defer stop()
+	g, err := newHostGatherer(cfgs[0])
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
+	stun, err := newStunSocket(vnetStunServer, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stun.Close()
 	cands, err := stun.GetCandidates()
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+	var srflx *Candidate
+	for i, c := range cands {
+		t.Logf("cands[%d]=%s", i, c)
+		if c.Type == CandidateServerReflexive {
+			srflx = c
+		}
+	}
+	if srflx == nil || srflx.baseAddr != stun.LocalAddr || addrToUDPAddr(srflx.addr).IP.String() == addrToUDPAddr(stun.LocalAddr).IP.String() {
+		t.Errorf("should get srflx of %s behind nat, got %v", stun.LocalAddr, cands)
 	}
-	spew.Dump("cands", cands)
 }
@@ -0,0 +1,406 @@
+package ice
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nkbai/goice/clock"
+	"github.com/nkbai/log"
+)
+
+/*
+RFC 6544 规定 active candidate 的端口一律写为9,真正使用的端口在连接时才确定.
+*/
+const tcpActivePort = 9
+
+/*
+RFC 4571 每个 frame 前面有两个字节的长度.
+*/
+const tcpFrameHeaderSize = 2
+
+const maxTCPFrameSize = 0xffff
+
+var (
+	errTCPFrameTooLarge   = errors.New("frame too large for RFC 4571 framing")
+	errTCPNoConnection    = errors.New("no tcp connection to peer and passive candidate cannot connect")
+	errTCPPacketConnClose = errors.New("tcp packet conn closed")
+)
+
+/*
+writeTCPFrame 按照 RFC 4571 把一个 stun message 或者数据包写入 tcp 连接.
+*/
+func writeTCPFrame(w io.Writer, data []byte) error {
+	if len(data) > maxTCPFrameSize {
+		return errTCPFrameTooLarge
+	}
+	buf := make([]byte, tcpFrameHeaderSize+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	copy(buf[tcpFrameHeaderSize:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+/*
+readTCPFrame 从 tcp 连接读出一个完整的 frame.
+*/
+func readTCPFrame(r io.Reader) ([]byte, error) {
+	var header [tcpFrameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+type tcpPacket struct {
+	data []byte
+	from net.Addr
+}
+
+/*
+tcpPacketConn 把多个 tcp 连接包装成一个 net.PacketConn,
+这样 stunServerSock 不用关心底层是 udp 还是 tcp.
+passive: 只监听,等待对方连接.
+active: 不监听,第一次向某个地址发送的时候主动连接.
+so: 既监听也主动连接,哪一个连接先建立就用哪一个.
+*/
+type tcpPacketConn struct {
+	addr     string //candidate address, active candidate 的端口为9
+	tcpType  TCPType
+	listener net.Listener
+	conns    map[string]net.Conn //remote address -> connection
+	dialing  map[string]*tcpDial //remote address -> 正在进行的连接, 同时发送的只连接一次
+	lock     sync.Mutex
+	rxchan   chan *tcpPacket
+	quitChan chan struct{}
+	closed   bool
+	log      log.Logger
+
+	dialTimeout time.Duration //active 主动连接的超时时间, 即 Timing.MaxRTO, session 使用它自己的 Timing
+	/*
+		readDeadline 让阻塞的 ReadFrom 返回, writeDeadline 设置到每一个 tcp 连接上, 也限制主动连接的时间.
+		deadline 是调用者给出的绝对时间, 使用系统时钟.
+	*/
+	readDeadline  *deadline
+	writeDeadline time.Time
+}
+
+type tcpDial struct {
+	done chan struct{}
+	conn net.Conn
+	err  error
+}
+
+/*
+newTCPPacketConn 为一个 tcp host candidate 创建连接.
+passive 使用收集 candidate 时已经监听的 l, 为 nil 的时候在 addr 上重新监听.
+so 需要在同一个端口上既监听又主动连接, 目前不收集这种 candidate, 对端的 so candidate 也不会和本地配对.
+*/
+func newTCPPacketConn(addr string, tcpType TCPType, l net.Listener) (t *tcpPacketConn, err error) {
+	t = &tcpPacketConn{
+		addr:     addr,
+		tcpType:  tcpType,
+		conns:    make(map[string]net.Conn),
+		dialing:  make(map[string]*tcpDial),
+		rxchan:   make(chan *tcpPacket, 10),
+		quitChan: make(chan struct{}),
+		log:      log.New("name", fmt.Sprintf("%s-tcpPacketConn", addr)),
+
+		dialTimeout:  Timing{}.withDefaults().MaxRTO,
+		readDeadline: newDeadline(clock.New()),
+	}
+	if tcpType == TCPTypePassive {
+		if l == nil {
+			l, err = net.Listen("tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		t.listener = l
+		go t.acceptLoop()
+	}
+	return t, nil
+}
+
+func (t *tcpPacketConn) acceptLoop() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			t.log.Trace(fmt.Sprintf("%s accept err %s", t.addr, err))
+			return
+		}
+		t.log.Trace(fmt.Sprintf("%s accept connection from %s", t.addr, conn.RemoteAddr()))
+		t.addConn(conn)
+	}
+}
+
+func (t *tcpPacketConn) addConn(conn net.Conn) {
+	key := conn.RemoteAddr().String()
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		conn.Close()
+		return
+	}
+	if old, ok := t.conns[key]; ok {
+		old.Close()
+	}
+	t.conns[key] = conn
+	if !t.writeDeadline.IsZero() {
+		conn.SetWriteDeadline(t.writeDeadline)
+	}
+	t.lock.Unlock()
+	go t.readLoop(key, conn)
+}
+
+func (t *tcpPacketConn) readLoop(key string, conn net.Conn) {
+	defer func() {
+		t.lock.Lock()
+		if t.conns[key] == conn {
+			delete(t.conns, key)
+		}
+		t.lock.Unlock()
+		conn.Close()
+	}()
+	for {
+		data, err := readTCPFrame(conn)
+		if err != nil {
+			t.log.Trace(fmt.Sprintf("%s read from %s err %s", t.addr, key, err))
+			return
+		}
+		select {
+		case t.rxchan <- &tcpPacket{data, conn.RemoteAddr()}:
+		case <-t.quitChan:
+			return
+		}
+	}
+}
+
+/*
+找到一个已经建立的连接,如果没有并且我可以主动连接,那么就连接过去.
+同一个地址正在连接的时候等待它的结果, 不会建立两个连接.
+*/
+func (t *tcpPacketConn) getConn(to string) (conn net.Conn, err error) {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return nil, errTCPPacketConnClose
+	}
+	if conn, ok := t.conns[to]; ok {
+		t.lock.Unlock()
+		return conn, nil
+	}
+	if t.tcpType == TCPTypePassive {
+		t.lock.Unlock()
+		return nil, errTCPNoConnection
+	}
+	if d, ok := t.dialing[to]; ok {
+		t.lock.Unlock()
+		select {
+		case <-d.done:
+			return d.conn, d.err
+		case <-t.quitChan:
+			return nil, errTCPPacketConnClose
+		}
+	}
+	d := &tcpDial{done: make(chan struct{})}
+	t.dialing[to] = d
+	deadline := t.writeDeadline
+	t.lock.Unlock()
+	d.conn, d.err = t.dial(to, deadline)
+	if d.err == nil {
+		t.log.Trace(fmt.Sprintf("%s connected to %s from %s", t.addr, to, d.conn.LocalAddr()))
+		t.addConn(d.conn)
+	}
+	t.lock.Lock()
+	delete(t.dialing, to)
+	t.lock.Unlock()
+	close(d.done)
+	return d.conn, d.err
+}
+
+func (t *tcpPacketConn) dial(to string, deadline time.Time) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(t.addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: net.ParseIP(host)},
+		Timeout:   t.dialTimeout,
+		Deadline:  deadline,
+	}
+	return dialer.Dial("tcp", to)
+}
+
+//ReadFrom implements net.PacketConn, one frame per call.
+func (t *tcpPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	timer := clock.NewStoppedTimer(t.readDeadline.clock)
+	defer timer.Stop()
+	for {
+		changed := t.readDeadline.wait(timer)
+		select {
+		case p := <-t.rxchan:
+			n = copy(b, p.data)
+			return n, p.from, nil
+		case <-t.quitChan:
+			return 0, nil, errTCPPacketConnClose
+		case <-timer.C():
+			return 0, nil, timeoutError{}
+		case <-changed:
+		}
+	}
+}
+
+//WriteTo implements net.PacketConn, data is framed as RFC 4571
+func (t *tcpPacketConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	conn, err := t.getConn(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	err = writeTCPFrame(conn, b)
+	if err != nil {
+		conn.Close()
+		return 0, err
+	}
+	return len(b), nil
+}
+
+//Close implements net.PacketConn
+func (t *tcpPacketConn) Close() error {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return nil
+	}
+	t.closed = true
+	for k, c := range t.conns {
+		c.Close()
+		delete(t.conns, k)
+	}
+	t.lock.Unlock()
+	close(t.quitChan)
+	if t.listener != nil {
+		return t.listener.Close()
+	}
+	return nil
+}
+
+//LocalAddr implements net.PacketConn
+func (t *tcpPacketConn) LocalAddr() net.Addr {
+	if t.listener != nil {
+		return t.listener.Addr()
+	}
+	addr, _ := net.ResolveTCPAddr("tcp", t.addr)
+	return addr
+}
+
+//SetDeadline implements net.PacketConn
+func (t *tcpPacketConn) SetDeadline(d time.Time) error {
+	t.SetReadDeadline(d)
+	return t.SetWriteDeadline(d)
+}
+
+//SetReadDeadline implements net.PacketConn, a blocked ReadFrom returns timeout error when it's exceeded
+func (t *tcpPacketConn) SetReadDeadline(d time.Time) error {
+	t.readDeadline.set(d)
+	return nil
+}
+
+//SetWriteDeadline implements net.PacketConn, applies to all connections and new dials
+func (t *tcpPacketConn) SetWriteDeadline(d time.Time) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.writeDeadline = d
+	for _, c := range t.conns {
+		c.SetWriteDeadline(d)
+	}
+	return nil
+}
+
+/*
+根据已经收集到的 udp host candidate, 生成对应的 tcp candidate.
+每一个 host 地址生成一个 passive 和一个 active candidate,
+如果有 srflx candidate, 那么它的公网 ip 也可以作为 active srflx 使用.
+passive candidate 的端口在这里监听, listeners 的 key 是 candidate 的地址, 出错时已经监听的都被关闭.
+*/
+func getTCPCandidates(udpCandidates []*Candidate) (candidates []*Candidate, listeners map[string]net.Listener, err error) {
+	listeners = make(map[string]net.Listener)
+	defer func() {
+		if err != nil {
+			closeTCPListeners(listeners)
+			candidates, listeners = nil, nil
+		}
+	}()
+	for _, c := range udpCandidates {
+		if c.Type != CandidateHost {
+			continue
+		}
+		//1:1 NAT 映射的地址无法监听, 使用 base
+		var host string
+		host, _, err = net.SplitHostPort(c.baseAddr)
+		if err != nil {
+			return
+		}
+		var l net.Listener
+		l, err = net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			return
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		passive := new(Candidate)
+		passive.Type = CandidateHost
+		passive.transport = TransportTCP
+		passive.TCPType = TCPTypePassive
+		passive.addr = net.JoinHostPort(host, fmt.Sprintf("%d", port))
+		passive.baseAddr = passive.addr
+		passive.Foundation = calcFoundation(passive.Type, passive.baseAddr, "", TransportTCP)
+		candidates = append(candidates, passive)
+		listeners[passive.addr] = l
+		active := new(Candidate)
+		active.Type = CandidateHost
+		active.transport = TransportTCP
+		active.TCPType = TCPTypeActive
+		active.addr = net.JoinHostPort(host, fmt.Sprintf("%d", tcpActivePort))
+		active.baseAddr = active.addr
+		active.Foundation = calcFoundation(active.Type, active.baseAddr, "", TransportTCP)
+		candidates = append(candidates, active)
+	}
+	for _, c := range udpCandidates {
+		if c.Type != CandidateServerReflexive {
+			continue
+		}
+		var host, basehost string
+		host, _, err = net.SplitHostPort(c.addr)
+		if err != nil {
+			return
+		}
+		basehost, _, err = net.SplitHostPort(c.baseAddr)
+		if err != nil {
+			return
+		}
+		srflx := new(Candidate)
+		srflx.Type = CandidateServerReflexive
+		srflx.transport = TransportTCP
+		srflx.TCPType = TCPTypeActive
+		srflx.addr = net.JoinHostPort(host, fmt.Sprintf("%d", tcpActivePort))
+		srflx.baseAddr = net.JoinHostPort(basehost, fmt.Sprintf("%d", tcpActivePort))
+		srflx.Foundation = calcFoundation(srflx.Type, srflx.baseAddr, "", TransportTCP)
+		candidates = append(candidates, srflx)
+	}
+	return
+}
+
+func closeTCPListeners(listeners map[string]net.Listener) {
+	for k, l := range listeners {
+		l.Close()
+		delete(listeners, k)
+	}
+}
@@ -0,0 +1,287 @@
+package ice
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTCPFrame(t *testing.T) {
+	buf := new(bytes.Buffer)
+	data := []byte("hello,tcp")
+	if err := writeTCPFrame(buf, data); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != len(data)+tcpFrameHeaderSize {
+		t.Errorf("frame length error, got %d", buf.Len())
+	}
+	got, err := readTCPFrame(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("frame data error, got %s", got)
+	}
+	if err = writeTCPFrame(buf, make([]byte, maxTCPFrameSize+1)); err != errTCPFrameTooLarge {
+		t.Errorf("expect too large, got %s", err)
+	}
+}
+
+func TestTCPPacketConn(t *testing.T) {
+	passive, err := newTCPPacketConn("127.0.0.1:0", TCPTypePassive, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer passive.Close()
+	active, err := newTCPPacketConn(fmt.Sprintf("127.0.0.1:%d", tcpActivePort), TCPTypeActive, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	_, err = active.WriteTo([]byte("ping"), passive.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, from, err := passive.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("passive received %s", buf[:n])
+	}
+	//passive can only reply on the accepted connection
+	_, err = passive.WriteTo([]byte("pong"), from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _, err = active.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong" {
+		t.Errorf("active received %s", buf[:n])
+	}
+	_, err = passive.WriteTo([]byte("pong"), &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1})
+	if err != errTCPNoConnection {
+		t.Errorf("passive should not connect, err=%v", err)
+	}
+}
+
+/*
+同时向一个地址发送, 只建立一个连接.
+*/
+func TestTCPPacketConnConcurrentDial(t *testing.T) {
+	passive, err := newTCPPacketConn("127.0.0.1:0", TCPTypePassive, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer passive.Close()
+	active, err := newTCPPacketConn(fmt.Sprintf("127.0.0.1:%d", tcpActivePort), TCPTypeActive, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := active.WriteTo([]byte("ping"), passive.LocalAddr()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	passive.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	for i := 0; i < n; i++ {
+		if _, _, err = passive.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	passive.lock.Lock()
+	accepted := len(passive.conns)
+	passive.lock.Unlock()
+	if accepted != 1 {
+		t.Errorf("only one connection should be made, got %d", accepted)
+	}
+}
+
+func TestTCPPacketConnDeadline(t *testing.T) {
+	c, err := newTCPPacketConn("127.0.0.1:0", TCPTypePassive, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err = c.ReadFrom(make([]byte, 100))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+	//清除 deadline 以后阻塞, 另一个协程设置的 deadline 让它返回
+	c.SetReadDeadline(time.Time{})
+	done := make(chan error)
+	go func() {
+		_, _, err := c.ReadFrom(make([]byte, 100))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	c.SetDeadline(time.Now())
+	select {
+	case err = <-done:
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			t.Errorf("expect timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SetDeadline should unblock ReadFrom")
+	}
+	//已经过期的 write deadline 也限制主动连接
+	active, err := newTCPPacketConn(fmt.Sprintf("127.0.0.1:%d", tcpActivePort), TCPTypeActive, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	active.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err = active.WriteTo([]byte("ping"), c.LocalAddr()); err == nil {
+		t.Error("write after deadline should fail")
+	}
+}
+
+/*
+passive candidate 的端口在收集时就已经监听, 不会被其他程序占用.
+*/
+func TestGetTCPCandidatesListen(t *testing.T) {
+	udp := []*Candidate{{Type: CandidateHost, addr: "127.0.0.1:5000", baseAddr: "127.0.0.1:5000"}}
+	candidates, listeners, err := getTCPCandidates(udp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTCPListeners(listeners)
+	var passive *Candidate
+	for _, c := range candidates {
+		if c.TCPType == TCPTypePassive {
+			passive = c
+		}
+	}
+	if passive == nil || len(listeners) != 1 || listeners[passive.addr] == nil {
+		t.Fatalf("passive candidate should be listened %v %v", candidates, listeners)
+	}
+	if l, err := net.Listen("tcp", passive.addr); err == nil {
+		l.Close()
+		t.Error("passive port should be held by the listener")
+	}
+	c, err := newTCPPacketConn(passive.addr, TCPTypePassive, listeners[passive.addr])
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(listeners, passive.addr)
+	defer c.Close()
+	if c.LocalAddr().String() != passive.addr {
+		t.Errorf("listener should be reused, %s", c.LocalAddr())
+	}
+}
+
+func TestCanPairTCP(t *testing.T) {
+	cases := []struct {
+		l, r TCPType
+		ok   bool
+	}{
+		{TCPTypeActive, TCPTypePassive, true},
+		{TCPTypePassive, TCPTypeActive, true},
+		{TCPTypeSimultaneousOpen, TCPTypeSimultaneousOpen, true},
+		{TCPTypeActive, TCPTypeActive, false},
+		{TCPTypePassive, TCPTypePassive, false},
+		{TCPTypeActive, TCPTypeSimultaneousOpen, false},
+	}
+	for i, c := range cases {
+		if canPairTCP(c.l, c.r) != c.ok {
+			t.Errorf("[%d] %s-%s expect %v", i, c.l, c.r, c.ok)
+		}
+	}
+	if calcTCPLocalPreference(CandidateHost, TCPTypeActive) >= defaultPreference {
+		t.Error("tcp candidate should have lower preference than udp")
+	}
+}
+
+/*
+只保留 tcp candidate, 缺省地址使用 passive candidate.
+*/
+func encodeSessionTCPOnly(t *StreamTransport) string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "v=0\no=- 3414953978 3414953978 IN IP4 localhost\ns=ice\nt=0 0\n")
+	fmt.Fprintf(buf, "a=ice-ufrag:%s\na=ice-pwd:%s\n", t.session.rxUserFrag, t.session.rxPassword)
+	for _, c := range t.component.candidates {
+		if c.transport == TransportTCP && c.TCPType == TCPTypePassive {
+			uaddr := addrToUDPAddr(c.addr)
+			fmt.Fprintf(buf, "m=audio %d RTP/AVP 0\nc=IN IP4 %s\n", uaddr.Port, uaddr.IP.String())
+			break
+		}
+	}
+	for _, c := range t.component.candidates {
+		if c.transport == TransportTCP {
+			fmt.Fprintf(buf, "%s\n", c)
+		}
+	}
+	return string(buf.Bytes())
+}
+
+func TestIceStreamTransport_StartNegotiationTCP(t *testing.T) {
+	cfg := NewTransportConfigHostonly()
+	cfg.EnableTCP = true
+	s1, err := NewIceStreamTransport(cfg, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := NewIceStreamTransport(cfg, "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb1 := newicecb("s1")
+	cb2 := newicecb("s2")
+	s1.cb = cb1
+	s2.cb = cb2
+	if err = s1.InitIce(SessionRoleControlling); err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.InitIce(SessionRoleControlled); err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop()
+	defer s2.Stop()
+	if err = s2.StartNegotiation(encodeSessionTCPOnly(s1)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s1.StartNegotiation(encodeSessionTCPOnly(s2)); err != nil {
+		t.Fatal(err)
+	}
+	for _, cb := range []*icecb{cb1, cb2} {
+		select {
+		case <-time.After(20 * time.Second):
+			t.Fatalf("%s negotiation timeout", cb.name)
+		case err = <-cb.iceresult:
+			if err != nil {
+				t.Fatalf("%s negotiation failed %s", cb.name, err)
+			}
+		}
+	}
+	if s1.session.sessionComponent.nominatedCheck.localCandidate.transport != TransportTCP {
+		t.Error("nominated check should be tcp")
+	}
+	s1data := []byte("hello,s2")
+	if err = s1.SendData(s1data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-time.After(10 * time.Second):
+		t.Error("s2 recevied timeout")
+	case data := <-cb2.data:
+		if !bytes.Equal(data, s1data) {
+			t.Error("s2 recevied error ,got ", string(data))
+		}
+	}
+}
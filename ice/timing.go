@@ -0,0 +1,215 @@
+package ice
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+Timing 是 check, 重传, nomination 等待, consent, keepalive, stun/turn 请求超时以及 turn keepalive/refresh 用到的时间参数,
+为 0 的字段使用 "default" 中的值. 局域网可以更激进, 卫星链路等高延迟网络需要更长的重传和超时.
+*/
+type Timing struct {
+	/*
+		CheckInterval 即 RFC 8445 的 Ta, 每隔这么长时间开始一个新的 check.
+	*/
+	CheckInterval time.Duration
+	/*
+		RTO check 第一次重传的最小间隔, 实际的值是 MAX(RTO, Ta * (waiting + in-progress)),
+		之后每次重传间隔加倍, 最多到 MaxRTO. MaxRetransmits 次以后没有 response, check 失败.
+		MaxRTO 同时也是 tcp candidate 建立连接的超时时间.
+	*/
+	RTO            time.Duration
+	MaxRTO         time.Duration
+	MaxRetransmits int
+	/*
+		NominationWait controlled 的 check 都结束以后, 等待对方 nominate 的时间.
+	*/
+	NominationWait time.Duration
+	/*
+		ConsentInterval 和 ConsentTimeout 见 TransportConfig, 小于 0 的 ConsentInterval 表示关闭 consent.
+	*/
+	ConsentInterval time.Duration
+	ConsentTimeout  time.Duration
+	/*
+		KeepAliveInterval consent 被关闭以后, 为了保持 NAT 映射发送 binding indication 的间隔.
+	*/
+	KeepAliveInterval time.Duration
+	/*
+		GatherTimeout 收集 candidate 时每个 stun/turn 服务器的超时时间, 包括 binding 和 allocate.
+		TransactionTimeout 协商以后向 turn server 发送 refresh, permission, channel bind 等待 response 的时间.
+	*/
+	GatherTimeout      time.Duration
+	TransactionTimeout time.Duration
+	/*
+		TurnKeepAlive 向 turn server 发送 binding indication 的间隔.
+		TurnRefreshMargin allocation 过期之前至少这么长时间刷新, 不会晚于 lifetime 的一半.
+	*/
+	TurnKeepAlive     time.Duration
+	TurnRefreshMargin time.Duration
+}
+
+//names of timing presets, see TimingPreset
+const (
+	TimingLAN         = "lan"
+	TimingDefault     = "default"
+	TimingHighLatency = "high-latency"
+)
+
+const (
+	defaultNominationWait     = time.Second * 10
+	defaultTransactionTimeout = time.Second * 5
+)
+
+var errUnknownTimingPreset = errors.New("unknown timing preset")
+
+var timingPresets = map[string]Timing{
+	TimingLAN: {
+		CheckInterval:      time.Millisecond * 20,
+		RTO:                time.Millisecond * 100,
+		MaxRTO:             time.Millisecond * 400,
+		MaxRetransmits:     5,
+		NominationWait:     time.Second * 2,
+		ConsentInterval:    time.Second * 2,
+		ConsentTimeout:     time.Second * 10,
+		KeepAliveInterval:  defaultKeepAliveInterval,
+		GatherTimeout:      time.Second * 3,
+		TransactionTimeout: time.Second * 2,
+		TurnKeepAlive:      turnKeepAliveSecond,
+		TurnRefreshMargin:  turnRefreshSecondsBefore,
+	},
+	TimingDefault: {
+		CheckInterval:      defaultCheckInterval,
+		RTO:                minCheckRTOValue,
+		MaxRTO:             stunTimeoutValue,
+		MaxRetransmits:     maxRetryBindingRequest,
+		NominationWait:     defaultNominationWait,
+		ConsentInterval:    defaultConsentInterval,
+		ConsentTimeout:     defaultConsentTimeout,
+		KeepAliveInterval:  defaultKeepAliveInterval,
+		GatherTimeout:      defaultReadDeadLine,
+		TransactionTimeout: defaultTransactionTimeout,
+		TurnKeepAlive:      turnKeepAliveSecond,
+		TurnRefreshMargin:  turnRefreshSecondsBefore,
+	},
+	TimingHighLatency: {
+		CheckInterval:      time.Millisecond * 100,
+		RTO:                time.Millisecond * 1500,
+		MaxRTO:             time.Second * 6,
+		MaxRetransmits:     9,
+		NominationWait:     time.Second * 30,
+		ConsentInterval:    time.Second * 5,
+		ConsentTimeout:     time.Second * 60,
+		KeepAliveInterval:  defaultKeepAliveInterval,
+		GatherTimeout:      time.Second * 30,
+		TransactionTimeout: time.Second * 20,
+		TurnKeepAlive:      turnKeepAliveSecond,
+		TurnRefreshMargin:  time.Second * 120,
+	},
+}
+
+/*
+TimingPreset returns the named timing: "lan", "default" or "high-latency".
+*/
+func TimingPreset(name string) (Timing, error) {
+	t, ok := timingPresets[name]
+	if !ok {
+		return Timing{}, fmt.Errorf("%s %q", errUnknownTimingPreset, name)
+	}
+	return t, nil
+}
+
+/*
+Validate checks that no field is negative (except ConsentInterval, which disables consent),
+MaxRTO is not smaller than RTO and ConsentTimeout is longer than ConsentInterval.
+zero fields are taken from the default preset.
+*/
+func (t Timing) Validate() error {
+	durations := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"CheckInterval", t.CheckInterval},
+		{"RTO", t.RTO},
+		{"MaxRTO", t.MaxRTO},
+		{"NominationWait", t.NominationWait},
+		{"ConsentTimeout", t.ConsentTimeout},
+		{"KeepAliveInterval", t.KeepAliveInterval},
+		{"GatherTimeout", t.GatherTimeout},
+		{"TransactionTimeout", t.TransactionTimeout},
+		{"TurnKeepAlive", t.TurnKeepAlive},
+		{"TurnRefreshMargin", t.TurnRefreshMargin},
+	}
+	for _, f := range durations {
+		if f.d < 0 {
+			return fmt.Errorf("invalid timing, %s=%s is negative", f.name, f.d)
+		}
+	}
+	if t.MaxRetransmits < 0 {
+		return fmt.Errorf("invalid timing, MaxRetransmits=%d is negative", t.MaxRetransmits)
+	}
+	t = t.withDefaults()
+	if t.MaxRTO < t.RTO {
+		return fmt.Errorf("invalid timing, MaxRTO=%s is smaller than RTO=%s", t.MaxRTO, t.RTO)
+	}
+	if t.ConsentInterval > 0 && t.ConsentTimeout <= t.ConsentInterval {
+		return fmt.Errorf("invalid timing, ConsentTimeout=%s is not longer than ConsentInterval=%s", t.ConsentTimeout, t.ConsentInterval)
+	}
+	return nil
+}
+
+/*
+为 0 的字段使用缺省值
+*/
+func (t Timing) withDefaults() Timing {
+	def := timingPresets[TimingDefault]
+	if t.CheckInterval == 0 {
+		t.CheckInterval = def.CheckInterval
+	}
+	if t.RTO == 0 {
+		t.RTO = def.RTO
+	}
+	if t.MaxRTO == 0 {
+		t.MaxRTO = def.MaxRTO
+	}
+	if t.MaxRetransmits == 0 {
+		t.MaxRetransmits = def.MaxRetransmits
+	}
+	if t.NominationWait == 0 {
+		t.NominationWait = def.NominationWait
+	}
+	if t.ConsentInterval == 0 {
+		t.ConsentInterval = def.ConsentInterval
+	}
+	if t.ConsentTimeout == 0 {
+		t.ConsentTimeout = def.ConsentTimeout
+	}
+	if t.KeepAliveInterval == 0 {
+		t.KeepAliveInterval = def.KeepAliveInterval
+	}
+	if t.GatherTimeout == 0 {
+		t.GatherTimeout = def.GatherTimeout
+	}
+	if t.TransactionTimeout == 0 {
+		t.TransactionTimeout = def.TransactionTimeout
+	}
+	if t.TurnKeepAlive == 0 {
+		t.TurnKeepAlive = def.TurnKeepAlive
+	}
+	if t.TurnRefreshMargin == 0 {
+		t.TurnRefreshMargin = def.TurnRefreshMargin
+	}
+	return t
+}
+
+/*
+turn allocation 的刷新间隔, lifetime 的一半, 或者在过期之前 margin 刷新, 取较早的.
+*/
+func refreshInterval(lifetime, margin time.Duration) time.Duration {
+	d := lifetime / 2
+	if lifetime > margin && lifetime-margin < d {
+		d = lifetime - margin
+	}
+	return d
+}
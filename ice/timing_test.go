@@ -0,0 +1,186 @@
+package ice
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nkbai/goice/clock"
+)
+
+func TestTimingPreset(t *testing.T) {
+	for _, name := range []string{TimingLAN, TimingDefault, TimingHighLatency} {
+		tm, err := TimingPreset(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tm.Validate(); err != nil {
+			t.Errorf("preset %s should be valid, %s", name, err)
+		}
+		if tm.withDefaults() != tm {
+			t.Errorf("preset %s should set all fields", name)
+		}
+	}
+	def, _ := TimingPreset(TimingDefault)
+	if (Timing{}).withDefaults() != def {
+		t.Error("zero timing should be the default preset")
+	}
+	if _, err := TimingPreset("satellite"); err == nil {
+		t.Error("unknown preset should fail")
+	}
+}
+
+func TestTimingValidate(t *testing.T) {
+	cases := []Timing{
+		{CheckInterval: -time.Millisecond},
+		{MaxRetransmits: -1},
+		{RTO: time.Second, MaxRTO: 500 * time.Millisecond},
+		{RTO: 2 * time.Second}, //大于缺省的 MaxRTO
+		{ConsentInterval: time.Second, ConsentTimeout: time.Second},
+		{ConsentInterval: time.Minute}, //大于缺省的 ConsentTimeout
+		{TurnRefreshMargin: -time.Second},
+	}
+	for i, tm := range cases {
+		if err := tm.Validate(); err == nil {
+			t.Errorf("case %d %+v should be invalid", i, tm)
+		}
+	}
+	if err := (Timing{ConsentInterval: -1}).Validate(); err != nil {
+		t.Errorf("negative consent interval disables consent, %s", err)
+	}
+	cfg := NewTransportConfigHostonly()
+	cfg.Timing.ConsentTimeout = time.Second
+	cfg.ConsentInterval = 2 * time.Second
+	if _, err := NewIceStreamTransport(cfg, "s1"); err == nil {
+		t.Error("invalid timing should be rejected")
+	}
+}
+
+func TestTimingRefreshInterval(t *testing.T) {
+	cases := []struct {
+		lifetime, margin, want time.Duration
+	}{
+		{600 * time.Second, 60 * time.Second, 300 * time.Second},
+		{600 * time.Second, 400 * time.Second, 200 * time.Second},
+		{60 * time.Second, 120 * time.Second, 30 * time.Second},
+	}
+	for _, c := range cases {
+		if d := refreshInterval(c.lifetime, c.margin); d != c.want {
+			t.Errorf("lifetime=%s margin=%s, want %s got %s", c.lifetime, c.margin, c.want, d)
+		}
+	}
+}
+
+/*
+对方不存在, 按照 Timing 重传: 100ms, 200ms, 200ms 以后失败, 一共发送 3 次.
+*/
+func TestIceStreamTransport_TimingRetransmits(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	cfgs := newLANConfigs(t, 1)
+	cfgs[0].Clock = fake
+	cfgs[0].Timing = Timing{RTO: 100 * time.Millisecond, MaxRTO: 200 * time.Millisecond, MaxRetransmits: 3}
+	s1, err := NewIceStreamTransport(cfgs[0], "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop()
+	cb1 := newicecb("s1")
+	s1.cb = cb1
+	if err = s1.InitIce(SessionRoleControlling); err != nil {
+		t.Fatal(err)
+	}
+	peer := "v=0\r\no=- 1 1 IN IP4 10.1.9.9\r\ns=-\r\nt=0 0\r\nm=audio 5000 RTP/AVP 0\r\nc=IN IP4 10.1.9.9\r\n" +
+		"a=ice-ufrag:abcd\r\na=ice-pwd:abcdefghijklmnopqrstuvwx\r\na=candidate:1 1 UDP 2130706431 10.1.9.9 5000 typ host\r\n"
+	if err = s1.StartNegotiation(peer); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	pump(fake, 10*time.Millisecond, done)
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("check should time out on fake clock")
+	case err = <-cb1.iceresult:
+		if err == nil {
+			t.Fatal("negotiation should fail")
+		}
+	}
+	if d := fake.Now().Sub(start); d < 500*time.Millisecond || d > 2*time.Second {
+		t.Errorf("retransmissions should take about 500ms on fake clock, got %s", d)
+	}
+	st := s1.Stats()
+	if len(st.Pairs) != 1 || st.Pairs[0].RequestsSent != 3 {
+		t.Errorf("check should be sent 3 times %+v", st.Pairs)
+	}
+}
+
+/*
+stun/turn 请求的超时和关闭 consent 以后的 keepalive 间隔都来自 Timing.
+*/
+func TestTimingTimeouts(t *testing.T) {
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	cfg := NewTransportConfigHostonly()
+	cfg.Clock = fake
+	cfg.Timing, _ = TimingPreset(TimingHighLatency)
+	if d := cfg.timing().withDefaults().GatherTimeout; d != 30*time.Second {
+		t.Errorf("gather timeout should be taken from timing, got %s", d)
+	}
+	m := newMultiSock([]string{"127.0.0.1:1"}, nil, cfg.timing().withDefaults().GatherTimeout, nil)
+	for _, c := range m.children {
+		if d := c.(*stunSocket).ReadDeadline; d != 30*time.Second {
+			t.Errorf("stun binding timeout should be 30s, got %s", d)
+		}
+	}
+	m.Close()
+	cfg.GatherTimeout = time.Second
+	if d := cfg.timing().GatherTimeout; d != time.Second {
+		t.Errorf("GatherTimeout of config should override timing, got %s", d)
+	}
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newStunServerSockWithConn(c.LocalAddr().String(), c, &mockcb{}, "timing", cfg.sockOptions())
+	defer s.Close()
+	n := fake.Timers()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.wait(make(chan *serverSockResponse))
+		done <- err
+	}()
+	fake.BlockUntil(n + 1)
+	fake.Add(10 * time.Second)
+	select {
+	case err = <-done:
+		t.Fatalf("transaction should not time out after 10s, %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	fake.Add(10 * time.Second)
+	select {
+	case err = <-done:
+		if err != errTimeout {
+			t.Errorf("expect timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("transaction should time out after 20s")
+	}
+
+	cfg.ConsentInterval = -1
+	cfg.Timing.KeepAliveInterval = time.Minute
+	session := newIceSession("timing", SessionRoleControlling, nil, nil, &StreamTransport{cfg: cfg})
+	session.resetConsentTimer()
+	fake.Add(40 * time.Second)
+	select {
+	case <-session.consentTimer.C():
+		t.Fatal("keepalive should wait about a minute")
+	default:
+	}
+	fake.Add(40 * time.Second)
+	select {
+	case <-session.consentTimer.C():
+	default:
+		t.Error("keepalive should be sent within 72s")
+	}
+}
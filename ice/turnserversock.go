@@ -1,15 +1,18 @@
 package ice
 
 import (
+	"time"
+
 	"net"
 	"strconv"
 
 	"fmt"
 
-	"time"
-
 	"errors"
 
+	"sync"
+
+	"github.com/nkbai/goice/clock"
 	"github.com/nkbai/log"
 	"github.com/nkbai/goice/stun"
 	"github.com/nkbai/goice/turn"
@@ -24,6 +27,15 @@ type turnServerSockConfig struct {
 	lifetime     turn.Lifetime         //create permission life time.
 	relayAddress string
 	serverAddr   string
+	clock        clock.Clock //nil 表示系统时钟
+	batchIO      bool
+	/*
+		keepAlive 发送 binding indication 的间隔, refreshMargin allocation 过期之前多久刷新, 为 0 使用缺省值.
+	*/
+	keepAlive     time.Duration
+	refreshMargin time.Duration
+	//transactionTimeout 等待 turn server response 的时间, 为 0 使用缺省值
+	transactionTimeout time.Duration
 }
 type turnServerSock struct {
 	s        *stunServerSock
@@ -31,22 +43,32 @@ type turnServerSock struct {
 	cb       serverSockCallbacker
 	Name     string
 	stopchan chan struct{} //for stop refresh.
+	stopOnce sync.Once
+	clock    clock.Clock
 	log      log.Logger
 }
 
 func newTurnServerSockWrapper(bindAddr, name string, cb serverSockCallbacker, cfg *turnServerSockConfig) (ts *turnServerSock, err error) {
+	c, err := net.ListenPacket("udp", bindAddr)
+	if err != nil {
+		return
+	}
+	return newTurnServerSockWrapperWithConn(bindAddr, c, name, cb, cfg), nil
+}
+
+/*
+使用已经建立好的连接, 比如 Net 创建的连接.
+*/
+func newTurnServerSockWrapperWithConn(bindAddr string, c net.PacketConn, name string, cb serverSockCallbacker, cfg *turnServerSockConfig) (ts *turnServerSock) {
 	ts = &turnServerSock{
 		cfg:      cfg,
 		cb:       cb,
 		Name:     name,
 		stopchan: make(chan struct{}),
+		clock:    clock.OrNew(cfg.clock),
 		log:      log.New("name", fmt.Sprintf("%s-turnServerSock", name)),
 	}
-	s, err := newStunServerSock(bindAddr, ts, name)
-	if err != nil {
-		return
-	}
-	ts.s = s
+	ts.s = newStunServerSockWithConn(bindAddr, c, ts, name, serverSockOptions{clock: ts.clock, batchIO: cfg.batchIO, transactionTimeout: cfg.transactionTimeout})
 	return
 }
 
@@ -99,15 +121,16 @@ func (ts *turnServerSock) RecieveStunMessage(localAddr, remoteAddr string, msg *
 
 /*
 	ICE 协商建立连接以后,收到了对方发过来的数据,可能是经过 turn server 中转的 channel data( 不接受 sendData data request),也可能直接是数据.
-	如果是经过 turn server 中转的, channelNumber 一定介于0x4000-0x7fff 之间.否则一定为0
+	如果是经过 turn server 中转的, channelNumber 一定介于0x4000-0x4fff 之间.否则一定为0
 */
 func (ts *turnServerSock) ReceiveData(localAddr, peerAddr string, data []byte) {
-	msg2 := new(stun.Message)
-	_, err := msg2.Write(data)
-	if err == nil && msg2.Type.Method != stun.MethodChannelData {
-		//收到了发到中转地址的一个 stun message
-		ts.s.stunMessageReceived(ts.cfg.relayAddress, peerAddr, msg2)
-		return
+	if classifyPacket(data) == packetSTUN {
+		msg2 := new(stun.Message)
+		if _, err := msg2.Write(data); err == nil {
+			//收到了发到中转地址的一个 stun message
+			ts.s.stunMessageReceived(ts.cfg.relayAddress, peerAddr, msg2)
+			return
+		}
 	}
 	if ts.cb != nil {
 		ts.cb.ReceiveData(localAddr, peerAddr, data)
@@ -200,16 +223,12 @@ func (ts *turnServerSock) sendStunMessageAsync(msg *stun.Message, fromaddr, toad
 暂时不用
 */
 func (ts *turnServerSock) sendStunMessageWithResult(msg *stun.Message, fromaddr, toaddr string) (key stun.TransactionID, ch chan *serverSockResponse, err error) {
-	wait := make(chan *serverSockResponse)
-	err = ts.s.addWaiter(msg.TransactionID, wait)
+	ch = make(chan *serverSockResponse, 1)
+	err = ts.s.addWaiter(msg.TransactionID, ch)
 	if err != nil {
 		return
 	}
 	err = ts.sendStunMessageAsync(msg, fromaddr, toaddr)
-	if err != nil {
-		return
-	}
-	ch = ts.s.waiters[msg.TransactionID]
 	return
 }
 
@@ -217,7 +236,7 @@ func (ts *turnServerSock) sendStunMessageWithResult(msg *stun.Message, fromaddr,
 和异步发送一样需要考虑中转消息的封装.
 */
 func (ts *turnServerSock) sendStunMessageSync(msg *stun.Message, fromaddr, toaddr string) (res *stun.Message, err error) {
-	wait := make(chan *serverSockResponse)
+	wait := make(chan *serverSockResponse, 1)
 	err = ts.s.addWaiter(msg.TransactionID, wait)
 	if err != nil {
 		return
@@ -231,7 +250,9 @@ func (ts *turnServerSock) sendStunMessageSync(msg *stun.Message, fromaddr, toadd
 	return ts.s.wait(wait)
 }
 func (ts *turnServerSock) Close() {
-	close(ts.stopchan)
+	ts.stopOnce.Do(func() {
+		close(ts.stopchan)
+	})
 	ts.s.Close()
 }
 
@@ -246,19 +267,19 @@ func (ts *turnServerSock) StartRefresh() {
 		for {
 			ts.keepAlive()
 			select {
-			case <-time.After(turnKeepAliveSecond):
+			case <-ts.clock.After(ts.keepAliveInterval()):
 				continue
 			case <-ts.stopchan:
 				return
 			}
 		}
 	}()
-	if ts.s.mode == turnModeData {
+	if ts.s.getMode() == turnModeData {
 		go func() {
 			for {
 				ts.refreshRequest(ts.cfg.lifetime)
 				select {
-				case <-time.After(ts.cfg.lifetime.Duration / 2):
+				case <-ts.clock.After(ts.refreshInterval()):
 					continue
 				case <-ts.stopchan:
 					return
@@ -278,21 +299,13 @@ func (ts *turnServerSock) sendData(data []byte, fromaddr, toaddr string) error {
 			分成两个阶段,第一阶段协商完毕可以发送数据,但是 check 仍在继续,发送链接随时可能变化.
 			第二阶段: 协商完毕,我这边的已经稳定下来了,那么这时候就应该通过 channel 来发送数据.
 		*/
-		number := ts.s.address2ChannelNumber[toaddr]
+		number := ts.s.channelNumberOf(toaddr)
 		if number >= turn.MinChannelNumber && number <= turn.MaxChannelNumber {
-			wdata := &turn.ChannelData{
-				ChannelNumber: uint16(number),
-				Data:          data,
-			}
-			r, _ := stun.Build(turn.ChannelDataRequest)
-			err := wdata.AddTo(r)
-			if err != nil {
-				panic("turn.channeldata error")
-			}
-			ts.log.Trace(fmt.Sprintf("send  channel data %d, %s---->%s", len(r.Raw), ts.s.Addr, ts.cfg.serverAddr))
-			ts.s.sendData(r.Raw, ts.s.Addr, ts.cfg.serverAddr)
+			b := getPacketBuffer(channelDataHeaderSize + len(data))
+			putChannelData(*b, number, data)
+			ts.s.sendPooled(b, ts.cfg.serverAddr)
 		} else {
-			if ts.s.mode == turnModeData {
+			if ts.s.getMode() == turnModeData {
 				ts.log.Warn(fmt.Sprintf("should not happen only if channel binding fail"))
 			}
 			to := addrToUDPAddr(toaddr)
@@ -351,8 +364,7 @@ func (ts *turnServerSock) channelBind(addr string) error {
 我这边认为协商成功了,但是对方可能还灭与偶成功,所以仍然可能收到 stun message 消息,也就是通过 channel data 收到的还有可能是 stun 消息而不是真实的数据
 */
 func (ts *turnServerSock) FinishNegotiation(mode serverSockMode) {
-	ts.log.Trace(fmt.Sprintf("change mode from %d to %d", ts.s.mode, mode))
-	ts.s.mode = mode
+	ts.s.FinishNegotiation(mode)
 	ts.StartRefresh()
 }
 func (ts *turnServerSock) refreshRequest(lifetime turn.Lifetime) {
@@ -390,6 +402,24 @@ func (ts *turnServerSock) refreshRequest(lifetime turn.Lifetime) {
 	}
 }
 
+func (ts *turnServerSock) keepAliveInterval() time.Duration {
+	if ts.cfg.keepAlive > 0 {
+		return ts.cfg.keepAlive
+	}
+	return turnKeepAliveSecond
+}
+
+/*
+refreshRequest 可能会修改 lifetime, 每次都重新计算.
+*/
+func (ts *turnServerSock) refreshInterval() time.Duration {
+	margin := ts.cfg.refreshMargin
+	if margin <= 0 {
+		margin = turnRefreshSecondsBefore
+	}
+	return refreshInterval(ts.cfg.lifetime.Duration, margin)
+}
+
 /*
 only keep server reflexive port is valid.
 keep the allocate address valid ,should call refersh request.
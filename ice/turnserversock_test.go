@@ -1,83 +1,156 @@
 package ice
 
 import (
+	"fmt"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/nkbai/log"
+	"github.com/nkbai/goice/clock"
 	"github.com/nkbai/goice/stun"
+	"github.com/nkbai/goice/turn"
+	"github.com/nkbai/goice/vnet"
 )
 
-func setupTurnServerSock() (s1, s2 *turnServerSock) {
-	t1 := newTestTurnSock()
-	t2 := newTestTurnSock()
-	err := t1.allocateAddress()
-	if err != nil {
-		panic(err)
+/*
+两个内网中的 turnServerSock, 都在 vnetStunServer 上分配了 relay 地址, 并且允许对方的 relay 地址.
+*/
+func setupTurnServerSock(t *testing.T) (s1, s2 *turnServerSock, stop func()) {
+	cfgs, stopVNet := setupVNet(t, vnetLAN{nat: vnet.NATPortRestricted}, vnetLAN{nat: vnet.NATPortRestricted})
+	var socks []*turnServerSock
+	var candidates [][]*Candidate
+	for i, cfg := range cfgs {
+		ts := newTestTurnSock(t, cfg)
+		cands, err := ts.GetCandidates()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts.Close()
+		c, err := ts.s.gatherer.listenPacket(ts.s.LocalAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := new(mockcb)
+		m.s = newTurnServerSockWrapperWithConn(ts.s.LocalAddr, c, fmt.Sprintf("s%d", i+1), m, &turnServerSockConfig{
+			user:         ts.user,
+			password:     ts.password,
+			nonce:        ts.nonce,
+			realm:        ts.realm,
+			credentials:  ts.credentials,
+			lifetime:     ts.lifetime,
+			serverAddr:   ts.serverAddr,
+			relayAddress: ts.relayAddress,
+		})
+		socks = append(socks, m.s.(*turnServerSock))
+		candidates = append(candidates, cands)
 	}
-	err = t2.allocateAddress()
-	if err != nil {
-		panic(err)
+	s1, s2 = socks[0], socks[1]
+	if _, err := s1.createPermission(candidates[1]); err != nil {
+		t.Fatal(err)
 	}
-	t1.Close()
-	t2.Close()
-	cfg1 := &turnServerSockConfig{
-		user:         t1.user,
-		password:     t1.password,
-		nonce:        t1.nonce,
-		realm:        t1.realm,
-		credentials:  t1.credentials,
-		lifetime:     t1.lifetime,
-		serverAddr:   t1.serverAddr,
-		relayAddress: t1.relayAddress,
+	if _, err := s2.createPermission(candidates[0]); err != nil {
+		t.Fatal(err)
 	}
-	cfg2 := &turnServerSockConfig{
-		user:         t2.user,
-		password:     t2.password,
-		nonce:        t2.nonce,
-		realm:        t2.realm,
-		credentials:  t2.credentials,
-		lifetime:     t2.lifetime,
-		serverAddr:   t2.serverAddr,
-		relayAddress: t2.relayAddress,
+	log.Trace("------------------------------")
+	return s1, s2, func() {
+		s1.Close()
+		s2.Close()
+		stopVNet()
 	}
-	m1 := new(mockcb)
-	m2 := new(mockcb)
-	s1, err = newTurnServerSockWrapper(t1.s.LocalAddr, "s1", m1, cfg1)
+}
+
+/*
+relay 地址之间的 binding request 和 response 通过 Send/Data indication 中转.
+*/
+func TestNewTurnServerSockWrapper(t *testing.T) {
+	s1, s2, stop := setupTurnServerSock(t)
+	defer stop()
+	req, _ := stun.Build(stun.TransactionIDSetter, stun.BindingRequest, software, stun.Fingerprint)
+	res, err := s1.sendStunMessageSync(req, s1.cfg.relayAddress, s2.cfg.relayAddress)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
-	s2, err = newTurnServerSockWrapper(t2.s.LocalAddr, "s2", m2, cfg2)
-	if err != nil {
-		panic(err)
+	var addr stun.XORMappedAddress
+	if err = addr.GetFrom(res); err != nil || addr.String() != s1.cfg.relayAddress {
+		t.Errorf("s2 should see the relay address of s1 %s, got %s %v", s1.cfg.relayAddress, addr, err)
 	}
-	candidates1, err := t1.GetCandidates()
-	if err != nil {
-		panic(err)
+}
+
+/*
+fakeTurnServer 只应答 refresh 请求, 收到的 keepalive 和 refresh 分别通知测试.
+*/
+func fakeTurnServer(t *testing.T, c net.PacketConn, keepalives, refreshes chan struct{}) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+		if err = req.Decode(); err != nil {
+			continue
+		}
+		switch req.Type {
+		case stun.BindingIndication:
+			keepalives <- struct{}{}
+		case turn.RefreshRequest:
+			res := stun.MustBuild(stun.NewTransactionIDSetter(req.TransactionID), turn.RefreshResponse,
+				turn.Lifetime{Duration: 10 * time.Minute})
+			if _, err = c.WriteTo(res.Raw, from); err != nil {
+				t.Error(err)
+			}
+			refreshes <- struct{}{}
+		}
 	}
-	candidates2, err := t2.GetCandidates()
+}
+
+/*
+keepalive 和 allocation 的 refresh 在假时钟上触发.
+*/
+func TestTurnServerSock_FakeClockRefresh(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
-	m1.s = s1
-	m2.s = s2
-	_, err = s1.createPermission(candidates2)
-	if err != nil {
-		panic(err)
+	defer server.Close()
+	keepalives, refreshes := make(chan struct{}, 10), make(chan struct{}, 10)
+	go fakeTurnServer(t, server, keepalives, refreshes)
+	fake := clock.NewFake(time.Now())
+	cfg := &turnServerSockConfig{
+		user:        "u",
+		realm:       "r",
+		nonce:       "n",
+		credentials: stun.NewLongTermIntegrity("u", "r", "p"),
+		lifetime:    turn.Lifetime{Duration: 10 * time.Minute},
+		serverAddr:  server.LocalAddr().String(),
+		clock:       fake,
 	}
-	_, err = s2.createPermission(candidates1)
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
-	log.Trace("------------------------------")
-	return
-}
-func TestNewTurnServerSockWrapper(t *testing.T) {
-	s1, s2 := setupTurnServerSock()
-	req, _ := stun.Build(stun.TransactionIDSetter, stun.BindingRequest, software, stun.Fingerprint)
-	res, err := s1.sendStunMessageSync(req, s1.cfg.relayAddress, s2.cfg.relayAddress)
-	if err != nil {
-		t.Error(err)
-		return
+	ts := newTurnServerSockWrapperWithConn(c.LocalAddr().String(), c, "ts", new(mockcb), cfg)
+	defer ts.Close()
+	wait := func(ch chan struct{}, what string) {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not received", what)
+		}
+	}
+	ts.FinishNegotiation(turnModeData)
+	wait(keepalives, "keepalive")
+	wait(refreshes, "refresh")
+	//keepalive, refresh 的间隔以及 refresh 等待应答的超时
+	fake.BlockUntil(3)
+	fake.Add(turnKeepAliveSecond)
+	wait(keepalives, "keepalive after 15s")
+	select {
+	case <-refreshes:
+		t.Fatal("refresh should wait for half of lifetime")
+	default:
 	}
-	t.Log(res)
+	fake.Add(cfg.lifetime.Duration/2 - turnKeepAliveSecond)
+	wait(refreshes, "refresh after half of lifetime")
 }
@@ -2,7 +2,6 @@ package ice
 
 import (
 	"fmt"
-	"time"
 
 	"errors"
 
@@ -29,9 +28,9 @@ type turnSock struct {
 	serverAddr   string
 }
 
-func newTurnSock(serverAddr, user, password string) (t *turnSock, err error) {
+func newTurnSock(serverAddr, user, password string, g *hostGatherer) (t *turnSock, err error) {
 	var s *stunSocket
-	s, err = newStunSocket(serverAddr)
+	s, err = newStunSocket(serverAddr, g)
 	if err != nil {
 		return
 	}
@@ -46,9 +45,9 @@ func newTurnSock(serverAddr, user, password string) (t *turnSock, err error) {
 }
 
 func (t *turnSock) allocateAddress() error {
-	deadline := time.Now().Add(t.s.ReadDeadline)
+	deadline := t.s.gatherer.getClock().Now().Add(t.s.ReadDeadline)
 	var err error
-	t.s.Client.Do(stun.MustBuild(stun.TransactionIDSetter, turn.AllocateRequest, turn.RequestedTransportUDP), deadline, func(res stun.Event) {
+	doErr := t.s.Client.Do(stun.MustBuild(stun.TransactionIDSetter, turn.AllocateRequest, turn.RequestedTransportUDP), deadline, func(res stun.Event) {
 		if res.Error != nil {
 			err = res.Error
 			return
@@ -81,10 +80,13 @@ func (t *turnSock) allocateAddress() error {
 		t.credentials = stun.NewLongTermIntegrity(t.user, t.realm, t.password)
 
 	})
+	if doErr != nil {
+		return doErr
+	}
 	if err != nil {
 		return err
 	}
-	t.s.Client.Do(stun.MustBuild(stun.TransactionIDSetter, turn.AllocateRequest,
+	doErr = t.s.Client.Do(stun.MustBuild(stun.TransactionIDSetter, turn.AllocateRequest,
 		turn.RequestedTransportUDP, stun.Realm(t.realm),
 		stun.NewUsername(t.user), stun.Nonce(t.nonce), t.credentials), deadline, func(res stun.Event) {
 		if res.Error != nil {
@@ -117,6 +119,9 @@ func (t *turnSock) allocateAddress() error {
 		t.mapAddress = fmt.Sprintf("%s:%d", MappedAddress.IP, MappedAddress.Port)
 		t.relayAddress = fmt.Sprintf("%s:%d", RelayAddress.IP, RelayAddress.Port)
 	})
+	if doErr != nil {
+		return doErr
+	}
 	if err != nil {
 		return err
 	}
@@ -140,21 +145,19 @@ func (t *turnSock) GetCandidates() (candidates []*Candidate, err error) {
 	c.baseAddr = t.s.LocalAddr
 	c.Type = CandidateServerReflexive
 	c.addr = t.mapAddress
-	c.Foundation = calcFoundation(c.baseAddr)
+	c.Foundation = calcFoundation(c.Type, c.baseAddr, t.s.ServerAddr, TransportUDP)
 	c2 := new(Candidate)
 	c2.Type = CandidateRelay
 	c2.baseAddr = t.relayAddress
 	c2.addr = t.relayAddress
-	c2.Foundation = calcFoundation(c2.baseAddr)
-	candidates, err = getLocalCandidates(c.baseAddr)
+	c2.Foundation = calcFoundation(c2.Type, c2.baseAddr, t.s.ServerAddr, TransportUDP)
+	candidates, err = getLocalCandidates(c.baseAddr, t.s.gatherer)
 	if err != nil {
 		return
 	}
-	for _, c := range candidates {
-		t.localAddrs = append(t.localAddrs, c.addr)
-	}
+	t.localAddrs = listenAddrs(candidates)
 	if c.baseAddr != c.addr {
-		candidates = append(candidates, c)
+		candidates = addCandidates(candidates, c)
 	}
 	if c2.addr != c.baseAddr {
 		candidates = append(candidates, c2)
@@ -1,29 +1,44 @@
 package ice
 
 import (
-	"fmt"
 	"testing"
+
+	"github.com/nkbai/goice/vnet"
 )
 
-func newTestTurnSock() (turn *turnSock) {
-	turn, err := newTurnSock("182.254.155.208:3478", "bai", "bai")
+/*
+连接 setupVNet 中 vnetStunServer 地址上的 turn server.
+*/
+func newTestTurnSock(t testing.TB, cfg *TransportConfig) (turn *turnSock) {
+	g, err := newHostGatherer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	turn, err = newTurnSock(vnetStunServer, vnetTurnUser, vnetTurnPassword, g)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
 	return turn
 }
+
 func TestNewTurnSock(t *testing.T) {
-	turn, err := newTurnSock("182.254.155.208:3478", "bai", "bai")
-	if err != nil {
-		t.Error(err)
-		return
-	}
+	cfgs, stop := setupVNet(t, vnetLAN{nat: vnet.NATPortRestricted})
+	defer stop()
+	turn := newTestTurnSock(t, cfgs[0])
+	defer turn.Close()
 	cands, err := turn.GetCandidates()
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
+	types := make(map[CandidateType]int)
 	for i, c := range cands {
-		t.Log(fmt.Sprintf("cands[%d]=%s", i, c))
+		t.Logf("cands[%d]=%s", i, c)
+		types[c.Type]++
+	}
+	if types[CandidateHost] == 0 || types[CandidateServerReflexive] != 1 || types[CandidateRelay] != 1 {
+		t.Errorf("should have host, srflx and relay candidates, got %v", cands)
+	}
+	if relay := cands[len(cands)-1]; relay.Type != CandidateRelay || addrToUDPAddr(relay.addr).IP.String() != addrToUDPAddr(vnetStunServer).IP.String() {
+		t.Errorf("relay should be the last and on the turn server, got %v", cands)
 	}
 }
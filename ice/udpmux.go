@@ -0,0 +1,389 @@
+package ice
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nkbai/goice/clock"
+	"github.com/nkbai/goice/stun"
+	"github.com/nkbai/log"
+)
+
+/*
+UDPMux 让很多 StreamTransport 共用同一个 udp 端口, 每个网卡地址只有一个 socket.
+服务器面对成千上万个对端, 防火墙上只需要开放这一个端口.
+收到的 stun 消息按照 USERNAME 中本地的 ufrag 分发给对应的 session,
+没有 USERNAME 的消息(binding response, 协商以后的数据)按照对方地址分发,
+对方地址是在收到对方的 check 或者向对方发送数据时记录下来的.
+UDPMux 由使用者创建和关闭, StreamTransport 停止时只会注销自己.
+*/
+type UDPMux struct {
+	filter   *GatherFilter
+	addrs    []string                       //listening addresses, same port on every interface
+	conns    map[string]net.PacketConn      //local address -> socket
+	sessions map[string]map[string]*muxConn //ufrag -> local address -> conn
+	remotes  map[string]*muxConn            //local address + remote address -> conn
+	lock     sync.Mutex
+	closed   bool
+	log      log.Logger
+}
+
+var (
+	errUDPMuxClosed      = errors.New("udp mux closed")
+	errUDPMuxUfragExists = errors.New("ufrag already registered on udp mux")
+	errMuxConnClosed     = errors.New("mux conn closed")
+)
+
+/*
+每个 session 在每个本地地址上的接收队列长度, 满了以后丢弃.
+*/
+const defaultMuxQueueSize = 128
+
+/*
+NewUDPMux listens on port of every address accepted by filter,
+port 0 means a random port (in the range of filter if set), it's the same on all interfaces.
+*/
+func NewUDPMux(port int, filter *GatherFilter) (m *UDPMux, err error) {
+	if err = filter.validate(); err != nil {
+		return
+	}
+	g := &hostGatherer{filter: filter}
+	addrs, err := g.gather()
+	if err != nil {
+		return
+	}
+	if len(addrs) == 0 {
+		return nil, errNoHostAddress
+	}
+	if port == 0 {
+		port, err = g.pickPort(addrs)
+		if err != nil {
+			return
+		}
+	}
+	m = &UDPMux{
+		filter:   filter,
+		conns:    make(map[string]net.PacketConn),
+		sessions: make(map[string]map[string]*muxConn),
+		remotes:  make(map[string]*muxConn),
+		log:      log.New("name", fmt.Sprintf("udpmux-%d", port)),
+	}
+	for _, a := range addrs {
+		addr := fmt.Sprintf("%s:%d", a.IP.String(), port)
+		if _, ok := m.conns[addr]; ok {
+			continue
+		}
+		var c net.PacketConn
+		c, err = net.ListenPacket("udp", addr)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.conns[addr] = c
+		m.addrs = append(m.addrs, addr)
+	}
+	for addr, c := range m.conns {
+		go m.readLoop(addr, c)
+	}
+	return m, nil
+}
+
+//LocalAddrs returns addresses the mux is listening on
+func (m *UDPMux) LocalAddrs() []string {
+	return append([]string{}, m.addrs...)
+}
+
+//Close closes all sockets, transports using this mux can not receive anything after that.
+func (m *UDPMux) Close() error {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return nil
+	}
+	m.closed = true
+	var conns []*muxConn
+	for _, s := range m.sessions {
+		for _, c := range s {
+			conns = append(conns, c)
+		}
+	}
+	m.lock.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	for _, c := range m.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func remoteKey(local, remote string) string {
+	return local + "|" + remote
+}
+
+/*
+newConn 为 session 在本地地址 local 上创建一个虚拟的 PacketConn, ufrag 是 session 自己的 ufrag.
+*/
+func (m *UDPMux) newConn(ufrag, local string) (c *muxConn, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil, errUDPMuxClosed
+	}
+	pc, ok := m.conns[local]
+	if !ok {
+		return nil, fmt.Errorf("udp mux is not listening on %s", local)
+	}
+	s := m.sessions[ufrag]
+	if s == nil {
+		s = make(map[string]*muxConn)
+		m.sessions[ufrag] = s
+	}
+	if _, ok = s[local]; ok {
+		return nil, errUDPMuxUfragExists
+	}
+	c = &muxConn{
+		mux:      m,
+		ufrag:    ufrag,
+		local:    local,
+		pc:       pc,
+		rxchan:   make(chan *tcpPacket, defaultMuxQueueSize),
+		quitChan: make(chan struct{}),
+		//deadline 是调用者给出的绝对时间, 使用系统时钟
+		readDeadline:  newDeadline(clock.New()),
+		writeDeadline: newDeadline(clock.New()),
+	}
+	s[local] = c
+	return c, nil
+}
+
+func (m *UDPMux) removeConn(c *muxConn) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if s := m.sessions[c.ufrag]; s != nil && s[c.local] == c {
+		delete(s, c.local)
+		if len(s) == 0 {
+			delete(m.sessions, c.ufrag)
+		}
+	}
+	for k, c2 := range m.remotes {
+		if c2 == c {
+			delete(m.remotes, k)
+		}
+	}
+}
+
+/*
+向对方发送数据以后, 对方的回应(没有 USERNAME)就可以根据地址找到 session 了.
+*/
+func (m *UDPMux) learnRemote(c *muxConn, remote string) {
+	key := remoteKey(c.local, remote)
+	m.lock.Lock()
+	if m.remotes[key] != c && !m.closed {
+		m.remotes[key] = c
+	}
+	m.lock.Unlock()
+}
+
+/*
+stunUfrag 返回 binding request USERNAME 中冒号前面的部分, 也就是接收方的 ufrag.
+*/
+func stunUfrag(data []byte) string {
+	if !stun.IsMessage(data) {
+		return ""
+	}
+	msg := new(stun.Message)
+	if _, err := msg.Write(data); err != nil {
+		return ""
+	}
+	var userName stun.Username
+	if err := userName.GetFrom(msg); err != nil {
+		return ""
+	}
+	return strings.SplitN(userName.String(), ":", 2)[0]
+}
+
+/*
+route 找到 local 上收到的来自 remote 的数据属于哪个 session.
+带 USERNAME 的 stun 消息总是按照 ufrag 分发, 这样对方重启以后用同一个地址也能找到新的 session.
+*/
+func (m *UDPMux) route(local, remote string, data []byte) *muxConn {
+	key := remoteKey(local, remote)
+	ufrag := stunUfrag(data)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if ufrag != "" {
+		if c := m.sessions[ufrag][local]; c != nil {
+			m.remotes[key] = c
+			return c
+		}
+	}
+	return m.remotes[key]
+}
+
+func (m *UDPMux) readLoop(local string, pc net.PacketConn) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			m.log.Trace(fmt.Sprintf("%s read err %s", local, err))
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		c := m.route(local, from.String(), data)
+		if c == nil {
+			m.log.Trace(fmt.Sprintf("%s drop packet from %s len=%d, no session", local, from, n))
+			continue
+		}
+		c.deliver(data, from)
+	}
+}
+
+/*
+muxConn 是一个 session 在 UDPMux 的一个本地地址上的 net.PacketConn,
+stunServerSock 通过它收发数据, 和独占一个 socket 没有区别.
+*/
+type muxConn struct {
+	mux      *UDPMux
+	ufrag    string
+	local    string
+	pc       net.PacketConn
+	rxchan   chan *tcpPacket
+	quitChan chan struct{}
+	lock     sync.Mutex
+	closed   bool
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+}
+
+func (c *muxConn) deliver(data []byte, from net.Addr) {
+	select {
+	case c.rxchan <- &tcpPacket{data, from}:
+	case <-c.quitChan:
+	default:
+		c.mux.log.Warn(fmt.Sprintf("%s queue of %s full, packet dropped", c.local, c.ufrag))
+	}
+}
+
+//ReadFrom implements net.PacketConn
+func (c *muxConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	timer := clock.NewStoppedTimer(c.readDeadline.clock)
+	defer timer.Stop()
+	for {
+		changed := c.readDeadline.wait(timer)
+		select {
+		case p := <-c.rxchan:
+			n = copy(b, p.data)
+			return n, p.from, nil
+		case <-c.quitChan:
+			return 0, nil, errMuxConnClosed
+		case <-timer.C():
+			return 0, nil, timeoutError{}
+		case <-changed:
+		}
+	}
+}
+
+//WriteTo implements net.PacketConn
+func (c *muxConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	c.lock.Lock()
+	closed := c.closed
+	c.lock.Unlock()
+	if closed {
+		return 0, errMuxConnClosed
+	}
+	if c.writeDeadline.exceeded() {
+		return 0, timeoutError{}
+	}
+	c.mux.learnRemote(c, addr.String())
+	return c.pc.WriteTo(b, addr)
+}
+
+//Close implements net.PacketConn, only unregisters from mux, the socket is still open.
+func (c *muxConn) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.lock.Unlock()
+	c.mux.removeConn(c)
+	close(c.quitChan)
+	return nil
+}
+
+//LocalAddr implements net.PacketConn
+func (c *muxConn) LocalAddr() net.Addr {
+	return c.pc.LocalAddr()
+}
+
+//SetDeadline implements net.PacketConn
+func (c *muxConn) SetDeadline(d time.Time) error {
+	c.readDeadline.set(d)
+	c.writeDeadline.set(d)
+	return nil
+}
+
+//SetReadDeadline implements net.PacketConn, a blocked ReadFrom returns timeout error when it's exceeded
+func (c *muxConn) SetReadDeadline(d time.Time) error {
+	c.readDeadline.set(d)
+	return nil
+}
+
+/*
+SetWriteDeadline implements net.PacketConn, socket 是共用的, 不能设置它的 deadline,
+只是在超过 deadline 以后 WriteTo 直接返回 timeout 错误, 已经开始的写不受影响.
+*/
+func (c *muxConn) SetWriteDeadline(d time.Time) error {
+	c.writeDeadline.set(d)
+	return nil
+}
+
+/*
+muxSock 使用 UDPMux 的地址作为 host candidate, 不需要自己监听.
+*/
+type muxSock struct {
+	mux             *UDPMux
+	gatherer        *hostGatherer
+	localCandidates []string
+}
+
+//GetCandidates Gather interface
+func (m *muxSock) GetCandidates() (candidates []*Candidate, err error) {
+	if len(m.mux.addrs) == 0 {
+		return nil, errNoHostAddress
+	}
+	g := &hostGatherer{filter: m.mux.filter}
+	if m.gatherer != nil {
+		g.nat = m.gatherer.nat
+		g.natType = m.gatherer.natType
+	}
+	all, err := getLocalCandidates(m.mux.addrs[0], g)
+	if err != nil {
+		return
+	}
+	//创建 mux 以后新出现的地址没有 socket, 不能使用
+	for _, c := range all {
+		if _, ok := m.mux.conns[c.baseAddr]; ok {
+			candidates = append(candidates, c)
+		}
+	}
+	m.localCandidates = listenAddrs(candidates)
+	return
+}
+
+//Close sockets belong to mux, nothing to do
+func (m *muxSock) Close() {
+
+}
+
+func (m *muxSock) getListenCandidiates() []string {
+	return m.localCandidates
+}
@@ -0,0 +1,135 @@
+package ice
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nkbai/goice/stun"
+)
+
+func TestStunUfrag(t *testing.T) {
+	msg, err := stun.Build(stun.TransactionIDSetter, stun.BindingRequest, stun.Username("abc:def"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := stunUfrag(msg.Raw); u != "abc" {
+		t.Errorf("ufrag error %s", u)
+	}
+	if u := stunUfrag([]byte("hello")); u != "" {
+		t.Errorf("not stun,got %s", u)
+	}
+}
+
+/*
+两个 StreamTransport 共用一个 mux 端口, 分别和不同的对端协商.
+*/
+func TestUDPMux(t *testing.T) {
+	filter := &GatherFilter{IncludeLoopback: true, IncludeCIDRs: []string{"127.0.0.1/32"}}
+	mux, err := NewUDPMux(0, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	if len(mux.LocalAddrs()) != 1 {
+		t.Fatalf("mux addrs error %v", mux.LocalAddrs())
+	}
+	cfg := NewTransportConfigHostonly()
+	cfg.GatherFilter = filter
+	muxcfg := *cfg
+	muxcfg.UDPMux = mux
+	var servers []*StreamTransport
+	for i := 0; i < 2; i++ {
+		client, server, cb1, cb2 := setupNegotiatedPair(t, cfg, &muxcfg)
+		defer client.Stop()
+		servers = append(servers, server)
+		for _, c := range server.component.candidates {
+			if c.baseAddr != mux.LocalAddrs()[0] {
+				t.Errorf("server should use mux address,got %s", c)
+			}
+		}
+		data := []byte("hello,mux")
+		if err = client.SendData(data); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-time.After(5 * time.Second):
+			t.Fatal("server recevied timeout")
+		case d := <-cb2.data:
+			if !bytes.Equal(d, data) {
+				t.Error("server recevied error ,got ", string(d))
+			}
+		}
+		if err = server.SendData(data); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-time.After(5 * time.Second):
+			t.Fatal("client recevied timeout")
+		case d := <-cb1.data:
+			if !bytes.Equal(d, data) {
+				t.Error("client recevied error ,got ", string(d))
+			}
+		}
+	}
+	for _, s := range servers {
+		s.Stop()
+	}
+	mux.lock.Lock()
+	n, r := len(mux.sessions), len(mux.remotes)
+	mux.lock.Unlock()
+	if n != 0 || r != 0 {
+		t.Errorf("sessions should be removed after stop,sessions=%d,remotes=%d", n, r)
+	}
+}
+
+/*
+大于 1500 的包完整分发, muxConn 的 deadline 生效.
+*/
+func TestUDPMuxConnLargePacketAndDeadline(t *testing.T) {
+	filter := &GatherFilter{IncludeLoopback: true, IncludeCIDRs: []string{"127.0.0.1/32"}}
+	mux, err := NewUDPMux(0, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	local := mux.LocalAddrs()[0]
+	c, err := mux.newConn("abcd", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	msg, err := stun.Build(stun.TransactionIDSetter, stun.BindingRequest, stun.Username("abcd:efgh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Add(stun.AttrType(0x8030), bytes.Repeat([]byte{1}, 4000))
+	if _, err = peer.WriteTo(msg.Raw, addrToUDPAddr(local)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, maxPacketSize)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(msg.Raw) {
+		t.Errorf("packet truncated, got %d want %d", n, len(msg.Raw))
+	}
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err = c.ReadFrom(buf)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("expect timeout,got %v", err)
+	}
+	c.SetWriteDeadline(time.Now().Add(-time.Second))
+	_, err = c.WriteTo([]byte("x"), peer.LocalAddr())
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("expect write timeout,got %v", err)
+	}
+}
@@ -23,6 +23,10 @@ func addrToUDPAddr(addr string) *net.UDPAddr {
 	}
 }
 func udpAddrToAddr(udpAddr net.Addr) string {
+	//tcp candidate 的连接也会用到这里
+	if addr, ok := udpAddr.(*net.TCPAddr); ok {
+		return fmt.Sprintf("%s:%d", addr.IP.String(), addr.Port)
+	}
 	addr := udpAddr.(*net.UDPAddr)
 	return fmt.Sprintf("%s:%d", addr.IP.String(), addr.Port)
 }
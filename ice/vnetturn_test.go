@@ -0,0 +1,224 @@
+package ice
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nkbai/goice/stun"
+	"github.com/nkbai/goice/turn"
+	"github.com/nkbai/goice/vnet"
+)
+
+/*
+vnetStunServer 同时也是一个最简单的 turn server, 用于离线测试 relay candidate.
+支持 long term 认证的 Allocate, CreatePermission, Refresh, ChannelBind, Send/Data indication 以及 ChannelData,
+不检查 permission, allocation 不会过期, 只有 Refresh lifetime=0 和 server 关闭时释放.
+*/
+const (
+	vnetTurnUser     = "bai"
+	vnetTurnPassword = "bai"
+	vnetTurnRealm    = "vnet"
+	vnetTurnNonce    = "0123456789abcdef"
+	vnetTurnLifetime = 10 * time.Minute
+)
+
+var vnetTurnIntegrity = stun.NewLongTermIntegrity(vnetTurnUser, vnetTurnRealm, vnetTurnPassword)
+
+type vnetTurnServer struct {
+	n      *vnet.Net
+	c      net.PacketConn
+	lock   sync.Mutex
+	allocs map[string]*vnetAllocation //key 是客户端的地址
+}
+
+type vnetAllocation struct {
+	s        *vnetTurnServer
+	client   net.Addr
+	relay    net.PacketConn
+	lock     sync.Mutex
+	channels map[int]string //channel number -> peer
+	numbers  map[string]int //peer -> channel number
+}
+
+func newVNetTurnServer(n *vnet.Net, c net.PacketConn) *vnetTurnServer {
+	return &vnetTurnServer{n: n, c: c, allocs: make(map[string]*vnetAllocation)}
+}
+
+func (s *vnetTurnServer) allocation(client net.Addr) *vnetAllocation {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.allocs[client.String()]
+}
+
+func (s *vnetTurnServer) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for k, a := range s.allocs {
+		a.relay.Close()
+		delete(s.allocs, k)
+	}
+}
+
+func (s *vnetTurnServer) reply(req *stun.Message, to net.Addr, setters ...stun.Setter) {
+	setters = append([]stun.Setter{stun.NewTransactionIDSetter(req.TransactionID)}, setters...)
+	res, err := stun.Build(setters...)
+	if err != nil {
+		return
+	}
+	s.c.WriteTo(res.Raw, to)
+}
+
+func (s *vnetTurnServer) authorized(req *stun.Message) bool {
+	var user stun.Username
+	if err := user.GetFrom(req); err != nil || user.String() != vnetTurnUser {
+		return false
+	}
+	return vnetTurnIntegrity.Check(req) == nil
+}
+
+/*
+handle 处理 binding 以外的 stun 消息.
+*/
+func (s *vnetTurnServer) handle(req *stun.Message, from net.Addr) {
+	if req.Type == turn.SendIndication {
+		s.send(req, from)
+		return
+	}
+	if req.Type.Class != stun.ClassRequest {
+		return
+	}
+	if !s.authorized(req) {
+		s.reply(req, from, stun.NewType(req.Type.Method, stun.ClassErrorResponse),
+			&stun.ErrorCodeAttribute{Code: stun.CodeUnauthorised, Reason: []byte("Unauthorized")},
+			stun.Realm(vnetTurnRealm), stun.Nonce(vnetTurnNonce), stun.Fingerprint)
+		return
+	}
+	success := stun.NewType(req.Type.Method, stun.ClassSuccessResponse)
+	switch req.Type.Method {
+	case stun.MethodAllocate:
+		a, err := s.allocate(from)
+		if err != nil {
+			s.reply(req, from, stun.NewType(req.Type.Method, stun.ClassErrorResponse),
+				&stun.ErrorCodeAttribute{Code: stun.CodeServerError, Reason: []byte(err.Error())}, stun.Fingerprint)
+			return
+		}
+		ra, ua := a.relay.LocalAddr().(*net.UDPAddr), from.(*net.UDPAddr)
+		s.reply(req, from, success, &turn.RelayedAddress{IP: ra.IP, Port: ra.Port},
+			&stun.XORMappedAddress{IP: ua.IP, Port: ua.Port}, turn.Lifetime{Duration: vnetTurnLifetime},
+			vnetTurnIntegrity, stun.Fingerprint)
+	case stun.MethodRefresh:
+		var lifetime turn.Lifetime
+		lifetime.GetFrom(req)
+		if _, ok := req.Attributes.Get(stun.AttrLifetime); ok && lifetime.Duration == 0 {
+			s.release(from)
+		} else {
+			lifetime.Duration = vnetTurnLifetime
+		}
+		s.reply(req, from, success, lifetime, vnetTurnIntegrity, stun.Fingerprint)
+	case stun.MethodCreatePermission:
+		s.reply(req, from, success, vnetTurnIntegrity, stun.Fingerprint)
+	case stun.MethodChannelBind:
+		var number turn.ChannelNumber
+		var peer turn.PeerAddress
+		a := s.allocation(from)
+		if a == nil || number.GetFrom(req) != nil || peer.GetFrom(req) != nil {
+			s.reply(req, from, stun.NewType(req.Type.Method, stun.ClassErrorResponse),
+				&stun.ErrorCodeAttribute{Code: stun.CodeBadRequest, Reason: []byte("Bad Request")}, stun.Fingerprint)
+			return
+		}
+		a.lock.Lock()
+		a.channels[int(number)] = peer.String()
+		a.numbers[peer.String()] = int(number)
+		a.lock.Unlock()
+		s.reply(req, from, success, vnetTurnIntegrity, stun.Fingerprint)
+	}
+}
+
+func (s *vnetTurnServer) allocate(client net.Addr) (*vnetAllocation, error) {
+	if a := s.allocation(client); a != nil {
+		return a, nil
+	}
+	relay, err := s.n.ListenPacket("udp", net.JoinHostPort(addrToUDPAddr(vnetStunServer).IP.String(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	a := &vnetAllocation{
+		s:        s,
+		client:   client,
+		relay:    relay,
+		channels: make(map[int]string),
+		numbers:  make(map[string]int),
+	}
+	s.lock.Lock()
+	s.allocs[client.String()] = a
+	s.lock.Unlock()
+	go a.serve()
+	return a, nil
+}
+
+func (s *vnetTurnServer) release(client net.Addr) {
+	s.lock.Lock()
+	a := s.allocs[client.String()]
+	delete(s.allocs, client.String())
+	s.lock.Unlock()
+	if a != nil {
+		a.relay.Close()
+	}
+}
+
+func (s *vnetTurnServer) send(ind *stun.Message, from net.Addr) {
+	var data turn.Data
+	var peer turn.PeerAddress
+	a := s.allocation(from)
+	if a == nil || data.GetFrom(ind) != nil || peer.GetFrom(ind) != nil {
+		return
+	}
+	a.relay.WriteTo(data, &net.UDPAddr{IP: peer.IP, Port: peer.Port})
+}
+
+/*
+客户端发来的 ChannelData 转发给绑定的 peer.
+*/
+func (s *vnetTurnServer) channelData(b []byte, from net.Addr) {
+	a := s.allocation(from)
+	if a == nil {
+		return
+	}
+	number, data := parseChannelData(b)
+	a.lock.Lock()
+	peer, ok := a.channels[number]
+	a.lock.Unlock()
+	if ok {
+		a.relay.WriteTo(data, addrToUDPAddr(peer))
+	}
+}
+
+/*
+peer 发到 relay 地址的数据, 绑定了 channel 的用 ChannelData, 否则用 Data indication 转给客户端.
+*/
+func (a *vnetAllocation) serve() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := a.relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		a.lock.Lock()
+		number, ok := a.numbers[from.String()]
+		a.lock.Unlock()
+		if ok {
+			b := make([]byte, channelDataHeaderSize+n)
+			putChannelData(b, number, buf[:n])
+			a.s.c.WriteTo(b, a.client)
+			continue
+		}
+		ua := from.(*net.UDPAddr)
+		ind, err := stun.Build(stun.TransactionIDSetter, turn.DataIndication,
+			&turn.PeerAddress{IP: ua.IP, Port: ua.Port}, turn.Data(buf[:n]), stun.Fingerprint)
+		if err != nil {
+			continue
+		}
+		a.s.c.WriteTo(ind.Raw, a.client)
+	}
+}
@@ -0,0 +1,268 @@
+package mdns
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nkbai/log"
+)
+
+const (
+	//DefaultAddress is the ipv4 multicast group and port of mDNS
+	DefaultAddress = "224.0.0.251:5353"
+	//LocalSuffix of all names resolved by mDNS
+	LocalSuffix = ".local"
+
+	mdnsPort       = 5353
+	maxMessageSize = 9000
+	//查询的重传间隔, 每次翻倍
+	queryInterval    = 250 * time.Millisecond
+	maxQueryInterval = time.Second
+)
+
+var (
+	//ErrClosed is returned by Query after Close
+	ErrClosed = errors.New("mdns: connection closed")
+	//ErrTimeout is returned by Query when no one answers
+	ErrTimeout = errors.New("mdns: query timeout")
+)
+
+/*
+Conn is a mDNS responder and querier on one socket.
+It answers queries for published names and resolves names published by others.
+*/
+type Conn struct {
+	pc      net.PacketConn
+	group   net.Addr
+	lock    sync.Mutex
+	names   map[string]net.IP          //发布的名字
+	queries map[string][]chan net.IP //正在查询的名字
+	closed  chan struct{}
+	once    sync.Once
+	log     log.Logger
+}
+
+/*
+Listen joins the mDNS multicast group on all interfaces.
+*/
+func Listen() (*Conn, error) {
+	group, err := net.ResolveUDPAddr("udp4", DefaultAddress)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, err
+	}
+	return Server(pc, group), nil
+}
+
+/*
+Server serves mDNS on pc, queries and multicast responses are sent to group.
+pc is closed by Conn.Close.
+*/
+func Server(pc net.PacketConn, group net.Addr) *Conn {
+	c := &Conn{
+		pc:      pc,
+		group:   group,
+		names:   make(map[string]net.IP),
+		queries: make(map[string][]chan net.IP),
+		closed:  make(chan struct{}),
+		log:     log.New("name", fmt.Sprintf("%s-mdns", pc.LocalAddr())),
+	}
+	go c.loop()
+	return c
+}
+
+/*
+RandomName returns a name like 1f0e6b2c-3a4d-4e5f-8a9b-0c1d2e3f4a5b.local,
+it is used to hide the private address of host candidates.
+*/
+func RandomName() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40 //uuid version 4
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x%s", b[0:4], b[4:6], b[6:8], b[8:10], b[10:], LocalSuffix)
+}
+
+//Publish answers queries for name with ip
+func (c *Conn) Publish(name string, ip net.IP) {
+	c.lock.Lock()
+	c.names[canonicalName(name)] = ip
+	c.lock.Unlock()
+}
+
+//Unpublish stops answering queries for name
+func (c *Conn) Unpublish(name string) {
+	c.lock.Lock()
+	delete(c.names, canonicalName(name))
+	c.lock.Unlock()
+}
+
+/*
+Query resolves name, the query is retransmitted until someone answers or timeout.
+*/
+func (c *Conn) Query(name string, timeout time.Duration) (net.IP, error) {
+	name = canonicalName(name)
+	ch := make(chan net.IP, 1)
+	c.lock.Lock()
+	if ip, ok := c.names[name]; ok {
+		c.lock.Unlock()
+		return ip, nil
+	}
+	c.queries[name] = append(c.queries[name], ch)
+	c.lock.Unlock()
+	defer c.removeQuery(name, ch)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	interval := queryInterval
+	for {
+		if err := c.sendQuery(name); err != nil {
+			c.log.Warn(fmt.Sprintf("send query %s err %s", name, err))
+		}
+		retry := time.NewTimer(interval)
+		select {
+		case ip := <-ch:
+			retry.Stop()
+			return ip, nil
+		case <-deadline.C:
+			retry.Stop()
+			return nil, ErrTimeout
+		case <-c.closed:
+			retry.Stop()
+			return nil, ErrClosed
+		case <-retry.C:
+		}
+		if interval *= 2; interval > maxQueryInterval {
+			interval = maxQueryInterval
+		}
+	}
+}
+
+func (c *Conn) removeQuery(name string, ch chan net.IP) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	chs := c.queries[name]
+	for i, ch2 := range chs {
+		if ch2 == ch {
+			chs = append(chs[:i], chs[i+1:]...)
+			break
+		}
+	}
+	if len(chs) == 0 {
+		delete(c.queries, name)
+	} else {
+		c.queries[name] = chs
+	}
+}
+
+func (c *Conn) sendQuery(name string) error {
+	m := &message{questions: []question{{name: name, typ: typeA}}}
+	b, err := m.pack()
+	if err != nil {
+		return err
+	}
+	_, err = c.pc.WriteTo(b, c.group)
+	return err
+}
+
+//Close stops the responder and all pending queries
+func (c *Conn) Close() error {
+	err := ErrClosed
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.pc.Close()
+	})
+	return err
+}
+
+func (c *Conn) loop() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := c.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-c.closed:
+			default:
+				c.log.Error(fmt.Sprintf("read err %s", err))
+				c.Close()
+			}
+			return
+		}
+		m := new(message)
+		if err = m.unpack(buf[:n]); err != nil {
+			c.log.Trace(fmt.Sprintf("invalid message from %s err %s", from, err))
+			continue
+		}
+		if m.response {
+			c.onResponse(m)
+		} else {
+			c.onQuery(m, from)
+		}
+	}
+}
+
+func (c *Conn) onResponse(m *message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, a := range m.answers {
+		for _, ch := range c.queries[a.name] {
+			select {
+			case ch <- a.ip:
+			default:
+			}
+		}
+	}
+}
+
+/*
+RFC 6762 6.7 源端口不是 5353 的是普通的 DNS 客户端, 需要单播回应, 带上 id 和 question.
+设置了 unicast 标志的也单播回应, 否则发给组播地址.
+*/
+func (c *Conn) onQuery(m *message, from net.Addr) {
+	res := &message{response: true}
+	legacy := false
+	if ua, ok := from.(*net.UDPAddr); ok && ua.Port != mdnsPort {
+		legacy = true
+		res.id = m.id
+	}
+	unicast := legacy
+	c.lock.Lock()
+	for _, q := range m.questions {
+		ip, ok := c.names[q.name]
+		if !ok {
+			continue
+		}
+		if (q.typ == typeA) != (ip.To4() != nil) && q.typ != typeANY {
+			continue
+		}
+		if legacy {
+			res.questions = append(res.questions, q)
+		}
+		res.answers = append(res.answers, answer{name: q.name, ip: ip, ttl: defaultTTL})
+		unicast = unicast || q.unicast
+	}
+	c.lock.Unlock()
+	if len(res.answers) == 0 {
+		return
+	}
+	b, err := res.pack()
+	if err != nil {
+		c.log.Error(fmt.Sprintf("pack response err %s", err))
+		return
+	}
+	to := c.group
+	if unicast {
+		to = from
+	}
+	if _, err = c.pc.WriteTo(b, to); err != nil {
+		c.log.Warn(fmt.Sprintf("send response to %s err %s", to, err))
+	}
+}
@@ -0,0 +1,110 @@
+package mdns
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessagePackUnpack(t *testing.T) {
+	m := &message{
+		id:        7,
+		response:  true,
+		questions: []question{{name: "a.local", typ: typeA, unicast: true}},
+		answers: []answer{
+			{name: "a.local", ip: net.ParseIP("192.168.1.2"), ttl: defaultTTL},
+			{name: "b.local", ip: net.ParseIP("fe80::1"), ttl: 10},
+		},
+	}
+	b, err := m.pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2 := new(message)
+	if err = m2.unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	if m2.id != 7 || !m2.response || len(m2.questions) != 1 || !m2.questions[0].unicast || len(m2.answers) != 2 {
+		t.Fatalf("unpack error %+v", m2)
+	}
+	if !m2.answers[0].ip.Equal(net.ParseIP("192.168.1.2")) || !m2.answers[1].ip.Equal(net.ParseIP("fe80::1")) || m2.answers[1].ttl != 10 {
+		t.Errorf("answer error %+v", m2.answers)
+	}
+	if _, err = (&message{questions: []question{{name: strings.Repeat("a", 64) + ".local"}}}).pack(); err == nil {
+		t.Error("label too long should fail")
+	}
+	for i := 0; i < len(b); i++ {
+		if err = new(message).unpack(b[:i]); err == nil {
+			t.Errorf("truncated message %d should fail", i)
+		}
+	}
+}
+
+/*
+其他实现的回应会使用压缩指针, answer 的名字指向 question.
+*/
+func TestMessageCompression(t *testing.T) {
+	b := []byte{
+		0, 0, 0x84, 0, 0, 1, 0, 1, 0, 0, 0, 0,
+		1, 'X', 5, 'l', 'o', 'c', 'a', 'l', 0, 0, 1, 0, 1,
+		0xC0, 12, 0, 1, 0x80, 1, 0, 0, 0, 120, 0, 4, 10, 0, 0, 1,
+	}
+	m := new(message)
+	if err := m.unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.answers) != 1 || m.answers[0].name != "x.local" || !m.answers[0].ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("answer error %+v", m.answers)
+	}
+	//指向自己的指针不能死循环
+	b[25], b[26] = 0xC0, 25
+	if err := new(message).unpack(b); err == nil {
+		t.Error("pointer loop should fail")
+	}
+}
+
+func listen(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc
+}
+
+/*
+querier 把查询直接发给 responder, 源端口不是 5353, 所以 responder 单播回应.
+*/
+func TestConnQuery(t *testing.T) {
+	rpc := listen(t)
+	responder := Server(rpc, rpc.LocalAddr())
+	defer responder.Close()
+	querier := Server(listen(t), rpc.LocalAddr())
+	defer querier.Close()
+
+	name := RandomName()
+	if !strings.HasSuffix(name, LocalSuffix) || len(name) != 36+len(LocalSuffix) || name == RandomName() {
+		t.Fatalf("random name error %s", name)
+	}
+	ip := net.ParseIP("192.168.1.2")
+	responder.Publish(name, ip)
+	got, err := querier.Query(strings.ToUpper(name)+".", time.Second)
+	if err != nil || !got.Equal(ip) {
+		t.Fatalf("query error %s %v", got, err)
+	}
+	//自己发布的名字不需要查询
+	if got, err = responder.Query(name, 0); err != nil || !got.Equal(ip) {
+		t.Errorf("local query error %s %v", got, err)
+	}
+	responder.Unpublish(name)
+	if _, err = querier.Query(name, 100*time.Millisecond); err != ErrTimeout {
+		t.Errorf("unpublished name should timeout, got %v", err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		querier.Close()
+	}()
+	if _, err = querier.Query(name, time.Second); err != ErrClosed {
+		t.Errorf("query should be stopped by close, got %v", err)
+	}
+}
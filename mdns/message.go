@@ -0,0 +1,223 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+/*
+只实现了 mDNS 用到的最小的 DNS 报文格式(RFC 1035, RFC 6762):
+header, question, 以及 A/AAAA 类型的 answer, 其他的 record 在解析时被跳过.
+*/
+const (
+	headerSize = 12
+	maxLabel   = 63
+	maxName    = 255
+
+	typeA    uint16 = 1
+	typeAAAA uint16 = 28
+	typeANY  uint16 = 255
+	classIN  uint16 = 1
+
+	//question 中表示希望单播回应, answer 中表示 cache flush
+	classTopBit uint16 = 1 << 15
+
+	flagResponse      uint16 = 1 << 15
+	flagAuthoritative uint16 = 1 << 10
+
+	defaultTTL = 120
+)
+
+var (
+	errShortMessage = errors.New("dns message too short")
+	errInvalidName  = errors.New("invalid dns name")
+	errTooManyPtrs  = errors.New("too many compression pointers")
+)
+
+type question struct {
+	name    string //小写, 没有最后的点
+	typ     uint16
+	unicast bool
+}
+
+type answer struct {
+	name string
+	ip   net.IP
+	ttl  uint32
+}
+
+type message struct {
+	id        uint16
+	response  bool
+	questions []question
+	answers   []answer
+}
+
+/*
+canonicalName 名字不区分大小写, 末尾的点可有可无.
+*/
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) == 0 || len(name) > maxName {
+		return nil, errInvalidName
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > maxLabel {
+			return nil, errInvalidName
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0), nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func (m *message) pack() ([]byte, error) {
+	b := make([]byte, 0, 512)
+	b = appendUint16(b, m.id)
+	var flags uint16
+	if m.response {
+		flags = flagResponse | flagAuthoritative
+	}
+	b = appendUint16(b, flags)
+	b = appendUint16(b, uint16(len(m.questions)))
+	b = appendUint16(b, uint16(len(m.answers)))
+	b = appendUint16(b, 0) //authority
+	b = appendUint16(b, 0) //additional
+	var err error
+	for _, q := range m.questions {
+		if b, err = appendName(b, q.name); err != nil {
+			return nil, err
+		}
+		class := classIN
+		if q.unicast {
+			class |= classTopBit
+		}
+		b = appendUint16(b, q.typ)
+		b = appendUint16(b, class)
+	}
+	for _, a := range m.answers {
+		if b, err = appendName(b, a.name); err != nil {
+			return nil, err
+		}
+		ip, typ := a.ip.To4(), typeA
+		if ip == nil {
+			ip, typ = a.ip.To16(), typeAAAA
+		}
+		b = appendUint16(b, typ)
+		b = appendUint16(b, classIN|classTopBit)
+		b = append(b, byte(a.ttl>>24), byte(a.ttl>>16), byte(a.ttl>>8), byte(a.ttl))
+		b = appendUint16(b, uint16(len(ip)))
+		b = append(b, ip...)
+	}
+	return b, nil
+}
+
+/*
+readName 返回名字以及名字后面的位置, 支持压缩指针.
+*/
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1 //第一次跳转以前的位置
+	for ptrs := 0; ; {
+		if off >= len(b) {
+			return "", 0, errShortMessage
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			off++
+			if next < 0 {
+				next = off
+			}
+			name := strings.Join(labels, ".")
+			if len(name) > maxName {
+				return "", 0, errInvalidName
+			}
+			return strings.ToLower(name), next, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(b) {
+				return "", 0, errShortMessage
+			}
+			if ptrs++; ptrs > 10 {
+				return "", 0, errTooManyPtrs
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+		case l > maxLabel:
+			return "", 0, errInvalidName
+		default:
+			if off+1+l > len(b) {
+				return "", 0, errShortMessage
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+func (m *message) unpack(b []byte) error {
+	if len(b) < headerSize {
+		return errShortMessage
+	}
+	m.id = binary.BigEndian.Uint16(b)
+	m.response = binary.BigEndian.Uint16(b[2:])&flagResponse != 0
+	qdcount := int(binary.BigEndian.Uint16(b[4:]))
+	//authority 和 additional 中的 record 也可能是我们要的地址
+	rrcount := int(binary.BigEndian.Uint16(b[6:])) + int(binary.BigEndian.Uint16(b[8:])) + int(binary.BigEndian.Uint16(b[10:]))
+	off := headerSize
+	for i := 0; i < qdcount; i++ {
+		name, n, err := readName(b, off)
+		if err != nil {
+			return err
+		}
+		if n+4 > len(b) {
+			return errShortMessage
+		}
+		class := binary.BigEndian.Uint16(b[n+2:])
+		m.questions = append(m.questions, question{
+			name:    name,
+			typ:     binary.BigEndian.Uint16(b[n:]),
+			unicast: class&classTopBit != 0,
+		})
+		off = n + 4
+	}
+	for i := 0; i < rrcount; i++ {
+		name, n, err := readName(b, off)
+		if err != nil {
+			return err
+		}
+		if n+10 > len(b) {
+			return errShortMessage
+		}
+		typ := binary.BigEndian.Uint16(b[n:])
+		class := binary.BigEndian.Uint16(b[n+2:]) &^ classTopBit
+		ttl := binary.BigEndian.Uint32(b[n+4:])
+		l := int(binary.BigEndian.Uint16(b[n+8:]))
+		off = n + 10 + l
+		if off > len(b) {
+			return errShortMessage
+		}
+		rdata := b[n+10 : off]
+		if class != classIN || !(typ == typeA && l == net.IPv4len || typ == typeAAAA && l == net.IPv6len) {
+			continue
+		}
+		m.answers = append(m.answers, answer{
+			name: name,
+			ip:   append(net.IP{}, rdata...),
+			ttl:  ttl,
+		})
+	}
+	return nil
+}
@@ -551,8 +551,13 @@ func (d *Decoder) decodeConnectionData(m *Message) error {
 		err := d.newFieldError("connection-address is empty")
 		return errors.Wrap(err, "failed to decode connection data")
 	}
-	m.Connection.AddressType = string(addressType)
-	m.Connection.NetworkType = string(netType)
+	// media level connection data belongs to current media.
+	c := &m.Connection
+	if d.section == sectionMedia {
+		c = &d.m.Connection
+	}
+	c.AddressType = string(addressType)
+	c.NetworkType = string(netType)
 
 	// decoding address
 	// <base multicast address>[/<ttl>]/<number of addresses>
@@ -579,29 +584,29 @@ func (d *Decoder) decodeConnectionData(m *Message) error {
 			return errors.Wrap(err, "failed to decode connection data")
 		}
 	}
-	m.Connection.IP, err = decodeIP(m.Connection.IP, base)
+	c.IP, err = decodeIP(c.IP, base)
 	if err != nil {
 		return errors.Wrap(err, "failed to decode connection data")
 	}
-	isV4 := isIPv4(m.Connection.IP)
+	isV4 := isIPv4(c.IP)
 	if len(second) > 0 {
 		if !isV4 {
 			err := d.newFieldError("unexpected TTL for IPv6")
 			return errors.Wrap(err, "failed to decode connection data")
 		}
-		m.Connection.TTL, err = decodeByte(first)
+		c.TTL, err = decodeByte(first)
 		if err != nil {
 			return errors.Wrap(err, "failed to decode connection data")
 		}
-		m.Connection.Addresses, err = decodeByte(second)
+		c.Addresses, err = decodeByte(second)
 		if err != nil {
 			return errors.Wrap(err, "failed to decode connection data")
 		}
 	} else if len(first) > 0 {
 		if isV4 {
-			m.Connection.TTL, err = decodeByte(first)
+			c.TTL, err = decodeByte(first)
 		} else {
-			m.Connection.Addresses, err = decodeByte(second)
+			c.Addresses, err = decodeByte(first)
 		}
 		if err != nil {
 			msg := fmt.Sprintf("bad connection data <%s> at <%s>",
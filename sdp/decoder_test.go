@@ -267,3 +267,34 @@ func TestDecoder_Errors(t *testing.T) {
 		}
 	}
 }
+
+func TestDecoder_MediaConnection(t *testing.T) {
+	s := "v=0\no=- 1 1 IN IP4 127.0.0.1\ns=-\nc=IN IP4 10.0.0.1\nt=0 0\n" +
+		"m=audio 5000 RTP/AVP 0\nc=IN IP6 2001:db8::1\n" +
+		"m=video 9 RTP/AVP 96\nc=IN IP6 FF15::101/3\n" +
+		"m=text 9 RTP/AVP 98\n"
+	session, err := DecodeSession([]byte(s), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(Message)
+	decoder := NewDecoder(session)
+	if err = decoder.Decode(m); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Connection.IP.Equal(net.ParseIP("10.0.0.1")) {
+		t.Error("session connection", m.Connection)
+	}
+	if len(m.Medias) != 3 {
+		t.Fatal("len(medias)", len(m.Medias))
+	}
+	if !m.Medias[0].Connection.IP.Equal(net.ParseIP("2001:db8::1")) || m.Medias[0].Connection.AddressType != "IP6" {
+		t.Error("media connection", m.Medias[0].Connection)
+	}
+	if m.Medias[1].Connection.Addresses != 3 {
+		t.Error("ipv6 number of addresses", m.Medias[1].Connection)
+	}
+	if !m.Medias[2].Connection.Blank() {
+		t.Error("media without connection", m.Medias[2].Connection)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"github.com/nkbai/goice/clock"
 )
 
 // Dial connects to the address on the named network and then
@@ -26,6 +28,7 @@ type ClientOptions struct {
 	Agent       ClientAgent
 	Connection  Connection
 	TimeoutRate time.Duration // defaults to 100 ms
+	Clock       clock.Clock   // defaults to system clock
 }
 
 const defaultTimeoutRate = time.Millisecond * 100
@@ -43,6 +46,7 @@ func NewClient(options ClientOptions) (*Client, error) {
 		c:      options.Connection,
 		a:      options.Agent,
 		gcRate: options.TimeoutRate,
+		clock:  clock.OrNew(options.Clock),
 	}
 	if c.c == nil {
 		return nil, ErrNoConnection
@@ -84,6 +88,7 @@ type Client struct {
 	closed    bool
 	closedMux sync.RWMutex
 	gcRate    time.Duration
+	clock     clock.Clock
 	wg        sync.WaitGroup
 }
 
@@ -146,15 +151,16 @@ func closedOrPanic(err error) {
 }
 
 func (c *Client) collectUntilClosed() {
-	t := time.NewTicker(c.gcRate)
+	t := c.clock.NewTimer(c.gcRate)
 	defer c.wg.Done()
 	for {
 		select {
 		case <-c.close:
 			t.Stop()
 			return
-		case gcTime := <-t.C:
-			closedOrPanic(c.a.Collect(gcTime))
+		case <-t.C():
+			closedOrPanic(c.a.Collect(c.clock.Now()))
+			t.Reset(c.gcRate)
 		}
 	}
 }
@@ -6,6 +6,8 @@ import (
 	"log"
 	"testing"
 	"time"
+
+	"github.com/nkbai/goice/clock"
 )
 
 type TestAgent struct {
@@ -443,3 +445,59 @@ func TestClientGC(t *testing.T) {
 		t.Error("timed out")
 	}
 }
+
+// blockingConnection blocks Read until closed.
+type blockingConnection struct {
+	closed chan struct{}
+}
+
+func (c *blockingConnection) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (c *blockingConnection) Read(b []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *blockingConnection) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestClientFakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	c, err := NewClient(ClientOptions{
+		Connection: &blockingConnection{closed: make(chan struct{})},
+		Clock:      fake,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	result := make(chan error, 1)
+	m := MustBuild(TransactionIDSetter, BindingRequest)
+	if err = c.Start(m, start.Add(time.Second*5), HandlerFunc(func(e Event) {
+		result <- e.Error
+	})); err != nil {
+		t.Fatal(err)
+	}
+	fake.BlockUntil(1)
+	fake.Add(time.Second * 4)
+	fake.BlockUntil(1)
+	select {
+	case err = <-result:
+		t.Fatalf("should not time out before deadline, got %v", err)
+	default:
+	}
+	fake.Add(time.Second * 2)
+	select {
+	case err = <-result:
+		if err != ErrTransactionTimeOut {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("transaction should time out")
+	}
+}
@@ -0,0 +1,130 @@
+package vnet
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/nkbai/log"
+)
+
+/*
+NATType is the mapping and filtering behavior of a router, RFC 4787.
+*/
+type NATType int
+
+const (
+	//NATNone no nat, the subnet is routed directly
+	NATNone NATType = iota
+	//NATFullCone endpoint independent mapping and filtering, anyone can send to the mapped address
+	NATFullCone
+	//NATRestricted endpoint independent mapping, address dependent filtering
+	NATRestricted
+	//NATPortRestricted endpoint independent mapping, address and port dependent filtering
+	NATPortRestricted
+	//NATSymmetric address and port dependent mapping and filtering, a new mapping for every destination
+	NATSymmetric
+)
+
+func (t NATType) String() string {
+	switch t {
+	case NATNone:
+		return "none"
+	case NATFullCone:
+		return "full-cone"
+	case NATRestricted:
+		return "restricted"
+	case NATPortRestricted:
+		return "port-restricted"
+	case NATSymmetric:
+		return "symmetric"
+	}
+	return "unknown"
+}
+
+/*
+映射出去的端口从这里开始分配
+*/
+const natPortStart = 40000
+
+type natMapping struct {
+	local   *net.UDPAddr
+	public  *net.UDPAddr
+	allowed map[string]bool //允许进入的地址, restricted 只有 ip, 其他是 ip:port
+}
+
+/*
+natTable 记录内网地址和公网地址的映射.
+*/
+type natTable struct {
+	typ         NATType
+	publicIP    net.IP
+	lock        sync.Mutex
+	outMappings map[string]*natMapping
+	inMappings  map[int]*natMapping //public port -> mapping
+	nextPort    int
+}
+
+func newNATTable(typ NATType, publicIP net.IP) *natTable {
+	return &natTable{
+		typ:         typ,
+		publicIP:    publicIP,
+		outMappings: make(map[string]*natMapping),
+		inMappings:  make(map[int]*natMapping),
+		nextPort:    natPortStart,
+	}
+}
+
+/*
+outbound 把内网发出的数据的源地址替换为映射的公网地址, 同时记录允许回来的地址.
+*/
+func (t *natTable) outbound(c *chunk) *chunk {
+	key := c.src.String()
+	if t.typ == NATSymmetric {
+		key = fmt.Sprintf("%s|%s", c.src, c.dst)
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	m, ok := t.outMappings[key]
+	if !ok {
+		m = &natMapping{
+			local:   c.src,
+			public:  &net.UDPAddr{IP: t.publicIP, Port: t.nextPort},
+			allowed: make(map[string]bool),
+		}
+		t.nextPort++
+		t.outMappings[key] = m
+		t.inMappings[m.public.Port] = m
+		log.Trace(fmt.Sprintf("%s nat mapping %s->%s for %s", t.typ, m.local, m.public, c.dst))
+	}
+	if t.typ == NATRestricted {
+		m.allowed[c.dst.IP.String()] = true
+	} else {
+		m.allowed[c.dst.String()] = true
+	}
+	return &chunk{src: m.public, dst: c.dst, data: c.data}
+}
+
+/*
+inbound 找到公网地址对应的内网地址, 不允许进入返回 nil.
+*/
+func (t *natTable) inbound(c *chunk) *chunk {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	m, ok := t.inMappings[c.dst.Port]
+	if !ok || !c.dst.IP.Equal(t.publicIP) {
+		return nil
+	}
+	switch t.typ {
+	case NATFullCone:
+	case NATRestricted:
+		if !m.allowed[c.src.IP.String()] {
+			return nil
+		}
+	default:
+		if !m.allowed[c.src.String()] {
+			return nil
+		}
+	}
+	return &chunk{src: c.src, dst: m.local, data: c.data}
+}
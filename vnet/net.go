@@ -0,0 +1,443 @@
+package vnet
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	errUnsupportedNetwork = errors.New("only udp is supported")
+	errNotAttached        = errors.New("net is not attached to a router")
+	errAddrNotLocal       = errors.New("address is not local")
+	errAddrInUse          = errors.New("address already in use")
+	errNoFreePort         = errors.New("no free port")
+	errClosed             = errors.New("use of closed connection")
+	errNotConnected       = errors.New("connection is not connected")
+	errInvalidAddr        = errors.New("invalid address")
+)
+
+const (
+	ephemeralPortStart = 5000
+	ephemeralPortEnd   = 65535
+	rxQueueSize        = 256 //接收队列满了以后直接丢弃, 和真实的 udp 一样
+)
+
+/*
+NetConfig of a Net, StaticIPs must be in the subnet of router.
+*/
+type NetConfig struct {
+	StaticIPs []string
+}
+
+/*
+Net is a host in the virtual network, it provides the same functions as package net,
+so it can be used instead of real sockets in tests.
+*/
+type Net struct {
+	static   []net.IP
+	router   *Router
+	lock     sync.Mutex
+	ips      []net.IP
+	conns    map[string]*UDPConn //ip:port, 0.0.0.0:port 表示绑定所有地址
+	mcast    []*UDPConn          //加入了组播组的, 同一个组可以有多个
+	nextPort int
+}
+
+//NewNet creates a host, it must be added to a router by Router.AddNet before use
+func NewNet(cfg *NetConfig) (*Net, error) {
+	n := &Net{
+		conns:    make(map[string]*UDPConn),
+		nextPort: ephemeralPortStart,
+	}
+	if cfg == nil {
+		return n, nil
+	}
+	for _, s := range cfg.StaticIPs {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return nil, errInvalidAddr
+		}
+		n.static = append(n.static, ip)
+	}
+	return n, nil
+}
+
+//IPs of this host
+func (n *Net) IPs() []net.IP {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return append([]net.IP{}, n.ips...)
+}
+
+func (n *Net) hasIP(ip net.IP) bool {
+	for _, ip2 := range n.ips {
+		if ip2.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//InterfaceAddrs is like net.InterfaceAddrs, returns *net.IPNet of all ips
+func (n *Net) InterfaceAddrs() ([]net.Addr, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.router == nil {
+		return nil, errNotAttached
+	}
+	var addrs []net.Addr
+	for _, ip := range n.ips {
+		addrs = append(addrs, &net.IPNet{IP: ip, Mask: n.router.ipNet.Mask})
+	}
+	return addrs, nil
+}
+
+func checkNetwork(network string) error {
+	if network != "udp" && network != "udp4" {
+		return errUnsupportedNetwork
+	}
+	return nil
+}
+
+//ListenPacket is like net.ListenPacket, only udp is supported
+func (n *Net) ListenPacket(network, address string) (net.PacketConn, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+	laddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return n.bind(laddr, nil)
+}
+
+/*
+DialUDP is like net.DialUDP, laddr can be nil.
+When laddr has no ip, it is bound to the first ip.
+*/
+func (n *Net) DialUDP(network string, laddr, raddr *net.UDPAddr) (net.Conn, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+	if raddr == nil {
+		return nil, errInvalidAddr
+	}
+	if laddr == nil {
+		laddr = &net.UDPAddr{}
+	}
+	if laddr.IP == nil || laddr.IP.IsUnspecified() {
+		//和系统一样, 连接以后的本地地址是一个确定的 ip
+		ips := n.IPs()
+		if len(ips) == 0 {
+			return nil, errNotAttached
+		}
+		laddr = &net.UDPAddr{IP: ips[0], Port: laddr.Port}
+	}
+	return n.bind(laddr, raddr)
+}
+
+/*
+ListenMulticastUDP is like net.ListenMulticastUDP, ifi is ignored.
+Multicast packets are delivered to all hosts of the same router (including the sender),
+they are never forwarded to other routers.
+*/
+func (n *Net) ListenMulticastUDP(network string, ifi *net.Interface, gaddr *net.UDPAddr) (net.PacketConn, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+	if gaddr == nil || gaddr.IP.To4() == nil || !gaddr.IP.IsMulticast() || gaddr.Port == 0 {
+		return nil, errInvalidAddr
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.router == nil {
+		return nil, errNotAttached
+	}
+	c := newUDPConn(n, &net.UDPAddr{IP: gaddr.IP.To4(), Port: gaddr.Port}, nil)
+	n.mcast = append(n.mcast, c)
+	return c, nil
+}
+
+func newUDPConn(n *Net, laddr, raddr *net.UDPAddr) *UDPConn {
+	return &UDPConn{
+		n:        n,
+		laddr:    laddr,
+		raddr:    raddr,
+		rx:       make(chan *chunk, rxQueueSize),
+		deadline: make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (n *Net) bind(laddr, raddr *net.UDPAddr) (*UDPConn, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.router == nil {
+		return nil, errNotAttached
+	}
+	ip := laddr.IP
+	if ip == nil || ip.IsUnspecified() {
+		ip = net.IPv4zero
+	} else if ip = ip.To4(); ip == nil || !n.hasIP(ip) {
+		return nil, errAddrNotLocal
+	}
+	port := laddr.Port
+	if port == 0 {
+		for i := ephemeralPortStart; i <= ephemeralPortEnd; i++ {
+			if n.portFree(ip, n.nextPort) {
+				port = n.nextPort
+			}
+			n.nextPort++
+			if n.nextPort > ephemeralPortEnd {
+				n.nextPort = ephemeralPortStart
+			}
+			if port != 0 {
+				break
+			}
+		}
+		if port == 0 {
+			return nil, errNoFreePort
+		}
+	} else if !n.portFree(ip, port) {
+		return nil, errAddrInUse
+	}
+	c := newUDPConn(n, &net.UDPAddr{IP: ip, Port: port}, raddr)
+	n.conns[c.laddr.String()] = c
+	return c, nil
+}
+
+/*
+绑定 0.0.0.0 的端口和所有 ip 上的同一个端口冲突
+*/
+func (n *Net) portFree(ip net.IP, port int) bool {
+	if _, ok := n.conns[(&net.UDPAddr{IP: net.IPv4zero, Port: port}).String()]; ok {
+		return false
+	}
+	if !ip.IsUnspecified() {
+		_, ok := n.conns[(&net.UDPAddr{IP: ip, Port: port}).String()]
+		return !ok
+	}
+	for _, ip2 := range n.ips {
+		if _, ok := n.conns[(&net.UDPAddr{IP: ip2, Port: port}).String()]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *Net) unbind(c *UDPConn) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.conns[c.laddr.String()] == c {
+		delete(n.conns, c.laddr.String())
+	}
+	for i, c2 := range n.mcast {
+		if c2 == c {
+			n.mcast = append(n.mcast[:i], n.mcast[i+1:]...)
+			break
+		}
+	}
+}
+
+/*
+send 发给自己的包直接投递, 其他的交给路由器.
+*/
+func (n *Net) send(c *chunk) {
+	n.lock.Lock()
+	r := n.router
+	local := n.hasIP(c.dst.IP)
+	n.lock.Unlock()
+	if local {
+		n.deliver(c)
+		return
+	}
+	r.push(c, false)
+}
+
+func (n *Net) deliver(c *chunk) {
+	n.lock.Lock()
+	conn, ok := n.conns[c.dst.String()]
+	if !ok {
+		conn, ok = n.conns[(&net.UDPAddr{IP: net.IPv4zero, Port: c.dst.Port}).String()]
+	}
+	n.lock.Unlock()
+	if !ok {
+		return
+	}
+	conn.push(c)
+}
+
+func (n *Net) deliverMulticast(c *chunk) {
+	n.lock.Lock()
+	var conns []*UDPConn
+	for _, conn := range n.mcast {
+		if conn.laddr.IP.Equal(c.dst.IP) && conn.laddr.Port == c.dst.Port {
+			conns = append(conns, conn)
+		}
+	}
+	n.lock.Unlock()
+	for _, conn := range conns {
+		conn.push(c)
+	}
+}
+
+/*
+UDPConn implements net.PacketConn and net.Conn.
+*/
+type UDPConn struct {
+	n        *Net
+	laddr    *net.UDPAddr
+	raddr    *net.UDPAddr //DialUDP 时才有
+	rx       chan *chunk
+	lock     sync.Mutex
+	rdl      time.Time
+	deadline chan struct{} //通知正在读的 goroutine deadline 变了
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func (c *UDPConn) push(ch *chunk) {
+	select {
+	case c.rx <- ch:
+	default:
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+//ReadFrom implements net.PacketConn
+func (c *UDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		ch, err := c.next()
+		if err != nil {
+			return 0, nil, err
+		}
+		if ch == nil {
+			continue //deadline 变了
+		}
+		if c.raddr != nil && (!ch.src.IP.Equal(c.raddr.IP) || ch.src.Port != c.raddr.Port) {
+			continue //connected 只接收对方的
+		}
+		return copy(p, ch.data), ch.src, nil
+	}
+}
+
+func (c *UDPConn) next() (*chunk, error) {
+	c.lock.Lock()
+	rdl := c.rdl
+	c.lock.Unlock()
+	var timeout <-chan time.Time
+	if !rdl.IsZero() {
+		d := time.Until(rdl)
+		if d <= 0 {
+			return nil, timeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case ch := <-c.rx:
+		return ch, nil
+	case <-timeout:
+		return nil, timeoutError{}
+	case <-c.deadline:
+		return nil, nil
+	case <-c.closed:
+		return nil, errClosed
+	}
+}
+
+//WriteTo implements net.PacketConn
+func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errClosed
+	default:
+	}
+	dst, ok := addr.(*net.UDPAddr)
+	if !ok || dst.IP.To4() == nil {
+		return 0, errInvalidAddr
+	}
+	src := c.laddr
+	if src.IP.IsUnspecified() || src.IP.IsMulticast() {
+		ips := c.n.IPs()
+		if len(ips) == 0 {
+			return 0, errNotAttached
+		}
+		src = &net.UDPAddr{IP: ips[0], Port: src.Port}
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+	c.n.send(&chunk{src: src, dst: &net.UDPAddr{IP: dst.IP.To4(), Port: dst.Port}, data: data})
+	return len(p), nil
+}
+
+//Read implements net.Conn
+func (c *UDPConn) Read(p []byte) (int, error) {
+	if c.raddr == nil {
+		return 0, errNotConnected
+	}
+	n, _, err := c.ReadFrom(p)
+	return n, err
+}
+
+//Write implements net.Conn
+func (c *UDPConn) Write(p []byte) (int, error) {
+	if c.raddr == nil {
+		return 0, errNotConnected
+	}
+	return c.WriteTo(p, c.raddr)
+}
+
+//Close releases the port
+func (c *UDPConn) Close() error {
+	err := errClosed
+	c.once.Do(func() {
+		close(c.closed)
+		c.n.unbind(c)
+		err = nil
+	})
+	return err
+}
+
+//LocalAddr implements net.PacketConn
+func (c *UDPConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+//RemoteAddr implements net.Conn, nil if not connected
+func (c *UDPConn) RemoteAddr() net.Addr {
+	if c.raddr == nil {
+		return nil
+	}
+	return c.raddr
+}
+
+//SetDeadline implements net.PacketConn, only read deadline is supported
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+//SetReadDeadline implements net.PacketConn
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.rdl = t
+	c.lock.Unlock()
+	select {
+	case c.deadline <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+//SetWriteDeadline implements net.PacketConn, writing never blocks
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,269 @@
+package vnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nkbai/log"
+)
+
+var (
+	errInvalidCIDR     = errors.New("invalid cidr")
+	errNoPublicIP      = errors.New("router with nat must have a parent or public ip")
+	errAlreadyAttached = errors.New("already attached to a router")
+	errIPNotInSubnet   = errors.New("ip is not in the subnet of router")
+	errIPInUse         = errors.New("ip is already in use")
+	errNoFreeIP        = errors.New("no free ip in subnet")
+)
+
+/*
+chunk 是在虚拟网络中传递的一个 udp 包
+*/
+type chunk struct {
+	src  *net.UDPAddr
+	dst  *net.UDPAddr
+	data []byte
+}
+
+func (c *chunk) String() string {
+	return fmt.Sprintf("%s->%s %d bytes", c.src, c.dst, len(c.data))
+}
+
+/*
+RouterConfig describes a subnet and how it is connected to its parent.
+The root router has no parent and works as the internet, its nat is ignored.
+*/
+type RouterConfig struct {
+	Name     string
+	CIDR     string        //subnet of this router, like "192.168.1.0/24"
+	NAT      NATType       //how the subnet is connected to the parent
+	PublicIP string        //address on the parent subnet, empty means allocated by parent
+	Latency  time.Duration //delay of every packet entering this router
+	LossRate float64       //0-1, probability of dropping a packet entering this router
+	Seed     int64         //seed of loss, same seed gives the same result
+}
+
+/*
+Router 连接一个子网内的 Net 和子路由器, 不在子网内的包经过 NAT 发给上级路由器.
+*/
+type Router struct {
+	name     string
+	ipNet    *net.IPNet
+	natType  NATType
+	publicIP net.IP
+	nat      *natTable
+	latency  time.Duration
+	lossRate float64
+	parent   *Router
+	lock     sync.Mutex
+	children []*Router
+	nets     []*Net
+	used     map[string]bool //已经分配的 ip
+	nextIP   uint32
+	rand     *rand.Rand
+	log      log.Logger
+}
+
+//NewRouter creates a router for subnet cfg.CIDR
+func NewRouter(cfg *RouterConfig) (*Router, error) {
+	_, ipNet, err := net.ParseCIDR(cfg.CIDR)
+	if err != nil || ipNet.IP.To4() == nil {
+		return nil, errInvalidCIDR
+	}
+	r := &Router{
+		name:     cfg.Name,
+		ipNet:    ipNet,
+		natType:  cfg.NAT,
+		latency:  cfg.Latency,
+		lossRate: cfg.LossRate,
+		used:     make(map[string]bool),
+		nextIP:   binary.BigEndian.Uint32(ipNet.IP.To4()) + 1,
+		rand:     rand.New(rand.NewSource(cfg.Seed)),
+		log:      log.New("name", fmt.Sprintf("%s-router", cfg.Name)),
+	}
+	if cfg.PublicIP != "" {
+		r.publicIP = net.ParseIP(cfg.PublicIP).To4()
+		if r.publicIP == nil {
+			return nil, errIPNotInSubnet
+		}
+	}
+	return r, nil
+}
+
+//Name of the router
+func (r *Router) Name() string {
+	return r.name
+}
+
+//PublicIP is the address of the router on its parent subnet, nil before attached
+func (r *Router) PublicIP() net.IP {
+	return r.publicIP
+}
+
+/*
+allocIP 在子网中分配一个没有使用的 ip, ip 不为空时检查是否可用.
+*/
+func (r *Router) allocIP(ip net.IP) (net.IP, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if ip != nil {
+		if !r.ipNet.Contains(ip) {
+			return nil, errIPNotInSubnet
+		}
+		if r.used[ip.String()] {
+			return nil, errIPInUse
+		}
+		r.used[ip.String()] = true
+		return ip, nil
+	}
+	for r.ipNet.Contains(uint32ToIP(r.nextIP)) {
+		ip = uint32ToIP(r.nextIP)
+		r.nextIP++
+		if !r.used[ip.String()] {
+			r.used[ip.String()] = true
+			return ip, nil
+		}
+	}
+	return nil, errNoFreeIP
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+/*
+AddRouter attaches child to r, the public ip of child is allocated from the subnet of r if not set.
+*/
+func (r *Router) AddRouter(child *Router) error {
+	if child.parent != nil {
+		return errAlreadyAttached
+	}
+	ip, err := r.allocIP(child.publicIP)
+	if err != nil {
+		return err
+	}
+	child.publicIP = ip
+	child.parent = r
+	if child.natType != NATNone {
+		child.nat = newNATTable(child.natType, ip)
+	}
+	r.lock.Lock()
+	r.children = append(r.children, child)
+	r.lock.Unlock()
+	r.log.Trace(fmt.Sprintf("add router %s public ip %s nat %s", child.name, ip, child.natType))
+	return nil
+}
+
+/*
+AddNet attaches n to r, ip addresses of n are allocated from the subnet of r if NetConfig.StaticIPs is empty.
+*/
+func (r *Router) AddNet(n *Net) error {
+	if n.router != nil {
+		return errAlreadyAttached
+	}
+	var ips []net.IP
+	if len(n.static) == 0 {
+		ip, err := r.allocIP(nil)
+		if err != nil {
+			return err
+		}
+		ips = append(ips, ip)
+	}
+	for _, ip := range n.static {
+		ip, err := r.allocIP(ip)
+		if err != nil {
+			return err
+		}
+		ips = append(ips, ip)
+	}
+	n.lock.Lock()
+	n.router = r
+	n.ips = ips
+	n.lock.Unlock()
+	r.lock.Lock()
+	r.nets = append(r.nets, n)
+	r.lock.Unlock()
+	r.log.Trace(fmt.Sprintf("add net %v", ips))
+	return nil
+}
+
+/*
+push 是所有进入路由器的包的入口, 在这里模拟丢包和延迟.
+fromParent 表示来自上级路由器, 需要经过 NAT 的过滤.
+*/
+func (r *Router) push(c *chunk, fromParent bool) {
+	if r.lossRate > 0 {
+		r.lock.Lock()
+		lost := r.rand.Float64() < r.lossRate
+		r.lock.Unlock()
+		if lost {
+			r.log.Trace(fmt.Sprintf("drop %s", c))
+			return
+		}
+	}
+	if r.latency > 0 {
+		time.AfterFunc(r.latency, func() {
+			r.route(c, fromParent)
+		})
+		return
+	}
+	r.route(c, fromParent)
+}
+
+func (r *Router) route(c *chunk, fromParent bool) {
+	if fromParent && r.nat != nil {
+		c = r.nat.inbound(c)
+		if c == nil {
+			return
+		}
+	}
+	dst := c.dst.IP
+	r.lock.Lock()
+	if dst.IsMulticast() {
+		//组播只在本地网络内
+		nets := append([]*Net{}, r.nets...)
+		r.lock.Unlock()
+		for _, n := range nets {
+			n.deliverMulticast(c)
+		}
+		return
+	}
+	var toNet *Net
+	var toRouter *Router
+	for _, n := range r.nets {
+		if n.hasIP(dst) {
+			toNet = n
+			break
+		}
+	}
+	for _, child := range r.children {
+		if toNet != nil {
+			break
+		}
+		if child.publicIP.Equal(dst) || (child.nat == nil && child.ipNet.Contains(dst)) {
+			toRouter = child
+			break
+		}
+	}
+	r.lock.Unlock()
+	switch {
+	case toNet != nil:
+		toNet.deliver(c)
+	case toRouter != nil:
+		toRouter.push(c, true)
+	case fromParent || r.parent == nil || r.ipNet.Contains(dst):
+		//没有这个地址, 或者没有上级路由器
+		r.log.Trace(fmt.Sprintf("no route for %s", c))
+	case r.nat != nil:
+		r.parent.push(r.nat.outbound(c), false)
+	default:
+		r.parent.push(c, false)
+	}
+}
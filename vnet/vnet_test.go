@@ -0,0 +1,269 @@
+package vnet
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+/*
+internet 1.0.0.0/8 上有一个 server, lan 192.168.1.0/24 通过 nat 连接到 internet.
+*/
+func setupVNet(t *testing.T, nat NATType) (server, client *Net, lan *Router) {
+	wan, err := NewRouter(&RouterConfig{Name: "wan", CIDR: "1.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lan, err = NewRouter(&RouterConfig{Name: "lan", CIDR: "192.168.1.0/24", NAT: nat})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = wan.AddRouter(lan); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewNet(&NetConfig{StaticIPs: []string{"1.0.0.100", "1.0.0.101"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = wan.AddNet(server); err != nil {
+		t.Fatal(err)
+	}
+	client, _ = NewNet(nil)
+	if err = lan.AddNet(client); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func listen(t *testing.T, n *Net, addr string) net.PacketConn {
+	c, err := n.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+/*
+recv 返回收到的数据的来源, 超时返回 nil
+*/
+func recv(c net.PacketConn, timeout time.Duration) net.Addr {
+	buf := make([]byte, 100)
+	c.SetReadDeadline(time.Now().Add(timeout))
+	_, addr, err := c.ReadFrom(buf)
+	if err != nil {
+		return nil
+	}
+	return addr
+}
+
+func TestVNetAddress(t *testing.T) {
+	server, client, lan := setupVNet(t, NATPortRestricted)
+	if !lan.PublicIP().Equal(net.ParseIP("1.0.0.1")) {
+		t.Errorf("public ip error %s", lan.PublicIP())
+	}
+	if ips := client.IPs(); len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.168.1.1")) {
+		t.Errorf("client ip error %v", ips)
+	}
+	addrs, err := server.InterfaceAddrs()
+	if err != nil || len(addrs) != 2 || addrs[1].String() != "1.0.0.101/8" {
+		t.Errorf("server addrs error %v %v", addrs, err)
+	}
+	c := listen(t, client, "0.0.0.0:3000")
+	if _, err = client.ListenPacket("udp", "192.168.1.1:3000"); err == nil {
+		t.Error("port should be in use")
+	}
+	if _, err = client.ListenPacket("udp", "10.0.0.1:0"); err == nil {
+		t.Error("address should not be local")
+	}
+	c.Close()
+	c = listen(t, client, "192.168.1.1:3000")
+	c.Close()
+	if _, err = c.WriteTo([]byte("a"), &net.UDPAddr{IP: net.ParseIP("1.0.0.100"), Port: 1}); err == nil {
+		t.Error("write to closed conn should fail")
+	}
+}
+
+func TestVNetDialUDP(t *testing.T) {
+	server, client, _ := setupVNet(t, NATFullCone)
+	s := listen(t, server, "1.0.0.100:3478")
+	defer s.Close()
+	c, err := client.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("1.0.0.100"), Port: 3478})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.LocalAddr().(*net.UDPAddr).IP.String() != "192.168.1.1" {
+		t.Errorf("local addr error %s", c.LocalAddr())
+	}
+	if _, err = c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	s.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := s.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("server read error %s %s", buf[:n], err)
+	}
+	if from.String() != "1.0.0.1:40000" {
+		t.Errorf("mapped address error %s", from)
+	}
+	if _, err = s.WriteTo([]byte("world"), from); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = c.Read(buf)
+	if err != nil || string(buf[:n]) != "world" {
+		t.Errorf("client read error %s %s", buf[:n], err)
+	}
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err = c.Read(buf); err == nil || !err.(net.Error).Timeout() {
+		t.Errorf("should timeout, got %v", err)
+	}
+}
+
+/*
+客户端先发给 1.0.0.100:1, 然后检查从不同的地址发回来能否收到, 以及不同目的地址的映射是否相同.
+*/
+func TestVNetNATBehavior(t *testing.T) {
+	cases := []struct {
+		nat          NATType
+		samePort     bool //同一个 ip 不同端口
+		otherIP      bool //不同的 ip
+		sameMapping  bool //发给不同目的地址时映射相同
+		fromInternet bool //没有映射的外部地址能否直接访问内网, 只有 NATNone 可以
+	}{
+		{NATNone, true, true, true, true},
+		{NATFullCone, true, true, true, false},
+		{NATRestricted, true, false, true, false},
+		{NATPortRestricted, false, false, true, false},
+		{NATSymmetric, false, false, false, false},
+	}
+	for _, cs := range cases {
+		server, client, _ := setupVNet(t, cs.nat)
+		s1 := listen(t, server, "1.0.0.100:1")
+		s2 := listen(t, server, "1.0.0.100:2")
+		s3 := listen(t, server, "1.0.0.101:1")
+		c := listen(t, client, "0.0.0.0:3000")
+		c.WriteTo([]byte("a"), s1.LocalAddr())
+		mapped := recv(s1, time.Second)
+		if mapped == nil {
+			t.Fatalf("%s s1 should receive", cs.nat)
+		}
+		if got := recv(c, 0); got != nil {
+			t.Fatalf("%s nothing should be received", cs.nat)
+		}
+		s2.WriteTo([]byte("b"), mapped)
+		if got := recv(c, 100*time.Millisecond) != nil; got != cs.samePort {
+			t.Errorf("%s from same ip different port expect %v", cs.nat, cs.samePort)
+		}
+		s3.WriteTo([]byte("c"), mapped)
+		if got := recv(c, 100*time.Millisecond) != nil; got != cs.otherIP {
+			t.Errorf("%s from other ip expect %v", cs.nat, cs.otherIP)
+		}
+		s1.WriteTo([]byte("d"), mapped)
+		if recv(c, 100*time.Millisecond) == nil {
+			t.Errorf("%s response should be received", cs.nat)
+		}
+		c.WriteTo([]byte("e"), s3.LocalAddr())
+		mapped2 := recv(s3, time.Second)
+		if mapped2 == nil || (mapped2.String() == mapped.String()) != cs.sameMapping {
+			t.Errorf("%s mapping %s %s expect same %v", cs.nat, mapped, mapped2, cs.sameMapping)
+		}
+		s1.WriteTo([]byte("f"), &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 3000})
+		if got := recv(c, 100*time.Millisecond) != nil; got != cs.fromInternet {
+			t.Errorf("%s from internet expect %v", cs.nat, cs.fromInternet)
+		}
+		for _, conn := range []net.PacketConn{s1, s2, s3, c} {
+			conn.Close()
+		}
+	}
+}
+
+/*
+相同的 seed 丢包的结果一样
+*/
+func TestVNetLossAndLatency(t *testing.T) {
+	lost := func(seed int64) (received []bool) {
+		r, _ := NewRouter(&RouterConfig{Name: "lossy", CIDR: "10.0.0.0/24", LossRate: 0.5, Seed: seed})
+		n1, _ := NewNet(nil)
+		n2, _ := NewNet(nil)
+		r.AddNet(n1)
+		r.AddNet(n2)
+		c1 := listen(t, n1, "0.0.0.0:0")
+		c2 := listen(t, n2, "0.0.0.0:1000")
+		defer c1.Close()
+		defer c2.Close()
+		for i := 0; i < 20; i++ {
+			c1.WriteTo([]byte("a"), &net.UDPAddr{IP: n2.IPs()[0], Port: 1000})
+			received = append(received, recv(c2, 10*time.Millisecond) != nil)
+		}
+		return
+	}
+	r1, r2 := lost(1), lost(1)
+	n := 0
+	for i := range r1 {
+		if r1[i] != r2[i] {
+			t.Fatal("loss should be deterministic")
+		}
+		if r1[i] {
+			n++
+		}
+	}
+	if n == 0 || n == len(r1) {
+		t.Errorf("loss rate error, received %d", n)
+	}
+
+	r, _ := NewRouter(&RouterConfig{Name: "slow", CIDR: "10.0.0.0/24", Latency: 50 * time.Millisecond})
+	n1, _ := NewNet(nil)
+	n2, _ := NewNet(nil)
+	r.AddNet(n1)
+	r.AddNet(n2)
+	c1 := listen(t, n1, "0.0.0.0:0")
+	c2 := listen(t, n2, "0.0.0.0:1000")
+	defer c1.Close()
+	defer c2.Close()
+	start := time.Now()
+	c1.WriteTo([]byte("a"), &net.UDPAddr{IP: n2.IPs()[0], Port: 1000})
+	if recv(c2, time.Second) == nil || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("latency error %s", time.Since(start))
+	}
+}
+
+/*
+组播发给同一个路由器下的所有主机, 包括自己, 不会转发到其他路由器.
+*/
+func TestVNetMulticast(t *testing.T) {
+	server, client, lan := setupVNet(t, NATFullCone)
+	other, _ := NewNet(nil)
+	if err := lan.AddNet(other); err != nil {
+		t.Fatal(err)
+	}
+	group := &net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: 5353}
+	var conns []net.PacketConn
+	for _, n := range []*Net{client, other, server} {
+		c, err := n.ListenMulticastUDP("udp4", nil, group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	if _, err := client.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP("1.0.0.1"), Port: 5353}); err == nil {
+		t.Error("unicast address should fail")
+	}
+	conns[0].WriteTo([]byte("a"), group)
+	for i, c := range conns[:2] {
+		from := recv(c, time.Second)
+		if from == nil || from.String() != "192.168.1.1:5353" {
+			t.Errorf("conn %d should receive from client, got %v", i, from)
+		}
+	}
+	if recv(conns[2], 100*time.Millisecond) != nil {
+		t.Error("multicast should not be forwarded")
+	}
+	conns[1].Close()
+	conns[0].WriteTo([]byte("b"), group)
+	if recv(conns[1], 50*time.Millisecond) != nil {
+		t.Error("closed conn should not receive")
+	}
+}